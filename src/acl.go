@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// ACLConfig restricts which clients may query the server at all, which
+// may have their queries forwarded to the fallback and which may ask for
+// qtype ANY. Deny entries win over allow entries; an empty allow list
+// allows everyone.
+type ACLConfig struct {
+	AllowQuery     []string `yaml:"allow_query"`
+	DenyQuery      []string `yaml:"deny_query"`
+	AllowRecursion []string `yaml:"allow_recursion"`
+	DenyRecursion  []string `yaml:"deny_recursion"`
+	AllowAny       []string `yaml:"allow_any"`
+	DenyAny        []string `yaml:"deny_any"`
+}
+
+type accessList struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func (f *filterSet) loadACLs(cfg *Config) error {
+	var err error
+	if f.queryACL, err = newAccessList("acl.allow_query", cfg.ACL.AllowQuery, "acl.deny_query", cfg.ACL.DenyQuery); err != nil {
+		return err
+	}
+	if f.recursionACL, err = newAccessList("acl.allow_recursion", cfg.ACL.AllowRecursion, "acl.deny_recursion", cfg.ACL.DenyRecursion); err != nil {
+		return err
+	}
+	f.anyACL, err = newAccessList("acl.allow_any", cfg.ACL.AllowAny, "acl.deny_any", cfg.ACL.DenyAny)
+	return err
+}
+
+func newAccessList(allowKey string, allow []string, denyKey string, deny []string) (accessList, error) {
+	var acl accessList
+	var err error
+	if acl.allow, err = parseCIDRs(allowKey, allow); err != nil {
+		return acl, err
+	}
+	acl.deny, err = parseCIDRs(denyKey, deny)
+	return acl, err
+}
+
+// permits reports whether ip passes the list. Requests whose source can't
+// be determined are only permitted by an unrestricted list.
+func (a accessList) permits(ip net.IP) bool {
+	if ip == nil {
+		return len(a.allow) == 0 && len(a.deny) == 0
+	}
+	if onNetworks(ip, a.deny) {
+		return false
+	}
+	return len(a.allow) == 0 || onNetworks(ip, a.allow)
+}
+
+// parseCIDRs parses a config list of networks. Bare addresses are accepted
+// as single-host networks.
+func parseCIDRs(key string, list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
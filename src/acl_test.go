@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAccessLists(t *testing.T) {
+	cfg := &Config{ACL: ACLConfig{
+		AllowQuery:     []string{"192.0.2.0/24", "2001:db8::/32"},
+		DenyQuery:      []string{"192.0.2.66"},
+		AllowRecursion: []string{"192.0.2.0/25"},
+		DenyAny:        []string{"0.0.0.0/0"},
+	}}
+	f := &filterSet{}
+	if err := f.loadACLs(cfg); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		acl  accessList
+		ip   string
+		want bool
+	}{
+		{f.queryACL, "192.0.2.10", true},
+		{f.queryACL, "192.0.2.66", false}, // deny wins
+		{f.queryACL, "198.51.100.1", false},
+		{f.queryACL, "2001:db8::1", true},
+		{f.recursionACL, "192.0.2.10", true},
+		{f.recursionACL, "192.0.2.200", false},
+		{f.anyACL, "192.0.2.10", false},
+		{f.anyACL, "2001:db8::1", true}, // 0.0.0.0/0 is IPv4 only
+	} {
+		if got := tc.acl.permits(net.ParseIP(tc.ip)); got != tc.want {
+			t.Errorf("%s: permitted %v, want %v", tc.ip, got, tc.want)
+		}
+	}
+
+	// An unknown source only passes an unrestricted list.
+	if f.queryACL.permits(nil) || !(accessList{}).permits(nil) {
+		t.Error("source-less request judged wrongly")
+	}
+
+	bad := &Config{ACL: ACLConfig{DenyQuery: []string{"192.0.2.0/33"}}}
+	if err := (&filterSet{}).loadACLs(bad); err == nil {
+		t.Error("invalid network accepted")
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ACMEConfig lets ACME clients (certbot, lego, acme.sh) complete DNS-01
+// challenges against this server through the admin listener, in two ways:
+//
+//   - acme-dns compatible: POST /acme/register (admin token) creates an
+//     account with its own subdomain of Domain, and POST /acme/update with
+//     the account's X-Api-User and X-Api-Key sets its TXT record. Users
+//     CNAME _acme-challenge.<their name> to the account's fulldomain. As in
+//     acme-dns, the two latest values are served, for a name and its
+//     wildcard. Accounts are kept in AccountsFile.
+//   - direct: POST /acme/present and /acme/cleanup (admin token) with
+//     {"fqdn": "_acme-challenge.example.com.", "value": "..."}, as lego's
+//     httpreq provider sends.
+//
+// Challenge records are served with a short TTL and dropped after Expiry
+// seconds, so an abandoned challenge doesn't linger. The names must be in
+// a zone this server is authoritative for on the public internet.
+type ACMEConfig struct {
+	Enabled      bool   `yaml:"enabled"`
+	Domain       string `yaml:"domain"`        // parent of acme-dns subdomains
+	AccountsFile string `yaml:"accounts_file"` // acme-dns accounts
+	TTL          uint32 `yaml:"ttl"`           // of challenge records, default 30
+	Expiry       int    `yaml:"expiry"`        // seconds, default 3600
+}
+
+const sourceACME = "acme"
+
+// acmeAccount is an acme-dns account. Passwords are random, so a plain
+// SHA-256 of one is as good as a slow hash.
+type acmeAccount struct {
+	Username     string   `json:"username"`
+	PasswordHash string   `json:"password_hash"`
+	Subdomain    string   `json:"subdomain"`
+	AllowFrom    []string `json:"allowfrom,omitempty"`
+
+	allow []*net.IPNet
+}
+
+// acmeValue is one challenge value being served.
+type acmeValue struct {
+	value   string
+	expires time.Time
+}
+
+type acmeServer struct {
+	mu       sync.Mutex
+	domain   string
+	accounts map[string]*acmeAccount // by username
+	values   map[string][]acmeValue  // by owner name
+}
+
+var acme *acmeServer
+
+// acmeTokenRE matches a DNS-01 key authorization digest: base64url
+// SHA-256, 43 characters.
+var acmeTokenRE = regexp.MustCompile(`^[A-Za-z0-9_-]{43}$`)
+
+func setupACME() error {
+	cfg := &config.ACME
+	if !cfg.Enabled {
+		return nil
+	}
+	if config.Admin.Listen == "" {
+		return fmt.Errorf("acme needs admin.listen")
+	}
+	if cfg.TTL == 0 {
+		cfg.TTL = 30
+	}
+	if cfg.Expiry == 0 {
+		cfg.Expiry = 3600
+	}
+	if cfg.Expiry < 0 {
+		return fmt.Errorf("acme.expiry must not be negative")
+	}
+	a := &acmeServer{accounts: make(map[string]*acmeAccount), values: make(map[string][]acmeValue)}
+	if cfg.Domain != "" {
+		a.domain = dns.CanonicalName(cfg.Domain)
+		if _, ok := dns.IsDomainName(a.domain); !ok {
+			return fmt.Errorf("acme.domain: invalid name %q", cfg.Domain)
+		}
+		if cfg.AccountsFile == "" {
+			return fmt.Errorf("acme.domain needs acme.accounts_file")
+		}
+	}
+	if cfg.AccountsFile != "" {
+		if err := a.loadAccounts(cfg.AccountsFile); err != nil {
+			return fmt.Errorf("acme.accounts_file: %v", err)
+		}
+	}
+	acme = a
+	log.Printf("ACME DNS-01 endpoints on, %d acme-dns account(s)", len(a.accounts))
+	return nil
+}
+
+func (a *acmeServer) loadAccounts(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []*acmeAccount
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	for _, acct := range list {
+		if acct.allow, err = parseCIDRs("allowfrom", acct.AllowFrom); err != nil {
+			return fmt.Errorf("account %s: %v", acct.Username, err)
+		}
+		a.accounts[acct.Username] = acct
+	}
+	return nil
+}
+
+// saveAccounts writes the accounts file. Callers hold a.mu.
+func (a *acmeServer) saveAccounts() error {
+	path := config.ACME.AccountsFile
+	list := make([]*acmeAccount, 0, len(a.accounts))
+	for _, acct := range a.accounts {
+		list = append(list, acct)
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// set serves value at owner, keeping at most keep values there (0 for no
+// limit), and publishes the result.
+func (a *acmeServer) set(owner, value string, keep int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	expiry := time.Duration(config.ACME.Expiry) * time.Second
+	list := append(a.values[owner], acmeValue{value: value, expires: time.Now().Add(expiry)})
+	if keep > 0 && len(list) > keep {
+		list = list[len(list)-keep:]
+	}
+	a.values[owner] = list
+	a.publish()
+	time.AfterFunc(expiry+time.Second, a.expire)
+}
+
+// remove stops serving value at owner.
+func (a *acmeServer) remove(owner, value string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	list := a.values[owner]
+	for i, v := range list {
+		if v.value == value {
+			a.values[owner] = append(list[:i:i], list[i+1:]...)
+			a.publish()
+			return true
+		}
+	}
+	return false
+}
+
+// expire drops the values whose time is up.
+func (a *acmeServer) expire() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.publish()
+}
+
+// publish installs the unexpired values as the acme record source. Callers
+// hold a.mu.
+func (a *acmeServer) publish() {
+	now := time.Now()
+	recs := make(map[string][]Record)
+	for owner, list := range a.values {
+		var kept []acmeValue
+		for _, v := range list {
+			if v.expires.After(now) {
+				kept = append(kept, v)
+				recs[owner] = append(recs[owner], Record{Type: "TXT", TTL: config.ACME.TTL, Data: v.value})
+			}
+		}
+		if len(kept) == 0 {
+			delete(a.values, owner)
+		} else {
+			a.values[owner] = kept
+		}
+	}
+	records.setSource(sourceACME, recs)
+}
+
+// handleACMERegister serves POST /acme/register, as in acme-dns. The
+// password is only ever returned here.
+func handleACMERegister(w http.ResponseWriter, r *http.Request) {
+	if acme == nil || acme.domain == "" {
+		http.Error(w, "acme-dns accounts need acme.domain", http.StatusNotFound)
+		return
+	}
+	var req struct {
+		AllowFrom []string `json:"allowfrom"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if req.AllowFrom == nil {
+		req.AllowFrom = []string{}
+	}
+	allow, err := parseCIDRs("allowfrom", req.AllowFrom)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	password := randomToken(30)
+	acct := &acmeAccount{
+		Username:     newUUID(),
+		PasswordHash: hashACMEPassword(password),
+		Subdomain:    newUUID(),
+		AllowFrom:    req.AllowFrom,
+		allow:        allow,
+	}
+	acme.mu.Lock()
+	acme.accounts[acct.Username] = acct
+	err = acme.saveAccounts()
+	if err != nil {
+		delete(acme.accounts, acct.Username)
+	}
+	acme.mu.Unlock()
+	if err != nil {
+		log.Printf("Failed to save ACME accounts: %v", err)
+		http.Error(w, "failed to save the account", http.StatusInternalServerError)
+		return
+	}
+	auditf(r, "acme-dns account %s registered for %s.%s", acct.Username, acct.Subdomain, acme.domain)
+	writeJSON(w, http.StatusCreated, map[string]any{
+		"username":   acct.Username,
+		"password":   password,
+		"fulldomain": strings.TrimSuffix(acct.Subdomain+"."+acme.domain, "."),
+		"subdomain":  acct.Subdomain,
+		"allowfrom":  acct.AllowFrom,
+	})
+}
+
+// handleACMEUpdate serves POST /acme/update {"subdomain": ..., "txt": ...}
+// with X-Api-User and X-Api-Key, as in acme-dns.
+func handleACMEUpdate(w http.ResponseWriter, r *http.Request) {
+	if acme == nil || acme.domain == "" {
+		http.Error(w, "acme-dns accounts need acme.domain", http.StatusNotFound)
+		return
+	}
+	acme.mu.Lock()
+	acct := acme.accounts[r.Header.Get("X-Api-User")]
+	acme.mu.Unlock()
+	key := hashACMEPassword(r.Header.Get("X-Api-Key"))
+	if acct == nil || subtle.ConstantTimeCompare([]byte(key), []byte(acct.PasswordHash)) != 1 {
+		http.Error(w, `{"error": "forbidden"}`, http.StatusUnauthorized)
+		return
+	}
+	if len(acct.allow) > 0 {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); ip == nil || !onNetworks(ip, acct.allow) {
+			http.Error(w, `{"error": "forbidden"}`, http.StatusUnauthorized)
+			return
+		}
+	}
+	var req struct {
+		Subdomain string `json:"subdomain"`
+		TXT       string `json:"txt"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "malformed_json"}`, http.StatusBadRequest)
+		return
+	}
+	if req.Subdomain != acct.Subdomain {
+		http.Error(w, `{"error": "bad_subdomain"}`, http.StatusUnauthorized)
+		return
+	}
+	if !acmeTokenRE.MatchString(req.TXT) {
+		http.Error(w, `{"error": "bad_txt"}`, http.StatusBadRequest)
+		return
+	}
+	acme.set(acct.Subdomain+"."+acme.domain, req.TXT, 2)
+	auditf(r, "acme-dns challenge set for %s.%s", acct.Subdomain, acme.domain)
+	writeJSON(w, http.StatusOK, map[string]string{"txt": req.TXT})
+}
+
+// acmeChallenge is the body of POST /acme/present and /acme/cleanup.
+type acmeChallenge struct {
+	FQDN  string `json:"fqdn"`
+	Value string `json:"value"`
+}
+
+func readACMEChallenge(w http.ResponseWriter, r *http.Request) (owner, value string, ok bool) {
+	if acme == nil {
+		http.Error(w, "acme is not enabled", http.StatusNotFound)
+		return "", "", false
+	}
+	var c acmeChallenge
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return "", "", false
+	}
+	owner = dns.CanonicalName(c.FQDN)
+	if _, valid := dns.IsDomainName(owner); !valid || !strings.HasPrefix(owner, "_acme-challenge.") {
+		http.Error(w, "fqdn must be an _acme-challenge name", http.StatusBadRequest)
+		return "", "", false
+	}
+	if c.Value == "" || len(c.Value) > 255 {
+		http.Error(w, "value must be 1 to 255 characters", http.StatusBadRequest)
+		return "", "", false
+	}
+	return owner, c.Value, true
+}
+
+// handleACMEPresent serves POST /acme/present.
+func handleACMEPresent(w http.ResponseWriter, r *http.Request) {
+	owner, value, ok := readACMEChallenge(w, r)
+	if !ok {
+		return
+	}
+	acme.set(owner, value, 0)
+	auditf(r, "acme challenge presented at %s", owner)
+	writeJSON(w, http.StatusOK, map[string]string{"fqdn": owner})
+}
+
+// handleACMECleanup serves POST /acme/cleanup.
+func handleACMECleanup(w http.ResponseWriter, r *http.Request) {
+	owner, value, ok := readACMEChallenge(w, r)
+	if !ok {
+		return
+	}
+	if !acme.remove(owner, value) {
+		http.Error(w, "no such challenge", http.StatusNotFound)
+		return
+	}
+	auditf(r, "acme challenge cleaned up at %s", owner)
+	writeJSON(w, http.StatusOK, map[string]string{"fqdn": owner})
+}
+
+func hashACMEPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// randomToken returns n random bytes in hex.
+func randomToken(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// AdminConfig enables the HTTP admin API. Requests must carry the token as
+// a bearer token when one is set; only a loopback listener may go without.
+type AdminConfig struct {
+	Listen  string `yaml:"listen"`
+	Token   string `yaml:"token"`
+	History int    `yaml:"history"` // zone versions kept for rollback, default 10; -1 disables
+}
+
+func setupAdmin() error {
+	if config.Admin.Listen == "" || config.Admin.Token != "" {
+		return nil
+	}
+	if !loopbackListen(config.Admin.Listen) {
+		return fmt.Errorf("admin.token is required when admin.listen (%s) isn't a loopback address", config.Admin.Listen)
+	}
+	log.Printf("Admin API on %s has no token; any local user can change records", config.Admin.Listen)
+	return nil
+}
+
+// loopbackListen reports whether addr, a host:port to listen on, only
+// accepts connections from this machine.
+func loopbackListen(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func serveAdmin() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /stats", adminAuth(handleStats))
+	mux.HandleFunc("GET /stats/heatmap", adminAuth(handleHeatmap))
+	mux.HandleFunc("GET /stats/top", adminAuth(handleTop))
+	mux.HandleFunc("GET /traces", adminAuth(handleTraces))
+	mux.HandleFunc("GET /dashboard", handleDashboard)
+	mux.HandleFunc("POST /records/normalize", adminAuth(handleNormalize))
+	mux.HandleFunc("POST /records/apply", adminAuth(handleApply))
+	mux.HandleFunc("GET /records/dump", adminAuth(handleDump))
+	mux.HandleFunc("GET /cluster", adminAuth(handleCluster))
+	mux.HandleFunc("GET /splits", adminAuth(handleSplits))
+	mux.HandleFunc("POST /splits", adminAuth(handleSplitWeights))
+	mux.HandleFunc("GET /db/records", adminAuth(handleDBRecordsGet))
+	mux.HandleFunc("POST /db/records", adminAuth(handleDBRecords))
+	mux.HandleFunc("POST /config/reload", adminAuth(handleReload))
+	mux.HandleFunc("POST /config/log_level", adminAuth(handleLogLevel))
+	mux.HandleFunc("GET /zone/versions", adminAuth(handleZoneVersions))
+	mux.HandleFunc("POST /zone/rollback", adminAuth(handleZoneRollback))
+	mux.HandleFunc("POST /acme/register", adminAuth(handleACMERegister))
+	mux.HandleFunc("POST /acme/update", handleACMEUpdate) // its own credentials
+	mux.HandleFunc("POST /acme/present", adminAuth(handleACMEPresent))
+	mux.HandleFunc("POST /acme/cleanup", adminAuth(handleACMECleanup))
+	if err := http.ListenAndServe(config.Admin.Listen, mux); err != nil {
+		log.Printf("Admin API stopped: %v", err)
+	}
+}
+
+// adminAuth rejects requests without the configured token.
+func adminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token := config.Admin.Token; token != "" {
+			got, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// auditf records an admin action along with who made it.
+func auditf(r *http.Request, format string, args ...any) {
+	log.Printf("Audit [%s]: "+format, append([]any{r.RemoteAddr}, args...)...)
+}
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestSetupAdminToken(t *testing.T) {
+	old := *config
+	t.Cleanup(func() { *config = old })
+
+	for _, tc := range []struct {
+		listen, token string
+		ok            bool
+	}{
+		{"127.0.0.1:8054", "", true},
+		{"[::1]:8054", "", true},
+		{"localhost:8054", "", true},
+		{":8054", "", false},
+		{"0.0.0.0:8054", "", false},
+		{"10.0.0.2:8054", "", false},
+		{"admin.lan:8054", "", false},
+		{"10.0.0.2:8054", "secret", true},
+		{"", "", true},
+	} {
+		config.Admin = AdminConfig{Listen: tc.listen, Token: tc.token}
+		if err := setupAdmin(); (err == nil) != tc.ok {
+			t.Errorf("listen %q token %q: %v", tc.listen, tc.token, err)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// AnalyticsConfig sends a record of every query to ClickHouse or InfluxDB
+// for long-term analysis, apart from the log. Records are queued and
+// inserted in batches of BatchSize, or every FlushInterval seconds; when
+// the sink falls behind and Buffer records are waiting, new ones are
+// dropped rather than slowing down answers.
+//
+// ClickHouse gets JSONEachRow inserts over its HTTP interface into Table,
+// which needs the columns time (DateTime64(6)), client, listener, name,
+// type, rcode, source (String) and duration_us (UInt32). InfluxDB 2 gets
+// "dns_query" points in line protocol, tagged with listener, type, rcode
+// and source.
+type AnalyticsConfig struct {
+	Sink          string `yaml:"sink"` // clickhouse or influxdb
+	URL           string `yaml:"url"`  // e.g. http://127.0.0.1:8123 or http://127.0.0.1:8086
+	Table         string `yaml:"table"`
+	User          string `yaml:"user"`
+	Password      string `yaml:"password"`
+	Org           string `yaml:"org"`
+	Bucket        string `yaml:"bucket"`
+	Token         string `yaml:"token"`
+	BatchSize     int    `yaml:"batch_size"`     // default 1000
+	FlushInterval int    `yaml:"flush_interval"` // seconds, default 5
+	Buffer        int    `yaml:"buffer"`         // queued records, default 10 * batch_size
+}
+
+const (
+	sinkClickHouse = "clickhouse"
+	sinkInfluxDB   = "influxdb"
+)
+
+// queryRecord is one query as sent to the sink.
+type queryRecord struct {
+	Time       time.Time `json:"-"`
+	Stamp      string    `json:"time"`
+	Client     string    `json:"client"`
+	Listener   string    `json:"listener"`
+	Name       string    `json:"name"`
+	Type       string    `json:"type"`
+	Rcode      string    `json:"rcode"`
+	Source     string    `json:"source"`
+	DurationUs int64     `json:"duration_us"`
+}
+
+type analyticsSink struct {
+	cfg     AnalyticsConfig
+	http    *http.Client
+	queue   chan queryRecord
+	sent    atomic.Uint64
+	failed  atomic.Uint64 // records in batches the sink refused
+	dropped atomic.Uint64 // records discarded for want of buffer space
+	errLog  atomic.Int64  // unix second of the last error log line
+}
+
+var analytics *analyticsSink
+
+func setupAnalytics() error {
+	cfg := config.Analytics
+	if cfg.Sink == "" {
+		return nil
+	}
+	switch cfg.Sink {
+	case sinkClickHouse:
+		if cfg.Table == "" {
+			return fmt.Errorf("analytics.table is required for clickhouse")
+		}
+	case sinkInfluxDB:
+		if cfg.Org == "" || cfg.Bucket == "" {
+			return fmt.Errorf("analytics.org and analytics.bucket are required for influxdb")
+		}
+	default:
+		return fmt.Errorf("analytics.sink: unknown sink %q (want clickhouse or influxdb)", cfg.Sink)
+	}
+	if u, err := url.Parse(cfg.URL); err != nil || u.Host == "" {
+		return fmt.Errorf("analytics.url: invalid URL %q", cfg.URL)
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 1000
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = 5
+	}
+	if cfg.Buffer <= 0 {
+		cfg.Buffer = 10 * cfg.BatchSize
+	}
+	analytics = &analyticsSink{
+		cfg:   cfg,
+		http:  &http.Client{Timeout: 30 * time.Second},
+		queue: make(chan queryRecord, cfg.Buffer),
+	}
+	log.Printf("Sending query records to %s at %s", cfg.Sink, cfg.URL)
+	return nil
+}
+
+// record queues a query for the sink without ever blocking.
+func (a *analyticsSink) record(client net.IP, listener string, q dns.Question, rcode int, source string, d time.Duration) {
+	rec := queryRecord{
+		Time:       time.Now(),
+		Listener:   listener,
+		Name:       strings.ToLower(q.Name),
+		Type:       dns.TypeToString[q.Qtype],
+		Rcode:      dns.RcodeToString[rcode],
+		Source:     source,
+		DurationUs: d.Microseconds(),
+	}
+	if client != nil {
+		rec.Client = clientLabel(client)
+	}
+	select {
+	case a.queue <- rec:
+	default:
+		a.dropped.Add(1)
+	}
+}
+
+// run sends queued records in batches.
+func (a *analyticsSink) run() {
+	ticker := time.NewTicker(time.Duration(a.cfg.FlushInterval) * time.Second)
+	defer ticker.Stop()
+	batch := make([]queryRecord, 0, a.cfg.BatchSize)
+	for {
+		select {
+		case rec := <-a.queue:
+			batch = append(batch, rec)
+			if len(batch) < a.cfg.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := a.send(batch); err != nil {
+			a.failed.Add(uint64(len(batch)))
+			if now := time.Now().Unix(); a.errLog.Swap(now) != now {
+				log.Printf("Analytics: failed to send %d query record(s) to %s: %v", len(batch), a.cfg.Sink, err)
+			}
+		} else {
+			a.sent.Add(uint64(len(batch)))
+		}
+		batch = batch[:0]
+	}
+}
+
+func (a *analyticsSink) send(batch []queryRecord) error {
+	var body bytes.Buffer
+	var req *http.Request
+	var err error
+	base := strings.TrimSuffix(a.cfg.URL, "/")
+	switch a.cfg.Sink {
+	case sinkClickHouse:
+		enc := json.NewEncoder(&body)
+		for _, rec := range batch {
+			rec.Stamp = rec.Time.UTC().Format("2006-01-02 15:04:05.000000")
+			enc.Encode(rec)
+		}
+		query := url.Values{"query": {"INSERT INTO " + a.cfg.Table + " FORMAT JSONEachRow"}}
+		req, err = http.NewRequest("POST", base+"/?"+query.Encode(), &body)
+		if err != nil {
+			return err
+		}
+		if a.cfg.User != "" {
+			req.Header.Set("X-ClickHouse-User", a.cfg.User)
+			req.Header.Set("X-ClickHouse-Key", a.cfg.Password)
+		}
+	case sinkInfluxDB:
+		for _, rec := range batch {
+			writeLinePoint(&body, rec)
+		}
+		query := url.Values{"org": {a.cfg.Org}, "bucket": {a.cfg.Bucket}, "precision": {"us"}}
+		req, err = http.NewRequest("POST", base+"/api/v2/write?"+query.Encode(), &body)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		if a.cfg.Token != "" {
+			req.Header.Set("Authorization", "Token "+a.cfg.Token)
+		}
+	}
+	resp, err := a.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+var (
+	lineTagEscaper   = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	lineFieldEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+// writeLinePoint writes rec as an InfluxDB line protocol point.
+func writeLinePoint(b *bytes.Buffer, rec queryRecord) {
+	fmt.Fprintf(b, "dns_query,listener=%s,type=%s,rcode=%s,source=%s client=\"%s\",name=\"%s\",duration_us=%di %d\n",
+		lineTagEscaper.Replace(rec.Listener), lineTagEscaper.Replace(rec.Type),
+		lineTagEscaper.Replace(rec.Rcode), lineTagEscaper.Replace(rec.Source),
+		lineFieldEscaper.Replace(rec.Client), lineFieldEscaper.Replace(rec.Name),
+		rec.DurationUs, rec.Time.UnixMicro())
+}
+
+type analyticsReport struct {
+	Sink    string `json:"sink"`
+	Sent    uint64 `json:"sent"`
+	Failed  uint64 `json:"failed"`
+	Dropped uint64 `json:"dropped"`
+	Queued  int    `json:"queued"`
+}
+
+func (a *analyticsSink) report() analyticsReport {
+	return analyticsReport{
+		Sink:    a.cfg.Sink,
+		Sent:    a.sent.Load(),
+		Failed:  a.failed.Load(),
+		Dropped: a.dropped.Load(),
+		Queued:  len(a.queue),
+	}
+}
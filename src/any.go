@@ -0,0 +1,59 @@
+package main
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Answers to qtype ANY for a local name (any_response).
+const (
+	anyAll   = "all"   // every RRset of the name
+	anyHINFO = "hinfo" // one synthesized HINFO record (RFC 8482)
+)
+
+// metaQtype reports whether qtype is a meta-type (RFC 6895) the server
+// doesn't answer queries for. ANY, AXFR and IXFR have their own handling.
+func metaQtype(qtype uint16) bool {
+	switch qtype {
+	case dns.TypeOPT, dns.TypeTSIG, dns.TypeTKEY, dns.TypeMAILA, dns.TypeMAILB:
+		return true
+	}
+	return false
+}
+
+// answerAny answers an ANY query for a name that has local records. Each
+// RRset goes through the same health, canary, ordering and size policies
+// as a query for its type; a CNAME is returned alone, not followed.
+func answerAny(store *recordStore, qname string, authZone *zone, loc geoLocation) []dns.RR {
+	name := dns.Fqdn(strings.ToLower(qname))
+	recs := store.lookup(name)
+	if config.AnyResponse == anyHINFO {
+		ttl := recs[0].TTL
+		for _, rec := range recs {
+			ttl = min(ttl, rec.TTL)
+		}
+		return []dns.RR{&dns.HINFO{
+			Hdr: dns.RR_Header{Name: qname, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: clampTTL(ttl, config.MinTTL, config.MaxTTL)},
+			Cpu: "RFC8482",
+		}}
+	}
+
+	var answers []dns.RR
+	if authZone != nil && name == authZone.origin {
+		answers = append(answers, authZone.soa())
+	}
+	var types []uint16
+	for _, rec := range recs {
+		if t := dns.StringToType[rec.Type]; !slices.Contains(types, t) {
+			types = append(types, t)
+		}
+	}
+	for _, t := range types {
+		// The name owns records of type t, so no CNAME is chased.
+		rrs, _ := resolveLocal(store, qname, t, loc)
+		answers = append(answers, rrs...)
+	}
+	return answers
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AnycastConfig lets an anycast deployment withdraw this instance when it
+// can no longer answer properly. On every health transition the matching
+// command is run through /bin/sh, and the optional HTTP endpoint reports
+// 200 or 503 for external route controllers (e.g. an ExaBGP healthcheck).
+type AnycastConfig struct {
+	HealthListen     string `yaml:"health_listen"`
+	OnUnhealthy      string `yaml:"on_unhealthy"`
+	OnHealthy        string `yaml:"on_healthy"`
+	UpstreamFailures int    `yaml:"upstream_failures"` // consecutive forward errors before unhealthy
+	Interval         int    `yaml:"interval"`          // seconds between evaluations
+}
+
+var (
+	upstreamFailStreak atomic.Int64
+	zoneLoadFailed     atomic.Bool
+
+	instanceMu      sync.Mutex
+	instanceReasons []string
+	instanceHealthy = true
+)
+
+func anycastEnabled() bool {
+	c := config.Anycast
+	return c.HealthListen != "" || c.OnUnhealthy != "" || c.OnHealthy != ""
+}
+
+func setupAnycast() error {
+	cfg := &config.Anycast
+	if cfg.UpstreamFailures <= 0 {
+		cfg.UpstreamFailures = 5
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 5
+	}
+	return nil
+}
+
+// recordUpstreamResult tracks consecutive forwarding failures.
+func recordUpstreamResult(err error) {
+	if err != nil {
+		upstreamFailStreak.Add(1)
+	} else {
+		upstreamFailStreak.Store(0)
+	}
+}
+
+// unhealthyReasons lists everything currently preventing proper service.
+func unhealthyReasons() []string {
+	var reasons []string
+	if config.Mode != modeForwarder {
+		if zoneLoadFailed.Load() {
+			reasons = append(reasons, "zone file failed to load")
+		} else if len(records.source(sourceZone)) == 0 {
+			reasons = append(reasons, "zone is empty")
+		}
+	}
+	if config.FallbackDNS != "" {
+		if n := upstreamFailStreak.Load(); n >= int64(config.Anycast.UpstreamFailures) {
+			reasons = append(reasons, fmt.Sprintf("%d consecutive upstream failures", n))
+		}
+	}
+	return reasons
+}
+
+// monitorInstance evaluates instance health periodically and runs the
+// configured hook on every transition.
+func monitorInstance() {
+	cfg := config.Anycast
+	for {
+		reasons := unhealthyReasons()
+		healthy := len(reasons) == 0
+
+		instanceMu.Lock()
+		changed := healthy != instanceHealthy
+		instanceHealthy, instanceReasons = healthy, reasons
+		instanceMu.Unlock()
+
+		if changed {
+			if healthy {
+				log.Println("Instance healthy again")
+				runHook(cfg.OnHealthy, "healthy", "")
+			} else {
+				log.Printf("Instance unhealthy: %s", strings.Join(reasons, "; "))
+				runHook(cfg.OnUnhealthy, "unhealthy", strings.Join(reasons, "; "))
+			}
+		}
+		time.Sleep(time.Duration(cfg.Interval) * time.Second)
+	}
+}
+
+func runHook(command, state, reason string) {
+	if command == "" {
+		return
+	}
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(), "MICRODNS_STATE="+state, "MICRODNS_REASON="+reason)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Printf("Health hook %q failed: %v: %s", command, err, strings.TrimSpace(string(out)))
+	}
+}
+
+// serveInstanceHealth answers 200 while healthy and 503 otherwise.
+func serveInstanceHealth() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, _ *http.Request) {
+		instanceMu.Lock()
+		healthy, reasons := instanceHealthy, instanceReasons
+		instanceMu.Unlock()
+		if !healthy {
+			http.Error(w, strings.Join(reasons, "\n"), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", handleReadyz)
+	if err := http.ListenAndServe(config.Anycast.HealthListen, mux); err != nil {
+		log.Printf("Health endpoint stopped: %v", err)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v2"
+)
+
+// applyManifest is the desired state of part of the zone. The names listed
+// under Records are managed, as is every name matching the Scope glob: a
+// managed name ends up with exactly the listed records, and one that isn't
+// listed loses all of its records. Other names are never touched.
+type applyManifest struct {
+	Scope   string                  `yaml:"scope" json:"scope"`
+	Records map[string][]recordSpec `yaml:"records" json:"records"`
+	DryRun  bool                    `yaml:"-" json:"dry_run"`
+}
+
+// applyChange adds or removes one record, as a zone file line.
+type applyChange struct {
+	Op     string `json:"op"` // "+" or "-"
+	Record string `json:"record"`
+}
+
+type applyResult struct {
+	DryRun  bool          `json:"dry_run"`
+	Changes []applyChange `json:"changes"`
+}
+
+func handleApply(w http.ResponseWriter, r *http.Request) {
+	var m applyManifest
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	res, err := applyToZone(m)
+	if err != nil {
+		auditf(r, "apply scope=%q rejected: %v", m.Scope, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !m.DryRun {
+		auditf(r, "apply scope=%q: %d change(s)", m.Scope, len(res.Changes))
+		for _, c := range res.Changes {
+			auditf(r, "  %s %s", c.Op, c.Record)
+		}
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// applyToZone brings the managed names of the zone to the manifest's
+// state, or for a dry run only reports the changes that would take.
+func applyToZone(m applyManifest) (applyResult, error) {
+	res := applyResult{DryRun: m.DryRun, Changes: []applyChange{}}
+	scope := ""
+	if m.Scope != "" {
+		scope = dns.Fqdn(strings.ToLower(m.Scope))
+		if _, err := path.Match(scope, ""); err != nil {
+			return res, fmt.Errorf("scope: %v", err)
+		}
+	}
+	desired := make(map[string][]Record)
+	for name, specs := range m.Records {
+		owner := dns.Fqdn(strings.ToLower(name))
+		if _, ok := dns.IsDomainName(owner); !ok {
+			return res, fmt.Errorf("invalid name %q", name)
+		}
+		for i, spec := range specs {
+			rec, err := spec.toRecord()
+			if err != nil {
+				return res, fmt.Errorf("%s[%d]: %v", name, i, err)
+			}
+			desired[owner] = append(desired[owner], rec)
+		}
+		if _, ok := desired[owner]; !ok {
+			desired[owner] = nil
+		}
+	}
+
+	plan := func(cur map[string][]Record) map[string][]Record {
+		managed := make(map[string]bool)
+		for name := range desired {
+			managed[name] = true
+		}
+		if scope != "" {
+			for name := range cur {
+				if ok, _ := path.Match(scope, name); ok {
+					managed[name] = true
+				}
+			}
+		}
+		updated := make(map[string][]Record)
+		for name := range managed {
+			next, changes := diffRecords(name, cur[name], desired[name])
+			if len(changes) > 0 {
+				updated[name] = next
+				res.Changes = append(res.Changes, changes...)
+			}
+		}
+		return updated
+	}
+
+	if m.DryRun {
+		plan(records.source(sourceZone))
+	} else {
+		if err := backupZoneFile("apply"); err != nil {
+			return res, err
+		}
+		records.updateSource(sourceZone, func(recs map[string][]Record) {
+			updated := plan(recs)
+			if len(updated) == 0 {
+				return
+			}
+			old := make(map[string][]Record)
+			for name, list := range updated {
+				old[name] = recs[name]
+				if len(list) == 0 {
+					delete(recs, name)
+				} else {
+					recs[name] = list
+				}
+			}
+			recordChange("admin apply", old, recs)
+			snapshotZone("admin apply", recs)
+		})
+	}
+	slices.SortStableFunc(res.Changes, func(a, b applyChange) int {
+		return strings.Compare(a.Record, b.Record)
+	})
+	return res, nil
+}
+
+// diffRecords returns the records name should have, keeping the current
+// ones that are still wanted in their order, and the changes to get there.
+func diffRecords(name string, cur, want []Record) ([]Record, []applyChange) {
+	wanted := make(map[string]int)
+	for _, rec := range want {
+		wanted[formatZoneLine(name, rec)]++
+	}
+	var next []Record
+	var changes []applyChange
+	for _, rec := range cur {
+		line := formatZoneLine(name, rec)
+		if wanted[line] > 0 {
+			wanted[line]--
+			next = append(next, rec)
+			continue
+		}
+		changes = append(changes, applyChange{Op: "-", Record: line})
+	}
+	for _, rec := range want {
+		line := formatZoneLine(name, rec)
+		if wanted[line] > 0 {
+			wanted[line]--
+			next = append(next, rec)
+			changes = append(changes, applyChange{Op: "+", Record: line})
+		}
+	}
+	return next, changes
+}
+
+// runApply implements "micro-dns apply": it sends a record manifest to a
+// running server's admin API, prints the plan and applies it once
+// confirmed.
+func runApply(args []string) int {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "Config file to take the admin address and token from")
+	admin := fs.String("admin", "", "Admin API address (default: admin.listen from the config)")
+	planOnly := fs.Bool("plan", false, "Print the plan and exit")
+	autoApprove := fs.Bool("auto-approve", false, "Apply without asking for confirmation")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: micro-dns apply [flags] <records.yaml>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "apply: %v\n", err)
+		return 1
+	}
+	var m applyManifest
+	if err := yaml.UnmarshalStrict(data, &m); err != nil {
+		fmt.Fprintf(os.Stderr, "apply: %s: %v\n", fs.Arg(0), err)
+		return 1
+	}
+
+	cfg := &Config{}
+	if data, err := os.ReadFile(*configPath); err == nil {
+		yaml.Unmarshal(data, cfg)
+	}
+	if *admin == "" {
+		*admin = cfg.Admin.Listen
+	}
+	if *admin == "" {
+		fmt.Fprintln(os.Stderr, "apply: no admin address given and none configured")
+		return 1
+	}
+	token := cfg.Admin.Token
+	if t := os.Getenv("MICRODNS_ADMIN_TOKEN"); t != "" {
+		token = t
+	}
+
+	m.DryRun = true
+	plan, err := postApply(*admin, token, m)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "apply: %v\n", err)
+		return 1
+	}
+	printApplyChanges(plan.Changes)
+	if len(plan.Changes) == 0 {
+		fmt.Println("No changes.")
+		return 0
+	}
+	if *planOnly {
+		return 0
+	}
+	if !*autoApprove {
+		fmt.Print("Apply these changes? Only 'yes' is accepted: ")
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.TrimSpace(answer) != "yes" {
+			fmt.Println("Apply cancelled.")
+			return 1
+		}
+	}
+
+	m.DryRun = false
+	applied, err := postApply(*admin, token, m)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "apply: %v\n", err)
+		return 1
+	}
+	if !slices.Equal(applied.Changes, plan.Changes) {
+		fmt.Println("The zone changed since the plan was made; applied instead:")
+		printApplyChanges(applied.Changes)
+	}
+	fmt.Printf("Applied %d change(s).\n", len(applied.Changes))
+	return 0
+}
+
+func printApplyChanges(changes []applyChange) {
+	adds := 0
+	for _, c := range changes {
+		fmt.Printf("%s %s\n", c.Op, c.Record)
+		if c.Op == "+" {
+			adds++
+		}
+	}
+	if len(changes) > 0 {
+		fmt.Printf("Plan: %d to add, %d to remove.\n", adds, len(changes)-adds)
+	}
+}
+
+func postApply(admin, token string, m applyManifest) (applyResult, error) {
+	var res applyResult
+	body, err := json.Marshal(m)
+	if err != nil {
+		return res, err
+	}
+	if !strings.Contains(admin, "://") {
+		admin = "http://" + admin
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(admin, "/")+"/records/apply", bytes.NewReader(body))
+	if err != nil {
+		return res, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return res, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return res, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return res, json.NewDecoder(resp.Body).Decode(&res)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestApplyToZone(t *testing.T) {
+	withRecords(t)
+	old := *config
+	t.Cleanup(func() { *config = old })
+	config.Backup = BackupConfig{}
+	records.setSource(sourceZone, map[string][]Record{
+		"web1.lab.": {{Type: "A", TTL: 300, Data: "10.0.0.1"}},
+		"web2.lab.": {{Type: "A", TTL: 300, Data: "10.0.0.2"}},
+		"db.prod.":  {{Type: "A", TTL: 300, Data: "10.1.0.1"}},
+	})
+	m := applyManifest{
+		Scope: "*.lab",
+		Records: map[string][]recordSpec{
+			"web1.lab": {{Type: "A", TTL: 300, Value: "10.0.0.11"}},
+			"web3.lab": {{Type: "A", TTL: 300, Value: "10.0.0.3"}},
+		},
+		DryRun: true,
+	}
+	plan, err := applyToZone(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[{- web1.lab. 300 IN A 10.0.0.1} {+ web1.lab. 300 IN A 10.0.0.11} " +
+		"{- web2.lab. 300 IN A 10.0.0.2} {+ web3.lab. 300 IN A 10.0.0.3}]"
+	if fmt.Sprint(plan.Changes) != want {
+		t.Errorf("plan %v\nwant %s", plan.Changes, want)
+	}
+	if recs := records.lookup("web2.lab."); len(recs) != 1 {
+		t.Fatal("dry run changed the zone")
+	}
+
+	m.DryRun = false
+	res, err := applyToZone(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(res.Changes) != want {
+		t.Errorf("applied %v, planned %v", res.Changes, plan.Changes)
+	}
+	for name, data := range map[string]string{"web1.lab.": "10.0.0.11", "web3.lab.": "10.0.0.3", "db.prod.": "10.1.0.1"} {
+		if recs := records.lookup(name); len(recs) != 1 || recs[0].Data != data {
+			t.Errorf("%s: %v, want %s", name, recs, data)
+		}
+	}
+	if recs := records.lookup("web2.lab."); len(recs) != 0 {
+		t.Errorf("unlisted name in scope kept %v", recs)
+	}
+
+	// Applying the same state again changes nothing.
+	if res, err := applyToZone(m); err != nil || len(res.Changes) != 0 {
+		t.Errorf("second apply: %v, %v", res.Changes, err)
+	}
+
+	bad := applyManifest{Records: map[string][]recordSpec{"x.lab": {{Type: "A", Value: "not-an-ip"}}}}
+	if _, err := applyToZone(bad); err == nil {
+		t.Error("invalid record applied")
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// BackupConfig copies the zone file into Dir before anything rewrites it
+// or changes records in bulk: apply, normalize and rollback through the
+// admin API, write-back merges and "lint --fix". Copies are named after
+// the file with a UTC timestamp and the operation, e.g.
+// zones.txt.20240101T120000.000Z.apply; a copy identical to the newest one
+// is skipped.
+type BackupConfig struct {
+	Dir        string `yaml:"dir"`
+	Keep       int    `yaml:"keep"`         // newest copies kept; default 20
+	MaxAgeDays int    `yaml:"max_age_days"` // older copies are removed; 0 = keep
+}
+
+const (
+	defaultBackupKeep = 20
+	backupTimeFormat  = "20060102T150405.000Z"
+)
+
+func setupBackup() error {
+	cfg := &config.Backup
+	if cfg.Dir == "" {
+		return nil
+	}
+	if config.HostsFile == "" {
+		return fmt.Errorf("backup needs a zone file")
+	}
+	if isRemoteZone(config.HostsFile) {
+		return fmt.Errorf("backup needs a local zone file, not a URL")
+	}
+	if cfg.Keep < 0 || cfg.MaxAgeDays < 0 {
+		return fmt.Errorf("backup: keep and max_age_days must not be negative")
+	}
+	if cfg.Keep == 0 {
+		cfg.Keep = defaultBackupKeep
+	}
+	if err := os.MkdirAll(cfg.Dir, 0750); err != nil {
+		return fmt.Errorf("backup.dir: %v", err)
+	}
+	return nil
+}
+
+// backupZoneFile snapshots the zone file before op changes it.
+func backupZoneFile(op string) error {
+	if config.Backup.Dir == "" {
+		return nil
+	}
+	zoneFileMu.Lock()
+	defer zoneFileMu.Unlock()
+	return backupZoneFileLocked(op)
+}
+
+// backupZoneFileLocked is backupZoneFile for callers holding zoneFileMu.
+func backupZoneFileLocked(op string) error {
+	if config.Backup.Dir == "" {
+		return nil
+	}
+	name, err := backupFile(config.Backup, config.HostsFile, op)
+	if err != nil {
+		return fmt.Errorf("zone backup: %v", err)
+	}
+	if name != "" {
+		log.Printf("Backed up %s to %s before %s", config.HostsFile, name, op)
+	}
+	return nil
+}
+
+// backupFile copies path into cfg.Dir and prunes old copies. It returns
+// the new copy's path, or "" when the newest copy already matches.
+func backupFile(cfg BackupConfig, path, op string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	prefix := filepath.Base(path) + "."
+	existing, err := listBackups(cfg.Dir, prefix)
+	if err != nil {
+		return "", err
+	}
+	if n := len(existing); n > 0 {
+		if last, err := os.ReadFile(existing[n-1]); err == nil && bytes.Equal(last, data) {
+			return "", nil
+		}
+	}
+
+	name := filepath.Join(cfg.Dir, prefix+time.Now().UTC().Format(backupTimeFormat)+"."+op)
+	if err := os.WriteFile(name, data, 0600); err != nil {
+		return "", err
+	}
+	pruneBackups(cfg, append(existing, name))
+	return name, nil
+}
+
+// listBackups returns the copies in dir with prefix, oldest first; the
+// timestamps in their names sort in time order.
+func listBackups(dir, prefix string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, e := range entries {
+		rest, ok := strings.CutPrefix(e.Name(), prefix)
+		if !ok || e.IsDir() || len(rest) < len(backupTimeFormat) {
+			continue
+		}
+		if _, err := time.Parse(backupTimeFormat, rest[:len(backupTimeFormat)]); err != nil {
+			continue
+		}
+		out = append(out, filepath.Join(dir, e.Name()))
+	}
+	slices.Sort(out)
+	return out, nil
+}
+
+// pruneBackups removes copies beyond cfg.Keep and past cfg.MaxAgeDays.
+// The newest copy is always kept.
+func pruneBackups(cfg BackupConfig, backups []string) {
+	cutoff := time.Time{}
+	if cfg.MaxAgeDays > 0 {
+		cutoff = time.Now().AddDate(0, 0, -cfg.MaxAgeDays)
+	}
+	for i, name := range backups[:len(backups)-1] {
+		expired := false
+		if !cutoff.IsZero() {
+			if info, err := os.Stat(name); err == nil && info.ModTime().Before(cutoff) {
+				expired = true
+			}
+		}
+		if !expired && len(backups)-i <= cfg.Keep {
+			continue
+		}
+		if err := os.Remove(name); err != nil {
+			log.Printf("Failed to remove old zone backup: %v", err)
+		}
+	}
+}
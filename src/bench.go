@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// runBench implements "micro-dns bench": it sends synthetic queries to a
+// server at a fixed rate for a while and reports latency percentiles,
+// rcodes and errors. Names come from a file or are random subdomains of a
+// domain, which always miss the cache. Queries are sent on schedule
+// whether or not earlier ones were answered; one due while -workers are
+// still outstanding is skipped and counted, so an overloaded server shows
+// up as a shortfall rather than a slower rate.
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	target := fs.String("target", "127.0.0.1:53", "Server to benchmark")
+	qps := fs.Int("qps", 1000, "Queries per second to send")
+	duration := fs.Duration("duration", 10*time.Second, "How long to send for")
+	namesFile := fs.String("names", "", "File of query names, one per line, optionally followed by a type")
+	random := fs.String("random", "", "Query random subdomains of this domain")
+	qtype := fs.String("type", "A", "Query type, where the names file gives none")
+	workers := fs.Int("workers", 256, "Maximum queries in flight")
+	timeout := fs.Duration("timeout", 2*time.Second, "Per-query timeout")
+	tcp := fs.Bool("tcp", false, "Query over TCP")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: micro-dns bench [flags] (-names <file> | -random <domain>)")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	defaultType, ok := dns.StringToType[strings.ToUpper(*qtype)]
+	if fs.NArg() != 0 || (*namesFile == "") == (*random == "") || !ok || *qps <= 0 || *workers <= 0 {
+		fs.Usage()
+		return 2
+	}
+
+	var pick func() replayQuery
+	if *namesFile != "" {
+		queries, err := readBenchNames(*namesFile, defaultType)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "bench: %v\n", err)
+			return 1
+		}
+		pick = func() replayQuery { return queries[rand.IntN(len(queries))] }
+	} else {
+		domain := dns.Fqdn(*random)
+		if _, ok := dns.IsDomainName(domain); !ok {
+			fmt.Fprintf(os.Stderr, "bench: invalid domain %q\n", *random)
+			return 1
+		}
+		pick = func() replayQuery {
+			return replayQuery{name: fmt.Sprintf("%08x.%s", rand.Uint32(), domain), qtype: defaultType}
+		}
+	}
+
+	network := "udp"
+	if *tcp {
+		network = "tcp"
+	}
+	client := &dns.Client{Net: network, Timeout: *timeout}
+	fmt.Printf("Sending %d qps to %s over %s for %s\n", *qps, *target, network, *duration)
+
+	var (
+		mu       sync.Mutex
+		results  []replayResult
+		timeouts int
+		firstErr error
+		skipped  atomic.Int64
+		sent     atomic.Int64
+		wg       sync.WaitGroup
+		sem      = make(chan struct{}, *workers)
+		interval = time.Second / time.Duration(*qps)
+		start    = time.Now()
+		end      = start.Add(*duration)
+	)
+	done := make(chan struct{})
+	go benchProgress(start, &sent, &skipped, done)
+	for i := 0; ; i++ {
+		due := start.Add(time.Duration(i) * interval)
+		if !due.Before(end) {
+			break
+		}
+		time.Sleep(time.Until(due))
+		select {
+		case sem <- struct{}{}:
+		default:
+			skipped.Add(1)
+			continue
+		}
+		sent.Add(1)
+		wg.Add(1)
+		go func(q replayQuery) {
+			defer func() { <-sem; wg.Done() }()
+			m := new(dns.Msg)
+			m.SetQuestion(q.name, q.qtype)
+			resp, rtt, err := client.Exchange(m, *target)
+			res := replayResult{err: err, rtt: rtt}
+			if err == nil {
+				res.rcode = resp.Rcode
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			results = append(results, res)
+			if isTimeout(err) {
+				timeouts++
+			} else if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}(pick())
+	}
+	sending := time.Since(start)
+	wg.Wait()
+	close(done)
+
+	printReplaySummary(results, sending)
+	failed := 0
+	for _, r := range results {
+		if r.err != nil {
+			failed++
+		}
+	}
+	if n := len(results); n > 0 {
+		fmt.Printf("Errors %.2f%% (%d timeouts, %d other)\n", 100*float64(failed)/float64(n), timeouts, failed-timeouts)
+	}
+	if firstErr != nil {
+		fmt.Printf("First other error: %v\n", firstErr)
+	}
+	if n := skipped.Load(); n > 0 {
+		fmt.Printf("Skipped %d queries with %d already in flight; the target is not keeping up with %d qps\n", n, *workers, *qps)
+	}
+	return 0
+}
+
+// benchProgress prints what has been sent each second until done closes.
+func benchProgress(start time.Time, sent, skipped *atomic.Int64, done chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var lastSent, lastSkipped int64
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			s, k := sent.Load(), skipped.Load()
+			fmt.Printf("  %3.0fs  %d sent, %d skipped\n", now.Sub(start).Seconds(), s-lastSent, k-lastSkipped)
+			lastSent, lastSkipped = s, k
+		}
+	}
+}
+
+// readBenchNames reads query names, one per line with an optional type
+// after the name; blank lines and # comments are skipped.
+func readBenchNames(path string, defaultType uint16) ([]replayQuery, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out []replayQuery
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		q := replayQuery{name: dns.Fqdn(fields[0]), qtype: defaultType}
+		if _, ok := dns.IsDomainName(q.name); !ok {
+			return nil, fmt.Errorf("%s line %d: invalid name %q", path, line, fields[0])
+		}
+		if len(fields) > 1 {
+			t, ok := dns.StringToType[strings.ToUpper(fields[1])]
+			if !ok {
+				return nil, fmt.Errorf("%s line %d: unknown type %q", path, line, fields[1])
+			}
+			q.qtype = t
+		}
+		out = append(out, q)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("%s: no names", path)
+	}
+	return out, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// BlockResponseConfig decides how a name blocked by a policy zone (an
+// NXDOMAIN or NODATA trigger) is answered, globally under block_response
+// and per zone under rpz[].response:
+//
+//   - policy:  as the policy zone says (the default)
+//   - nxdomain, nodata, refused
+//   - null:    0.0.0.0 for A and :: for AAAA, NODATA for other types
+//   - ip:      the landing page addresses in ips, NODATA for a family
+//     without one
+//
+// Some clients retry or fall back on NXDOMAIN, others give up quicker on
+// an address that goes nowhere.
+type BlockResponseConfig struct {
+	Style string   `yaml:"style"`
+	IPs   []string `yaml:"ips"`
+	TTL   uint32   `yaml:"ttl"` // of null and ip answers, default 60
+}
+
+const (
+	blockPolicy   = "policy"
+	blockNXDomain = "nxdomain"
+	blockNoData   = "nodata"
+	blockRefused  = "refused"
+	blockNull     = "null"
+	blockIP       = "ip"
+)
+
+type blockResponse struct {
+	style  string
+	v4, v6 []net.IP
+	ttl    uint32
+}
+
+// parseBlockResponse returns the response cfg configures, or nil to
+// answer as the policy zone says.
+func parseBlockResponse(key string, cfg BlockResponseConfig) (*blockResponse, error) {
+	b := &blockResponse{style: strings.ToLower(cfg.Style), ttl: cfg.TTL}
+	if b.ttl == 0 {
+		b.ttl = 60
+	}
+	if len(cfg.IPs) > 0 && b.style != blockIP {
+		return nil, fmt.Errorf("%s.ips needs style ip", key)
+	}
+	switch b.style {
+	case "", blockPolicy:
+		return nil, nil
+	case blockNXDomain, blockNoData, blockRefused:
+	case blockNull:
+		b.v4, b.v6 = []net.IP{net.IPv4zero.To4()}, []net.IP{net.IPv6zero}
+	case blockIP:
+		for _, a := range cfg.IPs {
+			ip := net.ParseIP(a)
+			switch {
+			case ip == nil:
+				return nil, fmt.Errorf("%s.ips: %q is not an IP address", key, a)
+			case ip.To4() != nil:
+				b.v4 = append(b.v4, ip.To4())
+			default:
+				b.v6 = append(b.v6, ip)
+			}
+		}
+		if len(b.v4)+len(b.v6) == 0 {
+			return nil, fmt.Errorf("%s: style ip needs ips", key)
+		}
+	default:
+		return nil, fmt.Errorf("%s.style: unknown style %q (want policy, nxdomain, nodata, null, ip or refused)", key, cfg.Style)
+	}
+	return b, nil
+}
+
+// answer fills m with the blocked response to q.
+func (b *blockResponse) answer(m *dns.Msg, q dns.Question) {
+	switch b.style {
+	case blockNXDomain:
+		m.Rcode = dns.RcodeNameError
+	case blockRefused:
+		m.Rcode = dns.RcodeRefused
+		m.Authoritative = false
+	case blockNull, blockIP:
+		hdr := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: b.ttl}
+		switch q.Qtype {
+		case dns.TypeA:
+			hdr.Rrtype = dns.TypeA
+			for _, ip := range b.v4 {
+				m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: ip})
+			}
+		case dns.TypeAAAA:
+			hdr.Rrtype = dns.TypeAAAA
+			for _, ip := range b.v6 {
+				m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+	}
+	// nodata: an empty NOERROR
+}
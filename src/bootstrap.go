@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Bootstrap resolution: every hostname the daemon itself looks up
+// (hostname upstreams, webhooks, Kubernetes, Consul, health checks) is
+// resolved through bootstrap_dns instead of the OS resolver, which may
+// point back at this server. Answers are cached by TTL and served stale if
+// the bootstrap servers become unreachable.
+
+const (
+	bootstrapMinTTL = 30 * time.Second
+	bootstrapMaxTTL = time.Hour
+)
+
+type bootstrapEntry struct {
+	msg     *dns.Msg
+	expires time.Time
+}
+
+var (
+	bootstrapServers []string
+	bootstrapMu      sync.Mutex
+	bootstrapCache   = map[string]bootstrapEntry{}
+)
+
+func setupBootstrap() error {
+	for _, s := range config.BootstrapDNS {
+		addr := withDefaultPort(s, "53")
+		host, _, _ := net.SplitHostPort(addr)
+		if net.ParseIP(host) == nil {
+			return fmt.Errorf("bootstrap_dns: %q must be an IP address", s)
+		}
+		if isSelf(addr) {
+			return fmt.Errorf("bootstrap_dns: %s is this server", s)
+		}
+		bootstrapServers = append(bootstrapServers, addr)
+	}
+	// Without explicit servers, IP-literal upstreams can bootstrap.
+	if len(bootstrapServers) == 0 {
+		for _, u := range activeUpstreams() {
+			if u.proto != protoUDP && u.proto != protoTCP {
+				continue
+			}
+			if net.ParseIP(hostOnly(u.addr)) != nil && !isSelf(u.addr) {
+				bootstrapServers = append(bootstrapServers, u.addr)
+			}
+		}
+	}
+
+	if len(bootstrapServers) == 0 {
+		if cc, err := dns.ClientConfigFromFile("/etc/resolv.conf"); err == nil {
+			for _, ns := range cc.Servers {
+				if isSelf(net.JoinHostPort(ns, cc.Port)) {
+					log.Printf("Warning: the system resolver (%s) is this server; hostnames in the configuration will resolve through it. Set bootstrap_dns to avoid a resolver loop", ns)
+				}
+			}
+		}
+		return nil
+	}
+	net.DefaultResolver = &net.Resolver{PreferGo: true, Dial: dialBootstrap}
+	return nil
+}
+
+// isSelf reports whether addr is this server's own DNS listener.
+func isSelf(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || !slices.Contains(listenPorts(), port) {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialBootstrap hands Go's resolver an in-memory connection answered from
+// the bootstrap cache, so lookups are cached across the whole process.
+func dialBootstrap(ctx context.Context, _, _ string) (net.Conn, error) {
+	client, server := net.Pipe()
+	go serveBootstrapConn(server)
+	return client, nil
+}
+
+// serveBootstrapConn speaks DNS over TCP framing, which is what the Go
+// resolver uses on a stream connection.
+func serveBootstrapConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var size [2]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(buf); err != nil || len(req.Question) != 1 {
+			return
+		}
+		resp := bootstrapExchange(req)
+		out, err := resp.Pack()
+		if err != nil {
+			return
+		}
+		binary.BigEndian.PutUint16(size[:], uint16(len(out)))
+		if _, err := conn.Write(append(size[:], out...)); err != nil {
+			return
+		}
+	}
+}
+
+// bootstrapExchange answers req from the cache or the bootstrap servers.
+func bootstrapExchange(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	key := strings.ToLower(q.Name) + "/" + dns.TypeToString[q.Qtype]
+
+	bootstrapMu.Lock()
+	e, ok := bootstrapCache[key]
+	bootstrapMu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return bootstrapReply(req, e.msg)
+	}
+
+	var resp *dns.Msg
+	var err error
+	c := &dns.Client{Net: "udp", Timeout: 2 * time.Second}
+	m := new(dns.Msg)
+	m.SetQuestion(q.Name, q.Qtype)
+	for _, server := range bootstrapServers {
+		if resp, _, err = c.Exchange(m, server); err == nil && resp.Rcode != dns.RcodeServerFailure {
+			break
+		}
+	}
+	if err != nil || resp == nil {
+		if ok {
+			log.Printf("Bootstrap lookup of %s failed (%v); using the cached answer", q.Name, err)
+			return bootstrapReply(req, e.msg)
+		}
+		log.Printf("Bootstrap lookup of %s failed: %v", q.Name, err)
+		fail := new(dns.Msg)
+		fail.SetRcode(req, dns.RcodeServerFailure)
+		return fail
+	}
+
+	ttl := bootstrapMaxTTL
+	for _, rr := range append(resp.Answer, resp.Ns...) {
+		ttl = min(ttl, time.Duration(rr.Header().Ttl)*time.Second)
+	}
+	ttl = max(ttl, bootstrapMinTTL)
+	bootstrapMu.Lock()
+	bootstrapCache[key] = bootstrapEntry{msg: resp, expires: time.Now().Add(ttl)}
+	bootstrapMu.Unlock()
+	return bootstrapReply(req, resp)
+}
+
+func bootstrapReply(req, cached *dns.Msg) *dns.Msg {
+	resp := cached.Copy()
+	resp.Id = req.Id
+	resp.Question = req.Question
+	return resp
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// CacheConfig controls caching of forwarded answers. Negative answers
+// (NXDOMAIN and NODATA) are kept for the SOA minimum TTL as in RFC 2308,
+// capped by MaxNegativeTTL. With ServeStale or Prefetch, positive answers are
+// cached too; ServeStale keeps them past their TTL for when the upstreams
+// fail.
+type CacheConfig struct {
+	Negative       bool `yaml:"negative"`
+	MaxNegativeTTL int  `yaml:"max_negative_ttl"` // seconds
+	Size           int  `yaml:"size"`             // maximum entries
+	// Saved here on shutdown (SIGINT/SIGTERM) and loaded at startup, so a
+	// restart doesn't send every client's queries upstream at once.
+	File       string           `yaml:"file"`
+	ServeStale ServeStaleConfig `yaml:"serve_stale"`
+	Prefetch   PrefetchConfig   `yaml:"prefetch"`
+}
+
+const (
+	defaultMaxNegativeTTL = 3600
+	defaultCacheSize      = 10000
+)
+
+type cacheEntry struct {
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+
+	hits       int  // lookups since stored
+	prefetched bool // a refresh was started ahead of expiry
+}
+
+// gone reports whether the entry is of no more use, not even as a stale
+// answer.
+func (e cacheEntry) gone(now time.Time) bool {
+	return now.After(e.expires.Add(staleWindow()))
+}
+
+// responseCache holds forwarded responses keyed by question and the request
+// flags that change the answer.
+type responseCache struct {
+	mu         sync.Mutex
+	entries    map[string]cacheEntry
+	size       int
+	refreshing map[string]bool // keys being refreshed in the background
+}
+
+var cache *responseCache
+
+func setupCache() error {
+	cfg := &config.Cache
+	if !cfg.Negative && !cachesPositive() {
+		if cfg.File != "" {
+			return fmt.Errorf("cache.file needs cache.negative, cache.serve_stale or cache.prefetch")
+		}
+		return nil
+	}
+	if err := setupServeStale(&cfg.ServeStale); err != nil {
+		return err
+	}
+	if err := setupPrefetch(&cfg.Prefetch); err != nil {
+		return err
+	}
+	if cfg.MaxNegativeTTL <= 0 {
+		cfg.MaxNegativeTTL = defaultMaxNegativeTTL
+	}
+	if cfg.Size <= 0 {
+		cfg.Size = defaultCacheSize
+	}
+	cache = &responseCache{entries: make(map[string]cacheEntry), size: cfg.Size, refreshing: make(map[string]bool)}
+	if cfg.File != "" {
+		n, err := cache.load(cfg.File)
+		if err != nil {
+			// A lost cache only costs upstream queries.
+			log.Printf("Failed to load cache from %s: %v", cfg.File, err)
+		} else if n > 0 {
+			log.Printf("Loaded %d cached answer(s) from %s", n, cfg.File)
+		}
+	}
+	return nil
+}
+
+// cacheKey is the key of r's answer, scoped to the client subnet r is
+// forwarded with.
+func cacheKey(r *dns.Msg) string {
+	return globalCacheKey(r) + subnetKey(r)
+}
+
+// globalCacheKey is the key of r's answer when it holds for every client.
+func globalCacheKey(r *dns.Msg) string {
+	q := r.Question[0]
+	var b strings.Builder
+	b.WriteString(strings.ToLower(q.Name))
+	b.WriteString("/" + dns.TypeToString[q.Qtype] + "/" + dns.ClassToString[q.Qclass])
+	if dnssecOK(r) {
+		b.WriteString("/do")
+	}
+	if r.CheckingDisabled {
+		b.WriteString("/cd")
+	}
+	return b.String()
+}
+
+// storeKey is where resp is cached: under r's subnet unless the upstream
+// scoped the answer to /0.
+func storeKey(r, resp *dns.Msg) string {
+	if responseScope(resp) == 0 {
+		return globalCacheKey(r)
+	}
+	return cacheKey(r)
+}
+
+// len returns the number of cached responses.
+func (c *responseCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// lookup returns a copy of the cached response to r with its id and TTLs
+// adjusted, or nil. A nil cache never hits.
+func (c *responseCache) lookup(r *dns.Msg) *dns.Msg {
+	if c == nil || len(r.Question) != 1 {
+		return nil
+	}
+	key := cacheKey(r)
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if global := globalCacheKey(r); !ok && key != global {
+		key = global
+		e, ok = c.entries[key]
+	}
+	now := time.Now()
+	if ok && e.gone(now) {
+		delete(c.entries, key)
+	}
+	prefetch := false
+	if ok && !now.After(e.expires) {
+		e.hits++
+		prefetch = e.duePrefetch(now)
+		c.entries[key] = e
+	}
+	c.mu.Unlock()
+	if !ok || now.After(e.expires) {
+		return nil
+	}
+	if prefetch {
+		go c.refresh(r.Copy())
+	}
+
+	resp := e.msg.Copy()
+	resp.Id = r.Id
+	age := uint32(time.Since(e.stored).Seconds())
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			if h := rr.Header(); h.Rrtype != dns.TypeOPT {
+				h.Ttl = max(h.Ttl, age) - age
+			}
+		}
+	}
+	return resp
+}
+
+// storeNegative caches resp if it is an NXDOMAIN or NODATA answer with an
+// SOA to take the negative TTL from.
+func (c *responseCache) storeNegative(r, resp *dns.Msg) {
+	if c == nil || !config.Cache.Negative || len(r.Question) != 1 || len(resp.Answer) > 0 || resp.Truncated {
+		return
+	}
+	if resp.Rcode != dns.RcodeNameError && resp.Rcode != dns.RcodeSuccess {
+		return
+	}
+	var ttl uint32
+	found := false
+	for _, rr := range resp.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl, found = min(soa.Hdr.Ttl, soa.Minttl), true
+			break
+		}
+	}
+	if !found || ttl == 0 {
+		return
+	}
+	ttl = min(ttl, uint32(config.Cache.MaxNegativeTTL))
+
+	msg := resp.Copy()
+	for _, section := range [][]dns.RR{msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if h := rr.Header(); h.Rrtype != dns.TypeOPT {
+				h.Ttl = min(h.Ttl, ttl)
+			}
+		}
+	}
+	now := time.Now()
+	c.put(storeKey(r, resp), cacheEntry{msg: msg, stored: now, expires: now.Add(time.Duration(ttl) * time.Second)})
+}
+
+// refresh forwards r again to renew its cache entry, for prefetching and
+// stale answers; one refresh per question runs at a time.
+func (c *responseCache) refresh(r *dns.Msg) {
+	key := cacheKey(r)
+	c.mu.Lock()
+	if c.refreshing[key] {
+		c.mu.Unlock()
+		return
+	}
+	c.refreshing[key] = true
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.refreshing, key)
+		c.mu.Unlock()
+	}()
+
+	uq := upstreamQuery(r)
+	if config.DNSSEC.Validate {
+		dnssecUpstream(uq)
+	}
+	resp, err := forwardToFallback(uq)
+	if err == nil && config.DNSSEC.Validate && !dnssecFinish(r, resp) {
+		err = errBogus
+	}
+	c.staleOnFailure(r, resp, err) // notes whether the upstreams are back
+	if err != nil || resp.Rcode == dns.RcodeServerFailure {
+		return
+	}
+	c.storeNegative(r, resp)
+	c.storePositive(r, resp)
+	log.Printf("Refreshed cache entry %s", key)
+}
+
+func (c *responseCache) put(key string, e cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.size {
+		now := time.Now()
+		for k, old := range c.entries {
+			if old.gone(now) {
+				delete(c.entries, k)
+			}
+		}
+		// Still full: evict arbitrary entries.
+		for k := range c.entries {
+			if len(c.entries) < c.size {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = e
+}
+
+// savedCacheEntry is one cache entry as written to cache.file.
+type savedCacheEntry struct {
+	Key     string    `json:"key"`
+	Msg     []byte    `json:"msg"` // wire format
+	Stored  time.Time `json:"stored"`
+	Expires time.Time `json:"expires"`
+}
+
+// save writes the unexpired entries to path.
+func (c *responseCache) save(path string) (int, error) {
+	now := time.Now()
+	var saved []savedCacheEntry
+	c.mu.Lock()
+	for key, e := range c.entries {
+		if e.gone(now) {
+			continue
+		}
+		wire, err := e.msg.Pack()
+		if err != nil {
+			continue
+		}
+		saved = append(saved, savedCacheEntry{Key: key, Msg: wire, Stored: e.stored, Expires: e.expires})
+	}
+	c.mu.Unlock()
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		// writeFileAtomic keeps the mode of an existing file.
+		if err := os.WriteFile(path, nil, 0600); err != nil {
+			return 0, err
+		}
+	}
+	return len(saved), writeFileAtomic(path, data)
+}
+
+// load fills the cache from a file written by save. Entries keep their
+// original store time, so TTLs count down across the restart; expired ones
+// are dropped, unless still usable as stale answers. A missing file is an
+// empty cache.
+func (c *responseCache) load(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var saved []savedCacheEntry
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	n := 0
+	for _, s := range saved {
+		e := cacheEntry{stored: s.Stored, expires: s.Expires}
+		if e.gone(now) || s.Stored.After(now) {
+			continue
+		}
+		msg := new(dns.Msg)
+		if err := msg.Unpack(s.Msg); err != nil {
+			continue
+		}
+		e.msg = msg
+		c.put(s.Key, e)
+		n++
+	}
+	return n, nil
+}
+
+// saveCacheOnExit saves the cache to cache.file when the process is asked
+// to stop, then exits.
+func saveCacheOnExit() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	s := <-sig
+	saveCacheFile(s.String())
+	os.Exit(0)
+}
+
+// saveCacheFile saves the cache to cache.file, if set, before the process
+// stops for the given reason.
+func saveCacheFile(reason string) {
+	if config.Cache.File == "" {
+		return
+	}
+	if n, err := cache.save(config.Cache.File); err != nil {
+		log.Printf("Failed to save cache to %s: %v", config.Cache.File, err)
+	} else {
+		log.Printf("Saved %d cached answer(s) to %s on %s", n, config.Cache.File, reason)
+	}
+}
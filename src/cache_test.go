@@ -0,0 +1,150 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func newTestCache(t *testing.T, size int) *responseCache {
+	old := *config
+	t.Cleanup(func() { *config = old })
+	config.Cache = CacheConfig{
+		Negative:       true,
+		MaxNegativeTTL: 600,
+		Size:           size,
+		ServeStale:     ServeStaleConfig{Enabled: true, MaxStale: 3600},
+	}
+	return &responseCache{entries: make(map[string]cacheEntry), size: size, refreshing: make(map[string]bool)}
+}
+
+func testQuestion(name string, qtype uint16) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetQuestion(name, qtype)
+	return r
+}
+
+func TestCacheKey(t *testing.T) {
+	a := testQuestion("WWW.Example.com.", dns.TypeA)
+	if got := cacheKey(a); got != "www.example.com./A/IN" {
+		t.Errorf("key %q", got)
+	}
+	do := testQuestion("www.example.com.", dns.TypeA)
+	do.SetEdns0(1232, true)
+	cd := testQuestion("www.example.com.", dns.TypeA)
+	cd.CheckingDisabled = true
+	aaaa := testQuestion("www.example.com.", dns.TypeAAAA)
+	seen := map[string]bool{}
+	for _, r := range []*dns.Msg{a, do, cd, aaaa} {
+		k := cacheKey(r)
+		if seen[k] {
+			t.Errorf("key %q shared by answers that differ", k)
+		}
+		seen[k] = true
+	}
+}
+
+func TestCachePositiveAging(t *testing.T) {
+	c := newTestCache(t, 10)
+	r := testQuestion("www.example.com.", dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetReply(r)
+	resp.Answer = []dns.RR{mustRR(t, "www.example.com. 300 IN A 192.0.2.1")}
+	c.storePositive(r, resp)
+
+	// Age the entry by 100 seconds.
+	key := cacheKey(r)
+	e := c.entries[key]
+	e.stored = e.stored.Add(-100 * time.Second)
+	e.expires = e.expires.Add(-100 * time.Second)
+	c.entries[key] = e
+
+	q := testQuestion("WWW.EXAMPLE.COM.", dns.TypeA)
+	q.Id = 4242
+	hit := c.lookup(q)
+	if hit == nil {
+		t.Fatal("miss")
+	}
+	if hit.Id != 4242 {
+		t.Errorf("id %d", hit.Id)
+	}
+	if ttl := hit.Answer[0].Header().Ttl; ttl < 199 || ttl > 200 {
+		t.Errorf("TTL %d after 100s of 300", ttl)
+	}
+	hit.Answer[0].Header().Ttl = 1
+	if again := c.lookup(q); again.Answer[0].Header().Ttl == 1 {
+		t.Error("lookup handed out the cached message itself")
+	}
+
+	if c.lookup(testQuestion("www.example.com.", dns.TypeAAAA)) != nil {
+		t.Error("AAAA answered from the A entry")
+	}
+
+	// Expired but within the stale window: no hit, but kept for serve-stale.
+	e = c.entries[key]
+	e.expires = time.Now().Add(-time.Second)
+	c.entries[key] = e
+	if c.lookup(q) != nil {
+		t.Error("expired entry returned")
+	}
+	if _, ok := c.entries[key]; !ok {
+		t.Error("entry dropped inside the stale window")
+	}
+}
+
+func TestCacheNegative(t *testing.T) {
+	c := newTestCache(t, 10)
+	soa := func(ttl, minttl uint32) dns.RR {
+		return &dns.SOA{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+			Ns: "ns.example.com.", Mbox: "hostmaster.example.com.", Serial: 1, Minttl: minttl}
+	}
+	tests := []struct {
+		name   string
+		rcode  int
+		ns     []dns.RR
+		stored bool
+		ttl    uint32
+	}{
+		{"nx.example.com.", dns.RcodeNameError, []dns.RR{soa(3600, 60)}, true, 60},
+		{"nodata.example.com.", dns.RcodeSuccess, []dns.RR{soa(30, 900)}, true, 30},
+		{"capped.example.com.", dns.RcodeNameError, []dns.RR{soa(86400, 86400)}, true, 600},
+		{"nosoa.example.com.", dns.RcodeNameError, nil, false, 0},
+		{"servfail.example.com.", dns.RcodeServerFailure, []dns.RR{soa(3600, 60)}, false, 0},
+	}
+	for _, tt := range tests {
+		r := testQuestion(tt.name, dns.TypeA)
+		resp := new(dns.Msg)
+		resp.SetRcode(r, tt.rcode)
+		resp.Ns = tt.ns
+		c.storeNegative(r, resp)
+		e, ok := c.entries[cacheKey(r)]
+		if ok != tt.stored {
+			t.Errorf("%s: stored %v", tt.name, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if got := e.expires.Sub(e.stored); got != time.Duration(tt.ttl)*time.Second {
+			t.Errorf("%s: kept for %v, want %ds", tt.name, got, tt.ttl)
+		}
+		if got := e.msg.Ns[0].Header().Ttl; got > tt.ttl {
+			t.Errorf("%s: SOA TTL %d above %d", tt.name, got, tt.ttl)
+		}
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	c := newTestCache(t, 3)
+	now := time.Now()
+	for _, name := range []string{"a.", "b.", "c.", "d.", "e."} {
+		c.put(name, cacheEntry{msg: new(dns.Msg), stored: now, expires: now.Add(time.Minute)})
+	}
+	if n := c.len(); n != 3 {
+		t.Errorf("%d entries in a cache of 3", n)
+	}
+	if _, ok := c.entries["e."]; !ok {
+		t.Error("newest entry evicted")
+	}
+}
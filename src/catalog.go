@@ -0,0 +1,135 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// Catalog zones (RFC 9432) provision secondary zones. A zone of type
+// "catalog" is transferred from its masters like a secondary but not
+// served; every member zone it lists ("<id>.zones.<catalog> PTR
+// <member>.") becomes a secondary zone transferred from the same masters,
+// with the catalog's authoritative, notify and allow_transfer settings,
+// and members dropped from the catalog are removed. A zone added on the
+// primary thus reaches every consumer without configuration changes.
+// Member zones keep no copy on disk; they are transferred again at
+// startup.
+
+const zoneTypeCatalog = "catalog"
+
+var (
+	catalogMu sync.Mutex // serializes changes to the member lists
+	// catalogMembers are the member zones of every catalog, for lookups.
+	catalogMembers atomic.Pointer[[]*zone]
+)
+
+// memberZones returns the zones provisioned by catalogs.
+func memberZones() []*zone {
+	if p := catalogMembers.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+// catalogVersion returns the schema version the catalog declares.
+func (z *zone) catalogVersion(recs map[string][]Record) string {
+	for _, rec := range recs["version."+z.origin] {
+		if rec.Type == "TXT" {
+			v := rec.Data
+			if len(rec.Strings) > 0 {
+				v = rec.Strings[0]
+			}
+			return strings.Trim(v, `"\`)
+		}
+	}
+	return ""
+}
+
+// applyCatalog brings the member zones in line with a newly transferred
+// catalog.
+func (z *zone) applyCatalog(recs map[string][]Record) {
+	if v := z.catalogVersion(recs); v != "2" && v != "1" {
+		log.Printf("Catalog %s: unsupported schema version %q; members left as they were", z.origin, v)
+		return
+	}
+	suffix := ".zones." + z.origin
+	want := make(map[string]bool)
+	for name, rs := range recs {
+		id, ok := strings.CutSuffix(name, suffix)
+		if !ok || strings.Contains(id, ".") {
+			continue // properties (group, coo) and other data
+		}
+		for _, rec := range rs {
+			if rec.Type == "PTR" {
+				want[dns.CanonicalName(rec.Data)] = true
+				break
+			}
+		}
+	}
+
+	catalogMu.Lock()
+	defer catalogMu.Unlock()
+	var added, removed []string
+	for origin, m := range z.members {
+		if !want[origin] {
+			close(m.stop)
+			records.setSource(m.source(), nil)
+			delete(z.members, origin)
+			removed = append(removed, origin)
+		}
+	}
+	for origin := range want {
+		if z.members[origin] != nil {
+			continue
+		}
+		if zoneByOrigin(origin) != nil {
+			log.Printf("Catalog %s: member %s is already served here; skipped", z.origin, origin)
+			continue
+		}
+		m := &zone{
+			ZoneConfig: ZoneConfig{
+				Name:          origin,
+				Type:          zoneTypeSecondary,
+				Masters:       z.Masters,
+				Authoritative: z.Authoritative,
+				Notify:        z.Notify,
+			},
+			origin:      origin,
+			secondary:   true,
+			transferACL: z.transferACL,
+			notified:    make(chan struct{}, 1),
+			stop:        make(chan struct{}),
+		}
+		z.members[origin] = m
+		added = append(added, origin)
+		go m.follow()
+	}
+
+	var all []*zone
+	for _, c := range zones {
+		for _, m := range c.members {
+			all = append(all, m)
+		}
+	}
+	catalogMembers.Store(&all)
+	if len(added)+len(removed) > 0 {
+		sort.Strings(added)
+		sort.Strings(removed)
+		log.Printf("Catalog %s: %d member zone(s); added %v, removed %v", z.origin, len(z.members), added, removed)
+	}
+}
+
+// removed reports whether a catalog dropped the zone.
+func (z *zone) removed() bool {
+	select {
+	case <-z.stop:
+		return true
+	default:
+		return false
+	}
+}
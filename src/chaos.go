@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ChaosConfig answers the CHAOS-class TXT queries monitoring uses to tell
+// which server answered behind anycast or a load balancer: id.server and
+// hostname.bind get ID, version.server and version.bind get Version. With
+// chaos off, and for other CHAOS names, queries are REFUSED.
+type ChaosConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	ID      string `yaml:"id"`      // default: the hostname
+	Version string `yaml:"version"` // empty refuses version queries
+}
+
+func setupChaos() error {
+	cfg := &config.Chaos
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.ID == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("chaos.id: no hostname to default to: %v", err)
+		}
+		cfg.ID = host
+	}
+	return nil
+}
+
+// chaosText is the TXT string for a CHAOS name, or "" for none.
+func chaosText(name string) string {
+	switch strings.ToLower(name) {
+	case "id.server.", "hostname.bind.":
+		return config.Chaos.ID
+	case "version.server.", "version.bind.":
+		return config.Chaos.Version
+	}
+	return ""
+}
+
+// answerChaos answers a CHAOS-class query.
+func answerChaos(w dns.ResponseWriter, r *dns.Msg, listener string) {
+	q := r.Question[0]
+	m := new(dns.Msg)
+	text := ""
+	if config.Chaos.Enabled {
+		text = chaosText(q.Name)
+	}
+	if text == "" {
+		m.SetRcode(r, dns.RcodeRefused)
+		refusedEDE(r, m, "CHAOS query not answered")
+		w.WriteMsg(m)
+		log.Printf("[%s] Refused CHAOS query %s from %s", listener, q.Name, clientLabel(clientIP(w)))
+		return
+	}
+	m.SetReply(r)
+	m.Authoritative = true
+	if q.Qtype == dns.TypeTXT || q.Qtype == dns.TypeANY {
+		m.Answer = append(m.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+			Txt: []string{text},
+		})
+	}
+	finishEDNS(r, m)
+	w.WriteMsg(m)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// checkZoneTargets are the record types whose data names another record.
+var checkZoneTargets = map[string]bool{"CNAME": true, "MX": true, "SRV": true, "NS": true}
+
+// runCheckZone implements "micro-dns check-zone": it reads a zone file the
+// way the server does, $INCLUDEs and all, but reports every bad line
+// instead of skipping it, then checks the records as a whole. It exits 1
+// when anything was reported, so CI can gate zone changes on it.
+func runCheckZone(args []string) int {
+	fs := flag.NewFlagSet("check-zone", flag.ExitOnError)
+	origin := fs.String("origin", "", "Zone origin for relative names, as in a zones entry")
+	defaultTTL := fs.Uint("default-ttl", 0, "TTL for lines without one, as in a zones entry")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: micro-dns check-zone [flags] <zone file>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	path := fs.Arg(0)
+
+	zs := zoneSyntax{defaultTTL: uint32(*defaultTTL)}
+	if *origin != "" {
+		zs.origin = dns.CanonicalName(*origin)
+	}
+	problems := 0
+	zr := &zoneReader{
+		zs:      zs,
+		vars:    make(map[string]string),
+		recs:    make(map[string][]Record),
+		sources: make(map[string][]string),
+		problem: func(path string, line int, err error) {
+			fmt.Printf("%s:%d: invalid: %v\n", path, line, err)
+			problems++
+		},
+	}
+	if err := zr.read(path); err != nil {
+		fmt.Printf("%s: error: %v\n", path, err)
+		return 1
+	}
+	for _, f := range checkZoneRecords(zr.recs, zr.sources, zs.origin) {
+		fmt.Println(f)
+		problems++
+	}
+
+	if problems > 0 {
+		fmt.Fprintf(os.Stderr, "check-zone: %d problem(s) in %s\n", problems, path)
+		return 1
+	}
+	count := 0
+	for _, rs := range zr.recs {
+		count += len(rs)
+	}
+	fmt.Printf("%s: OK, %d records at %d names\n", path, count, len(zr.recs))
+	return 0
+}
+
+// checkZoneRecords looks for duplicate records, CNAMEs that share their
+// name with other data, canary shares over 100% and targets that would resolve to nothing. A target
+// only counts as dangling when it lies in a domain the file serves, either
+// under origin or next to a name the file defines; names elsewhere are
+// someone else's to answer for.
+func checkZoneRecords(recs map[string][]Record, sources map[string][]string, origin string) []string {
+	owners := make(map[string]bool)
+	parents := make(map[string]bool)
+	for name := range recs {
+		name = strings.ToLower(name)
+		owners[name] = true
+		parents[parentDomain(name)] = true
+	}
+	served := func(name string) bool {
+		if origin != "" && dns.IsSubDomain(origin, name) {
+			return true
+		}
+		return parents[parentDomain(name)]
+	}
+	exists := func(name string) bool {
+		return owners[name] || owners["*."+parentDomain(name)]
+	}
+
+	var out []string
+	names := make([]string, 0, len(recs))
+	for name := range recs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		rs, at := recs[name], sources[name]
+		seen := make(map[string]string)
+		cnames, plainCNAMEs, others := 0, 0, ""
+		for i, rec := range rs {
+			key := fmt.Sprintf("%s %d %s %d %d %d %v %v", rec.Type, rec.Pref, strings.ToLower(rec.Data), rec.SrvWeight, rec.Port, rec.Canary, rec.Countries, rec.Continents)
+			if first, dup := seen[key]; dup {
+				out = append(out, fmt.Sprintf("%s: duplicate: %s %s %s repeats %s", at[i], name, rec.Type, rec.Data, first))
+			} else {
+				seen[key] = at[i]
+			}
+			if rec.Type == "CNAME" {
+				cnames++
+				// Canary and GeoIP variants are alternatives, not extras.
+				if rec.Canary == 0 && len(rec.Countries)+len(rec.Continents) == 0 {
+					plainCNAMEs++
+				}
+				if plainCNAMEs > 1 {
+					out = append(out, fmt.Sprintf("%s: cname: %s has more than one CNAME", at[i], name))
+				}
+			} else if others == "" {
+				others = rec.Type
+			}
+			if !checkZoneTargets[rec.Type] || rec.Data == "." {
+				continue
+			}
+			target := dns.CanonicalName(rec.Data)
+			if served(target) && !exists(target) {
+				out = append(out, fmt.Sprintf("%s: dangling: %s %s target %s has no records", at[i], name, rec.Type, target))
+			}
+		}
+		if err := checkCanaries(name, rs); err != nil {
+			out = append(out, fmt.Sprintf("%s: canary: %v", at[0], err))
+		}
+		if cnames > 0 && others != "" {
+			i := slices.IndexFunc(rs, func(r Record) bool { return r.Type == "CNAME" })
+			out = append(out, fmt.Sprintf("%s: cname: %s has a CNAME and %s records; a CNAME must be the only data at its name", at[i], name, others))
+		}
+	}
+	return out
+}
+
+// parentDomain returns name with its first label removed.
+func parentDomain(name string) string {
+	if i, end := dns.NextLabel(name, 0); !end {
+		return name[i:]
+	}
+	return "."
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckZone(t *testing.T) {
+	dir := writeZoneFiles(t, map[string]string{
+		"good.txt": `@     IN A     192.0.2.1
+www   IN CNAME @
+mail  IN A     192.0.2.2
+@     IN MX    10 mail
+`,
+		"bad.txt": `www   IN A     192.0.2.1
+www   IN A     192.0.2.1
+www   IN CNAME web
+@     IN MX    10 mx
+app   IN A     192.0.2.3 canary=60
+app   IN A     192.0.2.4 canary=60
+ext   IN CNAME cdn.example.net.
+oops  IN A     300.1.1.1
+`,
+	})
+	if code := runCheckZone([]string{"-origin", "example.com.", "-default-ttl", "300", filepath.Join(dir, "good.txt")}); code != 0 {
+		t.Errorf("good zone: exit %d", code)
+	}
+	if code := runCheckZone([]string{"-origin", "example.com.", "-default-ttl", "300", filepath.Join(dir, "bad.txt")}); code != 1 {
+		t.Errorf("bad zone: exit %d", code)
+	}
+
+	recs := map[string][]Record{
+		"www.example.com.": {
+			{Type: "A", Data: "192.0.2.1"},
+			{Type: "A", Data: "192.0.2.1"},
+			{Type: "CNAME", Data: "web.example.com."},
+		},
+		"example.com.": {{Type: "MX", Data: "mx.example.com.", Pref: 10}},
+		"app.example.com.": {
+			{Type: "A", Data: "192.0.2.3", Canary: 60},
+			{Type: "A", Data: "192.0.2.4", Canary: 60},
+		},
+		"ext.example.com.": {{Type: "CNAME", Data: "cdn.example.net."}},
+	}
+	sources := make(map[string][]string)
+	for name, rs := range recs {
+		for i := range rs {
+			sources[name] = append(sources[name], fmt.Sprintf("zone:%d", i+1))
+		}
+	}
+	var kinds []string
+	for _, f := range checkZoneRecords(recs, sources, "example.com.") {
+		kind, _, _ := strings.Cut(strings.SplitN(f, ": ", 2)[1], ":")
+		kinds = append(kinds, kind)
+	}
+	// Targets outside the zone (cdn.example.net.) are not dangling.
+	want := "canary dangling duplicate dangling cname"
+	if got := strings.Join(kinds, " "); got != want {
+		t.Errorf("findings %q, want %q", got, want)
+	}
+}
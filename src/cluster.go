@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ClusterConfig keeps several instances behind anycast or a VIP answering
+// alike: each node sends the runtime changes it makes to the others, which
+// apply them as their own. That covers zone records changed by dynamic
+// updates and the admin API (apply, normalize, rollback), and the records
+// of DHCP leases the node sees, which peers serve as source "dhcp@<node>".
+//
+// Changes are pushed to every peer as they happen, and each node also
+// pulls the full set of runtime changes from its peers every SyncInterval
+// seconds, so a node that was down or missed a push catches up. A name
+// changed on two nodes at once ends up with the later change everywhere.
+// Messages carry an HMAC-SHA256 made with Secret, which every node shares,
+// over their body, time, a random nonce and what they are: the request
+// line, or for a reply the nonce of the request. A node refuses a nonce it
+// has already seen, so a captured message can't be played again. Without
+// TLSCert the channel itself is plain HTTP and anyone on the path can read
+// it; with TLSCert and TLSKey nodes talk HTTPS, and with TLSCA as well
+// each end must present a certificate signed by that CA.
+type ClusterConfig struct {
+	Listen       string   `yaml:"listen"` // host:port peers send to
+	Peers        []string `yaml:"peers"`  // the other nodes' listen addresses
+	Secret       string   `yaml:"secret"` // at least 16 characters
+	Node         string   `yaml:"node"`   // unique name, default the hostname
+	SyncInterval int      `yaml:"sync_interval"`
+	TLSCert      string   `yaml:"tls_cert"`
+	TLSKey       string   `yaml:"tls_key"`
+	TLSCA        string   `yaml:"tls_ca"` // verifies peers; system roots if empty
+}
+
+// clusterMaxSkew bounds how far a message's time may be from ours. Nonces
+// are remembered for twice as long, past which their time gives them away.
+const clusterMaxSkew = 60 * time.Second
+
+// clusterName is the last runtime change to a zone name: its records
+// after the change, ordered by when and where it was made.
+type clusterName struct {
+	Records []Record `json:"records"`
+	At      int64    `json:"at"` // unix nanoseconds
+	Node    string   `json:"node"`
+}
+
+// newer reports whether c supersedes old.
+func (c clusterName) newer(old clusterName) bool {
+	return c.At > old.At || (c.At == old.At && c.Node > old.Node)
+}
+
+// clusterMessage is a push, or a node's whole state in reply to a pull.
+// DHCP is nil when the message doesn't carry the sender's lease records.
+type clusterMessage struct {
+	Node  string                 `json:"node"`
+	Names map[string]clusterName `json:"names,omitempty"`
+	DHCP  map[string][]Record    `json:"dhcp"`
+}
+
+type clusterPeer struct {
+	addr     string
+	queue    chan *clusterMessage
+	lastOK   atomic.Int64 // unix seconds
+	failures atomic.Uint64
+	lastErr  atomic.Value // string
+}
+
+var (
+	clusterPeers  []*clusterPeer
+	clusterHTTP   = &http.Client{Timeout: 5 * time.Second}
+	clusterScheme = "http"
+	clusterTLS    *tls.Config // for the listener; nil without tls_cert
+
+	clusterNoncesMu sync.Mutex
+	clusterNonces   = map[string]time.Time{} // seen nonce -> when
+
+	clusterMu    sync.Mutex // guards the fields below; taken inside records.mu, never around it
+	clusterNames = map[string]clusterName{}
+	clusterDHCP  map[string][]Record // ours, as last published
+)
+
+func setupCluster() error {
+	cfg := &config.Cluster
+	if cfg.Listen == "" && len(cfg.Peers) == 0 {
+		return nil
+	}
+	switch {
+	case cfg.Listen == "" || len(cfg.Peers) == 0:
+		return fmt.Errorf("cluster needs listen and peers")
+	case len(cfg.Secret) < 16:
+		return fmt.Errorf("cluster.secret must be at least 16 characters")
+	case cfg.SyncInterval < 0:
+		return fmt.Errorf("cluster.sync_interval must not be negative")
+	}
+	if cfg.Node == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("cluster.node: no hostname to default to: %v", err)
+		}
+		cfg.Node = host
+	}
+	if cfg.SyncInterval == 0 {
+		cfg.SyncInterval = 30
+	}
+	if err := setupClusterTLS(cfg); err != nil {
+		return err
+	}
+	for _, addr := range cfg.Peers {
+		clusterPeers = append(clusterPeers, &clusterPeer{addr: addr, queue: make(chan *clusterMessage, 256)})
+	}
+	log.Printf("Cluster node %s with %d peer(s)", cfg.Node, len(clusterPeers))
+	return nil
+}
+
+// setupClusterTLS loads the node's certificate, if any, for both ends of
+// the channel.
+func setupClusterTLS(cfg *ClusterConfig) error {
+	switch {
+	case cfg.TLSCert == "" && cfg.TLSKey == "" && cfg.TLSCA == "":
+		return nil
+	case cfg.TLSCert == "" || cfg.TLSKey == "":
+		return fmt.Errorf("cluster.tls_cert and cluster.tls_key go together")
+	}
+	pair, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+	if err != nil {
+		return fmt.Errorf("cluster.tls_cert: %v", err)
+	}
+	server := &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{pair}}
+	client := &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{pair}}
+	if cfg.TLSCA != "" {
+		ca, err := os.ReadFile(cfg.TLSCA)
+		if err != nil {
+			return fmt.Errorf("cluster.tls_ca: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return fmt.Errorf("cluster.tls_ca: no certificates in %s", cfg.TLSCA)
+		}
+		server.ClientCAs, server.ClientAuth = pool, tls.RequireAndVerifyClientCert
+		client.RootCAs = pool
+	}
+	clusterTLS = server
+	clusterScheme = "https"
+	clusterHTTP = &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{TLSClientConfig: client}}
+	return nil
+}
+
+func clusterEnabled() bool {
+	return len(clusterPeers) > 0
+}
+
+// recordChange journals a change to the zone records of the names in old
+// and sends it to the cluster: old holds each name's records before the
+// change, recs the zone after it. It runs inside records.updateSource.
+func recordChange(origin string, old, recs map[string][]Record) {
+	journalChange(origin, old, recs)
+	if !clusterEnabled() || len(old) == 0 {
+		return
+	}
+	msg := &clusterMessage{Node: config.Cluster.Node, Names: make(map[string]clusterName, len(old))}
+	now := time.Now().UnixNano()
+	clusterMu.Lock()
+	for name := range old {
+		c := clusterName{Records: recs[name], At: max(now, clusterNames[name].At+1), Node: config.Cluster.Node}
+		clusterNames[name] = c
+		msg.Names[name] = c
+	}
+	clusterMu.Unlock()
+	broadcast(msg)
+}
+
+// announceLeases sends the records of our DHCP leases to the cluster.
+func announceLeases(recs map[string][]Record) {
+	if !clusterEnabled() {
+		return
+	}
+	clusterMu.Lock()
+	clusterDHCP = recs
+	clusterMu.Unlock()
+	broadcast(&clusterMessage{Node: config.Cluster.Node, DHCP: recs})
+}
+
+// overlayCluster applies the runtime changes the cluster knows of to zone
+// records just loaded, so a reload of the zone file doesn't undo them.
+func overlayCluster(recs map[string][]Record) {
+	clusterMu.Lock()
+	defer clusterMu.Unlock()
+	for name, c := range clusterNames {
+		if len(c.Records) == 0 {
+			delete(recs, name)
+		} else {
+			recs[name] = c.Records
+		}
+	}
+}
+
+// broadcast queues msg for every peer. A peer whose queue is full misses
+// it and catches up at its next pull.
+func broadcast(msg *clusterMessage) {
+	for _, p := range clusterPeers {
+		select {
+		case p.queue <- msg:
+		default:
+		}
+	}
+}
+
+// applyCluster applies a message from another node.
+func applyCluster(msg *clusterMessage) {
+	if msg.Node == "" || msg.Node == config.Cluster.Node {
+		return
+	}
+	if len(msg.Names) > 0 {
+		origin := "cluster change from " + msg.Node
+		records.updateSource(sourceZone, func(cur map[string][]Record) {
+			old := make(map[string][]Record)
+			clusterMu.Lock()
+			for name, c := range msg.Names {
+				if known, ok := clusterNames[name]; ok && !c.newer(known) {
+					continue
+				}
+				clusterNames[name] = c
+				old[name] = cur[name]
+				if len(c.Records) == 0 {
+					delete(cur, name)
+				} else {
+					cur[name] = c.Records
+				}
+			}
+			clusterMu.Unlock()
+			if len(old) > 0 {
+				journalChange(origin, old, cur)
+				snapshotZone(origin, cur)
+				log.Printf("Applied %d name change(s) from cluster node %s", len(old), msg.Node)
+			}
+		})
+	}
+	if msg.DHCP != nil && (len(msg.DHCP) > 0 || records.source(sourceDHCP+"@"+msg.Node) != nil) {
+		records.setSource(sourceDHCP+"@"+msg.Node, msg.DHCP)
+	}
+}
+
+// clusterState is our part of the cluster's state, for a pulling peer.
+func clusterState() *clusterMessage {
+	clusterMu.Lock()
+	defer clusterMu.Unlock()
+	msg := &clusterMessage{Node: config.Cluster.Node, Names: maps.Clone(clusterNames), DHCP: clusterDHCP}
+	if msg.DHCP == nil {
+		msg.DHCP = map[string][]Record{}
+	}
+	return msg
+}
+
+// clusterSignature authenticates body sent at unix time ts with nonce, as
+// what: the request line of a request, or "reply " and the request's nonce.
+func clusterSignature(ts, nonce, what string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(config.Cluster.Secret))
+	mac.Write([]byte(ts + "\n" + nonce + "\n" + what + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// clusterAuth is the X-Cluster-Auth header for body sent now as what, and
+// the nonce in it.
+func clusterAuth(what string, body []byte) (header, nonce string) {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	var b [16]byte
+	rand.Read(b[:])
+	nonce = hex.EncodeToString(b[:])
+	return ts + ":" + nonce + ":" + clusterSignature(ts, nonce, what, body), nonce
+}
+
+// verifyClusterAuth checks the X-Cluster-Auth header of a request or reply
+// carrying body as what, and returns its nonce. A nonce is accepted once.
+func verifyClusterAuth(header, what string, body []byte) (string, bool) {
+	parts := strings.Split(header, ":")
+	if len(parts) != 3 || parts[1] == "" {
+		return "", false
+	}
+	ts, nonce, sig := parts[0], parts[1], parts[2]
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || time.Since(time.Unix(sec, 0)).Abs() > clusterMaxSkew {
+		return "", false
+	}
+	if !hmac.Equal([]byte(sig), []byte(clusterSignature(ts, nonce, what, body))) {
+		return "", false
+	}
+	return nonce, firstNonce(nonce)
+}
+
+// firstNonce records nonce and reports whether it is new.
+func firstNonce(nonce string) bool {
+	now := time.Now()
+	clusterNoncesMu.Lock()
+	defer clusterNoncesMu.Unlock()
+	if _, seen := clusterNonces[nonce]; seen {
+		return false
+	}
+	for n, at := range clusterNonces {
+		if now.Sub(at) > 2*clusterMaxSkew {
+			delete(clusterNonces, n)
+		}
+	}
+	clusterNonces[nonce] = now
+	return true
+}
+
+func serveCluster() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /cluster/changes", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 64<<20))
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if _, ok := verifyClusterAuth(r.Header.Get("X-Cluster-Auth"), "POST /cluster/changes", body); !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var msg clusterMessage
+		if err := json.Unmarshal(body, &msg); err != nil {
+			http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		applyCluster(&msg)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /cluster/state", func(w http.ResponseWriter, r *http.Request) {
+		nonce, ok := verifyClusterAuth(r.Header.Get("X-Cluster-Auth"), "GET /cluster/state", nil)
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		body, _ := json.Marshal(clusterState())
+		auth, _ := clusterAuth("reply "+nonce, body)
+		w.Header().Set("X-Cluster-Auth", auth)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	})
+	for _, p := range clusterPeers {
+		go p.run()
+	}
+	srv := &http.Server{Addr: config.Cluster.Listen, Handler: mux, TLSConfig: clusterTLS}
+	var err error
+	if clusterTLS != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != nil {
+		log.Printf("Cluster endpoint stopped: %v", err)
+	}
+}
+
+// run sends queued changes to the peer and pulls its state, at once and
+// then every sync_interval.
+func (p *clusterPeer) run() {
+	p.pull()
+	tick := time.NewTicker(time.Duration(config.Cluster.SyncInterval) * time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case msg := <-p.queue:
+			p.push(msg)
+		case <-tick.C:
+			p.pull()
+		}
+	}
+}
+
+func (p *clusterPeer) push(msg *clusterMessage) {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		p.fail(err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, clusterScheme+"://"+p.addr+"/cluster/changes", bytes.NewReader(body))
+	if err != nil {
+		p.fail(err)
+		return
+	}
+	auth, _ := clusterAuth("POST /cluster/changes", body)
+	req.Header.Set("X-Cluster-Auth", auth)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := clusterHTTP.Do(req)
+	if err != nil {
+		p.fail(err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		p.fail(fmt.Errorf("%s", resp.Status))
+		return
+	}
+	p.ok()
+}
+
+func (p *clusterPeer) pull() {
+	req, err := http.NewRequest(http.MethodGet, clusterScheme+"://"+p.addr+"/cluster/state", nil)
+	if err != nil {
+		p.fail(err)
+		return
+	}
+	auth, nonce := clusterAuth("GET /cluster/state", nil)
+	req.Header.Set("X-Cluster-Auth", auth)
+	resp, err := clusterHTTP.Do(req)
+	if err != nil {
+		p.fail(err)
+		return
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<20))
+	if err != nil {
+		p.fail(err)
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		p.fail(fmt.Errorf("%s", resp.Status))
+		return
+	}
+	if _, ok := verifyClusterAuth(resp.Header.Get("X-Cluster-Auth"), "reply "+nonce, body); !ok {
+		p.fail(fmt.Errorf("reply failed authentication"))
+		return
+	}
+	var msg clusterMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		p.fail(err)
+		return
+	}
+	applyCluster(&msg)
+	p.ok()
+}
+
+func (p *clusterPeer) ok() {
+	if p.lastOK.Swap(time.Now().Unix()) == 0 && p.failures.Load() > 0 {
+		log.Printf("Cluster peer %s reachable", p.addr)
+	}
+}
+
+// fail logs the first failure after a success, so a peer that is down
+// doesn't flood the log.
+func (p *clusterPeer) fail(err error) {
+	p.failures.Add(1)
+	p.lastErr.Store(err.Error())
+	if p.lastOK.Swap(0) != 0 || p.failures.Load() == 1 {
+		log.Printf("Cluster peer %s: %v", p.addr, err)
+	}
+}
+
+type clusterPeerReport struct {
+	Addr      string `json:"addr"`
+	LastOK    int64  `json:"last_ok"` // unix seconds; 0 while failing
+	Failures  uint64 `json:"failures"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+func clusterReports() []clusterPeerReport {
+	out := []clusterPeerReport{}
+	for _, p := range clusterPeers {
+		rep := clusterPeerReport{Addr: p.addr, LastOK: p.lastOK.Load(), Failures: p.failures.Load()}
+		if e, ok := p.lastErr.Load().(string); ok {
+			rep.LastError = e
+		}
+		out = append(out, rep)
+	}
+	return out
+}
+
+func handleCluster(w http.ResponseWriter, r *http.Request) {
+	clusterMu.Lock()
+	changed := len(clusterNames)
+	clusterMu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"node":          config.Cluster.Node,
+		"changed_names": changed,
+		"peers":         clusterReports(),
+	})
+}
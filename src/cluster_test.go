@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func withClusterSecret(t *testing.T) {
+	old := config.Cluster
+	config.Cluster.Secret = "a-long-shared-secret"
+	t.Cleanup(func() { config.Cluster = old })
+}
+
+func TestClusterAuthReplay(t *testing.T) {
+	withClusterSecret(t)
+	body := []byte(`{"node":"dns2"}`)
+
+	header, nonce := clusterAuth("POST /cluster/changes", body)
+	if got, ok := verifyClusterAuth(header, "POST /cluster/changes", body); !ok || got != nonce {
+		t.Fatalf("fresh message refused")
+	}
+	if _, ok := verifyClusterAuth(header, "POST /cluster/changes", body); ok {
+		t.Error("replayed message accepted")
+	}
+
+	header, _ = clusterAuth("GET /cluster/state", nil)
+	if _, ok := verifyClusterAuth(header, "POST /cluster/changes", nil); ok {
+		t.Error("pull request accepted as a push")
+	}
+	header, _ = clusterAuth("POST /cluster/changes", body)
+	if _, ok := verifyClusterAuth(header, "POST /cluster/changes", []byte(`{"node":"dns3"}`)); ok {
+		t.Error("altered body accepted")
+	}
+
+	// A reply is bound to the nonce of the pull that asked for it.
+	header, _ = clusterAuth("reply 00112233", body)
+	if _, ok := verifyClusterAuth(header, "reply 44556677", body); ok {
+		t.Error("reply to another pull accepted")
+	}
+
+	old := clusterSignature("0", "aa", "POST /cluster/changes", body)
+	if _, ok := verifyClusterAuth("0:aa:"+old, "POST /cluster/changes", body); ok {
+		t.Error("stale message accepted")
+	}
+	if _, ok := verifyClusterAuth("1:"+old, "POST /cluster/changes", body); ok {
+		t.Error("header without a nonce accepted")
+	}
+}
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1, which also
+// serves as its own CA, and returns the paths of the certificate and key.
+func writeTestCert(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "cluster"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "node.crt"), filepath.Join(dir, "node.key")
+	os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certPath, keyPath
+}
+
+func TestClusterMutualTLS(t *testing.T) {
+	oldHTTP, oldScheme, oldTLS := clusterHTTP, clusterScheme, clusterTLS
+	t.Cleanup(func() { clusterHTTP, clusterScheme, clusterTLS = oldHTTP, oldScheme, oldTLS })
+
+	certPath, keyPath := writeTestCert(t)
+	if err := setupClusterTLS(&ClusterConfig{TLSCert: certPath}); err == nil {
+		t.Error("tls_cert without tls_key accepted")
+	}
+	if err := setupClusterTLS(&ClusterConfig{TLSCert: certPath, TLSKey: keyPath, TLSCA: certPath}); err != nil {
+		t.Fatal(err)
+	}
+	if clusterScheme != "https" {
+		t.Errorf("scheme %s", clusterScheme)
+	}
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	srv.TLS = clusterTLS
+	srv.StartTLS()
+	defer srv.Close()
+
+	resp, err := clusterHTTP.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("peer with a certificate: %v", err)
+	}
+	resp.Body.Close()
+
+	pool := x509.NewCertPool()
+	caPEM, _ := os.ReadFile(certPath)
+	pool.AppendCertsFromPEM(caPEM)
+	anon := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	if resp, err := anon.Get(srv.URL); err == nil {
+		resp.Body.Close()
+		t.Error("client without a certificate accepted")
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/bits"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// CookieConfig tunes DNS cookies (RFC 7873). Server cookies are given when
+// edns.options.cookie is "local" and are built as RFC 9018 specifies, with
+// SipHash-2-4 over the client's cookie and address, so instances behind
+// one anycast address should share Secret; other servers implementing
+// RFC 9018 (BIND, Knot, Unbound) accept cookies made with the same one.
+//
+// With Require, UDP queries without a valid server cookie get only a small
+// reply, BADCOOKIE with a fresh cookie or an empty truncated one for
+// clients without cookies, so the server is no use for reflection. Clients
+// that present a valid cookie are exempt from response rate limiting.
+//
+// Upstream sends client cookies on forwarded queries over plain UDP and
+// TCP, and drops UDP replies that don't echo them.
+type CookieConfig struct {
+	Secret   string `yaml:"secret"` // 32 hex digits; default: random at startup
+	Require  bool   `yaml:"require"`
+	Upstream bool   `yaml:"upstream"`
+}
+
+const (
+	clientCookieLen = 8
+	serverCookieLen = 16
+	cookieVersion   = 1
+	// cookieLifetime and cookieSkew bound the timestamps accepted in
+	// server cookies (RFC 9018 4.3).
+	cookieLifetime = time.Hour
+	cookieSkew     = 5 * time.Minute
+)
+
+var (
+	cookieSecret []byte
+	// serverCookies is set when this server answers cookies itself.
+	serverCookies bool
+
+	errBadCookie = errors.New("BADCOOKIE")
+)
+
+func setupCookies() error {
+	cfg := config.EDNS.Cookies
+	serverCookies = ednsAction(dns.EDNS0COOKIE) == ednsLocal
+	if cfg.Require && !serverCookies {
+		return fmt.Errorf("edns.cookies.require needs edns.options.cookie: local")
+	}
+	if cfg.Upstream && ednsAction(dns.EDNS0COOKIE) == ednsPass {
+		return fmt.Errorf("edns.cookies.upstream can't be used with edns.options.cookie: pass")
+	}
+	if cfg.Secret != "" {
+		secret, err := hex.DecodeString(cfg.Secret)
+		if err != nil || len(secret) != 16 {
+			return fmt.Errorf("edns.cookies.secret: want 32 hex digits")
+		}
+		cookieSecret = secret
+		return nil
+	}
+	cookieSecret = make([]byte, 16)
+	_, err := rand.Read(cookieSecret)
+	return err
+}
+
+// requestCookie returns the COOKIE option of r, or nil.
+func requestCookie(r *dns.Msg) *dns.EDNS0_COOKIE {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if c, ok := o.(*dns.EDNS0_COOKIE); ok {
+			return c
+		}
+	}
+	return nil
+}
+
+// serverCookie computes the server cookie for a client cookie and address
+// at time t: version, three reserved bytes, timestamp and the SipHash-2-4
+// of those with the client cookie and address (RFC 9018 4.4).
+func serverCookie(client []byte, ip net.IP, t time.Time) []byte {
+	sc := make([]byte, 8, serverCookieLen)
+	sc[0] = cookieVersion
+	binary.BigEndian.PutUint32(sc[4:], uint32(t.Unix()))
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	in := make([]byte, 0, len(client)+len(sc)+len(ip))
+	in = append(append(append(in, client...), sc...), ip...)
+	return binary.LittleEndian.AppendUint64(sc, siphash24(cookieSecret, in))
+}
+
+// siphash24 is SipHash-2-4 of msg under a 16-byte key.
+func siphash24(key, msg []byte) uint64 {
+	k0 := binary.LittleEndian.Uint64(key)
+	k1 := binary.LittleEndian.Uint64(key[8:])
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13) ^ v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16) ^ v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21) ^ v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17) ^ v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+	n := len(msg)
+	for ; len(msg) >= 8; msg = msg[8:] {
+		m := binary.LittleEndian.Uint64(msg)
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+	}
+	var last [8]byte
+	copy(last[:], msg)
+	last[7] = byte(n)
+	m := binary.LittleEndian.Uint64(last[:])
+	v3 ^= m
+	round()
+	round()
+	v0 ^= m
+	v2 ^= 0xff
+	for range 4 {
+		round()
+	}
+	return v0 ^ v1 ^ v2 ^ v3
+}
+
+// verifyCookie returns the client cookie of r, nil if there is none, and
+// whether r also holds a valid server cookie for client.
+func verifyCookie(r *dns.Msg, client net.IP) ([]byte, bool) {
+	o := requestCookie(r)
+	if o == nil {
+		return nil, false
+	}
+	// checkEDNS already rejected cookies of the wrong length.
+	raw, err := hex.DecodeString(o.Cookie)
+	if err != nil || len(raw) < clientCookieLen {
+		return nil, false
+	}
+	cc, sc := raw[:clientCookieLen], raw[clientCookieLen:]
+	if len(sc) != serverCookieLen || sc[0] != cookieVersion || client == nil {
+		return cc, false
+	}
+	ts := time.Unix(int64(binary.BigEndian.Uint32(sc[4:8])), 0)
+	now := time.Now()
+	if ts.Before(now.Add(-cookieLifetime)) || ts.After(now.Add(cookieSkew)) {
+		return cc, false
+	}
+	return cc, subtle.ConstantTimeCompare(sc, serverCookie(cc, client, ts)) == 1
+}
+
+// cookieWriter adds a fresh server cookie to every response with an OPT
+// record. valid is whether the query held a valid one already.
+type cookieWriter struct {
+	dns.ResponseWriter
+	client []byte
+	valid  bool
+}
+
+func (w cookieWriter) WriteMsg(m *dns.Msg) error {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return w.ResponseWriter.WriteMsg(m)
+	}
+	// Responses may be shared with the cache; add to a copy.
+	m = m.Copy()
+	opt = m.IsEdns0()
+	cookie := append(append([]byte(nil), w.client...), serverCookie(w.client, clientIP(w), time.Now())...)
+	option := &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: hex.EncodeToString(cookie)}
+	const optionLen = 4 + clientCookieLen + serverCookieLen
+	options := make([]dns.EDNS0, 0, len(opt.Option)+1)
+	for _, o := range opt.Option {
+		switch o := o.(type) {
+		case *dns.EDNS0_COOKIE:
+			continue
+		case *dns.EDNS0_PADDING:
+			// Keep the padded size, with the cookie ahead of the padding.
+			options = append(options, option)
+			option = nil
+			if len(o.Padding) >= optionLen {
+				o.Padding = o.Padding[:len(o.Padding)-optionLen]
+			}
+		}
+		options = append(options, o)
+	}
+	if option != nil {
+		options = append(options, option)
+	}
+	opt.Option = options
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// cookieVerified reports whether the query answered through w held a valid
+// server cookie.
+func cookieVerified(w dns.ResponseWriter) bool {
+	for {
+		switch rw := w.(type) {
+		case ruleWriter:
+			w = rw.ResponseWriter
+		case dns64Writer:
+			w = rw.ResponseWriter
+		case sortWriter:
+			w = rw.ResponseWriter
+		case cookieWriter:
+			return rw.valid
+		default:
+			return false
+		}
+	}
+}
+
+// checkCookie handles the cookie of a query from client. It returns the
+// writer to answer through and whether the query has been answered
+// already, for lack of a valid cookie when one is required.
+func checkCookie(w dns.ResponseWriter, r *dns.Msg, client net.IP) (dns.ResponseWriter, bool) {
+	if !serverCookies {
+		return w, false
+	}
+	cc, valid := verifyCookie(r, client)
+	if cc != nil {
+		w = cookieWriter{w, cc, valid}
+	}
+	if _, udp := w.RemoteAddr().(*net.UDPAddr); valid || !udp || !config.EDNS.Cookies.Require {
+		return w, false
+	}
+	m := new(dns.Msg)
+	m.SetReply(r)
+	if cc != nil {
+		m.Rcode = dns.RcodeBadCookie
+	} else {
+		m.Truncated = true
+	}
+	finishEDNS(r, m)
+	w.WriteMsg(m)
+	return w, true
+}
+
+// upstreamCookie is an upstream's side of the cookie exchange: the client
+// cookie sent to it and the last server cookie it gave back.
+type upstreamCookie struct {
+	client []byte
+	server []byte
+}
+
+// usesCookies reports whether queries to u carry client cookies.
+func (u *upstream) usesCookies() bool {
+	return config.EDNS.Cookies.Upstream && (u.proto == protoUDP || u.proto == protoTCP)
+}
+
+// withCookie returns a copy of r carrying u's cookies, or r itself when u
+// doesn't use them.
+func (u *upstream) withCookie(r *dns.Msg) *dns.Msg {
+	if !u.usesCookies() {
+		return r
+	}
+	u.cookieMu.Lock()
+	if u.cookie.client == nil {
+		u.cookie.client = make([]byte, clientCookieLen)
+		rand.Read(u.cookie.client)
+	}
+	cookie := append(append([]byte(nil), u.cookie.client...), u.cookie.server...)
+	u.cookieMu.Unlock()
+
+	q := r.Copy()
+	opt := q.IsEdns0()
+	if opt == nil {
+		q.SetEdns0(config.EDNS.UDPSize, false)
+		opt = q.IsEdns0()
+	}
+	options := opt.Option[:0:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0COOKIE {
+			options = append(options, o)
+		}
+	}
+	opt.Option = append(options, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: hex.EncodeToString(cookie)})
+	return q
+}
+
+// ownCookie reports whether resp, a reply from u, echoes u's client
+// cookie. A reply without a cookie passes only until u has given a server
+// cookie: an upstream without cookie support never sends one, but one that
+// has sent a cookie always does (RFC 7873 5.3).
+func (u *upstream) ownCookie(resp *dns.Msg) bool {
+	if !u.usesCookies() {
+		return true
+	}
+	u.cookieMu.Lock()
+	defer u.cookieMu.Unlock()
+	o := requestCookie(resp)
+	if o == nil {
+		return u.cookie.server == nil
+	}
+	raw, err := hex.DecodeString(o.Cookie)
+	if err != nil || len(raw) < clientCookieLen {
+		return false
+	}
+	return bytes.Equal(raw[:clientCookieLen], u.cookie.client)
+}
+
+// learnCookie keeps the server cookie of resp, a reply from u. It returns
+// errBadCookie when u refused the query for its cookie, to be sent again
+// with the new one.
+func (u *upstream) learnCookie(resp *dns.Msg) error {
+	if !u.usesCookies() || !u.ownCookie(resp) {
+		return nil
+	}
+	if o := requestCookie(resp); o != nil {
+		if raw, err := hex.DecodeString(o.Cookie); err == nil && len(raw) > clientCookieLen {
+			u.cookieMu.Lock()
+			u.cookie.server = raw[clientCookieLen:]
+			u.cookieMu.Unlock()
+		}
+	}
+	if resp.Rcode == dns.RcodeBadCookie {
+		log.Printf("Upstream %s: BADCOOKIE, retrying with its new cookie", u.name)
+		return errBadCookie
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestSipHash24(t *testing.T) {
+	// The example in the SipHash paper, appendix A.
+	key := mustHex(t, "000102030405060708090a0b0c0d0e0f")
+	msg := mustHex(t, "000102030405060708090a0b0c0d0e")
+	if got := siphash24(key, msg); got != 0xa129ca6149be45e5 {
+		t.Errorf("got %#x", got)
+	}
+}
+
+func TestServerCookie(t *testing.T) {
+	old := cookieSecret
+	t.Cleanup(func() { cookieSecret = old })
+
+	// RFC 9018 appendix A.1.
+	cookieSecret = mustHex(t, "e5e973e5a6b2a43f48e7dc849e37bfcf")
+	client := mustHex(t, "2464c4abcf10c957")
+	sc := serverCookie(client, net.ParseIP("198.51.100.100"), time.Unix(1559731985, 0))
+	if got := hex.EncodeToString(sc); got != "010000005cf79f111f8130c3eee29480" {
+		t.Errorf("server cookie %s", got)
+	}
+
+	query := func(cookie []byte) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion("example.com.", dns.TypeA)
+		r.SetEdns0(1232, false)
+		opt := r.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: hex.EncodeToString(cookie)})
+		return r
+	}
+	ip := net.ParseIP("192.0.2.1")
+	fresh := append(append([]byte(nil), client...), serverCookie(client, ip, time.Now())...)
+	if cc, ok := verifyCookie(query(fresh), ip); !ok || hex.EncodeToString(cc) != "2464c4abcf10c957" {
+		t.Error("fresh cookie not accepted")
+	}
+	if _, ok := verifyCookie(query(fresh), net.ParseIP("192.0.2.2")); ok {
+		t.Error("cookie accepted from another address")
+	}
+	stale := append(append([]byte(nil), client...), serverCookie(client, ip, time.Now().Add(-2*cookieLifetime))...)
+	if _, ok := verifyCookie(query(stale), ip); ok {
+		t.Error("expired cookie accepted")
+	}
+	if cc, ok := verifyCookie(query(client), ip); ok || cc == nil {
+		t.Errorf("client-only cookie: %x, %v", cc, ok)
+	}
+}
+
+func TestUpstreamOwnCookie(t *testing.T) {
+	old := *config
+	t.Cleanup(func() { *config = old })
+	config.EDNS.Cookies.Upstream = true
+
+	u := &upstream{name: "test", proto: protoUDP}
+	q := u.withCookie(new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+	sent := requestCookie(q)
+	if sent == nil {
+		t.Fatal("query sent without a cookie")
+	}
+
+	reply := func(cookie string) *dns.Msg {
+		m := new(dns.Msg).SetReply(q)
+		if cookie != "" {
+			m.SetEdns0(1232, false)
+			opt := m.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+		}
+		return m
+	}
+	if !u.ownCookie(reply("")) {
+		t.Error("reply without a cookie refused before any server cookie")
+	}
+	if u.ownCookie(reply("0011223344556677")) {
+		t.Error("reply with another client cookie accepted")
+	}
+
+	echoed := reply(sent.Cookie + "01000000aabbccdd0011223344556677")
+	if !u.ownCookie(echoed) {
+		t.Fatal("reply echoing our cookie refused")
+	}
+	if err := u.learnCookie(echoed); err != nil {
+		t.Fatal(err)
+	}
+	// Once the upstream has given a cookie, a reply without one is forged.
+	if u.ownCookie(reply("")) {
+		t.Error("reply without a cookie accepted after a server cookie")
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DatabaseConfig enables the embedded record database, a record source
+// for large zones that are changed through the admin API rather than by
+// editing a file. It survives restarts, and a change never means reparsing
+// the whole zone: the file is a log of transactions, each one line of JSON
+// written and synced in one go, so a change is either wholly applied or,
+// cut short by a crash, ignored on the next start. The log is compacted
+// into a snapshot when it has grown to twice the size of the data it holds.
+//
+// Records are kept in zone line form (see formatZoneLine) under absolute
+// names, so canary, weight and GeoIP options work as in zone files.
+type DatabaseConfig struct {
+	File string `yaml:"file"`
+}
+
+const sourceDatabase = "database"
+
+// dbTxn is one line of the database file. A name set to no records is
+// deleted.
+type dbTxn struct {
+	Time time.Time           `json:"time"`
+	By   string              `json:"by,omitempty"`
+	Set  map[string][]string `json:"set"`
+}
+
+// dbSnapshotNames is how many names go in one line of a compacted file.
+const dbSnapshotNames = 1000
+
+type recordDB struct {
+	mu   sync.Mutex // serializes commits and compaction
+	path string
+	f    *os.File
+	size int64 // of the file
+	base int64 // the size a snapshot of the data would take
+}
+
+// dbCompactSlack is how far past twice its data the file may grow.
+const dbCompactSlack = 1 << 20
+
+// needsCompaction reports whether the log has outgrown its data.
+func (db *recordDB) needsCompaction() bool {
+	return db.size > 2*db.base+dbCompactSlack
+}
+
+var database *recordDB
+
+func setupDatabase() error {
+	if config.Database.File == "" {
+		return nil
+	}
+	db, recs, err := openRecordDB(config.Database.File)
+	if err != nil {
+		return fmt.Errorf("database: %v", err)
+	}
+	database = db
+	records.setSource(sourceDatabase, recs)
+	count := 0
+	for _, rs := range recs {
+		count += len(rs)
+	}
+	log.Printf("Loaded %d record(s) at %d name(s) from database %s", count, len(recs), db.path)
+	if db.needsCompaction() {
+		if err := db.compact(recs); err != nil {
+			log.Printf("Failed to compact database %s: %v", db.path, err)
+		}
+	}
+	return nil
+}
+
+// openRecordDB opens or creates a database file and replays it.
+func openRecordDB(path string) (*recordDB, map[string][]Record, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+	db := &recordDB{path: path, f: f}
+	recs := make(map[string][]Record)
+	rd := bufio.NewReader(f)
+	var good int64 // offset after the last complete transaction
+	for {
+		line, err := rd.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(bytes.TrimSpace(line)) > 0 {
+				log.Printf("Database %s: discarding a transaction cut short at offset %d", path, good)
+			}
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		var txn dbTxn
+		if err := json.Unmarshal(line, &txn); err != nil {
+			f.Close()
+			return nil, nil, fmt.Errorf("offset %d: %v", good, err)
+		}
+		if err := applyDBTxn(recs, txn); err != nil {
+			f.Close()
+			return nil, nil, fmt.Errorf("offset %d: %v", good, err)
+		}
+		good += int64(len(line))
+	}
+	// Appends go after the last complete transaction.
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	db.size = good
+	for name, rs := range recs {
+		db.base += int64(len(name)) + 8
+		for _, line := range dbLines(name, rs) {
+			db.base += int64(len(line)) + 3
+		}
+	}
+	return db, recs, nil
+}
+
+// applyDBTxn applies a transaction to recs.
+func applyDBTxn(recs map[string][]Record, txn dbTxn) error {
+	for name, lines := range txn.Set {
+		owner := dns.Fqdn(strings.ToLower(name))
+		if len(lines) == 0 {
+			delete(recs, owner)
+			continue
+		}
+		list := make([]Record, 0, len(lines))
+		for _, line := range lines {
+			lname, rec, ok, err := zoneSyntax{}.parseLine(line)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			if !ok || strings.ToLower(lname) != owner {
+				return fmt.Errorf("%s: record %q is not for this name", name, line)
+			}
+			list = append(list, rec)
+		}
+		recs[owner] = list
+	}
+	return nil
+}
+
+// commitTxn writes txn to the file and then applies it to the served
+// records. Nothing is applied when the write fails.
+func (db *recordDB) commitTxn(txn dbTxn) error {
+	// A transaction that won't replay must not reach the file.
+	if err := applyDBTxn(make(map[string][]Record), txn); err != nil {
+		return err
+	}
+	line, err := json.Marshal(txn)
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, err := db.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := db.f.Sync(); err != nil {
+		return err
+	}
+	db.size += int64(len(line)) + 1
+	records.updateSource(sourceDatabase, func(recs map[string][]Record) {
+		applyDBTxn(recs, txn)
+	})
+	if db.needsCompaction() {
+		if err := db.compact(records.source(sourceDatabase)); err != nil {
+			log.Printf("Failed to compact database %s: %v", db.path, err)
+		}
+	}
+	return nil
+}
+
+// compact replaces the file with a snapshot of recs. Callers hold db.mu,
+// or are the only user of db.
+func (db *recordDB) compact(recs map[string][]Record) error {
+	names := make([]string, 0, len(recs))
+	for name := range recs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tmp, err := os.CreateTemp(filepath.Dir(db.path), "."+filepath.Base(db.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if info, err := os.Stat(db.path); err == nil {
+		tmp.Chmod(info.Mode().Perm())
+	}
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for len(names) > 0 {
+		n := min(len(names), dbSnapshotNames)
+		txn := dbTxn{Time: time.Now().UTC(), By: "compaction", Set: make(map[string][]string, n)}
+		for _, name := range names[:n] {
+			txn.Set[name] = dbLines(name, recs[name])
+		}
+		if err := enc.Encode(txn); err != nil {
+			tmp.Close()
+			return err
+		}
+		names = names[n:]
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := os.Rename(tmp.Name(), db.path); err != nil {
+		tmp.Close()
+		return err
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		return err
+	}
+	db.f.Close()
+	db.f, db.size, db.base = tmp, info.Size(), info.Size()
+	log.Printf("Compacted database %s to %d bytes", db.path, db.size)
+	return nil
+}
+
+// dbLines renders a name's records as stored.
+func dbLines(name string, recs []Record) []string {
+	out := make([]string, 0, len(recs))
+	for _, rec := range recs {
+		out = append(out, formatZoneLine(name, rec))
+	}
+	return out
+}
+
+// dbChange is the body of POST /db/records: names to set to exactly the
+// records given, and names to delete, applied as one transaction.
+type dbChange struct {
+	Set    map[string][]recordSpec `json:"set"`
+	Delete []string                `json:"delete"`
+}
+
+func handleDBRecords(w http.ResponseWriter, r *http.Request) {
+	if database == nil {
+		http.Error(w, "no database configured", http.StatusNotFound)
+		return
+	}
+	var c dbChange
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	txn := dbTxn{Time: time.Now().UTC(), By: "admin " + r.RemoteAddr, Set: make(map[string][]string)}
+	for name, specs := range c.Set {
+		owner := dns.Fqdn(strings.ToLower(name))
+		if _, ok := dns.IsDomainName(owner); !ok {
+			http.Error(w, fmt.Sprintf("invalid name %q", name), http.StatusBadRequest)
+			return
+		}
+		var recs []Record
+		for i, spec := range specs {
+			rec, err := spec.toRecord()
+			if err != nil {
+				http.Error(w, fmt.Sprintf("%s[%d]: %v", name, i, err), http.StatusBadRequest)
+				return
+			}
+			recs = append(recs, rec)
+		}
+		txn.Set[owner] = dbLines(owner, recs)
+	}
+	for _, name := range c.Delete {
+		owner := dns.Fqdn(strings.ToLower(name))
+		if _, ok := txn.Set[owner]; ok {
+			http.Error(w, fmt.Sprintf("%s is both set and deleted", name), http.StatusBadRequest)
+			return
+		}
+		txn.Set[owner] = []string{}
+	}
+	if len(txn.Set) == 0 {
+		http.Error(w, "nothing to change", http.StatusBadRequest)
+		return
+	}
+	if err := database.commitTxn(txn); err != nil {
+		auditf(r, "database change rejected: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	auditf(r, "database: %d name(s) set, %d deleted", len(c.Set), len(c.Delete))
+	writeJSON(w, http.StatusOK, map[string]int{"set": len(c.Set), "deleted": len(c.Delete)})
+}
+
+// handleDBRecordsGet serves GET /db/records?name=www.example.com.
+func handleDBRecordsGet(w http.ResponseWriter, r *http.Request) {
+	if database == nil {
+		http.Error(w, "no database configured", http.StatusNotFound)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	owner := dns.Fqdn(strings.ToLower(name))
+	writeJSON(w, http.StatusOK, map[string][]string{owner: dbLines(owner, records.source(sourceDatabase)[owner])})
+}
+
+// runDBImport implements "micro-dns db-import": it loads a zone file into
+// a database file, for moving a large zone over. Run it with the server
+// stopped; the names in the zone file replace those in the database.
+func runDBImport(args []string) int {
+	fs := flag.NewFlagSet("db-import", flag.ExitOnError)
+	origin := fs.String("origin", "", "Zone origin for relative names, as in a zones entry")
+	defaultTTL := fs.Uint("default-ttl", 0, "TTL for lines without one, as in a zones entry")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: micro-dns db-import [flags] <database file> <zone file>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+	zs := zoneSyntax{defaultTTL: uint32(*defaultTTL)}
+	if *origin != "" {
+		zs.origin = dns.CanonicalName(*origin)
+	}
+	recs, err := loadZoneFileIn(fs.Arg(1), zs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "db-import: %v\n", err)
+		return 1
+	}
+	db, cur, err := openRecordDB(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "db-import: %v\n", err)
+		return 1
+	}
+	count := 0
+	for name, rs := range recs {
+		cur[strings.ToLower(name)] = rs
+		count += len(rs)
+	}
+	// A snapshot, rather than one huge transaction.
+	if err := db.compact(cur); err != nil {
+		fmt.Fprintf(os.Stderr, "db-import: %v\n", err)
+		return 1
+	}
+	db.f.Close()
+	fmt.Printf("Imported %d record(s) at %d name(s) into %s\n", count, len(recs), fs.Arg(0))
+	return 0
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// NS records below the apex of an authoritative zone delegate that part of
+// the zone to other servers, e.g. a lab sub-zone:
+//
+//	lab.example.com.     3600 IN NS ns1.lab.example.com.
+//	ns1.lab.example.com. 3600 IN A  10.0.5.2
+//
+// A name at or below the cut gets a referral, as from any parent zone: no
+// answer, not authoritative, the NS records in the authority section and
+// the addresses of in-zone name servers (glue) in the additional section.
+// Local records below the cut other than glue aren't served. A client
+// asking for recursion, and allowed it, gets the answer instead: the
+// delegated servers are asked by their glue addresses. DS queries for the
+// cut itself are the parent's and answered from the zone.
+
+// delegation is the cut closest to the zone apex above a name.
+type delegation struct {
+	zone *zone
+	cut  string
+	ns   []Record
+}
+
+// delegationFor returns the delegation name lies in, within authoritative
+// zone z, or nil.
+func delegationFor(store *recordStore, name string, z *zone) *delegation {
+	starts := dns.Split(name)
+	for i := len(starts) - 1; i >= 0; i-- {
+		owner := name[starts[i]:]
+		if len(owner) <= len(z.origin) {
+			continue // the apex and above
+		}
+		var ns []Record
+		for _, rec := range store.lookup(owner) {
+			if rec.Type == "NS" {
+				ns = append(ns, rec)
+			}
+		}
+		if len(ns) > 0 {
+			return &delegation{zone: z, cut: owner, ns: ns}
+		}
+	}
+	return nil
+}
+
+// refer fills m with the referral.
+func (d *delegation) refer(m *dns.Msg, store *recordStore) {
+	m.Authoritative = false
+	for _, rec := range d.ns {
+		m.Ns = append(m.Ns, recordToRR(d.cut, rec))
+	}
+	m.Extra = append(m.Extra, d.glue(store)...)
+}
+
+// glue returns the address records of the name servers that lie in the
+// zone, the only ones a resolver can't look up elsewhere.
+func (d *delegation) glue(store *recordStore) []dns.RR {
+	var out []dns.RR
+	for _, rec := range d.ns {
+		host := dns.CanonicalName(rec.Data)
+		if !dns.IsSubDomain(d.zone.origin, host) {
+			continue
+		}
+		for _, a := range store.lookup(host) {
+			if a.Type == "A" || a.Type == "AAAA" {
+				out = append(out, recordToRR(host, a))
+			}
+		}
+	}
+	return out
+}
+
+var errNoGlue = errors.New("no glue addresses")
+
+// resolve asks the delegated servers for r's answer, following further
+// referrals below the cut.
+func (d *delegation) resolve(r *dns.Msg, store *recordStore) (*dns.Msg, error) {
+	var servers []string
+	for _, rr := range d.glue(store) {
+		switch rr := rr.(type) {
+		case *dns.A:
+			servers = append(servers, net.JoinHostPort(rr.A.String(), "53"))
+		case *dns.AAAA:
+			servers = append(servers, net.JoinHostPort(rr.AAAA.String(), "53"))
+		}
+	}
+	if len(servers) == 0 {
+		return nil, errNoGlue
+	}
+	q := upstreamQuery(r)
+	q.RecursionDesired = false
+	for range maxStubReferrals {
+		resp, err := exchangeServers(servers, q)
+		if err != nil {
+			return nil, err
+		}
+		next := referralServers(resp)
+		if next == nil {
+			resp.Id = r.Id
+			resp.RecursionDesired = r.RecursionDesired
+			resp.RecursionAvailable = true
+			resp.Authoritative = false
+			clampTTLs(resp, config.MinTTL, config.MaxTTL)
+			return resp, nil
+		}
+		servers = next
+	}
+	return nil, fmt.Errorf("too many referrals below %s", d.cut)
+}
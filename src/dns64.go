@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// DNS64Config turns on DNS64 (RFC 6147) for IPv6-only clients behind
+// NAT64: an AAAA query whose answer has no AAAA records, local or
+// forwarded, is answered with AAAA records made from the name's A records
+// by embedding each address in Prefix (RFC 6052; /32, /40, /48, /56, /64
+// or /96). Clients limits it to some networks, e.g. the IPv6-only segment.
+//
+// As RFC 6147 asks, a query with DO and CD set gets the real answer, since
+// the client validates and a synthesized record can't pass. Reverse
+// lookups of synthesized addresses are not mapped.
+type DNS64Config struct {
+	Enabled bool     `yaml:"enabled"`
+	Prefix  string   `yaml:"prefix"`  // default 64:ff9b::/96
+	Clients []string `yaml:"clients"` // CIDRs; empty is every client
+}
+
+type dns64Synth struct {
+	prefix  net.IP
+	bits    int
+	clients []*net.IPNet
+}
+
+var dns64 *dns64Synth
+
+func setupDNS64() error {
+	cfg := config.DNS64
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.Prefix == "" {
+		cfg.Prefix = "64:ff9b::/96"
+	}
+	ip, n, err := net.ParseCIDR(cfg.Prefix)
+	if err != nil || ip.To4() != nil {
+		return fmt.Errorf("dns64.prefix: %q is not an IPv6 prefix", cfg.Prefix)
+	}
+	bits, _ := n.Mask.Size()
+	switch bits {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return fmt.Errorf("dns64.prefix: /%d is not a NAT64 prefix length (32, 40, 48, 56, 64 or 96)", bits)
+	}
+	if n.IP[8] != 0 && bits > 64 {
+		return fmt.Errorf("dns64.prefix: bits 64 to 71 must be zero")
+	}
+	clients, err := parseCIDRs("dns64.clients", cfg.Clients)
+	if err != nil {
+		return err
+	}
+	dns64 = &dns64Synth{prefix: n.IP, bits: bits, clients: clients}
+	log.Printf("DNS64 synthesis on with prefix %s", n)
+	return nil
+}
+
+// appliesTo reports whether r from client gets synthesized answers.
+func (d *dns64Synth) appliesTo(r *dns.Msg, client net.IP) bool {
+	if len(r.Question) != 1 || r.Question[0].Qtype != dns.TypeAAAA {
+		return false
+	}
+	if len(d.clients) > 0 && (client == nil || !onNetworks(client, d.clients)) {
+		return false
+	}
+	if matchQtypeFilter(dns.TypeAAAA, client) != nil {
+		return false // filtered AAAA queries get no AAAA records at all
+	}
+	return !(r.CheckingDisabled && dnssecOK(r))
+}
+
+// embed maps an IPv4 address into the prefix as RFC 6052 2.2 lays out:
+// the address fills the bits after the prefix, skipping bits 64 to 71.
+func (d *dns64Synth) embed(v4 net.IP) net.IP {
+	out := make(net.IP, net.IPv6len)
+	copy(out, d.prefix)
+	pos := d.bits / 8
+	for _, b := range v4.To4() {
+		if pos == 8 {
+			pos++
+		}
+		out[pos] = b
+		pos++
+	}
+	return out
+}
+
+// dns64Writer synthesizes AAAA records into responses written through it
+// that have none.
+type dns64Writer struct {
+	dns.ResponseWriter
+	r         *dns.Msg
+	store     *recordStore
+	loc       geoLocation
+	recursion bool
+}
+
+func (w dns64Writer) WriteMsg(m *dns.Msg) error {
+	if m.Rcode != dns.RcodeSuccess || m.Truncated || hasRRType(m.Answer, dns.TypeAAAA) {
+		return w.ResponseWriter.WriteMsg(m)
+	}
+	a := w.lookupA(w.r.Question[0].Name)
+	if !hasRRType(a, dns.TypeA) {
+		return w.ResponseWriter.WriteMsg(m)
+	}
+	// Responses may be shared with the cache; change a copy.
+	m = m.Copy()
+	m.Answer, m.Ns = nil, nil
+	for _, rr := range a {
+		switch rr := rr.(type) {
+		case *dns.A:
+			hdr := rr.Hdr
+			hdr.Rrtype = dns.TypeAAAA
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: dns64.embed(rr.A)})
+		case *dns.CNAME, *dns.DNAME:
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// lookupA finds the A records of name the way the query would have been
+// answered: from the local records if it has any, else from the cache or
+// the upstreams.
+func (w dns64Writer) lookupA(name string) []dns.RR {
+	if len(w.store.lookup(dns.CanonicalName(name))) > 0 {
+		answers, external := resolveLocal(w.store, name, dns.TypeA, w.loc)
+		if external != "" && config.ChaseCNAME && w.recursion {
+			answers = append(answers, chaseExternal(external, dns.TypeA)...)
+		}
+		return answers
+	}
+	if !w.recursion || (w.store == records && authoritativeZone(dns.CanonicalName(name)) != nil) {
+		return nil
+	}
+	q := new(dns.Msg)
+	q.SetQuestion(name, dns.TypeA)
+	if resp := cache.lookup(q); resp != nil {
+		return resp.Answer
+	}
+	resp, err := forwardToFallback(q)
+	if err != nil {
+		log.Printf("DNS64: A lookup of %s failed: %v", name, err)
+		return nil
+	}
+	cache.storeNegative(q, resp)
+	cache.storePositive(q, resp)
+	return resp.Answer
+}
+
+func hasRRType(rrs []dns.RR, rrtype uint16) bool {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == rrtype {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDNS64Embed(t *testing.T) {
+	old, oldSynth := *config, dns64
+	t.Cleanup(func() { *config, dns64 = old, oldSynth })
+
+	// RFC 6052 2.4, with 192.0.2.33.
+	for prefix, want := range map[string]string{
+		"":                      "64:ff9b::c000:221",
+		"2001:db8::/32":         "2001:db8:c000:221::",
+		"2001:db8:100::/40":     "2001:db8:1c0:2:21::",
+		"2001:db8:122::/48":     "2001:db8:122:c000:2:2100::",
+		"2001:db8:122:300::/56": "2001:db8:122:3c0:0:221::",
+		"2001:db8:122:344::/64": "2001:db8:122:344:c0:2:2100:0",
+		"2001:db8:122:344::/96": "2001:db8:122:344::c000:221",
+	} {
+		config.DNS64 = DNS64Config{Enabled: true, Prefix: prefix}
+		if err := setupDNS64(); err != nil {
+			t.Errorf("%s: %v", prefix, err)
+			continue
+		}
+		if got := dns64.embed(net.ParseIP("192.0.2.33")); !got.Equal(net.ParseIP(want)) {
+			t.Errorf("%s: %s, want %s", prefix, got, want)
+		}
+	}
+
+	for _, bad := range []string{"192.0.2.0/24", "2001:db8::/80", "2001:db8:0:0:ff00::/96", "nonsense"} {
+		config.DNS64 = DNS64Config{Enabled: true, Prefix: bad}
+		if err := setupDNS64(); err == nil {
+			t.Errorf("prefix %s accepted", bad)
+		}
+	}
+}
+
+func TestDNS64Synthesis(t *testing.T) {
+	withRecords(t)
+	old, oldSynth := *config, dns64
+	t.Cleanup(func() { *config, dns64 = old, oldSynth })
+	config.DNS64 = DNS64Config{Enabled: true, Clients: []string{"2001:db8:6::/48"}}
+	if err := setupDNS64(); err != nil {
+		t.Fatal(err)
+	}
+	records.setSource(sourceZone, map[string][]Record{
+		"v4only.example.com.": {{Type: "A", TTL: 300, Data: "192.0.2.33"}},
+		"www.example.com.":    {{Type: "CNAME", TTL: 300, Data: "v4only.example.com."}},
+		"dual.example.com.":   {{Type: "A", TTL: 300, Data: "192.0.2.34"}, {Type: "AAAA", TTL: 300, Data: "2001:db8::34"}},
+	})
+
+	query := func(name string) *dns.Msg {
+		return new(dns.Msg).SetQuestion(name, dns.TypeAAAA)
+	}
+	client := net.ParseIP("2001:db8:6::10")
+	if !dns64.appliesTo(query("www.example.com."), client) {
+		t.Error("not applied to an IPv6-only client")
+	}
+	if dns64.appliesTo(query("www.example.com."), net.ParseIP("2001:db8:7::10")) {
+		t.Error("applied to a client outside dns64.clients")
+	}
+	if dns64.appliesTo(new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA), client) {
+		t.Error("applied to an A query")
+	}
+	validating := query("www.example.com.")
+	validating.SetEdns0(1232, true)
+	validating.CheckingDisabled = true
+	if dns64.appliesTo(validating, client) {
+		t.Error("applied to a query with DO and CD")
+	}
+
+	write := func(name string, reply *dns.Msg) *dns.Msg {
+		r := query(name)
+		rw := &recordingWriter{}
+		dns64Writer{rw, r, records, geoLocation{}, false}.WriteMsg(reply)
+		return rw.written[0]
+	}
+
+	// A NODATA answer through a CNAME gets the chain and the synthesized
+	// record.
+	r := query("www.example.com.")
+	empty := new(dns.Msg).SetReply(r)
+	got := write("www.example.com.", empty)
+	if len(got.Answer) != 2 {
+		t.Fatalf("synthesized answer %v", got.Answer)
+	}
+	if cname, ok := got.Answer[0].(*dns.CNAME); !ok || cname.Target != "v4only.example.com." {
+		t.Errorf("first record %v", got.Answer[0])
+	}
+	if aaaa, ok := got.Answer[1].(*dns.AAAA); !ok || aaaa.Hdr.Name != "v4only.example.com." ||
+		!aaaa.AAAA.Equal(net.ParseIP("64:ff9b::192.0.2.33")) {
+		t.Errorf("synthesized %v", got.Answer[1])
+	}
+	if len(empty.Answer) != 0 {
+		t.Error("shared response changed")
+	}
+
+	// Real AAAA records and errors are left alone.
+	withAAAA := new(dns.Msg).SetReply(query("dual.example.com."))
+	rr, _ := dns.NewRR("dual.example.com. 300 IN AAAA 2001:db8::34")
+	withAAAA.Answer = []dns.RR{rr}
+	if got := write("dual.example.com.", withAAAA); got != withAAAA {
+		t.Errorf("answer with AAAA records changed: %v", got.Answer)
+	}
+	nx := new(dns.Msg).SetRcode(query("nowhere.example.com."), dns.RcodeNameError)
+	if got := write("nowhere.example.com.", nx); got != nx {
+		t.Errorf("NXDOMAIN changed: %v", got)
+	}
+}
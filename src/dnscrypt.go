@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/chacha20"
+)
+
+// DNSCrypt upstreams (version 2), configured by server stamp:
+// "sdns://AQ…". The stamp names the server's address, the provider's
+// Ed25519 key and the provider name; the server's short-term certificates
+// are fetched as TXT records of the provider name, checked against that
+// key, and the newest valid one is used. Certificates are refetched hourly,
+// when the one in use expires, and after a failed exchange, so a server
+// rotating its keys is followed. Each certificate gets a fresh client key.
+// Only XChaCha20-Poly1305 certificates are supported.
+
+const (
+	dnscryptCertRefresh = time.Hour
+	dnscryptMinUDPQuery = 256 // padded size, so most answers fit untruncated
+	dnscryptPadBlock    = 64
+)
+
+var (
+	dnscryptCertMagic     = []byte("DNSC")
+	dnscryptResolverMagic = []byte("r6fnvWj8")
+)
+
+// Server stamp protocols (https://dnscrypt.info/stamps-specifications).
+const (
+	stampDNSCrypt   = 0x01
+	stampODoHTarget = 0x05
+)
+
+// serverStamp is a decoded sdns:// stamp.
+type serverStamp struct {
+	proto        byte
+	addr         string // DNSCrypt: ip:port
+	providerKey  ed25519.PublicKey
+	providerName string
+	odohURL      string // ODoH target: https://host/path
+}
+
+// parseStamp decodes the stamp of a DNSCrypt server or an ODoH target.
+func parseStamp(stamp string) (*serverStamp, error) {
+	bin, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(stamp, "sdns://"))
+	if err != nil || len(bin) < 9 {
+		return nil, fmt.Errorf("invalid stamp %q", stamp)
+	}
+	s := &serverStamp{proto: bin[0]}
+	rest := bin[9:] // the properties are for clients picking servers
+	next := func() (string, bool) {
+		if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+			return "", false
+		}
+		v := string(rest[1 : 1+rest[0]])
+		rest = rest[1+rest[0]:]
+		return v, true
+	}
+	switch s.proto {
+	case stampDNSCrypt:
+		addr, ok1 := next()
+		key, ok2 := next()
+		name, ok3 := next()
+		if !ok1 || !ok2 || !ok3 || len(key) != ed25519.PublicKeySize || name == "" {
+			return nil, fmt.Errorf("invalid DNSCrypt stamp %q", stamp)
+		}
+		s.addr = withDefaultPort(addr, "443")
+		s.providerKey = ed25519.PublicKey(key)
+		s.providerName = dns.Fqdn(name)
+	case stampODoHTarget:
+		host, ok1 := next()
+		path, ok2 := next()
+		if !ok1 || !ok2 || host == "" {
+			return nil, fmt.Errorf("invalid ODoH target stamp %q", stamp)
+		}
+		s.odohURL = "https://" + host + path
+	default:
+		return nil, fmt.Errorf("stamp %q is neither a DNSCrypt server nor an ODoH target", stamp)
+	}
+	return s, nil
+}
+
+// dnscryptServer is one DNSCrypt upstream.
+type dnscryptServer struct {
+	addr         string
+	providerName string
+	providerKey  ed25519.PublicKey
+	timeout      time.Duration
+
+	mu      sync.Mutex
+	cert    *dnscryptCert
+	fetched time.Time
+	stale   bool // an exchange failed; refetch before the next
+}
+
+// dnscryptCert is a verified server certificate and the client key used
+// with it.
+type dnscryptCert struct {
+	serial    uint32
+	magic     []byte // client magic, prefixed to queries
+	notAfter  time.Time
+	clientPub []byte
+	shared    [32]byte
+}
+
+func newDNSCryptServer(s *serverStamp, timeout time.Duration) *dnscryptServer {
+	return &dnscryptServer{addr: s.addr, providerName: s.providerName, providerKey: s.providerKey, timeout: timeout}
+}
+
+// exchange sends r over UDP, and again over TCP if the answer is truncated.
+func (d *dnscryptServer) exchange(ctx context.Context, r *dns.Msg) (*dns.Msg, error) {
+	cert, err := d.currentCert(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.exchangeOver(ctx, "udp", cert, r)
+	if err == nil && resp.Truncated {
+		resp, err = d.exchangeOver(ctx, "tcp", cert, r)
+	}
+	if err != nil {
+		d.mu.Lock()
+		d.stale = true
+		d.mu.Unlock()
+	}
+	return resp, err
+}
+
+// currentCert returns the certificate to use, fetching one when there is
+// none or it is due for a refresh. A failed refresh keeps the old one
+// while it is valid.
+func (d *dnscryptServer) currentCert(ctx context.Context) (*dnscryptCert, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	if d.cert != nil && !d.stale && now.Sub(d.fetched) < dnscryptCertRefresh && now.Before(d.cert.notAfter) {
+		return d.cert, nil
+	}
+	cert, err := d.fetchCert(ctx)
+	if err != nil {
+		if d.cert != nil && now.Before(d.cert.notAfter) {
+			return d.cert, nil
+		}
+		return nil, fmt.Errorf("fetching DNSCrypt certificate of %s: %v", d.providerName, err)
+	}
+	if d.cert == nil || cert.serial != d.cert.serial {
+		debugLogf("DNSCrypt %s: using certificate %d, valid until %s", d.providerName, cert.serial, cert.notAfter.Format(time.RFC3339))
+	}
+	d.cert, d.fetched, d.stale = cert, now, false
+	return cert, nil
+}
+
+// fetchCert asks the server for its certificates and picks the newest
+// valid one.
+func (d *dnscryptServer) fetchCert(ctx context.Context) (*dnscryptCert, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(d.providerName, dns.TypeTXT)
+	q.SetEdns0(4096, false)
+	c := &dns.Client{Net: "udp", Timeout: d.timeout, Dialer: outboundDialer("udp", d.addr, d.timeout)}
+	resp, _, err := c.ExchangeContext(ctx, q, d.addr)
+	if err == nil && resp.Truncated {
+		c = &dns.Client{Net: "tcp", Timeout: d.timeout, Dialer: outboundDialer("tcp", d.addr, d.timeout)}
+		resp, _, err = c.ExchangeContext(ctx, q, d.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var best *dnscryptCert
+	var lastErr error
+	for _, rr := range resp.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		cert, err := d.parseCert(unescapeTXT(strings.Join(txt.Txt, "")))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if best == nil || cert.serial > best.serial {
+			best = cert
+		}
+	}
+	if best == nil {
+		if lastErr == nil {
+			lastErr = errors.New("no certificate in the answer")
+		}
+		return nil, lastErr
+	}
+	return best, nil
+}
+
+// parseCert verifies a certificate and derives a shared key with it.
+func (d *dnscryptServer) parseCert(bin []byte) (*dnscryptCert, error) {
+	if len(bin) < 124 || !bytes.Equal(bin[:4], dnscryptCertMagic) {
+		return nil, errors.New("malformed certificate")
+	}
+	if v := binary.BigEndian.Uint16(bin[4:6]); v != 2 {
+		return nil, fmt.Errorf("certificate for es_version %d; only 2 (XChaCha20-Poly1305) is supported", v)
+	}
+	if !ed25519.Verify(d.providerKey, bin[72:], bin[8:72]) {
+		return nil, errors.New("certificate signature doesn't match the provider key")
+	}
+	notBefore := time.Unix(int64(binary.BigEndian.Uint32(bin[116:120])), 0)
+	notAfter := time.Unix(int64(binary.BigEndian.Uint32(bin[120:124])), 0)
+	if now := time.Now(); now.Before(notBefore) || !now.Before(notAfter) {
+		return nil, fmt.Errorf("certificate not valid now (%s to %s)", notBefore.Format(time.RFC3339), notAfter.Format(time.RFC3339))
+	}
+	serverPub, err := ecdh.X25519().NewPublicKey(bin[72:104])
+	if err != nil {
+		return nil, err
+	}
+	sk, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	dh, err := sk.ECDH(serverPub)
+	if err != nil {
+		return nil, err
+	}
+	// crypto_box_curve25519xchacha20poly1305_beforenm: HChaCha20 of the
+	// X25519 secret with an all-zero nonce.
+	subkey, err := chacha20.HChaCha20(dh, make([]byte, 16))
+	if err != nil {
+		return nil, err
+	}
+	cert := &dnscryptCert{
+		serial:    binary.BigEndian.Uint32(bin[112:116]),
+		magic:     append([]byte(nil), bin[104:112]...),
+		notAfter:  notAfter,
+		clientPub: sk.PublicKey().Bytes(),
+	}
+	copy(cert.shared[:], subkey)
+	return cert, nil
+}
+
+// exchangeOver sends one encrypted query over network and decrypts the
+// answer; UDP datagrams that don't decrypt are ignored.
+func (d *dnscryptServer) exchangeOver(ctx context.Context, network string, cert *dnscryptCert, r *dns.Msg) (*dns.Msg, error) {
+	wire, err := r.Pack()
+	if err != nil {
+		return nil, err
+	}
+	minSize := 0
+	if network == "udp" {
+		minSize = dnscryptMinUDPQuery
+	}
+	nonce := make([]byte, secretboxNonceSize)
+	rand.Read(nonce[:secretboxNonceSize/2])
+	packet := append(append([]byte(nil), cert.magic...), cert.clientPub...)
+	packet = append(packet, nonce[:secretboxNonceSize/2]...)
+	packet = append(packet, secretboxSeal(&cert.shared, nonce, dnscryptPad(wire, minSize))...)
+
+	conn, err := outboundDialer(network, d.addr, d.timeout).DialContext(ctx, network, d.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(d.timeout)
+	if dl, ok := ctx.Deadline(); ok && dl.Before(deadline) {
+		deadline = dl
+	}
+	conn.SetDeadline(deadline)
+
+	if network == "udp" {
+		if _, err := conn.Write(packet); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return nil, err
+			}
+			if resp, err := d.openAnswer(cert, nonce, buf[:n], r.Id); err == nil {
+				return resp, nil
+			}
+		}
+	}
+	framed := binary.BigEndian.AppendUint16(nil, uint16(len(packet)))
+	if _, err := conn.Write(append(framed, packet...)); err != nil {
+		return nil, err
+	}
+	var size [2]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	return d.openAnswer(cert, nonce, buf, r.Id)
+}
+
+// openAnswer decrypts a server's answer to the query sent with nonce.
+func (d *dnscryptServer) openAnswer(cert *dnscryptCert, nonce, packet []byte, id uint16) (*dns.Msg, error) {
+	head := len(dnscryptResolverMagic) + secretboxNonceSize
+	if len(packet) < head+secretboxTagSize || !bytes.Equal(packet[:8], dnscryptResolverMagic) ||
+		!bytes.Equal(packet[8:8+secretboxNonceSize/2], nonce[:secretboxNonceSize/2]) {
+		return nil, errors.New("not an answer to this query")
+	}
+	padded, err := secretboxOpen(&cert.shared, packet[8:head], packet[head:])
+	if err != nil {
+		return nil, err
+	}
+	wire, err := dnscryptUnpad(padded)
+	if err != nil {
+		return nil, err
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(wire); err != nil {
+		return nil, err
+	}
+	if resp.Id != id {
+		return nil, errors.New("not an answer to this query")
+	}
+	return resp, nil
+}
+
+// dnscryptPad appends 0x80 and zeros up to a multiple of 64 bytes, and at
+// least minSize.
+func dnscryptPad(msg []byte, minSize int) []byte {
+	size := max(len(msg)+1, minSize)
+	size = (size + dnscryptPadBlock - 1) / dnscryptPadBlock * dnscryptPadBlock
+	out := make([]byte, size)
+	copy(out, msg)
+	out[len(msg)] = 0x80
+	return out
+}
+
+func dnscryptUnpad(padded []byte) ([]byte, error) {
+	i := bytes.LastIndexByte(padded, 0x80)
+	if i < 0 || bytes.IndexFunc(padded[i+1:], func(r rune) bool { return r != 0 }) >= 0 {
+		return nil, errors.New("invalid padding")
+	}
+	return padded[:i], nil
+}
+
+// unescapeTXT turns a TXT string as miekg/dns presents it, with \DDD and
+// \X escapes, back into its bytes.
+func unescapeTXT(s string) []byte {
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 >= len(s) {
+			out = append(out, s[i])
+			continue
+		}
+		if i+3 < len(s) && isDigits(s[i+1:i+4]) {
+			if n, _ := strconv.Atoi(s[i+1 : i+4]); n < 256 {
+				out = append(out, byte(n))
+				i += 3
+				continue
+			}
+		}
+		out = append(out, s[i+1])
+		i++
+	}
+	return out
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// DnsmasqConfig reads a dnsmasq configuration, so a router's setup can be
+// moved over by pointing path at its dnsmasq.conf or conf directory
+// (/etc/dnsmasq.d; files are read in name order, skipping dotfiles and
+// backups). conf-file= and conf-dir= are followed. The directives that
+// shape DNS answers are taken over:
+//
+//   - address=/example.com/10.0.0.1: a rule answering the domain and its
+//     subdomains; "#" as the address answers 0.0.0.0 and ::, no address
+//     answers NXDOMAIN, and /#/ matches every name
+//   - server=/corp.example/10.1.1.1#5353: a forward.domains upstream
+//   - server=/lan/ and local=/lan/: local only, NXDOMAIN when not in the
+//     local records
+//   - server=8.8.8.8: a forward upstream (and fallback_dns if unset)
+//   - host-record=, cname=, addn-hosts= and local-ttl=: records, served
+//     from the "dnsmasq" source
+//
+// The rest (DHCP, interfaces, caching) have their own settings here or no
+// counterpart; they are listed in the log once, not errors.
+type DnsmasqConfig struct {
+	Path string `yaml:"path"`
+}
+
+const sourceDnsmasq = "dnsmasq"
+
+// dnsmasqConf is what a dnsmasq configuration comes down to.
+type dnsmasqConf struct {
+	rules       map[string]*RuleConfig // address=, by domain
+	domains     map[string][]string    // server= and local=
+	defaults    []string               // server=/domain/#
+	upstreams   []string
+	hostRecords [][]string
+	cnames      [][]string
+	addnHosts   []string
+	localTTL    uint32
+	ignored     map[string]int
+	files       int
+}
+
+// loadDnsmasq reads cfg.Path into c: rules, upstreams and domains are
+// added to those c has, and the records are returned for the dnsmasq
+// source.
+func loadDnsmasq(c *Config) (map[string][]Record, error) {
+	p := c.Dnsmasq.Path
+	if p == "" {
+		return nil, nil
+	}
+	d := &dnsmasqConf{
+		rules:   make(map[string]*RuleConfig),
+		domains: make(map[string][]string),
+		ignored: make(map[string]int),
+	}
+	if err := d.readPath(p, 0); err != nil {
+		return nil, fmt.Errorf("dnsmasq.path: %v", err)
+	}
+	recs, err := d.records()
+	if err != nil {
+		return nil, fmt.Errorf("dnsmasq.path: %v", err)
+	}
+	d.apply(c)
+	if len(d.ignored) > 0 {
+		var names []string
+		for k, n := range d.ignored {
+			names = append(names, fmt.Sprintf("%s (%d)", k, n))
+		}
+		sort.Strings(names)
+		log.Printf("dnsmasq: ignored directives without a counterpart: %s", strings.Join(names, ", "))
+	}
+	log.Printf("dnsmasq: read %d file(s) from %s: %d address rule(s), %d domain(s), %d upstream(s), %d record name(s)",
+		d.files, p, len(d.rules), len(d.domains), len(d.upstreams), len(recs))
+	return recs, nil
+}
+
+// setupDnsmasq merges the dnsmasq configuration into config before the
+// subsystems it feeds are set up.
+func setupDnsmasq() error {
+	recs, err := loadDnsmasq(config)
+	if err != nil || config.Dnsmasq.Path == "" {
+		return err
+	}
+	records.setSource(sourceDnsmasq, recs)
+	return nil
+}
+
+// readPath reads a file, or the files of a directory like conf-dir.
+func (d *dnsmasqConf) readPath(p string, depth int) error {
+	info, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return d.readDir(p, nil, nil, depth)
+	}
+	return d.readFile(p, depth)
+}
+
+// readDir reads the files in dir as conf-dir does: dotfiles and names
+// ending in "~" are skipped, as are those with an excluded extension or,
+// if include lists any, without an included one.
+func (d *dnsmasqConf) readDir(dir string, include, exclude []string, depth int) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(include) == 0 && len(exclude) == 0 {
+		exclude = []string{".bak", ".dpkg-old", ".dpkg-dist", ".rpmnew", ".rpmsave"}
+	}
+	for _, e := range entries { // sorted by name
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") || strings.HasSuffix(name, "~") {
+			continue
+		}
+		if hasAnySuffix(name, exclude) || (len(include) > 0 && !hasAnySuffix(name, include)) {
+			continue
+		}
+		if err := d.readFile(filepath.Join(dir, name), depth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hasAnySuffix(name string, suffixes []string) bool {
+	for _, s := range suffixes {
+		if strings.HasSuffix(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *dnsmasqConf) readFile(p string, depth int) error {
+	if depth > 8 {
+		return fmt.Errorf("%s: conf-file and conf-dir nested too deep", p)
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	d.files++
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		key, value, _ := strings.Cut(line, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if err := d.directive(key, value, depth); err != nil {
+			return fmt.Errorf("%s:%d: %s: %v", p, n, key, err)
+		}
+	}
+	return sc.Err()
+}
+
+// directive takes one line of the configuration.
+func (d *dnsmasqConf) directive(key, value string, depth int) error {
+	switch key {
+	case "address":
+		domains, addr, err := splitDomains(value)
+		if err != nil {
+			return err
+		}
+		for _, domain := range domains {
+			if err := d.address(domain, addr); err != nil {
+				return err
+			}
+		}
+	case "server", "local":
+		if !strings.HasPrefix(value, "/") {
+			if key == "local" {
+				return fmt.Errorf("want /domain/")
+			}
+			spec, err := dnsmasqUpstream(value)
+			if err != nil {
+				return err
+			}
+			d.upstreams = append(d.upstreams, spec)
+			return nil
+		}
+		domains, server, err := splitDomains(value)
+		if err != nil {
+			return err
+		}
+		for _, domain := range domains {
+			if domain == "#" || domain == "" {
+				return fmt.Errorf("/%s/ is not supported", domain)
+			}
+			origin := dns.CanonicalName(domain)
+			switch server {
+			case "":
+				d.domains[origin] = []string{}
+			case "#":
+				d.defaults = append(d.defaults, origin)
+			default:
+				spec, err := dnsmasqUpstream(server)
+				if err != nil {
+					return err
+				}
+				d.domains[origin] = append(d.domains[origin], spec)
+			}
+		}
+	case "host-record":
+		d.hostRecords = append(d.hostRecords, splitList(value))
+	case "cname":
+		d.cnames = append(d.cnames, splitList(value))
+	case "addn-hosts":
+		d.addnHosts = append(d.addnHosts, value)
+	case "local-ttl":
+		ttl, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return fmt.Errorf("bad TTL %q", value)
+		}
+		d.localTTL = uint32(ttl)
+	case "conf-file":
+		return d.readFile(value, depth+1)
+	case "conf-dir":
+		parts := splitList(value)
+		var include, exclude []string
+		for _, ext := range parts[1:] {
+			if strings.HasPrefix(ext, "*") {
+				include = append(include, ext[1:])
+			} else {
+				exclude = append(exclude, ext)
+			}
+		}
+		return d.readDir(parts[0], include, exclude, depth+1)
+	default:
+		d.ignored[key]++
+	}
+	return nil
+}
+
+// address adds an address= answer for domain; "#" as addr is the null
+// address and an empty one NXDOMAIN.
+func (d *dnsmasqConf) address(domain, addr string) error {
+	key := dns.CanonicalName(domain)
+	r := d.rules[key]
+	if r == nil {
+		r = &RuleConfig{Name: "dnsmasq " + key}
+		if domain == "#" {
+			r.Names = []string{"*"}
+		} else {
+			r.Names = []string{key, "*." + key}
+		}
+		d.rules[key] = r
+	}
+	switch {
+	case addr == "":
+		r.NXDomain, r.Answer = true, nil
+	case addr == "#":
+		r.Answer = append(r.Answer, "0.0.0.0", "::")
+	case net.ParseIP(addr) == nil:
+		return fmt.Errorf("%q is not an IP address", addr)
+	default:
+		r.Answer = append(r.Answer, addr)
+	}
+	if r.NXDomain && len(r.Answer) > 0 {
+		return fmt.Errorf("/%s/ is given both an address and none", domain)
+	}
+	if d.localTTL > 0 {
+		r.TTL = d.localTTL
+	}
+	return nil
+}
+
+// splitDomains splits "/a/b/rest" into its domains and what follows them.
+func splitDomains(value string) ([]string, string, error) {
+	last := strings.LastIndex(value, "/")
+	if !strings.HasPrefix(value, "/") || last == 0 {
+		return nil, "", fmt.Errorf("want /domain/...")
+	}
+	return strings.Split(value[1:last], "/"), value[last+1:], nil
+}
+
+func splitList(value string) []string {
+	parts := strings.Split(value, ",")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	return parts
+}
+
+// dnsmasqUpstream turns dnsmasq's "addr#port@interface" into an upstream
+// spec. Binding to an interface or source address isn't supported.
+func dnsmasqUpstream(s string) (string, error) {
+	if strings.Contains(s, "@") {
+		return "", fmt.Errorf("%q: source addresses and interfaces are not supported", s)
+	}
+	host, port, _ := strings.Cut(s, "#")
+	if net.ParseIP(host) == nil {
+		return "", fmt.Errorf("%q is not an IP address", host)
+	}
+	if port == "" {
+		port = "53"
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// records makes the records of host-record=, cname= and addn-hosts=.
+func (d *dnsmasqConf) records() (map[string][]Record, error) {
+	recs := make(map[string][]Record)
+	add := func(name string, rec Record) {
+		name = dns.CanonicalName(name)
+		recs[name] = append(recs[name], rec)
+	}
+	for _, fields := range d.hostRecords {
+		ttl := d.localTTL
+		var names []string
+		var ips []net.IP
+		for i, f := range fields {
+			if ip := net.ParseIP(f); ip != nil {
+				ips = append(ips, ip)
+			} else if n, err := strconv.ParseUint(f, 10, 32); err == nil && i == len(fields)-1 {
+				ttl = uint32(n)
+			} else if _, ok := dns.IsDomainName(f); ok && f != "" {
+				names = append(names, f)
+			} else {
+				return nil, fmt.Errorf("host-record: bad field %q", f)
+			}
+		}
+		if len(names) == 0 || len(ips) == 0 {
+			return nil, fmt.Errorf("host-record=%s: want names and addresses", strings.Join(fields, ","))
+		}
+		for _, ip := range ips {
+			rec := Record{Type: "AAAA", TTL: ttl, Data: ip.String()}
+			if ip.To4() != nil {
+				rec.Type = "A"
+			}
+			for _, n := range names {
+				add(n, rec)
+			}
+			// Like dnsmasq, the address maps back to the first name.
+			rev, _ := dns.ReverseAddr(ip.String())
+			add(rev, Record{Type: "PTR", TTL: ttl, Data: dns.CanonicalName(names[0])})
+		}
+	}
+	for _, fields := range d.cnames {
+		ttl := d.localTTL
+		if len(fields) > 2 {
+			if n, err := strconv.ParseUint(fields[len(fields)-1], 10, 32); err == nil {
+				ttl, fields = uint32(n), fields[:len(fields)-1]
+			}
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("cname=%s: want aliases and a target", strings.Join(fields, ","))
+		}
+		target := dns.CanonicalName(fields[len(fields)-1])
+		for _, alias := range fields[:len(fields)-1] {
+			if _, ok := dns.IsDomainName(alias); !ok || alias == "" {
+				return nil, fmt.Errorf("cname: invalid name %q", alias)
+			}
+			add(alias, Record{Type: "CNAME", TTL: ttl, Data: target})
+		}
+	}
+	for _, p := range d.addnHosts {
+		if err := d.readHosts(p, add); err != nil {
+			return nil, err
+		}
+	}
+	return recs, nil
+}
+
+// readHosts reads an addn-hosts file, or each file in a directory.
+func (d *dnsmasqConf) readHosts(p string, add func(string, Record)) error {
+	info, err := os.Stat(p)
+	if err != nil {
+		return fmt.Errorf("addn-hosts: %v", err)
+	}
+	paths := []string{p}
+	if info.IsDir() {
+		if paths, err = filepath.Glob(filepath.Join(p, "[^.]*")); err != nil {
+			return err
+		}
+	}
+	zs := zoneSyntax{defaultTTL: d.localTTL}
+	for _, file := range paths {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("addn-hosts: %v", err)
+		}
+		for n, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 || strings.HasPrefix(fields[0], "#") || !isHostsLine(fields) {
+				continue
+			}
+			entries, err := zs.parseHostsLine(line)
+			if err != nil {
+				log.Printf("dnsmasq: %s:%d: %v", file, n+1, err)
+				continue
+			}
+			for _, e := range entries {
+				add(e.name, e.rec)
+			}
+		}
+	}
+	return nil
+}
+
+// apply adds the directives to c. Rules go after c's own, most specific
+// domain first, since dnsmasq lets the longest match win.
+func (d *dnsmasqConf) apply(c *Config) {
+	keys := make([]string, 0, len(d.rules))
+	for k := range d.rules {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i] == "#." || keys[j] == "#." {
+			return keys[j] == "#." && keys[i] != "#." // /#/ matches last
+		}
+		li, lj := dns.CountLabel(keys[i]), dns.CountLabel(keys[j])
+		if li != lj {
+			return li > lj
+		}
+		return keys[i] < keys[j]
+	})
+	for _, k := range keys {
+		c.Rules = append(c.Rules, *d.rules[k])
+	}
+	for _, u := range d.upstreams {
+		if !slices.Contains(c.Forward.Upstreams, u) {
+			c.Forward.Upstreams = append(c.Forward.Upstreams, u)
+		}
+	}
+	if len(d.domains)+len(d.defaults) > 0 && c.Forward.Domains == nil {
+		c.Forward.Domains = make(map[string][]string)
+	}
+	for domain, list := range d.domains {
+		if _, ok := c.Forward.Domains[domain]; !ok {
+			c.Forward.Domains[domain] = list
+		}
+	}
+	// server=/domain/# is an exception back to the ordinary upstreams.
+	defaults := c.Forward.Upstreams
+	if len(defaults) == 0 && c.FallbackDNS != "" {
+		defaults = []string{c.FallbackDNS}
+	}
+	for _, domain := range d.defaults {
+		if _, ok := c.Forward.Domains[domain]; !ok {
+			c.Forward.Domains[domain] = defaults
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadDnsmasq(t *testing.T) {
+	dir := writeZoneFiles(t, map[string]string{
+		"extra.hosts":           "10.0.0.6 printer.lan\n",
+		"dnsmasq.d/skipped.bak": "address=/skipped.example/10.9.9.9\n",
+	})
+	// The files name each other by absolute path.
+	files := map[string]string{
+		"dnsmasq.conf": "# router config\n" +
+			"domain-needed\n" +
+			"local-ttl=120\n" +
+			"server=8.8.8.8\n" +
+			"server=/corp.example/10.1.1.1#5353\n" +
+			"local=/lan/\n" +
+			"address=/ads.example/#\n" +
+			"address=/shop.ads.example/10.0.0.9\n" +
+			"address=/blocked.example/\n" +
+			"conf-dir=" + filepath.Join(dir, "dnsmasq.d") + "\n",
+		"dnsmasq.d/hosts.conf": "host-record=nas.lan,10.0.0.5,fd00::5\n" +
+			"cname=files.lan,nas.lan\n" +
+			"addn-hosts=" + filepath.Join(dir, "extra.hosts") + "\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := &Config{Dnsmasq: DnsmasqConfig{Path: filepath.Join(dir, "dnsmasq.conf")}}
+	recs, err := loadDnsmasq(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, name := range []string{"nas.lan.", "files.lan.", "printer.lan.", "5.0.0.10.in-addr.arpa."} {
+		for _, r := range recs[name] {
+			got = append(got, fmt.Sprintf("%s %d %s %s", name, r.TTL, r.Type, r.Data))
+		}
+	}
+	want := "[nas.lan. 120 A 10.0.0.5 nas.lan. 120 AAAA fd00::5 files.lan. 120 CNAME nas.lan. " +
+		"printer.lan. 120 A 10.0.0.6 5.0.0.10.in-addr.arpa. 120 PTR nas.lan.]"
+	if fmt.Sprint(got) != want {
+		t.Errorf("records %v\nwant %s", got, want)
+	}
+
+	if fmt.Sprint(c.Forward.Upstreams) != "[8.8.8.8:53]" {
+		t.Errorf("upstreams %v", c.Forward.Upstreams)
+	}
+	if fmt.Sprint(c.Forward.Domains) != "map[corp.example.:[10.1.1.1:5353] lan.:[]]" {
+		t.Errorf("domains %v", c.Forward.Domains)
+	}
+
+	// The most specific domain's rule comes first; backups in conf-dir
+	// are skipped.
+	var rules []string
+	for _, r := range c.Rules {
+		rules = append(rules, fmt.Sprintf("%v %v %v", r.Names, r.Answer, r.NXDomain))
+	}
+	want = "[[shop.ads.example. *.shop.ads.example.] [10.0.0.9] false " +
+		"[ads.example. *.ads.example.] [0.0.0.0 ::] false " +
+		"[blocked.example. *.blocked.example.] [] true]"
+	if fmt.Sprint(rules) != want {
+		t.Errorf("rules %v\nwant %s", rules, want)
+	}
+
+	for _, bad := range []string{
+		"server=not-an-ip\n",
+		"server=10.0.0.1@eth0\n",
+		"address=/x.example/nowhere\n",
+		"address=/x.example/\naddress=/x.example/10.0.0.1\n",
+		"local=10.0.0.1\n",
+		"host-record=10.0.0.1\n",
+		"conf-file=" + filepath.Join(dir, "missing.conf") + "\n",
+	} {
+		d := writeZoneFiles(t, map[string]string{"bad.conf": bad})
+		if _, err := loadDnsmasq(&Config{Dnsmasq: DnsmasqConfig{Path: filepath.Join(d, "bad.conf")}}); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,687 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNSSECConfig turns the forwarder into a validating resolver and can sign
+// a local zone (see SigningConfig). When validating, forwarded queries are
+// sent with the DO bit, answers are checked against a chain of trust from
+// the trust anchors, bogus answers become SERVFAIL and secure ones get the
+// AD bit.
+type DNSSECConfig struct {
+	Validate     bool          `yaml:"validate"`
+	TrustAnchors []string      `yaml:"trust_anchors"` // DS records; defaults to the root KSKs
+	Sign         SigningConfig `yaml:"sign"`
+}
+
+// rootAnchors are the IANA root zone KSK-2017 and KSK-2024 DS records.
+var rootAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+type secStatus int
+
+const (
+	secInsecure secStatus = iota
+	secSecure
+	secBogus
+)
+
+func (s secStatus) String() string {
+	switch s {
+	case secSecure:
+		return "secure"
+	case secBogus:
+		return "bogus"
+	}
+	return "insecure"
+}
+
+// Cache lifetimes for validated chain data.
+const (
+	dnssecMaxCache   = time.Hour
+	dnssecBogusCache = 30 * time.Second
+)
+
+var trustAnchors = map[string][]*dns.DS{}
+
+var errBogus = errors.New("DNSSEC validation failed")
+
+// zoneInfo is what the validator knows about one name on the path from
+// the root: whether it is a zone cut, and if so the zone's validated keys.
+type zoneInfo struct {
+	status  secStatus
+	isCut   bool
+	keys    []*dns.DNSKEY
+	expires time.Time
+}
+
+var (
+	zoneCacheMu sync.Mutex
+	zoneCache   = map[string]zoneInfo{}
+)
+
+func setupDNSSEC() error {
+	if err := setupSigning(); err != nil {
+		return err
+	}
+	if !config.DNSSEC.Validate {
+		return nil
+	}
+	if config.FallbackDNS == "" {
+		return fmt.Errorf("dnssec.validate requires fallback_dns")
+	}
+	anchors := config.DNSSEC.TrustAnchors
+	if len(anchors) == 0 {
+		anchors = rootAnchors
+	}
+	for _, s := range anchors {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			return fmt.Errorf("dnssec.trust_anchors: %v", err)
+		}
+		ds, ok := rr.(*dns.DS)
+		if !ok {
+			return fmt.Errorf("dnssec.trust_anchors: %q is not a DS record", s)
+		}
+		zone := dns.CanonicalName(ds.Hdr.Name)
+		trustAnchors[zone] = append(trustAnchors[zone], ds)
+	}
+	return nil
+}
+
+// dnssecExchange sends the validator's own queries; tests answer them
+// from a fixture instead.
+var dnssecExchange = forwardToFallback
+
+// dnssecQuery asks the fallback for name/qtype with DNSSEC records and
+// checking disabled, so the validator sees the raw data.
+func dnssecQuery(name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	m.SetEdns0(defaultUDPSize, true)
+	m.CheckingDisabled = true
+	return dnssecExchange(m)
+}
+
+type rrsetKey struct {
+	name  string
+	rtype uint16
+}
+
+// splitRRsets groups a section into RRsets and their covering signatures.
+func splitRRsets(section []dns.RR) (map[rrsetKey][]dns.RR, map[rrsetKey][]*dns.RRSIG) {
+	sets := make(map[rrsetKey][]dns.RR)
+	sigs := make(map[rrsetKey][]*dns.RRSIG)
+	for _, rr := range section {
+		name := dns.CanonicalName(rr.Header().Name)
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			k := rrsetKey{name, sig.TypeCovered}
+			sigs[k] = append(sigs[k], sig)
+			continue
+		}
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		k := rrsetKey{name, rr.Header().Rrtype}
+		sets[k] = append(sets[k], rr)
+	}
+	return sets, sigs
+}
+
+// verifyRRset reports whether any signature over rrset verifies with one of
+// keys and is inside its validity period.
+func verifyRRset(rrset []dns.RR, sigs []*dns.RRSIG, keys []*dns.DNSKEY) bool {
+	now := time.Now()
+	for _, sig := range sigs {
+		if !sig.ValidityPeriod(now) {
+			continue
+		}
+		for _, key := range keys {
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+				continue
+			}
+			if sig.Verify(key, rrset) == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func minTTL(rrset []dns.RR) time.Duration {
+	ttl := dnssecMaxCache
+	for _, rr := range rrset {
+		if d := time.Duration(rr.Header().Ttl) * time.Second; d < ttl {
+			ttl = d
+		}
+	}
+	return ttl
+}
+
+// fetchZoneKeys retrieves the DNSKEY RRset of zone and validates it against
+// the given DS records.
+func fetchZoneKeys(zone string, dsSet []*dns.DS) ([]*dns.DNSKEY, time.Duration, error) {
+	resp, err := dnssecQuery(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, 0, err
+	}
+	sets, sigs := splitRRsets(resp.Answer)
+	k := rrsetKey{zone, dns.TypeDNSKEY}
+	rrset := sets[k]
+	var keys, entry []*dns.DNSKEY
+	for _, rr := range rrset {
+		key := rr.(*dns.DNSKEY)
+		keys = append(keys, key)
+		for _, ds := range dsSet {
+			if key.KeyTag() != ds.KeyTag || key.Algorithm != ds.Algorithm {
+				continue
+			}
+			if d := key.ToDS(ds.DigestType); d != nil && strings.EqualFold(d.Digest, ds.Digest) {
+				entry = append(entry, key)
+			}
+		}
+	}
+	if len(entry) == 0 {
+		return nil, 0, fmt.Errorf("no DNSKEY of %s matches its DS", zone)
+	}
+	if !verifyRRset(rrset, sigs[k], entry) {
+		return nil, 0, fmt.Errorf("DNSKEY RRset of %s is not signed by its key-signing key", zone)
+	}
+	return keys, minTTL(rrset), nil
+}
+
+func typeInBitmap(bitmap []uint16, t uint16) bool {
+	for _, b := range bitmap {
+		if b == t {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalLess orders names per RFC 4034 section 6.1.
+func canonicalLess(a, b string) bool {
+	la := dns.SplitDomainName(dns.CanonicalName(a))
+	lb := dns.SplitDomainName(dns.CanonicalName(b))
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if la[i] != lb[j] {
+			return la[i] < lb[j]
+		}
+	}
+	return len(la) < len(lb)
+}
+
+// nsecCovers reports whether an NSEC record proves name doesn't exist.
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner, next := nsec.Hdr.Name, nsec.NextDomain
+	if canonicalLess(owner, next) {
+		return canonicalLess(owner, name) && canonicalLess(name, next)
+	}
+	// Last NSEC in the zone wraps around to the apex.
+	return canonicalLess(owner, name) || canonicalLess(name, next)
+}
+
+// verifiedDenial checks that every NSEC/NSEC3 RRset in the authority
+// section is signed with keys and returns them.
+func verifiedDenial(ns []dns.RR, keys []*dns.DNSKEY) ([]*dns.NSEC, []*dns.NSEC3, bool) {
+	sets, sigs := splitRRsets(ns)
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	for k, rrset := range sets {
+		if k.rtype != dns.TypeNSEC && k.rtype != dns.TypeNSEC3 {
+			continue
+		}
+		if !verifyRRset(rrset, sigs[k], keys) {
+			return nil, nil, false
+		}
+		for _, rr := range rrset {
+			switch v := rr.(type) {
+			case *dns.NSEC:
+				nsecs = append(nsecs, v)
+			case *dns.NSEC3:
+				nsec3s = append(nsec3s, v)
+			}
+		}
+	}
+	return nsecs, nsec3s, true
+}
+
+// probeCut determines whether child, a name directly below the enclosing
+// secure zone (with keys), is a zone cut, and if so validates its keys.
+func probeCut(child string, keys []*dns.DNSKEY) zoneInfo {
+	bogus := zoneInfo{status: secBogus, expires: time.Now().Add(dnssecBogusCache)}
+	resp, err := dnssecQuery(child, dns.TypeDS)
+	if err != nil {
+		log.Printf("DNSSEC: DS lookup for %s failed: %v", child, err)
+		return bogus
+	}
+
+	sets, sigs := splitRRsets(resp.Answer)
+	k := rrsetKey{child, dns.TypeDS}
+	if dsRRs := sets[k]; len(dsRRs) > 0 {
+		if !verifyRRset(dsRRs, sigs[k], keys) {
+			log.Printf("DNSSEC: DS RRset of %s has no valid signature", child)
+			return bogus
+		}
+		var dsSet []*dns.DS
+		for _, rr := range dsRRs {
+			dsSet = append(dsSet, rr.(*dns.DS))
+		}
+		childKeys, ttl, err := fetchZoneKeys(child, dsSet)
+		if err != nil {
+			log.Printf("DNSSEC: %v", err)
+			return bogus
+		}
+		if dsTTL := minTTL(dsRRs); dsTTL < ttl {
+			ttl = dsTTL
+		}
+		return zoneInfo{status: secSecure, isCut: true, keys: childKeys, expires: time.Now().Add(ttl)}
+	}
+
+	// No DS: the parent must prove it with signed NSEC or NSEC3 records.
+	nsecs, nsec3s, ok := verifiedDenial(resp.Ns, keys)
+	if !ok || len(nsecs)+len(nsec3s) == 0 {
+		log.Printf("DNSSEC: missing or invalid proof of no DS for %s", child)
+		return bogus
+	}
+	expires := time.Now().Add(minTTL(resp.Ns))
+	for _, n := range nsecs {
+		if strings.EqualFold(n.Hdr.Name, child) {
+			return cutFromBitmap(child, n.TypeBitMap, expires)
+		}
+		if nsecCovers(n, child) {
+			// Empty non-terminal or missing name: not a cut.
+			return zoneInfo{status: secSecure, expires: expires}
+		}
+	}
+	for _, n := range nsec3s {
+		if n.Match(child) {
+			return cutFromBitmap(child, n.TypeBitMap, expires)
+		}
+	}
+	for _, n := range nsec3s {
+		if n.Cover(child) {
+			if n.Flags&1 == 1 { // opt-out: unsigned delegations may exist here
+				return zoneInfo{status: secInsecure, isCut: true, expires: expires}
+			}
+			return zoneInfo{status: secSecure, expires: expires}
+		}
+	}
+	log.Printf("DNSSEC: denial for %s proves nothing", child)
+	return bogus
+}
+
+// cutFromBitmap reads the parent's NSEC or NSEC3 record for child, which
+// answered a DS query with no DS. NS without SOA is an unsigned delegation;
+// a bitmap listing DS contradicts the empty answer, so a DS record was
+// stripped on the way and the response is bogus.
+func cutFromBitmap(child string, bitmap []uint16, expires time.Time) zoneInfo {
+	if typeInBitmap(bitmap, dns.TypeDS) {
+		log.Printf("DNSSEC: DS for %s withheld though its NSEC lists it", child)
+		return zoneInfo{status: secBogus, expires: time.Now().Add(dnssecBogusCache)}
+	}
+	if typeInBitmap(bitmap, dns.TypeNS) && !typeInBitmap(bitmap, dns.TypeSOA) {
+		return zoneInfo{status: secInsecure, isCut: true, expires: expires}
+	}
+	return zoneInfo{status: secSecure, expires: expires}
+}
+
+// enclosingZone walks from the closest trust anchor down to name and
+// returns the deepest zone containing it with that zone's validated keys,
+// or the first insecure or bogus link on the way. Names under no anchor
+// are insecure.
+func enclosingZone(name string) (string, []*dns.DNSKEY, secStatus) {
+	name = dns.CanonicalName(name)
+	labels := dns.SplitDomainName(name)
+
+	// Start at the deepest anchor; anchors for private zones are not
+	// reachable from the root.
+	start := -1
+	for i := 0; i <= len(labels); i++ {
+		if _, ok := trustAnchors[dns.Fqdn(strings.Join(labels[i:], "."))]; ok {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return ".", nil, secInsecure
+	}
+	zone := dns.Fqdn(strings.Join(labels[start:], "."))
+	info, ok := cachedZone(zone)
+	if !ok {
+		keys, ttl, err := fetchZoneKeys(zone, trustAnchors[zone])
+		if err != nil {
+			log.Printf("DNSSEC: %v", err)
+			info = zoneInfo{status: secBogus, expires: time.Now().Add(dnssecBogusCache)}
+		} else {
+			info = zoneInfo{status: secSecure, isCut: true, keys: keys, expires: time.Now().Add(ttl)}
+		}
+		storeZone(zone, info)
+	}
+	if info.status != secSecure {
+		return zone, nil, info.status
+	}
+	keys := info.keys
+
+	for i := start - 1; i >= 0; i-- {
+		child := dns.Fqdn(strings.Join(labels[i:], "."))
+		info, cached := cachedZone(child)
+		if !cached {
+			info = probeCut(child, keys)
+			storeZone(child, info)
+		}
+		switch {
+		case info.status != secSecure:
+			return child, nil, info.status
+		case info.isCut:
+			zone, keys = child, info.keys
+		}
+	}
+	return zone, keys, secSecure
+}
+
+func cachedZone(name string) (zoneInfo, bool) {
+	zoneCacheMu.Lock()
+	defer zoneCacheMu.Unlock()
+	info, ok := zoneCache[name]
+	if !ok || time.Now().After(info.expires) {
+		return zoneInfo{}, false
+	}
+	return info, true
+}
+
+func storeZone(name string, info zoneInfo) {
+	zoneCacheMu.Lock()
+	defer zoneCacheMu.Unlock()
+	zoneCache[name] = info
+}
+
+// validateResponse classifies a forwarded response for question q.
+func validateResponse(q dns.Question, resp *dns.Msg) secStatus {
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return secInsecure
+	}
+
+	sets, sigs := splitRRsets(resp.Answer)
+	status := secSecure
+	for k, rrset := range sets {
+		if k.rtype == dns.TypeCNAME && len(sigs[k]) == 0 && synthesizedCNAME(rrset, sets) {
+			continue
+		}
+		_, keys, st := enclosingZone(k.name)
+		if st == secBogus {
+			return secBogus
+		}
+		if st == secInsecure {
+			status = secInsecure
+			continue
+		}
+		if !verifyRRset(rrset, sigs[k], keys) {
+			log.Printf("DNSSEC: bogus %s %s", k.name, dns.TypeToString[k.rtype])
+			return secBogus
+		}
+	}
+	if len(sets) > 0 && resp.Rcode == dns.RcodeSuccess {
+		return status
+	}
+
+	// Negative answer (or a CNAME chain ending in one): the zone holding
+	// the final name must prove the denial.
+	target := dns.CanonicalName(q.Name)
+	for {
+		cname, ok := sets[rrsetKey{target, dns.TypeCNAME}]
+		if !ok {
+			break
+		}
+		target = dns.CanonicalName(cname[0].(*dns.CNAME).Target)
+	}
+	_, keys, st := enclosingZone(target)
+	if st != secSecure {
+		return st
+	}
+	nsecs, nsec3s, ok := verifiedDenial(resp.Ns, keys)
+	if !ok || len(nsecs)+len(nsec3s) == 0 {
+		log.Printf("DNSSEC: unproven denial for %s", target)
+		return secBogus
+	}
+	nxdomain := resp.Rcode == dns.RcodeNameError
+	proof := secBogus
+	if len(nsecs) > 0 {
+		if nsecDenial(nsecs, target, q.Qtype, nxdomain) {
+			proof = secSecure
+		}
+	} else {
+		proof = nsec3Denial(nsec3s, target, q.Qtype, nxdomain)
+	}
+	switch proof {
+	case secBogus:
+		if nxdomain {
+			log.Printf("DNSSEC: NXDOMAIN for %s is not proven", target)
+		} else {
+			log.Printf("DNSSEC: no data for %s %s is not proven", target, dns.TypeToString[q.Qtype])
+		}
+		return secBogus
+	case secInsecure:
+		return secInsecure
+	}
+	return status
+}
+
+// synthesizedCNAME reports whether cname follows from one of the answer's
+// DNAME records. Servers synthesize such CNAMEs unsigned (RFC 6672 section
+// 5.3.1); the DNAME is validated instead.
+func synthesizedCNAME(cname []dns.RR, sets map[rrsetKey][]dns.RR) bool {
+	if len(cname) != 1 {
+		return false
+	}
+	c := cname[0].(*dns.CNAME)
+	owner := dns.CanonicalName(c.Hdr.Name)
+	for k, rrset := range sets {
+		if k.rtype != dns.TypeDNAME || k.name == owner || !dns.IsSubDomain(k.name, owner) {
+			continue
+		}
+		want := strings.TrimSuffix(owner, k.name)
+		if t := dns.CanonicalName(rrset[0].(*dns.DNAME).Target); t != "." {
+			want += t
+		}
+		if dns.CanonicalName(c.Target) == want {
+			return true
+		}
+	}
+	return false
+}
+
+// commonAncestor returns the deepest name that is both a or one of its
+// ancestors and b or one of its ancestors.
+func commonAncestor(a, b string) string {
+	la := dns.SplitDomainName(dns.CanonicalName(a))
+	lb := dns.SplitDomainName(dns.CanonicalName(b))
+	n := 0
+	for n < len(la) && n < len(lb) && la[len(la)-1-n] == lb[len(lb)-1-n] {
+		n++
+	}
+	return dns.Fqdn(strings.Join(la[len(la)-n:], "."))
+}
+
+// wildcardOf returns the wildcard name directly below encloser.
+func wildcardOf(encloser string) string {
+	if encloser == "." {
+		return "*."
+	}
+	return "*." + encloser
+}
+
+func nsecCovering(nsecs []*dns.NSEC, name string) *dns.NSEC {
+	for _, n := range nsecs {
+		if nsecCovers(n, name) {
+			return n
+		}
+	}
+	return nil
+}
+
+// nsecDenial checks NSEC records proving that name doesn't exist, or has
+// no qtype records, directly or through a wildcard (RFC 4035 section 5.4).
+func nsecDenial(nsecs []*dns.NSEC, name string, qtype uint16, nxdomain bool) bool {
+	for _, n := range nsecs {
+		if strings.EqualFold(n.Hdr.Name, name) {
+			return !nxdomain && !typeInBitmap(n.TypeBitMap, qtype) && !typeInBitmap(n.TypeBitMap, dns.TypeCNAME)
+		}
+	}
+	cover := nsecCovering(nsecs, name)
+	if cover == nil {
+		return false
+	}
+	if dns.IsSubDomain(name, cover.NextDomain) {
+		// name is an empty non-terminal: it exists, with no data.
+		return !nxdomain
+	}
+	encloser := commonAncestor(name, cover.Hdr.Name)
+	if e := commonAncestor(name, cover.NextDomain); dns.CountLabel(e) > dns.CountLabel(encloser) {
+		encloser = e
+	}
+	wildcard := wildcardOf(encloser)
+	if nxdomain {
+		return nsecCovering(nsecs, wildcard) != nil
+	}
+	for _, n := range nsecs {
+		if strings.EqualFold(n.Hdr.Name, wildcard) {
+			return !typeInBitmap(n.TypeBitMap, qtype) && !typeInBitmap(n.TypeBitMap, dns.TypeCNAME)
+		}
+	}
+	return false
+}
+
+func nsec3Matching(nsec3s []*dns.NSEC3, name string) *dns.NSEC3 {
+	for _, n := range nsec3s {
+		if n.Match(name) {
+			return n
+		}
+	}
+	return nil
+}
+
+func nsec3Covering(nsec3s []*dns.NSEC3, name string) *dns.NSEC3 {
+	for _, n := range nsec3s {
+		if n.Cover(name) {
+			return n
+		}
+	}
+	return nil
+}
+
+// nsec3ClosestEncloser finds the closest encloser proof for name (RFC 5155
+// section 8.3): a record matching an ancestor and one covering the next
+// closer name below it. It returns the encloser and the covering record.
+func nsec3ClosestEncloser(nsec3s []*dns.NSEC3, name string) (string, *dns.NSEC3) {
+	labels := dns.SplitDomainName(name)
+	for i := 1; i <= len(labels); i++ {
+		encloser := dns.Fqdn(strings.Join(labels[i:], "."))
+		if nsec3Matching(nsec3s, encloser) == nil {
+			continue
+		}
+		return encloser, nsec3Covering(nsec3s, dns.Fqdn(strings.Join(labels[i-1:], ".")))
+	}
+	return "", nil
+}
+
+// nsec3Denial checks NSEC3 records proving a negative answer (RFC 5155
+// sections 8.4 to 8.7). A DS query answered from an opt-out span is
+// insecure: the name may be an unsigned delegation.
+func nsec3Denial(nsec3s []*dns.NSEC3, name string, qtype uint16, nxdomain bool) secStatus {
+	if n := nsec3Matching(nsec3s, name); n != nil {
+		if nxdomain || typeInBitmap(n.TypeBitMap, qtype) || typeInBitmap(n.TypeBitMap, dns.TypeCNAME) {
+			return secBogus
+		}
+		return secSecure
+	}
+	encloser, nextCloser := nsec3ClosestEncloser(nsec3s, name)
+	if nextCloser == nil {
+		return secBogus
+	}
+	wildcard := wildcardOf(encloser)
+	if nxdomain {
+		if nsec3Covering(nsec3s, wildcard) == nil {
+			return secBogus
+		}
+		return secSecure
+	}
+	if n := nsec3Matching(nsec3s, wildcard); n != nil {
+		if typeInBitmap(n.TypeBitMap, qtype) || typeInBitmap(n.TypeBitMap, dns.TypeCNAME) {
+			return secBogus
+		}
+		return secSecure
+	}
+	if qtype == dns.TypeDS && nextCloser.Flags&1 == 1 {
+		return secInsecure
+	}
+	return secBogus
+}
+
+// isDNSSECType reports whether rr is validation data a non-DO client
+// shouldn't receive.
+func isDNSSECType(rr dns.RR) bool {
+	switch rr.Header().Rrtype {
+	case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+		return true
+	}
+	return false
+}
+
+func stripDNSSEC(section []dns.RR) []dns.RR {
+	out := section[:0]
+	for _, rr := range section {
+		if !isDNSSECType(rr) {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+// dnssecOK reports whether the client set the DO bit.
+func dnssecOK(r *dns.Msg) bool {
+	opt := r.IsEdns0()
+	return opt != nil && opt.Do()
+}
+
+// dnssecUpstream prepares a forwarded query for validation.
+func dnssecUpstream(q *dns.Msg) {
+	opt := q.IsEdns0()
+	if opt == nil {
+		q.SetEdns0(defaultUDPSize, true)
+	} else {
+		opt.SetDo()
+	}
+	q.CheckingDisabled = true
+}
+
+// dnssecFinish validates a forwarded response for the client request r.
+// It reports false if the answer is bogus and must not be served.
+func dnssecFinish(r, resp *dns.Msg) bool {
+	clientDO := dnssecOK(r)
+	if !r.CheckingDisabled && len(r.Question) > 0 {
+		st := validateResponse(r.Question[0], resp)
+		if st == secBogus {
+			log.Printf("DNSSEC: bogus answer for %s %s", r.Question[0].Name, dns.TypeToString[r.Question[0].Qtype])
+			return false
+		}
+		resp.AuthenticatedData = st == secSecure
+	}
+	resp.CheckingDisabled = r.CheckingDisabled
+	if !clientDO {
+		resp.Answer = stripDNSSEC(resp.Answer)
+		resp.Ns = stripDNSSEC(resp.Ns)
+		resp.Extra = stripDNSSEC(resp.Extra)
+	}
+	return true
+}
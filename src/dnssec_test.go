@@ -0,0 +1,462 @@
+package main
+
+import (
+	"crypto"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testZone is a signed zone served by the fake upstream. One key signs
+// everything, which the validator accepts as both KSK and ZSK.
+type testZone struct {
+	name string
+	key  *dns.DNSKEY
+	priv crypto.Signer
+	rrs  []dns.RR
+}
+
+func newTestZone(t *testing.T, name string, records ...string) *testZone {
+	t.Helper()
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z := &testZone{name: name, key: key, priv: priv.(crypto.Signer), rrs: []dns.RR{key}}
+	for _, s := range records {
+		z.rrs = append(z.rrs, mustRR(t, s))
+	}
+	return z
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatalf("%q: %v", s, err)
+	}
+	return rr
+}
+
+// signValid signs rrset, valid from an hour ago to an hour from now.
+func (z *testZone) signValid(t *testing.T, rrset []dns.RR) *dns.RRSIG {
+	return z.sign(t, rrset, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+}
+
+func (z *testZone) sign(t *testing.T, rrset []dns.RR, inception, expiration time.Time) *dns.RRSIG {
+	t.Helper()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: rrset[0].Header().Ttl},
+		Algorithm:  z.key.Algorithm,
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.name,
+		Inception:  uint32(inception.Unix()),
+		Expiration: uint32(expiration.Unix()),
+	}
+	if err := sig.Sign(z.priv, rrset); err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+// rrset returns the zone's records of name and type.
+func (z *testZone) rrset(name string, rtype uint16) []dns.RR {
+	var out []dns.RR
+	for _, rr := range z.rrs {
+		if strings.EqualFold(rr.Header().Name, name) && rr.Header().Rrtype == rtype {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+// signed returns the rrset followed by its signature.
+func (z *testZone) signed(t *testing.T, name string, rtype uint16) []dns.RR {
+	t.Helper()
+	rrset := z.rrset(name, rtype)
+	if len(rrset) == 0 {
+		t.Fatalf("%s has no %s %s", z.name, name, dns.TypeToString[rtype])
+	}
+	return append(rrset, z.signValid(t, rrset))
+}
+
+// bitmaps lists the types at each owner name, with RRSIG and the given
+// denial type, for building a denial chain.
+func (z *testZone) bitmaps(denial uint16) map[string][]uint16 {
+	types := map[string][]uint16{}
+	for _, rr := range z.rrs {
+		name := dns.CanonicalName(rr.Header().Name)
+		if !typeInBitmap(types[name], rr.Header().Rrtype) {
+			types[name] = append(types[name], rr.Header().Rrtype)
+		}
+	}
+	for name, ts := range types {
+		ts = append(ts, dns.TypeRRSIG, denial)
+		sort.Slice(ts, func(i, j int) bool { return ts[i] < ts[j] })
+		types[name] = ts
+	}
+	return types
+}
+
+// addNSEC adds the zone's NSEC chain.
+func (z *testZone) addNSEC() {
+	types := z.bitmaps(dns.TypeNSEC)
+	var names []string
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return canonicalLess(names[i], names[j]) })
+	for i, name := range names {
+		z.rrs = append(z.rrs, &dns.NSEC{
+			Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 3600},
+			NextDomain: names[(i+1)%len(names)],
+			TypeBitMap: types[name],
+		})
+	}
+}
+
+// addNSEC3 adds the zone's NSEC3 chain, unsalted with no extra iterations.
+func (z *testZone) addNSEC3(optOut bool) {
+	types := z.bitmaps(dns.TypeNSEC3)
+	hashed := map[string][]uint16{}
+	var hashes []string
+	for name, ts := range types {
+		h := dns.HashName(name, dns.SHA1, 0, "")
+		hashed[h] = ts
+		hashes = append(hashes, h)
+	}
+	sort.Strings(hashes)
+	var flags uint8
+	if optOut {
+		flags = 1
+	}
+	for i, h := range hashes {
+		z.rrs = append(z.rrs, &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: h + "." + z.name, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 3600},
+			Hash:       dns.SHA1,
+			Flags:      flags,
+			HashLength: 20,
+			NextDomain: hashes[(i+1)%len(hashes)],
+			TypeBitMap: hashed[h],
+		})
+	}
+}
+
+// remove drops name/type from the zone, after the denial chain has been
+// built, as an attacker stripping records would.
+func (z *testZone) remove(name string, rtype uint16) {
+	out := z.rrs[:0]
+	for _, rr := range z.rrs {
+		if !strings.EqualFold(rr.Header().Name, name) || rr.Header().Rrtype != rtype {
+			out = append(out, rr)
+		}
+	}
+	z.rrs = out
+}
+
+// denial returns the zone's signed NSEC or NSEC3 records, the whole chain;
+// the validator picks the ones it needs.
+func (z *testZone) denial(t *testing.T) []dns.RR {
+	t.Helper()
+	var out []dns.RR
+	for _, rtype := range []uint16{dns.TypeNSEC, dns.TypeNSEC3} {
+		for _, rr := range z.rrs {
+			if rr.Header().Rrtype == rtype {
+				out = append(out, rr, z.signValid(t, []dns.RR{rr}))
+			}
+		}
+	}
+	return out
+}
+
+// testHierarchy is a signed root with a secure child, an unsigned
+// delegation, a child whose DS an attacker has stripped, and an NSEC3
+// child.
+type testHierarchy struct {
+	root, example, n3 *testZone
+}
+
+func newTestHierarchy(t *testing.T) *testHierarchy {
+	t.Helper()
+	h := &testHierarchy{
+		example: newTestZone(t, "example.",
+			"example. 3600 IN SOA ns.example. admin.example. 1 3600 600 86400 300",
+			"example. 3600 IN NS ns.example.",
+			"dn.example. 3600 IN DNAME example.",
+			"*.w.example. 3600 IN TXT \"wild\"",
+			"www.example. 3600 IN A 192.0.2.1",
+		),
+		n3: newTestZone(t, "n3.",
+			"n3. 3600 IN SOA ns.n3. admin.n3. 1 3600 600 86400 300",
+			"n3. 3600 IN NS ns.n3.",
+			"www.n3. 3600 IN A 192.0.2.3",
+		),
+	}
+	stripped := newTestZone(t, "stripped.")
+	h.root = newTestZone(t, ".",
+		". 3600 IN SOA a.root. admin.root. 1 3600 600 86400 300",
+		". 3600 IN NS a.root.",
+		"example. 3600 IN NS ns.example.",
+		h.example.key.ToDS(dns.SHA256).String(),
+		"insecure. 3600 IN NS ns.insecure.",
+		"n3. 3600 IN NS ns.n3.",
+		h.n3.key.ToDS(dns.SHA256).String(),
+		"stripped. 3600 IN NS ns.stripped.",
+		stripped.key.ToDS(dns.SHA256).String(),
+	)
+	h.root.addNSEC()
+	h.root.remove("stripped.", dns.TypeDS)
+	h.example.addNSEC()
+	h.n3.addNSEC3(false)
+	return h
+}
+
+// exchange answers as the zones' servers would, from the deepest zone
+// holding the name; DS comes from the parent.
+func (h *testHierarchy) exchange(t *testing.T) func(*dns.Msg) (*dns.Msg, error) {
+	return func(r *dns.Msg) (*dns.Msg, error) {
+		q := r.Question[0]
+		var zone *testZone
+		for _, z := range []*testZone{h.root, h.example, h.n3} {
+			if z == nil || !dns.IsSubDomain(z.name, q.Name) || (q.Qtype == dns.TypeDS && strings.EqualFold(z.name, q.Name)) {
+				continue
+			}
+			if zone == nil || dns.CountLabel(z.name) > dns.CountLabel(zone.name) {
+				zone = z
+			}
+		}
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if rrset := zone.rrset(q.Name, q.Qtype); len(rrset) > 0 {
+			m.Answer = append(rrset, zone.signValid(t, rrset))
+		} else {
+			m.Ns = zone.denial(t)
+		}
+		return m, nil
+	}
+}
+
+func setupTestValidator(t *testing.T) *testHierarchy {
+	t.Helper()
+	h := newTestHierarchy(t)
+	oldExchange, oldAnchors, oldCache := dnssecExchange, trustAnchors, zoneCache
+	t.Cleanup(func() { dnssecExchange, trustAnchors, zoneCache = oldExchange, oldAnchors, oldCache })
+	dnssecExchange = h.exchange(t)
+	trustAnchors = map[string][]*dns.DS{".": {h.root.key.ToDS(dns.SHA256)}}
+	zoneCache = map[string]zoneInfo{}
+	return h
+}
+
+func TestValidateResponse(t *testing.T) {
+	h := setupTestValidator(t)
+	insecureA := mustRR(t, "www.insecure. 300 IN A 192.0.2.2")
+	strippedA := mustRR(t, "www.stripped. 300 IN A 192.0.2.66")
+	wwwA := h.example.rrset("www.example.", dns.TypeA)
+	synthesized := mustRR(t, "www.dn.example. 3600 IN CNAME www.example.")
+	forged := mustRR(t, "www.dn.example. 3600 IN CNAME evil.test.")
+
+	// denialOnly keeps the signed NSEC records owned by names.
+	denialOnly := func(z *testZone, names ...string) []dns.RR {
+		var out []dns.RR
+		all := z.denial(t)
+		for i := 0; i < len(all); i += 2 {
+			for _, name := range names {
+				if strings.EqualFold(all[i].Header().Name, name) {
+					out = append(out, all[i], all[i+1])
+				}
+			}
+		}
+		return out
+	}
+
+	tests := []struct {
+		name   string
+		qname  string
+		qtype  uint16
+		rcode  int
+		answer []dns.RR
+		ns     []dns.RR
+		want   secStatus
+	}{
+		{
+			name:   "secure",
+			qname:  "www.example.",
+			qtype:  dns.TypeA,
+			answer: h.example.signed(t, "www.example.", dns.TypeA),
+			want:   secSecure,
+		},
+		{
+			name:   "unsigned answer in a secure zone",
+			qname:  "www.example.",
+			qtype:  dns.TypeA,
+			answer: wwwA,
+			want:   secBogus,
+		},
+		{
+			name:   "expired RRSIG",
+			qname:  "www.example.",
+			qtype:  dns.TypeA,
+			answer: append(wwwA, h.example.sign(t, wwwA, time.Now().Add(-48*time.Hour), time.Now().Add(-24*time.Hour))),
+			want:   secBogus,
+		},
+		{
+			name:   "insecure delegation",
+			qname:  "www.insecure.",
+			qtype:  dns.TypeA,
+			answer: []dns.RR{insecureA},
+			want:   secInsecure,
+		},
+		{
+			name:   "stripped DS",
+			qname:  "www.stripped.",
+			qtype:  dns.TypeA,
+			answer: []dns.RR{strippedA},
+			want:   secBogus,
+		},
+		{
+			name:  "NXDOMAIN",
+			qname: "nope.example.",
+			qtype: dns.TypeA,
+			rcode: dns.RcodeNameError,
+			ns:    denialOnly(h.example, "example.", "dn.example."),
+			want:  secSecure,
+		},
+		{
+			name:  "NXDOMAIN without wildcard proof",
+			qname: "nope.example.",
+			qtype: dns.TypeA,
+			rcode: dns.RcodeNameError,
+			ns:    denialOnly(h.example, "dn.example."),
+			want:  secBogus,
+		},
+		{
+			name:  "NXDOMAIN for an existing name",
+			qname: "www.example.",
+			qtype: dns.TypeA,
+			rcode: dns.RcodeNameError,
+			ns:    h.example.denial(t),
+			want:  secBogus,
+		},
+		{
+			name:  "NODATA",
+			qname: "www.example.",
+			qtype: dns.TypeAAAA,
+			ns:    denialOnly(h.example, "www.example."),
+			want:  secSecure,
+		},
+		{
+			name:  "NODATA for a type that exists",
+			qname: "www.example.",
+			qtype: dns.TypeA,
+			ns:    denialOnly(h.example, "www.example."),
+			want:  secBogus,
+		},
+		{
+			name:  "NODATA from an unrelated NSEC",
+			qname: "www.example.",
+			qtype: dns.TypeAAAA,
+			ns:    denialOnly(h.example, "*.w.example."),
+			want:  secBogus,
+		},
+		{
+			name:  "NODATA at an empty non-terminal",
+			qname: "w.example.",
+			qtype: dns.TypeA,
+			ns:    denialOnly(h.example, "dn.example."),
+			want:  secSecure,
+		},
+		{
+			name:  "NODATA through a wildcard",
+			qname: "x.w.example.",
+			qtype: dns.TypeA,
+			ns:    denialOnly(h.example, "*.w.example."),
+			want:  secSecure,
+		},
+		{
+			name:   "DNAME with synthesized CNAME",
+			qname:  "www.dn.example.",
+			qtype:  dns.TypeA,
+			answer: append(append(h.example.signed(t, "dn.example.", dns.TypeDNAME), synthesized), h.example.signed(t, "www.example.", dns.TypeA)...),
+			want:   secSecure,
+		},
+		{
+			name:   "DNAME with a CNAME it doesn't produce",
+			qname:  "www.dn.example.",
+			qtype:  dns.TypeA,
+			answer: append(h.example.signed(t, "dn.example.", dns.TypeDNAME), forged),
+			want:   secBogus,
+		},
+		{
+			name:   "secure under NSEC3",
+			qname:  "www.n3.",
+			qtype:  dns.TypeA,
+			answer: h.n3.signed(t, "www.n3.", dns.TypeA),
+			want:   secSecure,
+		},
+		{
+			name:  "NODATA under NSEC3",
+			qname: "www.n3.",
+			qtype: dns.TypeAAAA,
+			ns:    h.n3.denial(t),
+			want:  secSecure,
+		},
+		{
+			name:  "NXDOMAIN under NSEC3",
+			qname: "nope.n3.",
+			qtype: dns.TypeA,
+			rcode: dns.RcodeNameError,
+			ns:    h.n3.denial(t),
+			want:  secSecure,
+		},
+		{
+			name:  "NSEC3 NODATA for a type that exists",
+			qname: "www.n3.",
+			qtype: dns.TypeA,
+			ns:    h.n3.denial(t),
+			want:  secBogus,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &dns.Msg{Answer: tt.answer, Ns: tt.ns}
+			resp.Rcode = tt.rcode
+			got := validateResponse(dns.Question{Name: tt.qname, Qtype: tt.qtype, Qclass: dns.ClassINET}, resp)
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProbeCutOptOut(t *testing.T) {
+	// A DS query answered from an NSEC3 opt-out span is an unsigned
+	// delegation; without opt-out, the same span is no cut at all.
+	for _, optOut := range []bool{false, true} {
+		z := newTestZone(t, "parent.",
+			"parent. 3600 IN SOA ns.parent. admin.parent. 1 3600 600 86400 300",
+			"parent. 3600 IN NS ns.parent.",
+		)
+		z.addNSEC3(optOut)
+		h := &testHierarchy{root: z}
+		oldExchange := dnssecExchange
+		dnssecExchange = h.exchange(t)
+		info := probeCut("child.parent.", []*dns.DNSKEY{z.key})
+		dnssecExchange = oldExchange
+		want := secSecure
+		if optOut {
+			want = secInsecure
+		}
+		if info.status != want || info.isCut != optOut {
+			t.Errorf("opt-out %v: got %s cut %v, want %s cut %v", optOut, info.status, info.isCut, want, optOut)
+		}
+	}
+}
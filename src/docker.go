@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DockerConfig enables a backend that publishes A records for running
+// containers as <container-name>.<domain>. A container can choose its own
+// names with a comma-separated label (micro-dns.name by default). Label
+// names must lie under Domain unless AnyName is set, so a container cannot
+// take over names it has no business answering for.
+type DockerConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Socket  string `yaml:"socket"`
+	Domain  string `yaml:"domain"`
+	Label   string `yaml:"label"`
+	AnyName bool   `yaml:"any_name"`
+	TTL     uint32 `yaml:"ttl"`
+}
+
+const defaultDockerTTL = 10
+
+func setupDocker() error {
+	cfg := &config.Docker
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.Socket == "" {
+		cfg.Socket = "/var/run/docker.sock"
+	}
+	if cfg.Domain == "" {
+		cfg.Domain = "docker.local"
+	}
+	cfg.Domain = dns.Fqdn(strings.ToLower(cfg.Domain))
+	if _, ok := dns.IsDomainName(cfg.Domain); !ok {
+		return fmt.Errorf("docker.domain: invalid domain %q", cfg.Domain)
+	}
+	if cfg.Label == "" {
+		cfg.Label = "micro-dns.name"
+	}
+	if cfg.TTL == 0 {
+		cfg.TTL = defaultDockerTTL
+	}
+	return nil
+}
+
+// dockerClient returns an HTTP client that talks to the Docker socket.
+func dockerClient(socket string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+}
+
+type dockerContainer struct {
+	Names           []string          `json:"Names"`
+	Labels          map[string]string `json:"Labels"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// syncDocker lists running containers and builds their record set.
+func syncDocker(client *http.Client, cfg DockerConfig) (map[string][]Record, error) {
+	resp, err := client.Get("http://docker/containers/json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("list containers: %s", resp.Status)
+	}
+	var containers []dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return nil, err
+	}
+
+	recs := make(map[string][]Record)
+	for _, c := range containers {
+		var names []string
+		if label := c.Labels[cfg.Label]; label != "" {
+			for _, n := range strings.Split(label, ",") {
+				if n = strings.TrimSpace(n); n == "" {
+					continue
+				}
+				n = dns.Fqdn(strings.ToLower(n))
+				if !cfg.AnyName && !dns.IsSubDomain(cfg.Domain, n) {
+					log.Printf("Docker: ignoring %s label name %s outside %s", strings.Join(c.Names, ","), n, cfg.Domain)
+					continue
+				}
+				names = append(names, n)
+			}
+		} else {
+			for _, n := range c.Names {
+				names = append(names, strings.ToLower(strings.TrimPrefix(n, "/"))+"."+cfg.Domain)
+			}
+		}
+
+		for _, network := range c.NetworkSettings.Networks {
+			if network.IPAddress == "" {
+				continue
+			}
+			for _, name := range names {
+				if _, ok := dns.IsDomainName(name); !ok {
+					continue
+				}
+				recs[name] = append(recs[name], Record{Type: "A", TTL: cfg.TTL, Data: network.IPAddress})
+			}
+		}
+	}
+	return recs, nil
+}
+
+// watchDocker resyncs the docker record source at startup and on every
+// container event, reconnecting if the event stream drops.
+func watchDocker() {
+	cfg := config.Docker
+	client := dockerClient(cfg.Socket)
+	filters := url.QueryEscape(`{"type":["container"]}`)
+
+	resync := func() {
+		recs, err := syncDocker(client, cfg)
+		if err != nil {
+			log.Printf("Docker sync failed: %v", err)
+			return
+		}
+		records.setSource(sourceDocker, recs)
+		markWarm(warmDocker)
+	}
+
+	for {
+		resync()
+		resp, err := client.Get("http://docker/events?filters=" + filters)
+		if err != nil {
+			log.Printf("Docker event stream failed: %v", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			var ev struct {
+				Action string `json:"Action"`
+			}
+			if json.Unmarshal(scanner.Bytes(), &ev) != nil {
+				continue
+			}
+			switch ev.Action {
+			case "start", "die", "stop", "rename", "connect", "disconnect", "destroy":
+				resync()
+			}
+		}
+		resp.Body.Close()
+		log.Printf("Docker event stream closed, reconnecting")
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSyncDockerLabelNames(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[
+			{"Names":["/web"],"Labels":{"micro-dns.name":"app.docker.local, docker.local,www.example.com"},
+			 "NetworkSettings":{"Networks":{"bridge":{"IPAddress":"172.17.0.2"}}}},
+			{"Names":["/db"],"Labels":{},"NetworkSettings":{"Networks":{"bridge":{"IPAddress":"172.17.0.3"}}}}]`)
+	}))
+	defer srv.Close()
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", srv.Listener.Addr().String())
+		},
+	}}
+	cfg := DockerConfig{Domain: "docker.local.", Label: "micro-dns.name", TTL: 10}
+
+	recs, err := syncDocker(client, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"app.docker.local.", "docker.local.", "db.docker.local."} {
+		if len(recs[name]) != 1 {
+			t.Errorf("%s: %v", name, recs[name])
+		}
+	}
+	if _, ok := recs["www.example.com."]; ok {
+		t.Error("label name outside the domain was published")
+	}
+
+	cfg.AnyName = true
+	if recs, err = syncDocker(client, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if len(recs["www.example.com."]) != 1 {
+		t.Error("any_name did not allow a name outside the domain")
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v2"
+)
+
+// GET /records/dump on the admin API, and "micro-dns dump", write the
+// records the server holds right now in zone file form: the zone files as
+// loaded and changed since, and what every other source (Kubernetes,
+// Docker, KV, DHCP leases, ACME, ...) contributed. Each source is a
+// section headed by a "; source" comment, so the dump shows where a name's
+// records come from; the output loads back as a zone file. source= keeps
+// one source, name= one owner name and view= dumps a view's records.
+
+// sources returns a copy of the store's sources by name. The record maps
+// themselves are shared and must not be modified.
+func (s *recordStore) sourceSets() map[string]map[string][]Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]map[string][]Record, len(s.sources))
+	for name, recs := range s.sources {
+		out[name] = recs
+	}
+	return out
+}
+
+// writeDump writes the records of the matching sources and names to w.
+func writeDump(w io.Writer, store *recordStore, source, name string) {
+	srcs := store.sourceSets()
+	names := make([]string, 0, len(srcs))
+	for n := range srcs {
+		if source == "" || n == source {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	for _, src := range names {
+		recs := srcs[src]
+		owners := make([]string, 0, len(recs))
+		for owner := range recs {
+			if name == "" || owner == name {
+				owners = append(owners, owner)
+			}
+		}
+		if len(owners) == 0 {
+			continue
+		}
+		sort.Strings(owners)
+		fmt.Fprintf(w, "; source %s\n", src)
+		for _, owner := range owners {
+			for _, rec := range recs[owner] {
+				if rec.Type == "TXT" && rec.Data == "" {
+					// Generated TXT records only carry their strings.
+					quoted := make([]string, len(rec.Strings))
+					for i, t := range rec.Strings {
+						quoted[i] = strconv.Quote(t)
+					}
+					rec.Data = strings.Join(quoted, " ")
+				}
+				fmt.Fprintln(w, formatZoneLine(owner, rec))
+			}
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+func handleDump(w http.ResponseWriter, r *http.Request) {
+	store := records
+	if v := r.URL.Query().Get("view"); v != "" {
+		store = nil
+		for _, view := range views {
+			if view.name == v {
+				store = view.store
+			}
+		}
+		if store == nil {
+			http.Error(w, "no view "+v, http.StatusNotFound)
+			return
+		}
+	}
+	name := r.URL.Query().Get("name")
+	if name != "" {
+		name = dns.CanonicalName(name)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	writeDump(w, store, r.URL.Query().Get("source"), name)
+}
+
+// runDump implements "micro-dns dump": it fetches /records/dump from a
+// running server and writes it to stdout or -o.
+func runDump(args []string) int {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "Config file to take the admin address and token from")
+	admin := fs.String("admin", "", "Admin API address (default: admin.listen from the config)")
+	source := fs.String("source", "", "Dump only this record source (zone, kubernetes, docker, kv, dhcp, ...)")
+	name := fs.String("name", "", "Dump only this owner name")
+	view := fs.String("view", "", "Dump this view's records")
+	out := fs.String("o", "", "Write to this file instead of stdout")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: micro-dns dump [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+
+	cfg := &Config{}
+	if data, err := os.ReadFile(*configPath); err == nil {
+		yaml.Unmarshal(data, cfg)
+	}
+	if *admin == "" {
+		*admin = cfg.Admin.Listen
+	}
+	if *admin == "" {
+		fmt.Fprintln(os.Stderr, "dump: no admin address given and none configured")
+		return 1
+	}
+	token := cfg.Admin.Token
+	if t := os.Getenv("MICRODNS_ADMIN_TOKEN"); t != "" {
+		token = t
+	}
+	if !strings.Contains(*admin, "://") {
+		*admin = "http://" + *admin
+	}
+	q := url.Values{}
+	for k, v := range map[string]string{"source": *source, "name": *name, "view": *view} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	req, err := http.NewRequest("GET", strings.TrimSuffix(*admin, "/")+"/records/dump?"+q.Encode(), nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dump: %v\n", err)
+		return 1
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dump: %v\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		fmt.Fprintf(os.Stderr, "dump: %s: %s\n", resp.Status, strings.TrimSpace(string(msg)))
+		return 1
+	}
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "dump: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		fmt.Fprintf(os.Stderr, "dump: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// EDNS Client Subnet (RFC 7871) towards the upstreams. With
+// edns.options.ecs set to "pass", a client's own subnet option is
+// forwarded; "attach" also makes one from the client's address when it
+// sent none, so CDNs can pick a nearby edge. Either way the subnet is cut
+// to client_subnet's prefix lengths first, and cached answers are scoped
+// to that subnet unless the upstream said they hold for everyone (scope
+// /0). "strip" and "local" keep the client's address to this server.
+
+// ClientSubnetConfig sets how much of a client's address upstreams see.
+type ClientSubnetConfig struct {
+	IPv4Prefix int `yaml:"ipv4_prefix"` // default 24
+	IPv6Prefix int `yaml:"ipv6_prefix"` // default 56
+}
+
+const ednsAttach = "attach"
+
+const (
+	defaultECSIPv4Prefix = 24
+	defaultECSIPv6Prefix = 56
+)
+
+func setupClientSubnet() error {
+	cfg := &config.EDNS.ClientSubnet
+	if cfg.IPv4Prefix == 0 {
+		cfg.IPv4Prefix = defaultECSIPv4Prefix
+	}
+	if cfg.IPv6Prefix == 0 {
+		cfg.IPv6Prefix = defaultECSIPv6Prefix
+	}
+	if cfg.IPv4Prefix < 0 || cfg.IPv4Prefix > 32 {
+		return fmt.Errorf("edns.client_subnet.ipv4_prefix: %d is not between 0 and 32", cfg.IPv4Prefix)
+	}
+	if cfg.IPv6Prefix < 0 || cfg.IPv6Prefix > 128 {
+		return fmt.Errorf("edns.client_subnet.ipv6_prefix: %d is not between 0 and 128", cfg.IPv6Prefix)
+	}
+	return nil
+}
+
+// forwardsSubnet reports whether client subnets go upstream.
+func forwardsSubnet() bool {
+	action := ednsAction(dns.EDNS0SUBNET)
+	return action == ednsPass || action == ednsAttach
+}
+
+// requestSubnet returns the client subnet option of m, if any.
+func requestSubnet(m *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+	return nil
+}
+
+// subnetRequest returns r as it is to be forwarded and cached: carrying
+// the subnet upstreams may see, if any. r itself is left untouched.
+func subnetRequest(r *dns.Msg, client net.IP) *dns.Msg {
+	if !forwardsSubnet() {
+		return r
+	}
+	subnet := requestSubnet(r)
+	var addr net.IP
+	var family uint16
+	var bits int
+	switch {
+	case subnet != nil && subnet.Family != 0:
+		addr, family, bits = subnet.Address, subnet.Family, int(subnet.SourceNetmask)
+	case subnet != nil:
+		// Family 0 is the client asking for its address to stay private.
+		return r
+	case ednsAction(dns.EDNS0SUBNET) == ednsAttach && client != nil:
+		addr, family, bits = client, 1, 32
+		if client.To4() == nil {
+			family, bits = 2, 128
+		}
+	default:
+		return r
+	}
+	limit := config.EDNS.ClientSubnet.IPv4Prefix
+	size := 32
+	if family == 2 {
+		limit, size = config.EDNS.ClientSubnet.IPv6Prefix, 128
+	} else {
+		addr = addr.To4()
+	}
+	if addr == nil {
+		return r
+	}
+	bits = min(bits, limit)
+	trimmed := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        family,
+		SourceNetmask: uint8(bits),
+		Address:       addr.Mask(net.CIDRMask(bits, size)),
+	}
+
+	fr := r.Copy()
+	opt := fr.IsEdns0()
+	if opt == nil {
+		fr.SetEdns0(config.EDNS.UDPSize, false)
+		opt = fr.IsEdns0()
+	}
+	options := opt.Option[:0:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0SUBNET {
+			options = append(options, o)
+		}
+	}
+	opt.Option = append(options, trimmed)
+	return fr
+}
+
+// subnetKey is the cache key suffix of a request forwarded with a subnet.
+func subnetKey(r *dns.Msg) string {
+	if !forwardsSubnet() {
+		return ""
+	}
+	subnet := requestSubnet(r)
+	if subnet == nil || subnet.Family == 0 {
+		return ""
+	}
+	return fmt.Sprintf("/ecs=%s/%d", subnet.Address, subnet.SourceNetmask)
+}
+
+// responseScope is the prefix length an upstream said its answer holds
+// for; 0, for everyone, when it sent no subnet back.
+func responseScope(resp *dns.Msg) uint8 {
+	if subnet := requestSubnet(resp); subnet != nil {
+		return subnet.SourceScope
+	}
+	return 0
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// withECS sets edns.options.ecs to action.
+func withECS(t *testing.T, action string) {
+	t.Helper()
+	old, oldPolicy := *config, ednsPolicy
+	t.Cleanup(func() { *config, ednsPolicy = old, oldPolicy })
+	ednsPolicy = map[uint16]string{}
+	config.EDNS = EDNSConfig{Options: map[string]string{"ecs": action}}
+	if err := setupEDNS(); err != nil {
+		t.Fatal(err)
+	}
+	if err := setupClientSubnet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func subnetQuestion(family uint16, addr string, bits uint8) *dns.Msg {
+	r := testQuestion("www.example.com.", dns.TypeA)
+	r.SetEdns0(1232, false)
+	opt := r.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code: dns.EDNS0SUBNET, Family: family, SourceNetmask: bits, Address: net.ParseIP(addr),
+	})
+	return r
+}
+
+func TestSubnetRequest(t *testing.T) {
+	withECS(t, "attach")
+	client := net.ParseIP("198.51.100.77")
+
+	for _, tc := range []struct {
+		name string
+		r    *dns.Msg
+		key  string
+	}{
+		{"attached from the client", testQuestion("www.example.com.", dns.TypeA), "/ecs=198.51.100.0/24"},
+		{"client's /16 kept", subnetQuestion(1, "203.0.113.0", 16), "/ecs=203.0.0.0/16"},
+		{"client's /32 cut", subnetQuestion(1, "203.0.113.9", 32), "/ecs=203.0.113.0/24"},
+		{"IPv6 cut to /56", subnetQuestion(2, "2001:db8:1:2ff::1", 64), "/ecs=2001:db8:1:200::/56"},
+		{"family 0 kept private", subnetQuestion(0, "0.0.0.0", 0), ""},
+	} {
+		fr := subnetRequest(tc.r, client)
+		if got := subnetKey(fr); got != tc.key {
+			t.Errorf("%s: key %q, want %q", tc.name, got, tc.key)
+		}
+		if tc.key != "" && fr == tc.r {
+			t.Errorf("%s: request changed in place", tc.name)
+		}
+	}
+
+	// Without a client subnet option, "pass" sends none.
+	withECS(t, "pass")
+	r := testQuestion("www.example.com.", dns.TypeA)
+	if fr := subnetRequest(r, client); fr != r || requestSubnet(fr) != nil {
+		t.Error("pass attached a subnet")
+	}
+	withECS(t, "strip")
+	r = subnetQuestion(1, "203.0.113.0", 24)
+	if fr := subnetRequest(r, client); fr != r || subnetKey(fr) != "" {
+		t.Error("strip forwarded the subnet")
+	}
+
+	config.EDNS.ClientSubnet = ClientSubnetConfig{IPv4Prefix: 33}
+	if err := setupClientSubnet(); err == nil {
+		t.Error("IPv4 prefix /33 accepted")
+	}
+}
+
+func TestCacheSubnetScope(t *testing.T) {
+	withECS(t, "attach")
+	c := newTestCache(t, 10)
+	q := testQuestion("www.example.com.", dns.TypeA)
+	here := subnetRequest(q, net.ParseIP("198.51.100.77"))
+	there := subnetRequest(q, net.ParseIP("203.0.113.9"))
+
+	reply := func(r *dns.Msg, scope uint8, ip string) *dns.Msg {
+		resp := new(dns.Msg).SetReply(r)
+		resp.Answer = []dns.RR{mustRR(t, "www.example.com. 300 IN A "+ip)}
+		subnet := *requestSubnet(r)
+		subnet.SourceScope = scope
+		resp.SetEdns0(1232, false)
+		resp.IsEdns0().Option = []dns.EDNS0{&subnet}
+		return resp
+	}
+
+	// An answer scoped to the subnet is only for that subnet.
+	c.storePositive(here, reply(here, 24, "192.0.2.1"))
+	if got := c.lookup(here); got == nil || got.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Errorf("same subnet: %v", got)
+	}
+	if got := c.lookup(there); got != nil {
+		t.Errorf("another subnet got %v", got.Answer)
+	}
+
+	// Scope /0 holds for every client.
+	other := testQuestion("static.example.com.", dns.TypeA)
+	otherHere := subnetRequest(other, net.ParseIP("198.51.100.77"))
+	resp := reply(otherHere, 0, "192.0.2.2")
+	resp.Answer[0].Header().Name = "static.example.com."
+	c.storePositive(otherHere, resp)
+	if got := c.lookup(subnetRequest(other, net.ParseIP("203.0.113.9"))); got == nil {
+		t.Error("scope /0 answer not shared")
+	}
+	if got := c.lookupStale(subnetRequest(other, net.ParseIP("203.0.113.9"))); got == nil {
+		t.Error("scope /0 answer not served stale to another subnet")
+	}
+}
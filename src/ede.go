@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// Extended DNS errors (RFC 8914). An answer this server held back, made
+// up, or couldn't get carries an EDE option saying why, for clients that
+// use EDNS: "Blocked" with the policy zone or rule that blocked the name,
+// "Forged Answer" for a rule's rewrite, "Stale Answer" from the stale
+// cache, "No Reachable Authority" or "Network Error" when forwarding
+// failed, and so on. With log_level debug every query is also logged with
+// where its answer came from.
+
+// set records where the answer came from.
+func (t *answerTrace) set(via string) {
+	t.via, t.ede = via, nil
+	t.stage(via, "")
+}
+
+// explain records where the answer came from and the EDE that says why it
+// isn't an ordinary one.
+func (t *answerTrace) explain(via string, code uint16, text string) {
+	t.via, t.ede = via, &dns.EDNS0_EDE{InfoCode: code, ExtraText: text}
+	t.stage(via, dns.ExtendedErrorCodeToString[code])
+}
+
+// attach adds the trace's EDE to resp, which has been through finishEDNS.
+func (t *answerTrace) attach(resp *dns.Msg) {
+	if t.ede != nil {
+		attachEDE(resp, t.ede.InfoCode, t.ede.ExtraText)
+	}
+}
+
+// attachEDE adds an EDE option to resp's OPT record. A response without
+// one goes to a client that didn't use EDNS and gets none.
+func attachEDE(resp *dns.Msg, code uint16, text string) {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return
+	}
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_EDE); ok && e.InfoCode == code {
+			return // the upstream said so already
+		}
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: code, ExtraText: text})
+}
+
+// refusedEDE finishes a response refused by policy: REFUSED with a
+// "Prohibited" EDE.
+func refusedEDE(r, m *dns.Msg, text string) {
+	finishEDNS(r, m)
+	attachEDE(m, dns.ExtendedErrorCodeProhibited, text)
+}
+
+// forwardFailureEDE picks the EDE for a failed forward.
+func forwardFailureEDE(err error) (uint16, string) {
+	switch {
+	case errors.Is(err, errBogus):
+		return dns.ExtendedErrorCodeDNSBogus, ""
+	case errors.Is(err, errForwardBusy):
+		return dns.ExtendedErrorCodeOther, "too many queries in flight"
+	case isTimeout(err) || errors.Is(err, context.DeadlineExceeded):
+		return dns.ExtendedErrorCodeNoReachableAuthority, "no upstream answered"
+	default:
+		return dns.ExtendedErrorCodeNetworkError, "upstreams unreachable"
+	}
+}
+
+// label names the rule in logs and EDE text.
+func (r *rule) label() string {
+	switch {
+	case r.Name != "":
+		return r.Name
+	case len(r.Names) > 0:
+		return r.Names[0]
+	default:
+		return fmt.Sprintf("/%s/", r.Regex)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// EDNSConfig decides what happens to each EDNS option. "pass" forwards the
+// client's option upstream and relays the upstream's answer to it, "strip"
+// removes it in both directions, and "local" answers it from this server.
+type EDNSConfig struct {
+	UDPSize uint16            `yaml:"udp_size"`
+	NSID    string            `yaml:"nsid"`
+	Options map[string]string `yaml:"options"` // ecs, cookie, padding, nsid, unknown
+	Cookies CookieConfig      `yaml:"cookies"`
+
+	ClientSubnet ClientSubnetConfig `yaml:"client_subnet"`
+}
+
+const (
+	ednsPass  = "pass"
+	ednsStrip = "strip"
+	ednsLocal = "local"
+)
+
+const (
+	defaultUDPSize = 1232
+	paddingBlock   = 468 // RFC 8467 recommended response block size
+)
+
+// ednsOptionNames maps config keys to option codes; everything else falls
+// under "unknown".
+var ednsOptionNames = map[string]uint16{
+	"ecs":     dns.EDNS0SUBNET,
+	"cookie":  dns.EDNS0COOKIE,
+	"padding": dns.EDNS0PADDING,
+	"nsid":    dns.EDNS0NSID,
+}
+
+// ednsLocalCapable lists the options this server can answer itself.
+var ednsLocalCapable = map[string]bool{
+	"ecs":     true, // read for GeoIP, never forwarded
+	"cookie":  true,
+	"padding": true,
+	"nsid":    true,
+}
+
+var ednsPolicy = map[uint16]string{}
+var ednsUnknownPolicy = ednsStrip
+
+func setupEDNS() error {
+	cfg := &config.EDNS
+	if cfg.UDPSize == 0 {
+		cfg.UDPSize = defaultUDPSize
+	}
+	for name, action := range cfg.Options {
+		name = strings.ToLower(name)
+		action = strings.ToLower(action)
+		if action == ednsAttach && name == "ecs" {
+			ednsPolicy[dns.EDNS0SUBNET] = action
+			continue
+		}
+		if action != ednsPass && action != ednsStrip && action != ednsLocal {
+			if name == "ecs" {
+				return fmt.Errorf("edns.options.ecs: unknown action %q (want pass, attach, strip or local)", action)
+			}
+			return fmt.Errorf("edns.options.%s: unknown action %q (want pass, strip or local)", name, action)
+		}
+		if action == ednsLocal && !ednsLocalCapable[name] {
+			return fmt.Errorf("edns.options.%s: cannot be answered locally", name)
+		}
+		if name == "unknown" {
+			ednsUnknownPolicy = action
+			continue
+		}
+		code, ok := ednsOptionNames[name]
+		if !ok {
+			return fmt.Errorf("edns.options: unknown option %q", name)
+		}
+		ednsPolicy[code] = action
+	}
+	if ednsPolicy[dns.EDNS0NSID] == ednsLocal && cfg.NSID == "" {
+		return fmt.Errorf("edns.options.nsid is local but edns.nsid is empty")
+	}
+	return nil
+}
+
+func ednsAction(code uint16) string {
+	if action, ok := ednsPolicy[code]; ok {
+		return action
+	}
+	for _, known := range ednsOptionNames {
+		if known == code {
+			return ednsStrip
+		}
+	}
+	return ednsUnknownPolicy
+}
+
+// filterOptions keeps the options whose policy is "pass", and a client
+// subnet being attached.
+func filterOptions(opts []dns.EDNS0) []dns.EDNS0 {
+	var kept []dns.EDNS0
+	for _, o := range opts {
+		if action := ednsAction(o.Option()); action == ednsPass || action == ednsAttach {
+			kept = append(kept, o)
+		}
+	}
+	return kept
+}
+
+// checkEDNS applies the RFC 6891 rules to a request's OPT record, and the
+// option-specific ones to the options this server reads or relays. It
+// returns the rcode to refuse r with, or RcodeSuccess. Unknown options are
+// fine; they fall under the "unknown" policy.
+func checkEDNS(r *dns.Msg) (rcode int, reason string) {
+	for _, rr := range append(r.Answer, r.Ns...) {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			return dns.RcodeFormatError, "OPT record outside the additional section"
+		}
+	}
+	var opt *dns.OPT
+	for _, rr := range r.Extra {
+		if o, ok := rr.(*dns.OPT); ok {
+			if opt != nil {
+				return dns.RcodeFormatError, "more than one OPT record"
+			}
+			opt = o
+		}
+	}
+	if opt == nil {
+		return dns.RcodeSuccess, ""
+	}
+	if opt.Hdr.Name != "." {
+		return dns.RcodeFormatError, fmt.Sprintf("OPT owner %q is not the root", opt.Hdr.Name)
+	}
+	if v := opt.Version(); v != 0 {
+		return dns.RcodeBadVers, fmt.Sprintf("EDNS version %d", v)
+	}
+	for _, o := range opt.Option {
+		switch o := o.(type) {
+		case *dns.EDNS0_COOKIE:
+			// RFC 7873: an 8-byte client cookie, optionally followed by
+			// an 8 to 32 byte server cookie.
+			if n := len(o.Cookie) / 2; n != 8 && (n < 16 || n > 40) {
+				return dns.RcodeFormatError, fmt.Sprintf("cookie of %d bytes", n)
+			}
+		case *dns.EDNS0_SUBNET:
+			if err := checkSubnet(o); err != nil {
+				return dns.RcodeFormatError, err.Error()
+			}
+		}
+	}
+	return dns.RcodeSuccess, ""
+}
+
+// checkSubnet applies RFC 7871 7.1.2 to a query's client subnet: no scope,
+// and no address bits beyond the source prefix.
+func checkSubnet(o *dns.EDNS0_SUBNET) error {
+	if o.SourceScope != 0 {
+		return fmt.Errorf("client subnet with scope /%d in a query", o.SourceScope)
+	}
+	addr := o.Address
+	bits := 128
+	if o.Family == 1 {
+		addr, bits = addr.To4(), 32
+	}
+	if o.Family != 0 && !addr.Mask(net.CIDRMask(int(o.SourceNetmask), bits)).Equal(addr) {
+		return fmt.Errorf("client subnet %s has bits set beyond /%d", o.Address, o.SourceNetmask)
+	}
+	return nil
+}
+
+// logInvalidMsg notes messages the DNS library could not parse. It has
+// already answered them with FORMERR (or nothing, for non-queries).
+func logInvalidMsg(m []byte, err error) {
+	malformed.note("Malformed message of %d bytes: %v", len(m), err)
+}
+
+// upstreamQuery returns a copy of r with its OPT record filtered for
+// forwarding. r itself is left untouched.
+func upstreamQuery(r *dns.Msg) *dns.Msg {
+	q := r.Copy()
+	if opt := q.IsEdns0(); opt != nil {
+		opt.Option = filterOptions(opt.Option)
+	}
+	return q
+}
+
+// finishEDNS gives resp an OPT record matching the client's request: options
+// relayed from upstream are filtered by policy and locally answered options
+// are added. Responses to clients that didn't use EDNS carry no OPT.
+func finishEDNS(req, resp *dns.Msg) {
+	reqOpt := req.IsEdns0()
+	scope := responseScope(resp)
+	var relayed []dns.EDNS0
+	for i := len(resp.Extra) - 1; i >= 0; i-- {
+		if opt, ok := resp.Extra[i].(*dns.OPT); ok {
+			// The upstream's client subnet answers the one sent to it,
+			// which may differ from the client's; it is echoed below.
+			for _, o := range filterOptions(opt.Option) {
+				if o.Option() != dns.EDNS0SUBNET {
+					relayed = append(relayed, o)
+				}
+			}
+			resp.Extra = append(resp.Extra[:i], resp.Extra[i+1:]...)
+		}
+	}
+	if reqOpt == nil {
+		return
+	}
+
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	opt.SetUDPSize(config.EDNS.UDPSize)
+	opt.SetDo(reqOpt.Do())
+	opt.Option = relayed
+
+	asked := make(map[uint16]bool)
+	for _, o := range reqOpt.Option {
+		asked[o.Option()] = true
+	}
+	if asked[dns.EDNS0NSID] && ednsAction(dns.EDNS0NSID) == ednsLocal {
+		opt.Option = append(opt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: hex.EncodeToString([]byte(config.EDNS.NSID))})
+	}
+	if subnet := requestSubnet(req); subnet != nil && (forwardsSubnet() || ednsAction(dns.EDNS0SUBNET) == ednsLocal) {
+		// RFC 7871: echo the subnet with the scope the answer holds
+		// for: the upstream's for forwarded answers, and when GeoIP is
+		// on, the whole subnet for local ones, which may differ by
+		// location.
+		echo := *subnet
+		echo.SourceScope = 0
+		if forwardsSubnet() {
+			echo.SourceScope = min(scope, subnet.SourceNetmask)
+		} else if geoDB.Load() != nil {
+			echo.SourceScope = subnet.SourceNetmask
+		}
+		opt.Option = append(opt.Option, &echo)
+	}
+	resp.Extra = append(resp.Extra, opt)
+
+	if asked[dns.EDNS0PADDING] && ednsAction(dns.EDNS0PADDING) == ednsLocal {
+		padResponse(resp, opt)
+	}
+}
+
+// padResponse pads resp to a multiple of the RFC 8467 block size.
+func padResponse(resp *dns.Msg, opt *dns.OPT) {
+	const optionHeader = 4
+	size := resp.Len() + optionHeader
+	pad := (paddingBlock - size%paddingBlock) % paddingBlock
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, pad)})
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// recordingWriter is a dns.ResponseWriter that keeps what is written.
+type recordingWriter struct {
+	remote  net.Addr
+	written []*dns.Msg
+}
+
+func (w *recordingWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (w *recordingWriter) RemoteAddr() net.Addr {
+	if w.remote == nil {
+		return &net.UDPAddr{IP: net.IPv4(192, 0, 2, 7), Port: 40000}
+	}
+	return w.remote
+}
+
+func (w *recordingWriter) WriteMsg(m *dns.Msg) error {
+	w.written = append(w.written, m)
+	return nil
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.written = append(w.written, m)
+	return len(b), nil
+}
+
+func (w *recordingWriter) Close() error        { return nil }
+func (w *recordingWriter) TsigStatus() error   { return nil }
+func (w *recordingWriter) TsigTimersOnly(bool) {}
+func (w *recordingWriter) Hijack()             {}
+
+// Wire-form pieces of the test queries, in hex.
+const (
+	wireQuestion = "076578616d706c6503636f6d0000010001" // example.com. IN A
+	wireRoot     = "00"
+	wireCom      = "03636f6d00"
+)
+
+// wireOPT is an OPT record advertising 1232 bytes, with the given owner,
+// EDNS version and options.
+func wireOPT(owner string, version byte, options ...string) string {
+	rdata := strings.Join(options, "")
+	return fmt.Sprintf("%s002904d000%02x0000%04x%s", owner, version, len(rdata)/2, rdata)
+}
+
+// wireOption is one EDNS option.
+func wireOption(code uint16, data string) string {
+	return fmt.Sprintf("%04x%04x%s", code, len(data)/2, data)
+}
+
+// wireQuery is a recursive query for example.com. A followed by records,
+// counted as an answer, authority and additional records.
+func wireQuery(an, ns, ar int, records ...string) string {
+	return fmt.Sprintf("12340100 0001%04x%04x%04x", an, ns, ar) + wireQuestion + strings.Join(records, "")
+}
+
+// Packets seen from real clients and middleboxes, and ones built to break
+// the rules of RFC 6891, 7873 and 7871.
+var ednsCorpus = []struct {
+	name  string
+	wire  string
+	rcode int
+}{
+	{"no EDNS", wireQuery(0, 0, 0), dns.RcodeSuccess},
+	{"plain OPT", wireQuery(0, 0, 1, wireOPT(wireRoot, 0)), dns.RcodeSuccess},
+	{"two OPT records", wireQuery(0, 0, 2, wireOPT(wireRoot, 0), wireOPT(wireRoot, 0)), dns.RcodeFormatError},
+	{"OPT owned by com.", wireQuery(0, 0, 1, wireOPT(wireCom, 0)), dns.RcodeFormatError},
+	{"OPT in the answer section", wireQuery(1, 0, 0, wireOPT(wireRoot, 0)), dns.RcodeFormatError},
+	{"OPT in the authority section", wireQuery(0, 1, 0, wireOPT(wireRoot, 0)), dns.RcodeFormatError},
+	{"EDNS version 1", wireQuery(0, 0, 1, wireOPT(wireRoot, 1)), dns.RcodeBadVers},
+	{"EDNS version 255", wireQuery(0, 0, 1, wireOPT(wireRoot, 255)), dns.RcodeBadVers},
+	{"unknown option", wireQuery(0, 0, 1, wireOPT(wireRoot, 0, wireOption(0xfde9, "c0ffee"))), dns.RcodeSuccess},
+	{"client cookie", wireQuery(0, 0, 1, wireOPT(wireRoot, 0, wireOption(dns.EDNS0COOKIE, "0102030405060708"))), dns.RcodeSuccess},
+	{"client and server cookie", wireQuery(0, 0, 1, wireOPT(wireRoot, 0, wireOption(dns.EDNS0COOKIE, "0102030405060708"+"1112131415161718"))), dns.RcodeSuccess},
+	{"cookie of 5 bytes", wireQuery(0, 0, 1, wireOPT(wireRoot, 0, wireOption(dns.EDNS0COOKIE, "0102030405"))), dns.RcodeFormatError},
+	{"cookie of 12 bytes", wireQuery(0, 0, 1, wireOPT(wireRoot, 0, wireOption(dns.EDNS0COOKIE, "010203040506070811121314"))), dns.RcodeFormatError},
+	{"server cookie of 33 bytes", wireQuery(0, 0, 1, wireOPT(wireRoot, 0, wireOption(dns.EDNS0COOKIE, "0102030405060708"+strings.Repeat("aa", 33)))), dns.RcodeFormatError},
+	{"client subnet /24", wireQuery(0, 0, 1, wireOPT(wireRoot, 0, wireOption(dns.EDNS0SUBNET, "00011800c00002"))), dns.RcodeSuccess},
+	{"client subnet /0", wireQuery(0, 0, 1, wireOPT(wireRoot, 0, wireOption(dns.EDNS0SUBNET, "00010000"))), dns.RcodeSuccess},
+	{"client subnet with a scope", wireQuery(0, 0, 1, wireOPT(wireRoot, 0, wireOption(dns.EDNS0SUBNET, "00011810c00002"))), dns.RcodeFormatError},
+	{"client subnet /16 with host bits", wireQuery(0, 0, 1, wireOPT(wireRoot, 0, wireOption(dns.EDNS0SUBNET, "00011000c00002"))), dns.RcodeFormatError},
+	{"IPv6 client subnet /32 with host bits", wireQuery(0, 0, 1, wireOPT(wireRoot, 0, wireOption(dns.EDNS0SUBNET, "0002200020010db8ff"))), dns.RcodeFormatError},
+	{"IPv6 client subnet /56", wireQuery(0, 0, 1, wireOPT(wireRoot, 0, wireOption(dns.EDNS0SUBNET, "0002380020010db8000100"))), dns.RcodeSuccess},
+}
+
+func TestCheckEDNS(t *testing.T) {
+	for _, tt := range ednsCorpus {
+		t.Run(tt.name, func(t *testing.T) {
+			r := new(dns.Msg)
+			if err := r.Unpack(mustHex(t, strings.ReplaceAll(tt.wire, " ", ""))); err != nil {
+				t.Fatalf("unpack: %v", err)
+			}
+			if rcode, reason := checkEDNS(r); rcode != tt.rcode {
+				t.Errorf("got %s (%s), want %s", dns.RcodeToString[rcode], reason, dns.RcodeToString[tt.rcode])
+			}
+		})
+	}
+}
+
+// BADVERS is an extended rcode, so the reply must carry an OPT record.
+func TestBadVersReply(t *testing.T) {
+	r := new(dns.Msg)
+	if err := r.Unpack(mustHex(t, strings.ReplaceAll(wireQuery(0, 0, 1, wireOPT(wireRoot, 1)), " ", ""))); err != nil {
+		t.Fatal(err)
+	}
+	w := &recordingWriter{}
+	serveEDNSCheck(&Query{W: w, R: r, Client: net.IPv4(192, 0, 2, 7), Listener: "test"}, func(*Query) {
+		t.Error("the query went on down the chain")
+	})
+	if len(w.written) != 1 {
+		t.Fatalf("%d replies written", len(w.written))
+	}
+	wire, err := w.written[0].Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := new(dns.Msg)
+	if err := reply.Unpack(wire); err != nil {
+		t.Fatal(err)
+	}
+	opt := reply.IsEdns0()
+	if reply.Rcode != dns.RcodeBadVers || opt == nil || opt.Version() != 0 {
+		t.Errorf("reply rcode %d, OPT %v; want BADVERS with a version 0 OPT", reply.Rcode, opt)
+	}
+	if got := hex.EncodeToString(wire[:2]); got != "1234" {
+		t.Errorf("reply ID %s", got)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// FingerprintConfig tags clients with their probable OS or device type,
+// guessed from names only some systems look up: connectivity checks, WPAD,
+// domain controller discovery, vendor update and telemetry hosts. The tags
+// show up under "clients" in /stats to help spot unknown devices; they are
+// heuristics, not identification.
+type FingerprintConfig struct {
+	Enabled    bool              `yaml:"enabled"`
+	Rules      []FingerprintRule `yaml:"rules"`       // checked before the built-in ones
+	MaxClients int               `yaml:"max_clients"` // default 4096; the least recently seen are dropped
+}
+
+// FingerprintRule tags clients that look up any of Names (globs).
+type FingerprintRule struct {
+	Names []string `yaml:"names"`
+	Tag   string   `yaml:"tag"`
+}
+
+const defaultFingerprintClients = 4096
+
+// builtinFingerprints are the names that give a client away.
+var builtinFingerprints = []FingerprintRule{
+	{Tag: "windows", Names: []string{
+		"www.msftconnecttest.com.", "www.msftncsi.com.", "dns.msftncsi.com.",
+		"*.windowsupdate.com.", "settings-win.data.microsoft.com.",
+		"wpad.*", "_ldap._tcp.dc._msdcs.*",
+	}},
+	{Tag: "apple", Names: []string{
+		"captive.apple.com.", "mesu.apple.com.", "*.push.apple.com.", "gs.apple.com.",
+	}},
+	{Tag: "android", Names: []string{
+		"connectivitycheck.gstatic.com.", "connectivitycheck.android.com.",
+		"android.clients.google.com.", "clients3.google.com.",
+	}},
+	{Tag: "linux", Names: []string{
+		"connectivity-check.ubuntu.com.", "nmcheck.gnome.org.",
+		"network-test.debian.org.", "fedoraproject.org.", "ntp.ubuntu.com.",
+	}},
+	{Tag: "chromeos", Names: []string{"*.chromeos.gvt1.com."}},
+	{Tag: "playstation", Names: []string{"*.playstation.net."}},
+	{Tag: "xbox", Names: []string{"*.xboxlive.com."}},
+	{Tag: "nintendo", Names: []string{"*.nintendo.net."}},
+	{Tag: "roku", Names: []string{"*.roku.com."}},
+	{Tag: "amazon-device", Names: []string{"device-metrics-us.amazon.com.", "*.amazonalexa.com."}},
+	{Tag: "iot", Names: []string{"*.tuyaus.com.", "*.tuyaeu.com.", "*.meethue.com."}},
+}
+
+type clientPrint struct {
+	evidence map[string]uint64 // tag -> matching queries
+	lastSeen time.Time
+}
+
+type fingerprinter struct {
+	rules []FingerprintRule
+	max   int
+
+	mu      sync.Mutex
+	clients map[string]*clientPrint
+}
+
+var fingerprints *fingerprinter
+
+func setupFingerprints() error {
+	cfg := config.Fingerprint
+	if !cfg.Enabled {
+		return nil
+	}
+	f := &fingerprinter{max: cfg.MaxClients, clients: make(map[string]*clientPrint)}
+	if f.max <= 0 {
+		f.max = defaultFingerprintClients
+	}
+	for i, r := range cfg.Rules {
+		if r.Tag == "" || len(r.Names) == 0 {
+			return fmt.Errorf("fingerprint.rules[%d]: names and tag are required", i)
+		}
+		rule := FingerprintRule{Tag: r.Tag}
+		for _, n := range r.Names {
+			glob := dns.Fqdn(strings.ToLower(n))
+			if _, err := path.Match(glob, ""); err != nil {
+				return fmt.Errorf("fingerprint.rules[%d].names: %v", i, err)
+			}
+			rule.Names = append(rule.Names, glob)
+		}
+		f.rules = append(f.rules, rule)
+	}
+	f.rules = append(f.rules, builtinFingerprints...)
+	fingerprints = f
+	return nil
+}
+
+// tagFor returns the tag for a query of name (lowercase, fully
+// qualified), or "".
+func (f *fingerprinter) tagFor(name string) string {
+	for _, r := range f.rules {
+		for _, glob := range r.Names {
+			if ok, _ := path.Match(glob, name); ok {
+				return r.Tag
+			}
+		}
+	}
+	return ""
+}
+
+// observe counts a query for name from client as evidence.
+func (f *fingerprinter) observe(client net.IP, name string) {
+	if client == nil {
+		return
+	}
+	tag := f.tagFor(name)
+	if tag == "" {
+		return
+	}
+	key := clientLabel(client)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, ok := f.clients[key]
+	if !ok {
+		if len(f.clients) >= f.max {
+			f.evictLocked()
+		}
+		c = &clientPrint{evidence: make(map[string]uint64)}
+		f.clients[key] = c
+	}
+	c.evidence[tag]++
+	c.lastSeen = time.Now()
+}
+
+// evictLocked drops the least recently seen client.
+func (f *fingerprinter) evictLocked() {
+	var oldest string
+	var t time.Time
+	for key, c := range f.clients {
+		if oldest == "" || c.lastSeen.Before(t) {
+			oldest, t = key, c.lastSeen
+		}
+	}
+	delete(f.clients, oldest)
+}
+
+type clientReport struct {
+	Client   string            `json:"client"`
+	Tag      string            `json:"tag"` // the tag with the most evidence
+	Evidence map[string]uint64 `json:"evidence"`
+	LastSeen time.Time         `json:"last_seen"`
+}
+
+func (f *fingerprinter) reports() []clientReport {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make([]clientReport, 0, len(f.clients))
+	for key, c := range f.clients {
+		r := clientReport{Client: key, Evidence: make(map[string]uint64), LastSeen: c.lastSeen.UTC()}
+		for tag, n := range c.evidence {
+			r.Evidence[tag] = n
+			if best := c.evidence[r.Tag]; r.Tag == "" || n > best || (n == best && tag < r.Tag) {
+				r.Tag = tag
+			}
+		}
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Client < out[j].Client })
+	return out
+}
@@ -0,0 +1,813 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ForwardConfig lists the upstreams queries are forwarded to and how they
+// are used. fallback_dns, if set, is the first upstream.
+//
+// "failover" asks the upstreams one at a time, fastest first; "race" sends
+// each query to the Race fastest upstreams at once and returns the first
+// usable answer.
+//
+// Connections to each upstream, UDP sockets included, are pooled and
+// reused. An attempt that times out is retried on the same upstream up to
+// Retries times before the strategy moves on.
+//
+// A forwarded query as a whole gets QueryTimeoutMs, across retries and
+// upstreams, and at most MaxInFlight are outstanding at once; past either
+// limit the client gets SERVFAIL straight away.
+//
+// RandomizeCase mixes the case of query names sent over UDP (0x20) and
+// drops replies that don't echo it exactly. QnameMinimization applies where
+// queries go to authoritative servers, stub zones: each server only learns
+// the next label of the name (RFC 9156). Upstream resolvers always get the
+// full name, which they need to resolve it.
+//
+// Domains sends queries for names in a domain to upstreams of its own
+// (conditional forwarding, e.g. a corporate domain to its resolvers) with
+// the same strategy; the closest enclosing domain wins. A domain with no
+// upstreams is local only: names in it that aren't in the local records
+// are NXDOMAIN rather than forwarded.
+//
+// SourceAddresses, Interface and Mark choose how outbound queries leave;
+// see setupOutbound. ODoHRelay is the relay Oblivious DoH upstreams are
+// reached through (see odoh.go).
+type ForwardConfig struct {
+	Upstreams   []string `yaml:"upstreams"`
+	Strategy    string   `yaml:"strategy"`     // failover (default) or race
+	Race        int      `yaml:"race"`         // upstreams raced per query, default 2
+	TimeoutMs   int      `yaml:"timeout_ms"`   // per attempt, default 2000
+	Retries     int      `yaml:"retries"`      // extra attempts after a timeout
+	PoolSize    int      `yaml:"pool_size"`    // idle connections kept per upstream, default 8
+	IdleTimeout int      `yaml:"idle_timeout"` // seconds before an idle connection is dropped, default 30
+
+	QueryTimeoutMs int `yaml:"query_timeout_ms"` // per forwarded query, default 5000
+	MaxInFlight    int `yaml:"max_in_flight"`    // forwarded queries outstanding at once, default 1000
+
+	SourceAddresses []string `yaml:"source_addresses"` // at most one IPv4 and one IPv6
+	Interface       string   `yaml:"interface"`        // Linux only
+	Mark            int      `yaml:"mark"`             // Linux only
+
+	ODoHRelay string `yaml:"odoh_relay"` // e.g. https://relay.example/proxy
+
+	RandomizeCase     bool `yaml:"randomize_case"`
+	QnameMinimization bool `yaml:"qname_minimization"`
+
+	ProbeInterval int    `yaml:"probe_interval"` // seconds between upstream probes, 0 = off
+	ProbeName     string `yaml:"probe_name"`     // asked for A, default a.root-servers.net
+
+	Domains map[string][]string `yaml:"domains"`
+}
+
+const (
+	strategyFailover = "failover"
+	strategyRace     = "race"
+
+	// rttDecay weighs a new sample in an upstream's smoothed RTT.
+	rttDecay = 0.3
+	// exploreRate is the share of queries that also try an upstream
+	// outside the current fastest set, so rankings can change.
+	exploreRate = 0.05
+)
+
+// Upstream transports, chosen by the scheme of the configured address.
+const (
+	protoUDP = "udp"
+	protoTCP = "tcp"
+	protoDoT = "tls"
+	protoDoH = "https"
+
+	protoDNSCrypt = "dnscrypt" // from an sdns:// stamp
+	protoODoH     = "odoh"
+)
+
+// upstream is one forwarding target and its observed performance.
+type upstream struct {
+	name  string // as configured
+	proto string
+	addr  string // host:port for udp, tcp, tls and dnscrypt
+	url   string // for https and odoh
+
+	client   *dns.Client      // for udp, tcp and tls
+	conns    chan *pooledConn // idle connections, most recently used last
+	http     *http.Client     // for https and odoh
+	dnscrypt *dnscryptServer
+	odoh     *odohTarget
+
+	rtt         atomic.Int64  // smoothed round-trip time in ns; 0 until measured
+	failRate    atomic.Uint64 // smoothed share of failed exchanges, float64 bits
+	queries     atomic.Uint64
+	failures    atomic.Uint64
+	probes      atomic.Uint64
+	probeFails  atomic.Uint64
+	spoofs      atomic.Uint64 // replies dropped by exchangeUDP
+	spoofLogged atomic.Int64  // unix second of the last spoof log line
+
+	cookieMu sync.Mutex
+	cookie   upstreamCookie
+}
+
+// pooledConn is an idle connection to an upstream.
+type pooledConn struct {
+	*dns.Conn
+	lastUsed time.Time
+	uses     int
+}
+
+// udpMaxUses retires a pooled UDP socket after this many queries so the
+// source port, and with it spoofing resistance, keeps changing.
+const udpMaxUses = 100
+
+// newUpstream parses an upstream address: "1.1.1.1", "udp://1.1.1.1:53",
+// "tcp://…", "tls://1.1.1.1" (DNS over TLS, port 853),
+// "https://dns.google/dns-query" (DNS over HTTPS),
+// "odoh://odoh.example/dns-query" (Oblivious DoH) or an "sdns://…" stamp
+// of a DNSCrypt server or an ODoH target.
+func newUpstream(spec string) (*upstream, error) {
+	cfg := config.Forward
+	timeout := time.Duration(cfg.TimeoutMs) * time.Millisecond
+	u := &upstream{name: spec, proto: protoUDP}
+	rest := spec
+	if scheme, after, ok := strings.Cut(spec, "://"); ok {
+		u.proto, rest = strings.ToLower(scheme), after
+	}
+	switch u.proto {
+	case protoUDP, protoTCP:
+		u.addr = withDefaultPort(rest, "53")
+		u.client = &dns.Client{Net: u.proto, Timeout: timeout, Dialer: outboundDialer(u.proto, u.addr, timeout)}
+		u.conns = make(chan *pooledConn, cfg.PoolSize)
+	case protoDoT:
+		u.addr = withDefaultPort(rest, "853")
+		u.client = &dns.Client{
+			Net:       "tcp-tls",
+			Timeout:   timeout,
+			Dialer:    outboundDialer("tcp", u.addr, timeout),
+			TLSConfig: &tls.Config{ServerName: hostOnly(u.addr), MinVersion: tls.VersionTLS12},
+		}
+		u.conns = make(chan *pooledConn, cfg.PoolSize)
+	case protoDoH:
+		parsed, err := url.Parse(spec)
+		if err != nil || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid DoH URL %q", spec)
+		}
+		u.url = spec
+		u.http = upstreamHTTPClient(timeout)
+	case "sdns":
+		stamp, err := parseStamp(spec)
+		if err != nil {
+			return nil, err
+		}
+		if stamp.proto == stampDNSCrypt {
+			u.proto, u.addr = protoDNSCrypt, stamp.addr
+			u.dnscrypt = newDNSCryptServer(stamp, timeout)
+			break
+		}
+		if err := u.setupODoH(stamp.odohURL, timeout); err != nil {
+			return nil, err
+		}
+	case protoODoH:
+		if err := u.setupODoH("https://"+rest, timeout); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown upstream scheme %q in %q", u.proto, spec)
+	}
+	return u, nil
+}
+
+// upstreamHTTPClient is the HTTP client of a DoH or ODoH upstream.
+func upstreamHTTPClient(timeout time.Duration) *http.Client {
+	cfg := config.Forward
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialOutbound(timeout),
+			ForceAttemptHTTP2:   true,
+			MaxIdleConnsPerHost: cfg.PoolSize,
+			IdleConnTimeout:     time.Duration(cfg.IdleTimeout) * time.Second,
+			TLSHandshakeTimeout: timeout,
+		},
+	}
+}
+
+// setupODoH makes u an Oblivious DoH upstream for target, through
+// forward.odoh_relay.
+func (u *upstream) setupODoH(target string, timeout time.Duration) error {
+	relay := config.Forward.ODoHRelay
+	if relay != "" {
+		if parsed, err := url.Parse(relay); err != nil || parsed.Scheme != "https" || parsed.Host == "" {
+			return fmt.Errorf("forward.odoh_relay: %q is not an https URL", relay)
+		}
+	}
+	u.proto, u.http = protoODoH, upstreamHTTPClient(timeout)
+	t, err := newODoHTarget(target, relay, u.http)
+	if err != nil {
+		return err
+	}
+	u.odoh, u.url = t, t.url
+	return nil
+}
+
+// upstreams is the current upstream list; a config reload replaces it.
+var upstreams atomic.Pointer[[]*upstream]
+
+// activeUpstreams returns the upstreams queries are forwarded to.
+func activeUpstreams() []*upstream {
+	if p := upstreams.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+// domainUpstreams holds forward.domains, by canonical domain name; a
+// config reload replaces it.
+var domainUpstreams atomic.Pointer[map[string][]*upstream]
+
+var errLocalDomain = errors.New("the name is in a local-only domain")
+
+// upstreamsFor returns the upstreams for name: those of the closest
+// forward.domains entry enclosing it, if any, else the default ones. ok is
+// false for a name in a local-only domain.
+func upstreamsFor(name string) (list []*upstream, ok bool) {
+	if p := domainUpstreams.Load(); p != nil && len(*p) > 0 {
+		name = dns.CanonicalName(name)
+		for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+			if list, found := (*p)[name[off:]]; found {
+				return list, len(list) > 0
+			}
+		}
+	}
+	return activeUpstreams(), true
+}
+
+// buildDomainUpstreams makes the upstreams of forward.domains, keeping
+// those of old that are still listed.
+func buildDomainUpstreams(domains map[string][]string, old map[string][]*upstream) (map[string][]*upstream, error) {
+	kept := make(map[string]*upstream)
+	for _, list := range old {
+		for _, u := range list {
+			kept[u.name] = u
+		}
+	}
+	out := make(map[string][]*upstream, len(domains))
+	for domain, specs := range domains {
+		origin := dns.CanonicalName(domain)
+		if _, ok := dns.IsDomainName(origin); !ok {
+			return nil, fmt.Errorf("forward.domains: invalid domain %q", domain)
+		}
+		list := []*upstream{}
+		for _, spec := range specs {
+			u := kept[spec]
+			if u == nil {
+				var err error
+				if u, err = newUpstream(spec); err != nil {
+					return nil, fmt.Errorf("forward.domains.%s: %v", domain, err)
+				}
+				kept[spec] = u
+			}
+			list = append(list, u)
+		}
+		out[origin] = list
+	}
+	return out, nil
+}
+
+// allDomainUpstreams lists each upstream of forward.domains once.
+func allDomainUpstreams() []*upstream {
+	var out []*upstream
+	if p := domainUpstreams.Load(); p != nil {
+		for _, list := range *p {
+			for _, u := range list {
+				if !containsUpstream(out, u) {
+					out = append(out, u)
+				}
+			}
+		}
+	}
+	return out
+}
+
+func setupForwarding() error {
+	cfg := &config.Forward
+	if config.FallbackDNS == "" {
+		if len(cfg.Domains) > 0 {
+			return fmt.Errorf("forward.domains needs forwarding (fallback_dns or forward.upstreams)")
+		}
+		return nil
+	}
+	if cfg.TimeoutMs <= 0 {
+		cfg.TimeoutMs = 2000
+	}
+	if cfg.Retries < 0 {
+		return fmt.Errorf("forward.retries must not be negative")
+	}
+	if cfg.PoolSize <= 0 {
+		cfg.PoolSize = 8
+	}
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = 30
+	}
+	if cfg.QueryTimeoutMs <= 0 {
+		cfg.QueryTimeoutMs = 5000
+	}
+	if cfg.MaxInFlight <= 0 {
+		cfg.MaxInFlight = 1000
+	}
+	forwardSlots = make(chan struct{}, cfg.MaxInFlight)
+
+	list, err := buildUpstreams(config.FallbackDNS, cfg.Upstreams, nil)
+	if err != nil {
+		return err
+	}
+	upstreams.Store(&list)
+	domains, err := buildDomainUpstreams(cfg.Domains, nil)
+	if err != nil {
+		return err
+	}
+	domainUpstreams.Store(&domains)
+
+	cfg.Strategy = strings.ToLower(cfg.Strategy)
+	switch cfg.Strategy {
+	case "":
+		cfg.Strategy = strategyFailover
+	case strategyFailover, strategyRace:
+	default:
+		return fmt.Errorf("forward.strategy must be failover or race, got %q", cfg.Strategy)
+	}
+	if cfg.Race <= 0 {
+		cfg.Race = 2
+	}
+	if cfg.ProbeInterval < 0 {
+		return fmt.Errorf("forward.probe_interval must not be negative")
+	}
+	if cfg.ProbeName == "" {
+		cfg.ProbeName = "a.root-servers.net."
+	}
+	cfg.ProbeName = dns.Fqdn(cfg.ProbeName)
+	if _, ok := dns.IsDomainName(cfg.ProbeName); !ok {
+		return fmt.Errorf("forward.probe_name: invalid name %q", cfg.ProbeName)
+	}
+	return nil
+}
+
+// buildUpstreams makes the upstream list for fallback and the others,
+// keeping the upstreams of old that are still listed, with their
+// connections and statistics.
+func buildUpstreams(fallback string, others []string, old []*upstream) ([]*upstream, error) {
+	kept := make(map[string]*upstream)
+	for _, u := range old {
+		kept[u.name] = u
+	}
+	var list []*upstream
+	seen := make(map[string]bool)
+	for _, spec := range append([]string{fallback}, others...) {
+		u := kept[spec]
+		if u == nil {
+			var err error
+			if u, err = newUpstream(spec); err != nil {
+				return nil, fmt.Errorf("forward: %v", err)
+			}
+		}
+		if key := u.proto + " " + u.addr + u.url; !seen[key] {
+			seen[key] = true
+			list = append(list, u)
+		}
+	}
+	return list, nil
+}
+
+// closeIdle closes the pooled connections of an upstream no longer used.
+func (u *upstream) closeIdle() {
+	if u.http != nil {
+		u.http.CloseIdleConnections()
+	}
+	for {
+		select {
+		case pc := <-u.conns:
+			pc.Close()
+		default:
+			return
+		}
+	}
+}
+
+// withDefaultPort appends port to a bare host or IP.
+func withDefaultPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+	}
+	return addr
+}
+
+// observe folds one exchange into the upstream's statistics.
+func (u *upstream) observe(rtt time.Duration, err error) {
+	u.queries.Add(1)
+	if err != nil {
+		u.failures.Add(1)
+	}
+	u.smooth(rtt, err)
+}
+
+// smooth folds an exchange or probe into the smoothed RTT and failure
+// rate that rank the upstream.
+func (u *upstream) smooth(rtt time.Duration, err error) {
+	failed := 0.0
+	if err != nil {
+		// Count a failure as a slow answer so broken upstreams sink.
+		rtt = 2 * time.Second
+		failed = 1
+	}
+	for {
+		old := u.rtt.Load()
+		next := int64(rtt)
+		if old != 0 {
+			next = int64(float64(old)*(1-rttDecay) + float64(rtt)*rttDecay)
+		}
+		if u.rtt.CompareAndSwap(old, next) {
+			break
+		}
+	}
+	for {
+		old := u.failRate.Load()
+		next := math.Float64frombits(old)*(1-rttDecay) + failed*rttDecay
+		if u.failRate.CompareAndSwap(old, math.Float64bits(next)) {
+			return
+		}
+	}
+}
+
+// failing reports whether most of the upstream's recent exchanges failed.
+func (u *upstream) failing() bool {
+	return math.Float64frombits(u.failRate.Load()) > 0.5
+}
+
+// rankUpstreams returns list fastest first, and failing ones last;
+// unmeasured ones come first so they get measured.
+func rankUpstreams(list []*upstream) []*upstream {
+	ranked := append([]*upstream(nil), list...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if fi, fj := ranked[i].failing(), ranked[j].failing(); fi != fj {
+			return fj
+		}
+		return ranked[i].rtt.Load() < ranked[j].rtt.Load()
+	})
+	return ranked
+}
+
+// exchangeUpstream sends r to u, retrying timeouts per forward.retries.
+func exchangeUpstream(u *upstream, r *dns.Msg) (*dns.Msg, error) {
+	return exchangeUpstreamContext(context.Background(), u, r)
+}
+
+// exchangeUpstreamContext is exchangeUpstream within ctx's deadline.
+func exchangeUpstreamContext(ctx context.Context, u *upstream, r *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
+	resp, err := u.exchange(ctx, r)
+	u.observe(time.Since(start), err)
+	return resp, err
+}
+
+// exchange sends r to u, retrying timeouts, without touching u's
+// statistics.
+func (u *upstream) exchange(ctx context.Context, r *dns.Msg) (*dns.Msg, error) {
+	var resp *dns.Msg
+	var err error
+	for attempt := 0; attempt <= config.Forward.Retries; attempt++ {
+		if attempt > 0 && ctx.Err() != nil {
+			break
+		}
+		switch u.proto {
+		case protoDoH:
+			resp, err = u.exchangeHTTPS(ctx, r)
+		case protoDNSCrypt:
+			resp, err = u.dnscrypt.exchange(ctx, r)
+		case protoODoH:
+			resp, err = u.odoh.exchange(ctx, r)
+		default:
+			resp, err = u.exchangePooled(ctx, r)
+		}
+		if !isTimeout(err) {
+			break
+		}
+	}
+	if err == nil && !usableResponse(resp) {
+		err = fmt.Errorf("%s answered %s", u.name, dns.RcodeToString[resp.Rcode])
+	}
+	return resp, err
+}
+
+// exchangePooled sends r over a pooled connection, dialing one if none is
+// idle. A reused stream connection the server has since closed is replaced
+// once. Connections that fail are closed rather than pooled, so a late
+// reply can never be read as the answer to a later query.
+func (u *upstream) exchangePooled(ctx context.Context, r *dns.Msg) (*dns.Msg, error) {
+	badCookie := false
+	for attempt := 0; ; attempt++ {
+		pc := u.idleConn()
+		reused := pc != nil
+		if !reused {
+			conn, err := u.client.DialContext(ctx, u.addr)
+			if err != nil {
+				return nil, err
+			}
+			pc = &pooledConn{Conn: conn}
+		}
+		q := u.withCookie(r)
+		var resp *dns.Msg
+		var err error
+		if u.proto == protoUDP {
+			resp, err = u.exchangeUDP(ctx, q, pc.Conn)
+		} else {
+			resp, _, err = u.client.ExchangeWithConnContext(ctx, q, pc.Conn)
+		}
+		if err != nil {
+			pc.Close()
+			if reused && attempt == 0 && !isTimeout(err) {
+				continue
+			}
+			return nil, err
+		}
+		pc.uses++
+		u.release(pc)
+		if err := u.learnCookie(resp); err != nil {
+			if !badCookie {
+				badCookie = true
+				continue
+			}
+			return nil, err
+		}
+		return resp, nil
+	}
+}
+
+// idleConn takes a pooled connection, discarding any idle for too long.
+func (u *upstream) idleConn() *pooledConn {
+	maxIdle := time.Duration(config.Forward.IdleTimeout) * time.Second
+	for {
+		select {
+		case pc := <-u.conns:
+			if time.Since(pc.lastUsed) < maxIdle {
+				return pc
+			}
+			pc.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// release returns a healthy connection to the pool, or closes it if the
+// pool is full or a UDP socket has served its quota.
+func (u *upstream) release(pc *pooledConn) {
+	if u.proto == protoUDP && pc.uses >= udpMaxUses {
+		pc.Close()
+		return
+	}
+	pc.lastUsed = time.Now()
+	select {
+	case u.conns <- pc:
+	default:
+		pc.Close()
+	}
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// exchangeHTTPS sends r as an RFC 8484 POST.
+func (u *upstream) exchangeHTTPS(ctx context.Context, r *dns.Msg) (*dns.Msg, error) {
+	q := r.Copy()
+	q.Id = 0 // cache friendly, as RFC 8484 recommends
+	body, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	httpResp, err := u.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", u.url, httpResp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(httpResp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(data); err != nil {
+		return nil, err
+	}
+	resp.Id = r.Id
+	return resp, nil
+}
+
+func hostOnly(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+	return host
+}
+
+// usableResponse rejects answers another upstream might do better on.
+func usableResponse(resp *dns.Msg) bool {
+	return resp.Rcode != dns.RcodeServerFailure && resp.Rcode != dns.RcodeRefused
+}
+
+var errForwardBusy = errors.New("too many forwarded queries in flight")
+
+var (
+	forwardSlots    chan struct{} // one per forwarded query in flight
+	forwardRejected atomic.Uint64 // turned away at max_in_flight
+	forwardExpired  atomic.Uint64 // out of time at query_timeout_ms
+)
+
+func forwardToFallback(r *dns.Msg) (*dns.Msg, error) {
+	select {
+	case forwardSlots <- struct{}{}:
+		defer func() { <-forwardSlots }()
+	default:
+		forwardRejected.Add(1)
+		return nil, errForwardBusy
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.Forward.QueryTimeoutMs)*time.Millisecond)
+	defer cancel()
+
+	list, ok := upstreamsFor(r.Question[0].Name)
+	if !ok {
+		return nil, errLocalDomain
+	}
+	ranked := rankUpstreams(list)
+	var resp *dns.Msg
+	var err error
+	if config.Forward.Strategy == strategyRace && len(ranked) > 1 {
+		resp, err = forwardRace(ctx, ranked, r)
+	} else {
+		resp, err = forwardFailover(ctx, ranked, r)
+	}
+	if err != nil && ctx.Err() != nil {
+		forwardExpired.Add(1)
+		err = fmt.Errorf("no answer within %dms: %w", config.Forward.QueryTimeoutMs, err)
+	}
+	recordUpstreamResult(err)
+	if err == nil {
+		clampTTLs(resp, config.MinTTL, config.MaxTTL)
+	}
+	return resp, err
+}
+
+// forwardFailover tries the ranked upstreams in order until one answers.
+// A SERVFAIL or REFUSED answer is returned if nothing better comes along.
+func forwardFailover(ctx context.Context, ranked []*upstream, r *dns.Msg) (*dns.Msg, error) {
+	var last *dns.Msg
+	var err error
+	for _, u := range ranked {
+		if ctx.Err() != nil {
+			break
+		}
+		var resp *dns.Msg
+		if resp, err = exchangeUpstreamContext(ctx, u, r); err == nil {
+			return resp, nil
+		}
+		if resp != nil {
+			last = resp
+		}
+	}
+	if last != nil {
+		return last, nil
+	}
+	return nil, err
+}
+
+// forwardRace sends r to the fastest upstreams at once and returns the
+// first usable answer; the slower exchanges finish in the background, up to
+// the query's deadline, and still update their upstream's RTT.
+func forwardRace(ctx context.Context, ranked []*upstream, r *dns.Msg) (*dns.Msg, error) {
+	racers := ranked[:min(config.Forward.Race, len(ranked))]
+	if rest := ranked[len(racers):]; len(rest) > 0 && rand.Float64() < exploreRate {
+		racers = append(racers[:len(racers):len(racers)], rest[rand.IntN(len(rest))])
+	}
+
+	type result struct {
+		resp *dns.Msg
+		err  error
+	}
+	results := make(chan result, len(racers))
+	deadline, _ := ctx.Deadline()
+	for _, u := range racers {
+		go func(u *upstream) {
+			// Not cancelled once a faster upstream wins.
+			bg, cancel := context.WithDeadline(context.Background(), deadline)
+			defer cancel()
+			resp, err := exchangeUpstreamContext(bg, u, r.Copy())
+			results <- result{resp, err}
+		}(u)
+	}
+
+	var fallback *dns.Msg
+	var err error
+	for range racers {
+		var res result
+		select {
+		case res = <-results:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if res.err == nil {
+			return res.resp, nil
+		}
+		err = res.err
+		if res.resp != nil {
+			fallback = res.resp
+		}
+	}
+	if fallback != nil {
+		return fallback, nil
+	}
+	return nil, err
+}
+
+type upstreamReport struct {
+	Address   string  `json:"address"`
+	RTTMs     float64 `json:"rtt_ms"`
+	Queries   uint64  `json:"queries"`
+	Failures  uint64  `json:"failures"`
+	IdleConns int     `json:"idle_conns"`
+	Spoofed   uint64  `json:"spoofed"`           // replies dropped as spoof attempts
+	Domains   bool    `json:"domains,omitempty"` // used for forward.domains
+
+	FailRate    float64 `json:"fail_rate"` // smoothed, 0 to 1
+	Probes      uint64  `json:"probes,omitempty"`
+	ProbeFailed uint64  `json:"probe_failures,omitempty"`
+}
+
+type forwardReport struct {
+	InFlight    int    `json:"in_flight"`
+	MaxInFlight int    `json:"max_in_flight"`
+	Rejected    uint64 `json:"rejected"` // at max_in_flight
+	Expired     uint64 `json:"expired"`  // past query_timeout_ms
+}
+
+func forwardReports() forwardReport {
+	return forwardReport{
+		InFlight:    len(forwardSlots),
+		MaxInFlight: cap(forwardSlots),
+		Rejected:    forwardRejected.Load(),
+		Expired:     forwardExpired.Load(),
+	}
+}
+
+func upstreamReports() []upstreamReport {
+	var out []upstreamReport
+	list := activeUpstreams()
+	n := len(list)
+	for _, u := range allDomainUpstreams() {
+		if !containsUpstream(list, u) {
+			list = append(list, u)
+		}
+	}
+	for i, u := range list {
+		out = append(out, upstreamReport{
+			Address:   u.name,
+			RTTMs:     float64(u.rtt.Load()) / float64(time.Millisecond),
+			Queries:   u.queries.Load(),
+			Failures:  u.failures.Load(),
+			IdleConns: len(u.conns),
+			Spoofed:   u.spoofs.Load(),
+
+			FailRate:    math.Float64frombits(u.failRate.Load()),
+			Probes:      u.probes.Load(),
+			ProbeFailed: u.probeFails.Load(),
+			Domains:     i >= n,
+		})
+	}
+	return out
+}
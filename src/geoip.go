@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// GeoIPConfig steers clients to their nearest endpoint. Zone records tagged
+// country=US,CA or continent=EU are served only to clients the MaxMind
+// database (GeoLite2 Country or City) places there; untagged records are
+// the answer for everyone else. With edns.options.ecs set to local, the
+// client subnet a resolver sends on behalf of its client is located
+// instead of the resolver. The database is reloaded when the file changes.
+type GeoIPConfig struct {
+	Database string `yaml:"database"`
+}
+
+// geoLocation is where a client is; empty fields are unknown.
+type geoLocation struct {
+	country   string // ISO 3166-1 code, e.g. "DE"
+	continent string // e.g. "EU"
+	client    net.IP // the client, or its subnet; picks its canary variant
+}
+
+// continentCodes are the codes MaxMind uses.
+var continentCodes = map[string]bool{"AF": true, "AN": true, "AS": true, "EU": true, "NA": true, "OC": true, "SA": true}
+
+const geoIPPollInterval = time.Minute
+
+var geoDB atomic.Pointer[mmdb]
+
+func setupGeoIP() error {
+	path := config.GeoIP.Database
+	if path == "" {
+		return nil
+	}
+	db, err := openMMDB(path)
+	if err != nil {
+		return fmt.Errorf("geoip.database: %v", err)
+	}
+	geoDB.Store(db)
+	log.Printf("Loaded GeoIP database %s (%s, built %s)", path, db.dbType, db.built.Format(time.DateOnly))
+	return nil
+}
+
+// watchGeoIP reloads the database at path when the file is replaced, as
+// the MaxMind updater does weekly. A bad file keeps the old one in use.
+// main passes the path after dropPrivileges has mapped it into the chroot.
+func watchGeoIP(path string) {
+	last := time.Time{}
+	if info, err := os.Stat(path); err == nil {
+		last = info.ModTime()
+	}
+	for range time.Tick(geoIPPollInterval) {
+		info, err := os.Stat(path)
+		if err != nil || !info.ModTime().After(last) {
+			continue
+		}
+		last = info.ModTime()
+		db, err := openMMDB(path)
+		if err != nil {
+			log.Printf("Failed to reload GeoIP database %s: %v", path, err)
+			continue
+		}
+		geoDB.Store(db)
+		log.Printf("Reloaded GeoIP database %s (built %s)", path, db.built.Format(time.DateOnly))
+	}
+}
+
+// locateClient places the client of r, or reports nothing when GeoIP is
+// off or the address isn't in the database.
+func locateClient(client net.IP, r *dns.Msg) geoLocation {
+	if subnet := localClientSubnet(r); subnet != nil {
+		client = subnet.Address
+	}
+	loc := geoLocation{client: client}
+	db := geoDB.Load()
+	if db == nil || client == nil {
+		return loc
+	}
+	rec, err := db.lookup(client)
+	if err != nil {
+		log.Printf("GeoIP lookup of %s: %v", client, err)
+		return loc
+	}
+	for _, key := range []string{"country", "registered_country"} {
+		if code, ok := mmdbPath(rec, key, "iso_code").(string); ok {
+			loc.country = code
+			break
+		}
+	}
+	loc.continent, _ = mmdbPath(rec, "continent", "code").(string)
+	return loc
+}
+
+// localClientSubnet returns r's client subnet option when this server is
+// the one to act on it.
+func localClientSubnet(r *dns.Msg) *dns.EDNS0_SUBNET {
+	if ednsAction(dns.EDNS0SUBNET) != ednsLocal {
+		return nil
+	}
+	if subnet := requestSubnet(r); subnet != nil && subnet.Family != 0 && subnet.SourceNetmask > 0 {
+		return subnet
+	}
+	return nil
+}
+
+// pickGeo narrows recs to the ones tagged for loc: its country's if any,
+// else its continent's, else the untagged ones. With no untagged records
+// to fall back on, an unmatched client gets the whole set rather than an
+// empty answer.
+func pickGeo(recs []Record, loc geoLocation) []Record {
+	if !slices.ContainsFunc(recs, func(rec Record) bool { return len(rec.Countries)+len(rec.Continents) > 0 }) {
+		return recs
+	}
+	var country, continent, rest []Record
+	for _, rec := range recs {
+		switch {
+		case len(rec.Countries) == 0 && len(rec.Continents) == 0:
+			rest = append(rest, rec)
+		case loc.country != "" && slices.Contains(rec.Countries, loc.country):
+			country = append(country, rec)
+		case loc.continent != "" && slices.Contains(rec.Continents, loc.continent):
+			continent = append(continent, rec)
+		}
+	}
+	switch {
+	case len(rest) == len(recs):
+		return recs
+	case len(country) > 0:
+		return country
+	case len(continent) > 0:
+		return continent
+	case len(rest) > 0:
+		return rest
+	}
+	return recs
+}
+
+// parseGeoCodes reads the comma-separated codes of a country= or
+// continent= zone option.
+func parseGeoCodes(key, val string) ([]string, error) {
+	var codes []string
+	for _, code := range strings.Split(val, ",") {
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if len(code) != 2 || (key == "continent" && !continentCodes[code]) {
+			return nil, fmt.Errorf("invalid %s code %q", key, code)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// mmdb reads the MaxMind DB format: a binary search tree over address bits
+// whose leaves point into a section of typed, self-describing data.
+type mmdb struct {
+	tree       []byte
+	data       mmdbDecoder
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint // node reached after the 96 zero bits of ::/96
+
+	dbType string
+	built  time.Time
+}
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+func openMMDB(path string) (*mmdb, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errors.New("not a MaxMind DB file")
+	}
+	v, _, err := mmdbDecoder{buf[i+len(mmdbMetadataMarker):]}.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("metadata: %v", err)
+	}
+	meta, ok := v.(map[string]any)
+	if !ok {
+		return nil, errors.New("metadata is not a map")
+	}
+	num := func(key string) uint {
+		n, _ := meta[key].(uint64)
+		return uint(n)
+	}
+	db := &mmdb{nodeCount: num("node_count"), recordSize: num("record_size"), ipVersion: num("ip_version")}
+	db.dbType, _ = meta["database_type"].(string)
+	db.built = time.Unix(int64(num("build_epoch")), 0).UTC()
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", db.recordSize)
+	}
+	if db.ipVersion != 4 && db.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported IP version %d", db.ipVersion)
+	}
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+16 > uint(i) {
+		return nil, errors.New("search tree is larger than the file")
+	}
+	db.tree = buf[:treeSize]
+	db.data = mmdbDecoder{buf[treeSize+16 : i]}
+	if db.ipVersion == 6 {
+		for range 96 {
+			if db.ipv4Start >= db.nodeCount {
+				break
+			}
+			db.ipv4Start = db.child(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// child returns the left (bit 0) or right (bit 1) record of node.
+func (db *mmdb) child(node, bit uint) uint {
+	b := db.tree[node*db.recordSize/4:]
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	}
+	return uint(binary.BigEndian.Uint32(b[bit*4:]))
+}
+
+// lookup returns the data recorded for ip's network, or nil.
+func (db *mmdb) lookup(ip net.IP) (map[string]any, error) {
+	addr, node := ip.To16(), uint(0)
+	if v4 := ip.To4(); v4 != nil {
+		addr, node = v4, db.ipv4Start
+	} else if db.ipVersion == 4 {
+		return nil, nil
+	}
+	for i := 0; i < len(addr)*8 && node < db.nodeCount; i++ {
+		node = db.child(node, uint(addr[i/8]>>(7-i%8))&1)
+	}
+	switch {
+	case node == db.nodeCount:
+		return nil, nil
+	case node < db.nodeCount:
+		return nil, errors.New("search tree ends inside a node")
+	}
+	v, _, err := db.data.decode(node-db.nodeCount-16, 0)
+	if err != nil {
+		return nil, err
+	}
+	rec, _ := v.(map[string]any)
+	return rec, nil
+}
+
+// mmdbPath follows keys through nested maps.
+func mmdbPath(v any, keys ...string) any {
+	for _, key := range keys {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+	return v
+}
+
+// mmdbDecoder decodes values from a data section; pointers are offsets
+// into buf.
+type mmdbDecoder struct {
+	buf []byte
+}
+
+var errMMDBCorrupt = errors.New("corrupt data section")
+
+// decode returns the value at off and the offset just past it.
+func (d mmdbDecoder) decode(off uint, depth int) (any, uint, error) {
+	if depth > 32 {
+		return nil, 0, errors.New("data nested too deeply")
+	}
+	next := func(n uint) ([]byte, error) {
+		if off+n > uint(len(d.buf)) {
+			return nil, errMMDBCorrupt
+		}
+		b := d.buf[off : off+n]
+		off += n
+		return b, nil
+	}
+	b, err := next(1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := b[0]
+	typ := uint(ctrl >> 5)
+	if typ == 1 {
+		// A pointer: the value lives elsewhere, but decoding continues
+		// after the pointer.
+		ss := uint(ctrl>>3) & 3
+		b, err := next(ss + 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		p := uint(ctrl & 7)
+		if ss == 3 {
+			p = 0
+		}
+		for _, c := range b {
+			p = p<<8 | uint(c)
+		}
+		p += [4]uint{0, 2048, 526336, 0}[ss]
+		v, _, err := d.decode(p, depth+1)
+		return v, off, err
+	}
+	if typ == 0 {
+		if b, err = next(1); err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + uint(b[0])
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		if b, err = next(size - 28); err != nil {
+			return nil, 0, err
+		}
+		n := uint(0)
+		for _, c := range b {
+			n = n<<8 | uint(c)
+		}
+		size = [3]uint{29, 285, 65821}[size-29] + n
+	}
+
+	switch typ {
+	case 7: // map
+		m := make(map[string]any, size)
+		for range size {
+			k, o, err := d.decode(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			if m[key], off, err = d.decode(o, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, off, nil
+	case 11: // array
+		a := make([]any, 0, size)
+		for range size {
+			var v any
+			if v, off, err = d.decode(off, depth+1); err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+		}
+		return a, off, nil
+	case 14: // boolean, held in the size
+		return size != 0, off, nil
+	}
+	if b, err = next(size); err != nil {
+		return nil, 0, err
+	}
+	switch typ {
+	case 2: // UTF-8 string
+		return string(b), off, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), off, nil
+	case 4: // bytes
+		return slices.Clone(b), off, nil
+	case 5, 6, 9, 10: // unsigned integers; 128-bit ones are kept as bytes
+		if size > 8 {
+			return slices.Clone(b), off, nil
+		}
+		n := uint64(0)
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, off, nil
+	case 8: // int32
+		n := uint32(0)
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		return int32(n), off, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), off, nil
+	}
+	return nil, 0, fmt.Errorf("unknown data type %d", typ)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mmdbValue encodes strings, unsigned integers and string-keyed maps in
+// the MaxMind DB data format.
+func mmdbValue(v any) []byte {
+	switch v := v.(type) {
+	case string:
+		return append([]byte{2<<5 | byte(len(v))}, v...)
+	case uint32:
+		return []byte{6<<5 | 4, byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+	case map[string]any:
+		out := []byte{7<<5 | byte(len(v))}
+		for k, val := range v {
+			out = append(out, mmdbValue(k)...)
+			out = append(out, mmdbValue(val)...)
+		}
+		return out
+	}
+	panic("unsupported mmdb value")
+}
+
+// writeTestMMDB writes an IPv4 database that places 10.0.0.0/8 in
+// Germany and knows nothing else.
+func writeTestMMDB(t *testing.T) string {
+	t.Helper()
+	const nodes = 8
+	data := mmdbValue(map[string]any{
+		"country":   map[string]any{"iso_code": "DE"},
+		"continent": map[string]any{"code": "EU"},
+	})
+	var tree []byte
+	record := func(n uint32) { tree = append(tree, byte(n>>16), byte(n>>8), byte(n)) }
+	for i := range nodes {
+		next := uint32(i + 1)
+		if i == nodes-1 {
+			next = nodes + 16 // the data section's first value
+		}
+		if 10>>(7-i)&1 == 0 {
+			record(next)
+			record(nodes)
+		} else {
+			record(nodes)
+			record(next)
+		}
+	}
+	buf := append(tree, make([]byte, 16)...)
+	buf = append(buf, data...)
+	buf = append(buf, mmdbMetadataMarker...)
+	buf = append(buf, mmdbValue(map[string]any{
+		"node_count":    uint32(nodes),
+		"record_size":   uint32(24),
+		"ip_version":    uint32(4),
+		"database_type": "Test-Country",
+		"build_epoch":   uint32(1700000000),
+	})...)
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, buf, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGeoIPLookup(t *testing.T) {
+	db, err := openMMDB(writeTestMMDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.dbType != "Test-Country" {
+		t.Errorf("database type %q", db.dbType)
+	}
+	old := geoDB.Load()
+	geoDB.Store(db)
+	t.Cleanup(func() { geoDB.Store(old) })
+
+	if loc := locateClient(net.ParseIP("10.1.2.3"), nil); loc.country != "DE" || loc.continent != "EU" {
+		t.Errorf("10.1.2.3 located in %q/%q", loc.country, loc.continent)
+	}
+	if loc := locateClient(net.ParseIP("192.0.2.1"), nil); loc.country != "" || loc.continent != "" {
+		t.Errorf("192.0.2.1 located in %q/%q", loc.country, loc.continent)
+	}
+	if loc := locateClient(net.ParseIP("2001:db8::1"), nil); loc.country != "" {
+		t.Errorf("IPv6 client located in an IPv4 database: %q", loc.country)
+	}
+
+	dir := writeZoneFiles(t, map[string]string{"bad.mmdb": "not a database"})
+	if _, err := openMMDB(filepath.Join(dir, "bad.mmdb")); err == nil {
+		t.Error("opened a file without MaxMind metadata")
+	}
+}
+
+func TestPickGeo(t *testing.T) {
+	recs := []Record{
+		{Type: "A", Data: "10.0.0.1"},
+		{Type: "A", Data: "10.0.0.2", Countries: []string{"DE", "AT"}},
+		{Type: "A", Data: "10.0.0.3", Continents: []string{"EU"}},
+	}
+	for _, tc := range []struct {
+		loc  geoLocation
+		want string
+	}{
+		{geoLocation{country: "AT", continent: "EU"}, "10.0.0.2"},
+		{geoLocation{country: "FR", continent: "EU"}, "10.0.0.3"},
+		{geoLocation{country: "US", continent: "NA"}, "10.0.0.1"},
+		{geoLocation{}, "10.0.0.1"},
+	} {
+		got := pickGeo(recs, tc.loc)
+		if len(got) != 1 || got[0].Data != tc.want {
+			t.Errorf("%+v got %v, want %s", tc.loc, got, tc.want)
+		}
+	}
+
+	// With nothing untagged, an unmatched client gets every record.
+	tagged := recs[1:]
+	if got := pickGeo(tagged, geoLocation{country: "US", continent: "NA"}); len(got) != 2 {
+		t.Errorf("unmatched client got %v", got)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"path"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ClientGroups names sets of client networks, e.g. admins: [10.0.10.0/24],
+// for restrict entries to refer to.
+//
+// RestrictConfig hides names from every client outside its groups, without
+// a full split-horizon view: such clients get NXDOMAIN as if the name didn't
+// exist, and the name is never forwarded for them. Names are globs, so
+// "*.mgmt.lan" hides a subtree. With Types, only records of those types are
+// hidden and the name itself still resolves. Hidden records are also left
+// out when reached through a CNAME or a rule rewrite.
+type RestrictConfig struct {
+	Names  []string `yaml:"names"`
+	Types  []string `yaml:"types"`  // default: all
+	Groups []string `yaml:"groups"` // client_groups that still see the names
+}
+
+type restriction struct {
+	names []string
+	types map[uint16]bool // nil for all types
+	allow []*net.IPNet
+}
+
+// clientGroups parses client_groups.
+func clientGroups(cfg *Config) (map[string][]*net.IPNet, error) {
+	groups := make(map[string][]*net.IPNet)
+	for name, list := range cfg.ClientGroups {
+		nets, err := parseCIDRs("client_groups."+name, list)
+		if err != nil {
+			return nil, err
+		}
+		groups[name] = nets
+	}
+	return groups, nil
+}
+
+func (f *filterSet) loadRestrictions(c *Config) error {
+	groups, err := clientGroups(c)
+	if err != nil {
+		return err
+	}
+	for i, cfg := range c.Restrict {
+		key := fmt.Sprintf("restrict[%d]", i)
+		if len(cfg.Names) == 0 || len(cfg.Groups) == 0 {
+			return fmt.Errorf("%s: names and groups are required", key)
+		}
+		res := &restriction{}
+		for _, n := range cfg.Names {
+			glob := dns.Fqdn(strings.ToLower(n))
+			if _, err := path.Match(glob, ""); err != nil {
+				return fmt.Errorf("%s.names: %v", key, err)
+			}
+			res.names = append(res.names, glob)
+		}
+		for _, t := range cfg.Types {
+			qtype, ok := dns.StringToType[strings.ToUpper(t)]
+			if !ok {
+				return fmt.Errorf("%s.types: unknown type %q", key, t)
+			}
+			if res.types == nil {
+				res.types = make(map[uint16]bool)
+			}
+			res.types[qtype] = true
+		}
+		for _, g := range cfg.Groups {
+			nets, ok := groups[g]
+			if !ok {
+				return fmt.Errorf("%s.groups: no client group %q", key, g)
+			}
+			res.allow = append(res.allow, nets...)
+		}
+		f.restrictions = append(f.restrictions, res)
+	}
+	if len(f.restrictions) > 0 {
+		log.Printf("Restricting %d name pattern set(s) to client groups", len(f.restrictions))
+	}
+	return nil
+}
+
+// hidden reports whether name's records of qtype are hidden from client;
+// qtype 0 asks whether the name as a whole is. name is lowercase and fully
+// qualified. Clients of unknown address see nothing restricted.
+func hidden(name string, qtype uint16, client net.IP) bool {
+	for _, res := range activeFilters().restrictions {
+		if res.types != nil && (qtype == 0 || !res.types[qtype]) {
+			continue
+		}
+		for _, glob := range res.names {
+			if ok, _ := path.Match(glob, name); ok {
+				if client == nil || !onNetworks(client, res.allow) {
+					return true
+				}
+				break
+			}
+		}
+	}
+	return false
+}
+
+// withoutHidden drops the records client may not see from rrs.
+func withoutHidden(rrs []dns.RR, client net.IP) []dns.RR {
+	if len(activeFilters().restrictions) == 0 {
+		return rrs
+	}
+	out := rrs[:0:0]
+	for _, rr := range rrs {
+		h := rr.Header()
+		qtype := h.Rrtype
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			qtype = sig.TypeCovered
+		}
+		if qtype != dns.TypeOPT && hidden(strings.ToLower(h.Name), qtype, client) {
+			continue
+		}
+		out = append(out, rr)
+	}
+	return out
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// HealthCheckConfig attaches a probe to every address record of a name.
+// Addresses failing the probe are left out of answers until they pass again.
+type HealthCheckConfig struct {
+	Name     string `yaml:"name"`
+	Type     string `yaml:"type"` // "tcp" or "http"
+	Port     int    `yaml:"port"`
+	Path     string `yaml:"path"`     // http only, defaults to /
+	Interval int    `yaml:"interval"` // seconds, defaults to 10
+	Timeout  int    `yaml:"timeout"`  // seconds, defaults to 2
+}
+
+var (
+	healthMu   sync.RWMutex
+	unhealthy  = make(map[string]bool) // name|addr -> failing
+	healthKeys = make(map[string]bool) // names with a check attached
+)
+
+func healthKey(name, addr string) string {
+	return name + "|" + addr
+}
+
+func setupHealthChecks() error {
+	for i := range config.HealthChecks {
+		hc := &config.HealthChecks[i]
+		if hc.Name == "" {
+			return fmt.Errorf("health_checks[%d]: name is required", i)
+		}
+		hc.Name = dns.Fqdn(strings.ToLower(hc.Name))
+		hc.Type = strings.ToLower(hc.Type)
+		if hc.Type != "tcp" && hc.Type != "http" {
+			return fmt.Errorf("health_checks[%d]: type must be tcp or http", i)
+		}
+		if hc.Port <= 0 || hc.Port > 65535 {
+			return fmt.Errorf("health_checks[%d]: invalid port %d", i, hc.Port)
+		}
+		if hc.Path == "" {
+			hc.Path = "/"
+		}
+		if hc.Interval <= 0 {
+			hc.Interval = 10
+		}
+		if hc.Timeout <= 0 {
+			hc.Timeout = 2
+		}
+		healthKeys[hc.Name] = true
+	}
+	return nil
+}
+
+func startHealthChecks() {
+	for _, hc := range config.HealthChecks {
+		go runHealthCheck(hc)
+	}
+}
+
+func runHealthCheck(hc HealthCheckConfig) {
+	for {
+		var wg sync.WaitGroup
+		for _, rec := range records.lookup(hc.Name) {
+			if rec.Type != "A" && rec.Type != "AAAA" {
+				continue
+			}
+			wg.Add(1)
+			go func(addr string) {
+				defer wg.Done()
+				err := probe(hc, addr)
+				setHealth(hc.Name, addr, err)
+			}(rec.Data)
+		}
+		wg.Wait()
+		time.Sleep(time.Duration(hc.Interval) * time.Second)
+	}
+}
+
+func probe(hc HealthCheckConfig, addr string) error {
+	timeout := time.Duration(hc.Timeout) * time.Second
+	hostport := net.JoinHostPort(addr, strconv.Itoa(hc.Port))
+	if hc.Type == "tcp" {
+		conn, err := net.DialTimeout("tcp", hostport, timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get("http://" + hostport + hc.Path)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func setHealth(name, addr string, err error) {
+	key := healthKey(name, addr)
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	was := unhealthy[key]
+	if err != nil {
+		unhealthy[key] = true
+		if !was {
+			log.Printf("Health check failed for %s %s: %v", name, addr, err)
+		}
+		return
+	}
+	delete(unhealthy, key)
+	if was {
+		log.Printf("Health check recovered for %s %s", name, addr)
+	}
+}
+
+// filterHealthy drops address records whose checks are failing. If every
+// address is down the full set is returned, since answering with nothing
+// helps no one.
+func filterHealthy(name string, recs []Record) []Record {
+	if !healthKeys[name] {
+		return recs
+	}
+	healthMu.RLock()
+	defer healthMu.RUnlock()
+	var up []Record
+	for _, rec := range recs {
+		if !unhealthy[healthKey(name, rec.Data)] {
+			up = append(up, rec)
+		}
+	}
+	if len(up) == 0 {
+		return recs
+	}
+	return up
+}
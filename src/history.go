@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultZoneHistory is how many zone versions are kept when admin.history
+// is unset.
+const defaultZoneHistory = 10
+
+// zoneVersion is the zone (hosts_file) record set as it was after one
+// change. Record maps are never modified once published, so versions share
+// them with the store instead of copying.
+type zoneVersion struct {
+	ID      int       `json:"id"`
+	Time    time.Time `json:"time"`
+	Reason  string    `json:"reason"`
+	Names   int       `json:"names"`
+	Records int       `json:"records"`
+
+	recs map[string][]Record
+}
+
+var (
+	zoneHistoryMu sync.Mutex
+	zoneHistory   []zoneVersion // oldest first
+	zoneVersionID int
+)
+
+// snapshotZone remembers recs, the zone just published, as a new version.
+func snapshotZone(reason string, recs map[string][]Record) {
+	keep := config.Admin.History
+	if keep < 0 {
+		return
+	}
+	if keep == 0 {
+		keep = defaultZoneHistory
+	}
+	n := 0
+	for _, list := range recs {
+		n += len(list)
+	}
+	zoneHistoryMu.Lock()
+	defer zoneHistoryMu.Unlock()
+	zoneVersionID++
+	zoneHistory = append(zoneHistory, zoneVersion{
+		ID: zoneVersionID, Time: time.Now().UTC(), Reason: reason,
+		Names: len(recs), Records: n, recs: recs,
+	})
+	if len(zoneHistory) > keep {
+		zoneHistory = zoneHistory[len(zoneHistory)-keep:]
+	}
+}
+
+// rollbackZone reinstalls version id as the current zone. With write_back
+// the change is journaled, and so reaches the zone file; otherwise it lasts
+// until the zone file changes again.
+func rollbackZone(id int) (zoneVersion, error) {
+	zoneHistoryMu.Lock()
+	var target *zoneVersion
+	for i := range zoneHistory {
+		if zoneHistory[i].ID == id {
+			target = &zoneHistory[i]
+		}
+	}
+	if target == nil {
+		zoneHistoryMu.Unlock()
+		return zoneVersion{}, fmt.Errorf("no zone version %d", id)
+	}
+	recs := target.recs
+	zoneHistoryMu.Unlock()
+
+	if err := backupZoneFile("rollback"); err != nil {
+		return zoneVersion{}, err
+	}
+	reason := fmt.Sprintf("rollback to version %d", id)
+	records.updateSource(sourceZone, func(cur map[string][]Record) {
+		old := make(map[string][]Record)
+		for name := range cur {
+			old[name] = cur[name]
+		}
+		for name := range recs {
+			old[name] = cur[name]
+		}
+		clear(cur)
+		maps.Copy(cur, recs)
+		recordChange("admin "+reason, old, cur)
+		snapshotZone(reason, cur)
+	})
+
+	zoneHistoryMu.Lock()
+	defer zoneHistoryMu.Unlock()
+	return zoneHistory[len(zoneHistory)-1], nil
+}
+
+// handleZoneVersions lists the versions that can be rolled back to, newest
+// first.
+func handleZoneVersions(w http.ResponseWriter, _ *http.Request) {
+	zoneHistoryMu.Lock()
+	list := make([]zoneVersion, 0, len(zoneHistory))
+	for i := len(zoneHistory) - 1; i >= 0; i-- {
+		list = append(list, zoneHistory[i])
+	}
+	zoneHistoryMu.Unlock()
+	writeJSON(w, http.StatusOK, list)
+}
+
+func handleZoneRollback(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Version int `json:"version"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	v, err := rollbackZone(req.Version)
+	if err != nil {
+		auditf(r, "zone rollback to version %d rejected: %v", req.Version, err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	auditf(r, "zone rolled back to version %d (%d names, %d records), now version %d", req.Version, v.Names, v.Records, v.ID)
+	writeJSON(w, http.StatusOK, v)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Zone files also take lines in /etc/hosts form, an address followed by
+// its names:
+//
+//	10.0.0.5  web.example.local. web
+//	fd00::5   web.example.local.
+//
+// Each name gets an A or AAAA record, so hosts_file can point straight at a
+// hosts file, or a zone file can $INCLUDE one. Names are qualified like
+// owners of zone lines. Text after "#" is a comment.
+
+// defaultHostsTTL is the TTL of records from hosts lines when neither
+// hosts_entries.ttl nor the zone's default_ttl is set.
+const defaultHostsTTL = 300
+
+// HostsEntriesConfig tunes the records made from hosts lines.
+type HostsEntriesConfig struct {
+	TTL    uint32 `yaml:"ttl"`    // default: the zone's default_ttl, else 300
+	Domain string `yaml:"domain"` // appended to single-label names outside zones
+	// Add a PTR record for each address, pointing at its first name. Not
+	// for zones: their reverse names lie outside the zone.
+	PTR bool `yaml:"ptr"`
+}
+
+func setupHostsEntries() error {
+	cfg := &config.HostsEntries
+	if cfg.Domain != "" {
+		cfg.Domain = dns.Fqdn(strings.Trim(cfg.Domain, "."))
+		if _, ok := dns.IsDomainName(cfg.Domain); !ok {
+			return fmt.Errorf("hosts_entries.domain: invalid name %q", cfg.Domain)
+		}
+	}
+	return nil
+}
+
+type hostsEntry struct {
+	name string
+	rec  Record
+}
+
+// isHostsLine reports whether a zone file line with these fields is in
+// hosts form: zone lines start with an owner name, never an address.
+func isHostsLine(fields []string) bool {
+	addr, _, _ := strings.Cut(fields[0], "%")
+	return net.ParseIP(addr) != nil
+}
+
+// parseHostsLine returns the records for one hosts line.
+func (zs zoneSyntax) parseHostsLine(line string) ([]hostsEntry, error) {
+	line, _, _ = strings.Cut(line, "#")
+	fields := strings.Fields(line)
+	if strings.Contains(fields[0], "%") {
+		return nil, fmt.Errorf("scoped address %s", fields[0])
+	}
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("no names for %s", fields[0])
+	}
+	ip := net.ParseIP(fields[0])
+	cfg := config.HostsEntries
+	ttl := cfg.TTL
+	if ttl == 0 {
+		ttl = zs.defaultTTL
+	}
+	if ttl == 0 {
+		ttl = defaultHostsTTL
+	}
+	rec := Record{Type: "AAAA", TTL: ttl, Data: ip.String()}
+	if ip.To4() != nil {
+		rec.Type = "A"
+	}
+
+	var entries []hostsEntry
+	for _, n := range fields[1:] {
+		if zs.origin == "" && cfg.Domain != "" && !strings.Contains(strings.TrimSuffix(n, "."), ".") {
+			n = strings.TrimSuffix(n, ".") + "." + cfg.Domain
+		}
+		name := zs.qualify(n)
+		if _, ok := dns.IsDomainName(name); !ok {
+			return nil, fmt.Errorf("invalid name %s", n)
+		}
+		if zs.origin != "" && !dns.IsSubDomain(zs.origin, strings.ToLower(name)) {
+			return nil, fmt.Errorf("%s is outside zone %s", name, zs.origin)
+		}
+		entries = append(entries, hostsEntry{name: name, rec: rec})
+	}
+	if cfg.PTR && zs.origin == "" {
+		rev, err := dns.ReverseAddr(ip.String())
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, hostsEntry{name: rev, rec: Record{Type: "PTR", TTL: ttl, Data: entries[0].name}})
+	}
+	return entries, nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Zone files may pull in other files and define values once:
+//
+//	$VAR backend 10.0.0.5
+//	$INCLUDE services.zone
+//	api.example.local. 300 IN A ${backend}
+//
+// $INCLUDE paths are relative to the including file. Variables are visible
+// to every line after their definition, included files too, and a later
+// $VAR replaces the value from then on.
+
+var (
+	zoneVarName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	zoneVarRef  = regexp.MustCompile(`\$\{([^}]*)\}`)
+)
+
+// zoneReader reads one zone file and everything it includes.
+type zoneReader struct {
+	zs    zoneSyntax
+	vars  map[string]string
+	stack []string // files being read, outermost first
+	files []string // every file read, for change detection
+	recs  map[string][]Record
+
+	// For check-zone: skipped lines go to problem instead of the log, and
+	// sources, when set, gets "file:line" for each record in recs.
+	problem func(path string, line int, err error)
+	sources map[string][]string
+
+	// For reloads: the first line that doesn't parse fails the whole load
+	// instead of being skipped; it ends up in failed.
+	strict bool
+	failed error
+}
+
+var (
+	zoneIncludesMu sync.Mutex
+	zoneIncludes   = make(map[string][]string) // zone file -> files it included at its last load
+)
+
+func loadZoneFileIn(path string, zs zoneSyntax) (map[string][]Record, error) {
+	return readZoneFile(path, zs, false)
+}
+
+// readZoneFile loads path; with strict, a line that doesn't parse is an
+// error rather than skipped.
+func readZoneFile(path string, zs zoneSyntax, strict bool) (map[string][]Record, error) {
+	zr := &zoneReader{zs: zs, vars: make(map[string]string), recs: make(map[string][]Record), strict: strict}
+	if err := zr.read(path); err != nil {
+		return nil, err
+	}
+	if zr.failed != nil {
+		return nil, zr.failed
+	}
+	for name, recs := range zr.recs {
+		if err := checkCanaries(name, recs); err != nil {
+			return nil, err
+		}
+	}
+	zoneIncludesMu.Lock()
+	zoneIncludes[path] = zr.files[1:]
+	zoneIncludesMu.Unlock()
+	return zr.recs, nil
+}
+
+func (zr *zoneReader) read(path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	for i, p := range zr.stack {
+		if p == abs {
+			return fmt.Errorf("$INCLUDE cycle: %s", strings.Join(append(zr.stack[i:], abs), " -> "))
+		}
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	zr.stack = append(zr.stack, abs)
+	defer func() { zr.stack = zr.stack[:len(zr.stack)-1] }()
+	zr.files = append(zr.files, path)
+	return zr.readFrom(path, file)
+}
+
+// readFrom reads zone lines, or a structured record file, from r, which
+// came from path.
+func (zr *zoneReader) readFrom(path string, r io.Reader) error {
+	if isStructuredZone(path) {
+		return zr.readRecords(path, r)
+	}
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line, err := zr.expand(scanner.Text())
+		if err != nil {
+			zr.skip(path, lineNum, err)
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 0 && strings.HasPrefix(fields[0], "$") {
+			if err := zr.directive(path, fields); err != nil {
+				return fmt.Errorf("%s line %d: %v", path, lineNum, err)
+			}
+			continue
+		}
+		if len(fields) > 0 && isHostsLine(fields) {
+			entries, err := zr.zs.parseHostsLine(line)
+			if err != nil {
+				zr.skip(path, lineNum, err)
+				continue
+			}
+			for _, e := range entries {
+				if e.rec.Type == "PTR" && slices.ContainsFunc(zr.recs[e.name], func(r Record) bool { return r.Type == "PTR" }) {
+					continue // an earlier line has the address
+				}
+				zr.add(e.name, e.rec, path, lineNum)
+			}
+			continue
+		}
+		name, rec, ok, err := zr.zs.parseLine(line)
+		if err != nil {
+			zr.skip(path, lineNum, err)
+			continue
+		}
+		if ok {
+			zr.add(name, rec, path, lineNum)
+		}
+	}
+	return scanner.Err()
+}
+
+func (zr *zoneReader) add(name string, rec Record, path string, line int) {
+	zr.recs[name] = append(zr.recs[name], rec)
+	if zr.sources != nil {
+		zr.sources[name] = append(zr.sources[name], fmt.Sprintf("%s:%d", path, line))
+	}
+}
+
+func (zr *zoneReader) skip(path string, line int, err error) {
+	if zr.problem != nil {
+		zr.problem(path, line, err)
+		return
+	}
+	if zr.strict {
+		if zr.failed == nil {
+			zr.failed = fmt.Errorf("%s line %d: %v", path, line, err)
+		}
+		return
+	}
+	log.Printf("Skipping %s line %d: %v", path, line, err)
+}
+
+// directive handles a $ line. Errors here fail the whole load: a missing
+// include or a cycle would otherwise silently drop records.
+func (zr *zoneReader) directive(path string, fields []string) error {
+	switch strings.ToUpper(fields[0]) {
+	case "$INCLUDE":
+		if len(fields) != 2 {
+			return fmt.Errorf("usage: $INCLUDE <file>")
+		}
+		if isRemoteZone(path) {
+			return fmt.Errorf("$INCLUDE is not available in a remote zone")
+		}
+		inc := fields[1]
+		if !filepath.IsAbs(inc) {
+			inc = filepath.Join(filepath.Dir(path), inc)
+		}
+		return zr.read(inc)
+	case "$VAR":
+		if len(fields) != 3 || !zoneVarName.MatchString(fields[1]) {
+			return fmt.Errorf("usage: $VAR <name> <value>")
+		}
+		zr.vars[fields[1]] = fields[2]
+		return nil
+	}
+	return fmt.Errorf("unknown directive %s", fields[0])
+}
+
+// expand substitutes ${name} references in line.
+func (zr *zoneReader) expand(line string) (string, error) {
+	return expandZoneVars(line, zr.vars)
+}
+
+func expandZoneVars(line string, vars map[string]string) (string, error) {
+	var missing string
+	line = zoneVarRef.ReplaceAllStringFunc(line, func(ref string) string {
+		name := ref[2 : len(ref)-1]
+		val, ok := vars[name]
+		if !ok && missing == "" {
+			missing = name
+		}
+		return val
+	})
+	if missing != "" {
+		return "", fmt.Errorf("undefined variable %q", missing)
+	}
+	return line, nil
+}
+
+// zoneModTime returns the latest modification time of a zone file and the
+// files it included when last loaded, so editing an included file reloads
+// the zone too.
+func zoneModTime(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	latest := info.ModTime()
+	zoneIncludesMu.Lock()
+	included := zoneIncludes[path]
+	zoneIncludesMu.Unlock()
+	for _, inc := range included {
+		// A vanished include shows up as a load error on the next change
+		// to the zone file itself.
+		if info, err := os.Stat(inc); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
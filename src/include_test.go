@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeZoneFiles writes name -> content under a temporary directory and
+// returns the directory.
+func writeZoneFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestReadZoneFileIncludes(t *testing.T) {
+	old := *config
+	t.Cleanup(func() { *config = old })
+	config.HostsEntries = HostsEntriesConfig{Domain: "lan.", PTR: true}
+
+	dir := writeZoneFiles(t, map[string]string{
+		"main.txt": `$VAR backend 10.0.0.5
+$INCLUDE sub/services.txt
+api.local.   300 IN A ${backend}
+$VAR backend 10.0.0.6
+later.local. 300 IN A ${backend}
+bad.local.   300 IN A ${nope}
+10.0.0.9     nas nas.local.   # hosts form
+`,
+		"sub/services.txt": `$INCLUDE more.txt
+svc.local. 300 IN A ${backend}
+`,
+		"sub/more.txt": "more.local. 300 IN CNAME svc.local.\n",
+	})
+	mainPath := filepath.Join(dir, "main.txt")
+
+	recs, err := readZoneFile(mainPath, zoneSyntax{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"api.local.":             "10.0.0.5",
+		"svc.local.":             "10.0.0.5",
+		"more.local.":            "svc.local.",
+		"later.local.":           "10.0.0.6",
+		"nas.lan.":               "10.0.0.9",
+		"nas.local.":             "10.0.0.9",
+		"9.0.0.10.in-addr.arpa.": "nas.lan.",
+	}
+	for name, data := range want {
+		if got := recs[name]; len(got) != 1 || got[0].Data != data {
+			t.Errorf("%s: %v, want %s", name, got, data)
+		}
+	}
+	if _, ok := recs["bad.local."]; ok {
+		t.Error("line with an undefined variable was kept")
+	}
+	zoneIncludesMu.Lock()
+	included := zoneIncludes[mainPath]
+	zoneIncludesMu.Unlock()
+	if len(included) != 2 {
+		t.Errorf("included files %v", included)
+	}
+
+	// Under strict, as on reload, the bad line fails the load.
+	if _, err := readZoneFile(mainPath, zoneSyntax{}, true); err == nil || !strings.Contains(err.Error(), "line 6") {
+		t.Errorf("strict read: %v", err)
+	}
+}
+
+func TestReadZoneFileIncludeErrors(t *testing.T) {
+	dir := writeZoneFiles(t, map[string]string{
+		"a.txt":       "$INCLUDE b.txt\n",
+		"b.txt":       "$INCLUDE a.txt\n",
+		"missing.txt": "$INCLUDE nowhere.txt\n",
+		"bad.txt":     "$VAR 1x value\n",
+	})
+	for file, want := range map[string]string{
+		"a.txt":       "$INCLUDE cycle",
+		"missing.txt": "nowhere.txt",
+		"bad.txt":     "usage: $VAR",
+	} {
+		if _, err := readZoneFile(filepath.Join(dir, file), zoneSyntax{}, false); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: %v, want %q", file, err, want)
+		}
+	}
+}
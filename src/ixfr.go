@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// Incremental transfers (RFC 1995). A zone served to secondaries keeps
+// the differences between its recent versions, worked out on every reload
+// or transfer, and answers an IXFR from a serial it has changes from with
+// just those changes. Older serials get the whole zone, as do clients when
+// the changes would outweigh it. Secondaries here ask their masters for
+// IXFR once they hold a version of the zone.
+
+// ixfrMaxDeltas bounds the versions a zone keeps changes for.
+const ixfrMaxDeltas = 16
+
+// xfrVersion is a zone as a transfer would send it.
+type xfrVersion struct {
+	soa *dns.SOA
+	rrs []dns.RR
+}
+
+// zoneDelta is the change from one serial to the next.
+type zoneDelta struct {
+	from, to       *dns.SOA
+	deleted, added []dns.RR
+}
+
+// version returns the zone's current version for a later noteDelta, or
+// nil when no secondary can ask for changes.
+func (z *zone) version() *xfrVersion {
+	if len(z.transferACL) == 0 || z.catalog {
+		return nil
+	}
+	soa := z.soa().(*dns.SOA)
+	if soa.Serial == 0 {
+		return nil // nothing loaded yet
+	}
+	return &xfrVersion{soa: soa, rrs: z.zoneRRs()}
+}
+
+// noteDelta records how the zone changed since old.
+func (z *zone) noteDelta(old *xfrVersion) {
+	if old == nil {
+		return
+	}
+	cur := z.version()
+	if cur == nil || cur.soa.Serial == old.soa.Serial {
+		return
+	}
+	d := zoneDelta{from: old.soa, to: cur.soa}
+	oldCount := make(map[string]int, len(old.rrs))
+	for _, rr := range old.rrs {
+		oldCount[rr.String()]++
+	}
+	newCount := make(map[string]int, len(cur.rrs))
+	for _, rr := range cur.rrs {
+		newCount[rr.String()]++
+	}
+	for _, rr := range old.rrs {
+		if k := rr.String(); newCount[k] > 0 {
+			newCount[k]--
+		} else {
+			d.deleted = append(d.deleted, rr)
+		}
+	}
+	for _, rr := range cur.rrs {
+		if k := rr.String(); oldCount[k] > 0 {
+			oldCount[k]--
+		} else {
+			d.added = append(d.added, rr)
+		}
+	}
+
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if n := len(z.deltas); n > 0 && (z.deltas[n-1].to.Serial != d.from.Serial || !serialNewer(d.to.Serial, d.from.Serial)) {
+		// The chain is broken, e.g. the serial went back.
+		z.deltas = nil
+	}
+	z.deltas = append(z.deltas, d)
+	size := 0
+	for _, d := range z.deltas {
+		size += len(d.deleted) + len(d.added)
+	}
+	for len(z.deltas) > ixfrMaxDeltas || (len(z.deltas) > 0 && size > len(cur.rrs)) {
+		size -= len(z.deltas[0].deleted) + len(z.deltas[0].added)
+		z.deltas = z.deltas[1:]
+	}
+}
+
+// incrementalRecords returns the IXFR answer to r: the current SOA alone
+// for a client that is up to date, or the changes since its serial. It
+// returns nil when the zone has no changes from that serial.
+func (z *zone) incrementalRecords(r *dns.Msg) []dns.RR {
+	var from *dns.SOA
+	for _, rr := range r.Ns {
+		if s, ok := rr.(*dns.SOA); ok {
+			from = s
+		}
+	}
+	if from == nil {
+		return nil
+	}
+	cur := z.soa().(*dns.SOA)
+	if !serialNewer(cur.Serial, from.Serial) {
+		return []dns.RR{cur}
+	}
+	z.mu.Lock()
+	deltas := z.deltas
+	z.mu.Unlock()
+	if len(deltas) == 0 || deltas[len(deltas)-1].to.Serial != cur.Serial {
+		return nil
+	}
+	for i, d := range deltas {
+		if d.from.Serial != from.Serial {
+			continue
+		}
+		out := []dns.RR{cur}
+		for _, d := range deltas[i:] {
+			out = append(out, d.from)
+			out = append(out, d.deleted...)
+			out = append(out, d.to)
+			out = append(out, d.added...)
+		}
+		return append(out, cur)
+	}
+	return nil
+}
+
+// isIncremental reports whether a transfer's records are IXFR changes
+// rather than the whole zone: the second record is an older SOA.
+func isIncremental(rrs []dns.RR) bool {
+	if len(rrs) < 3 {
+		return false
+	}
+	first, ok1 := rrs[0].(*dns.SOA)
+	second, ok2 := rrs[1].(*dns.SOA)
+	return ok1 && ok2 && first.Serial != second.Serial
+}
+
+// applyIncremental applies IXFR changes to a copy of the zone's records.
+func (z *zone) applyIncremental(rrs []dns.RR) (*dns.SOA, map[string][]Record, error) {
+	z.mu.Lock()
+	cur := z.xfrSOA
+	z.mu.Unlock()
+	if cur == nil {
+		return nil, nil, fmt.Errorf("no version held to apply changes to")
+	}
+	last := rrs[0].(*dns.SOA)
+	recs := z.recordsCopy()
+	serial := cur.Serial
+	i := 1
+	for i < len(rrs)-1 {
+		from, ok := rrs[i].(*dns.SOA)
+		if !ok || from.Serial != serial {
+			return nil, nil, fmt.Errorf("changes don't follow on from serial %d", serial)
+		}
+		for i++; i < len(rrs) && !isSOA(rrs[i]); i++ {
+			if err := z.deleteRR(recs, rrs[i]); err != nil {
+				return nil, nil, err
+			}
+		}
+		if i >= len(rrs)-1 {
+			return nil, nil, fmt.Errorf("changes from serial %d cut short", serial)
+		}
+		serial = rrs[i].(*dns.SOA).Serial
+		for i++; i < len(rrs) && !isSOA(rrs[i]); i++ {
+			name := dns.CanonicalName(rrs[i].Header().Name)
+			if rec, ok := rrToRecord(rrs[i]); ok && dns.IsSubDomain(z.origin, name) {
+				recs[name] = append(recs[name], rec)
+			}
+		}
+	}
+	if serial != last.Serial {
+		return nil, nil, fmt.Errorf("changes end at serial %d, not %d", serial, last.Serial)
+	}
+	return last, recs, nil
+}
+
+// deleteRR removes rr from recs. Records of types the store can't hold
+// were never kept, so their deletion is a no-op.
+func (z *zone) deleteRR(recs map[string][]Record, rr dns.RR) error {
+	if _, ok := rrToRecord(rr); !ok {
+		return nil
+	}
+	name := dns.CanonicalName(rr.Header().Name)
+	list := recs[name]
+	for j, rec := range list {
+		if held := recordToRR(name, rec); held != nil && dns.IsDuplicate(held, rr) {
+			list = append(list[:j:j], list[j+1:]...)
+			if len(list) == 0 {
+				delete(recs, name)
+			} else {
+				recs[name] = list
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("deleted record %s is not in the zone", rr.String())
+}
+
+func isSOA(rr dns.RR) bool {
+	_, ok := rr.(*dns.SOA)
+	return ok
+}
+
+// recordsCopy returns a copy of the zone's records that can be changed.
+func (z *zone) recordsCopy() map[string][]Record {
+	src := records.source(z.source())
+	out := make(map[string][]Record, len(src))
+	for name, rs := range src {
+		out[name] = append([]Record(nil), rs...)
+	}
+	return out
+}
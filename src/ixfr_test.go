@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// withRecords gives the test an empty record store.
+func withRecords(t *testing.T) {
+	old := records
+	records = newRecordStore()
+	t.Cleanup(func() { records = old })
+}
+
+// setZoneVersion installs recs as the zone's records at serial.
+func setZoneVersion(z *zone, serial uint32, recs map[string][]Record) {
+	old := z.version()
+	z.mu.Lock()
+	z.serial = serial
+	z.mu.Unlock()
+	records.setSource(z.source(), recs)
+	z.noteDelta(old)
+}
+
+func ixfrRequest(serial uint32) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetIxfr("example.com.", serial, "ns.example.com.", "hostmaster.example.com.")
+	return r
+}
+
+func TestIXFR(t *testing.T) {
+	withRecords(t)
+	_, acl, _ := net.ParseCIDR("192.0.2.0/24")
+	primary := &zone{origin: "example.com.", transferACL: []*net.IPNet{acl}}
+
+	v1 := map[string][]Record{
+		"www.example.com.":  {{Type: "A", TTL: 300, Data: "192.0.2.1"}},
+		"mail.example.com.": {{Type: "MX", TTL: 300, Data: "mx.example.com.", Pref: 10}},
+	}
+	v2 := map[string][]Record{
+		"www.example.com.":  {{Type: "A", TTL: 300, Data: "192.0.2.2"}},
+		"mail.example.com.": {{Type: "MX", TTL: 300, Data: "mx.example.com.", Pref: 10}},
+		"new.example.com.":  {{Type: "TXT", TTL: 300, Data: `"hello"`}},
+	}
+	v3 := map[string][]Record{
+		"www.example.com.": {{Type: "A", TTL: 300, Data: "192.0.2.2"}},
+		"new.example.com.": {{Type: "TXT", TTL: 300, Data: `"hello"`}},
+	}
+	// Unchanged records, so the changes stay smaller than the zone and
+	// are kept.
+	for _, v := range []map[string][]Record{v1, v2, v3} {
+		for i := 0; i < 10; i++ {
+			v[fmt.Sprintf("host%d.example.com.", i)] = []Record{{Type: "A", TTL: 300, Data: fmt.Sprintf("192.0.2.%d", 100+i)}}
+		}
+	}
+	setZoneVersion(primary, 1, v1)
+	setZoneVersion(primary, 2, v2)
+	setZoneVersion(primary, 3, v3)
+
+	if got := primary.incrementalRecords(ixfrRequest(3)); len(got) != 1 || got[0].(*dns.SOA).Serial != 3 {
+		t.Errorf("up to date client got %v", got)
+	}
+	if got := primary.incrementalRecords(ixfrRequest(7)); len(got) != 1 {
+		t.Errorf("client ahead of us got %v", got)
+	}
+	if got := primary.incrementalRecords(ixfrRequest(0)); got != nil {
+		t.Errorf("client with an unknown serial got changes %v", got)
+	}
+
+	changes := primary.incrementalRecords(ixfrRequest(1))
+	var serials []uint32
+	for _, rr := range changes {
+		if soa, ok := rr.(*dns.SOA); ok {
+			serials = append(serials, soa.Serial)
+		}
+	}
+	// cur, (from 1, to 2), (from 2, to 3), cur
+	if want := []uint32{3, 1, 2, 2, 3, 3}; !equalSerials(serials, want) {
+		t.Fatalf("SOA sequence %v, want %v", serials, want)
+	}
+	if !isIncremental(changes) {
+		t.Error("changes not recognised as incremental")
+	}
+	if len(changes) != 6+4 { // www deleted and added, TXT added, MX deleted
+		t.Errorf("%d records in %v", len(changes), changes)
+	}
+
+	// A secondary holding serial 1 applies them and ends up with v3.
+	secondary := &zone{origin: "example.com.", secondary: true, ZoneConfig: ZoneConfig{Name: "example.com."}}
+	secondary.xfrSOA = &dns.SOA{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET}, Serial: 1}
+	saved := records.source(primary.source())
+	records.setSource(primary.source(), v1)
+	soa, recs, err := secondary.applyIncremental(changes)
+	records.setSource(primary.source(), saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if soa.Serial != 3 || !sameRecords(recs, v3) {
+		t.Errorf("serial %d, records %v", soa.Serial, recs)
+	}
+
+	// Changes that don't start from the held serial are refused.
+	secondary.xfrSOA.Serial = 2
+	if _, _, err := secondary.applyIncremental(changes); err == nil {
+		t.Error("changes from serial 1 applied to serial 2")
+	}
+
+	// A serial that goes back breaks the chain.
+	setZoneVersion(primary, 2, v2)
+	if got := primary.incrementalRecords(ixfrRequest(1)); got != nil {
+		t.Errorf("changes across a serial going back: %v", got)
+	}
+}
+
+func equalSerials(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func sameRecords(a, b map[string][]Record) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, ra := range a {
+		rb := b[name]
+		if len(ra) != len(rb) {
+			return false
+		}
+		var sa, sb []string
+		for i := range ra {
+			sa = append(sa, recordToRR(name, ra[i]).String())
+			sb = append(sb, recordToRR(name, rb[i]).String())
+		}
+		sort.Strings(sa)
+		sort.Strings(sb)
+		for i := range sa {
+			if sa[i] != sb[i] {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// WriteBackConfig persists dynamic changes (UPDATE, admin API) to the zone
+// file. Each change is appended to a journal at once and merged into the
+// zone file every Interval seconds: changed records are edited in place,
+// new ones go next to their owner's other records and everything else,
+// comments and alignment included, is left as written. Lines using $VAR
+// values are matched as expanded; a zone file with $INCLUDE is refused, as
+// the records of included files can't be edited in place.
+type WriteBackConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	Journal  string `yaml:"journal"`  // default: hosts_file + ".journal"
+	Interval int    `yaml:"interval"` // seconds between merges, default 5
+}
+
+// journalEntry adds or removes one record, as a zone file line.
+type journalEntry struct {
+	txn  int
+	add  bool
+	line string
+}
+
+var (
+	// zoneFileMu serializes reading, writing and stat-ing the zone file.
+	zoneFileMu sync.Mutex
+
+	journalMu      sync.Mutex // guards the fields below; never held while taking another lock
+	journalFile    *os.File
+	journalPending []journalEntry
+	journalTxn     int
+)
+
+func setupWriteBack() error {
+	cfg := &config.WriteBack
+	if !cfg.Enabled {
+		return nil
+	}
+	if config.Mode == modeForwarder || config.HostsFile == "" {
+		return fmt.Errorf("write_back needs a zone file")
+	}
+	if isRemoteZone(config.HostsFile) {
+		return fmt.Errorf("write_back needs a local zone file, not a URL")
+	}
+	if isStructuredZone(config.HostsFile) {
+		return fmt.Errorf("write_back needs a zone line file, not a structured record file")
+	}
+	if inc, err := zoneFileIncludes(config.HostsFile); err != nil {
+		return fmt.Errorf("write_back: %v", err)
+	} else if inc {
+		return fmt.Errorf("write_back can't edit records from $INCLUDEd files; remove $INCLUDE from %s or turn write_back off", config.HostsFile)
+	}
+	if cfg.Journal == "" {
+		cfg.Journal = config.HostsFile + ".journal"
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 5
+	}
+	f, err := os.OpenFile(cfg.Journal, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("write_back.journal: %v", err)
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, ";"):
+			journalTxn++
+		case strings.HasPrefix(line, "+ "), strings.HasPrefix(line, "- "):
+			journalPending = append(journalPending, journalEntry{txn: journalTxn, add: line[0] == '+', line: line[2:]})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("write_back.journal: %v", err)
+	}
+	if len(journalPending) > 0 {
+		log.Printf("Zone journal %s holds %d unmerged change(s)", cfg.Journal, len(journalPending))
+	}
+	journalFile = f
+	return nil
+}
+
+// zoneFileIncludes reports whether the zone file at path has an $INCLUDE
+// line.
+func zoneFileIncludes(path string) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if f := strings.Fields(line); len(f) > 0 && strings.EqualFold(f[0], "$INCLUDE") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// formatZoneLine renders a record the way loadZoneFile reads it.
+func formatZoneLine(name string, rec Record) string {
+	data := rec.Data
+	switch rec.Type {
+	case "MX":
+		data = fmt.Sprintf("%d %s", rec.Pref, rec.Data)
+	case "SRV":
+		data = fmt.Sprintf("%d %d %d %s", rec.Pref, rec.SrvWeight, rec.Port, rec.Data)
+	}
+	line := fmt.Sprintf("%s %d IN %s %s", name, rec.TTL, rec.Type, data)
+	if rec.Canary > 0 {
+		line += fmt.Sprintf(" canary=%d", rec.Canary)
+	}
+	if rec.Weight > 0 {
+		line += fmt.Sprintf(" weight=%d", rec.Weight)
+	}
+	if len(rec.Countries) > 0 {
+		line += " country=" + strings.Join(rec.Countries, ",")
+	}
+	if len(rec.Continents) > 0 {
+		line += " continent=" + strings.Join(rec.Continents, ",")
+	}
+	return line
+}
+
+// journalChange records how the zone records of the names in old changed:
+// old holds each name's records before the change, recs the zone after it.
+// It runs inside records.updateSource so entries are journaled in the
+// order they were applied.
+func journalChange(origin string, old, recs map[string][]Record) {
+	if journalFile == nil {
+		return
+	}
+	var entries []journalEntry
+	for name, before := range old {
+		was := make(map[string]int)
+		for _, rec := range before {
+			was[formatZoneLine(name, rec)]++
+		}
+		for _, rec := range recs[name] {
+			line := formatZoneLine(name, rec)
+			if was[line] > 0 {
+				was[line]--
+				continue
+			}
+			entries = append(entries, journalEntry{add: true, line: line})
+		}
+		for _, rec := range before {
+			line := formatZoneLine(name, rec)
+			if was[line] > 0 {
+				was[line]--
+				entries = append(entries, journalEntry{line: line})
+			}
+		}
+	}
+	if len(entries) == 0 {
+		return
+	}
+	// Removals first, so a changed record can take its old line.
+	slices.SortStableFunc(entries, func(a, b journalEntry) int {
+		if a.add == b.add {
+			return strings.Compare(a.line, b.line)
+		}
+		if a.add {
+			return 1
+		}
+		return -1
+	})
+
+	journalMu.Lock()
+	defer journalMu.Unlock()
+	journalTxn++
+	var b strings.Builder
+	fmt.Fprintf(&b, "; %s %s\n", time.Now().UTC().Format(time.RFC3339), origin)
+	for i := range entries {
+		entries[i].txn = journalTxn
+		op := "-"
+		if entries[i].add {
+			op = "+"
+		}
+		fmt.Fprintf(&b, "%s %s\n", op, entries[i].line)
+	}
+	if _, err := journalFile.WriteString(b.String()); err != nil {
+		log.Printf("Failed to journal zone change: %v", err)
+		return
+	}
+	journalFile.Sync()
+	journalPending = append(journalPending, entries...)
+}
+
+// installZone publishes records loaded from the zone file, with any
+// unmerged journal entries applied on top.
+func installZone(recs map[string][]Record) {
+	if journalFile == nil {
+		overlayCluster(recs)
+		records.setSource(sourceZone, recs)
+		snapshotZone("zone file loaded", recs)
+		return
+	}
+	records.updateSource(sourceZone, func(cur map[string][]Record) {
+		clear(cur)
+		maps.Copy(cur, recs)
+		replayJournal(cur)
+		overlayCluster(cur)
+		snapshotZone("zone file loaded", cur)
+	})
+}
+
+// replayJournal applies unmerged changes to records loaded from the zone
+// file. Entries already reflected in the file are no-ops.
+func replayJournal(recs map[string][]Record) {
+	journalMu.Lock()
+	pending := append([]journalEntry(nil), journalPending...)
+	journalMu.Unlock()
+	for _, e := range pending {
+		name, rec, ok, err := parseZoneLine(e.line)
+		if !ok || err != nil {
+			continue
+		}
+		i := slices.IndexFunc(recs[name], func(r Record) bool { return formatZoneLine(name, r) == e.line })
+		switch {
+		case e.add && i < 0:
+			recs[name] = append(recs[name][:len(recs[name]):len(recs[name])], rec)
+		case !e.add && i >= 0:
+			recs[name] = slices.Delete(slices.Clone(recs[name]), i, i+1)
+			if len(recs[name]) == 0 {
+				delete(recs, name)
+			}
+		}
+	}
+}
+
+// watchZoneJournal merges journaled changes into the zone file.
+func watchZoneJournal() {
+	for {
+		time.Sleep(time.Duration(config.WriteBack.Interval) * time.Second)
+		if err := mergeJournal(); err != nil {
+			log.Printf("Failed to write zone changes back to %s: %v", config.HostsFile, err)
+		}
+	}
+}
+
+func mergeJournal() error {
+	zoneFileMu.Lock()
+	defer zoneFileMu.Unlock()
+
+	journalMu.Lock()
+	pending := append([]journalEntry(nil), journalPending...)
+	journalMu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	if err := backupZoneFileLocked("write-back"); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(config.HostsFile)
+	if err != nil {
+		return err
+	}
+	text := strings.TrimSuffix(string(data), "\n")
+	merged, missing := mergeZoneLines(strings.Split(text, "\n"), pending)
+	if err := checkMissingRemovals(missing); err != nil {
+		// Keep the journal: truncating it would bring the record back on
+		// the next load.
+		return err
+	}
+	if err := writeFileAtomic(config.HostsFile, []byte(strings.Join(merged, "\n")+"\n")); err != nil {
+		return err
+	}
+	if mtime, err := zoneModTime(config.HostsFile); err == nil {
+		hostsFileModTime = mtime
+	}
+
+	// Keep whatever was journaled while the file was being written.
+	journalMu.Lock()
+	defer journalMu.Unlock()
+	journalPending = journalPending[len(pending):]
+	if err := journalFile.Truncate(0); err != nil {
+		return err
+	}
+	var b strings.Builder
+	txn := -1
+	for _, e := range journalPending {
+		if e.txn != txn {
+			txn = e.txn
+			fmt.Fprintf(&b, "; %s pending\n", time.Now().UTC().Format(time.RFC3339))
+		}
+		op := "-"
+		if e.add {
+			op = "+"
+		}
+		fmt.Fprintf(&b, "%s %s\n", op, e.line)
+	}
+	if _, err := journalFile.WriteString(b.String()); err != nil {
+		return err
+	}
+	log.Printf("Wrote %d zone change(s) back to %s", len(pending), config.HostsFile)
+	return journalFile.Sync()
+}
+
+// zoneLine is a zone file line with the record it holds, if any.
+type zoneLine struct {
+	text  string
+	key   string // formatZoneLine of the record; "" for comments and blanks
+	owner string
+}
+
+// checkMissingRemovals fails if a record whose removal found no line to
+// delete is still loaded from the zone file, e.g. from a hosts form line.
+// A record already gone from the file is fine: someone removed it by hand.
+func checkMissingRemovals(missing []string) error {
+	if len(missing) == 0 {
+		return nil
+	}
+	recs, err := loadZoneFileIn(config.HostsFile, hostsFileSyntax())
+	if err != nil {
+		return err
+	}
+	for _, line := range missing {
+		name, _, ok, err := parseZoneLine(line)
+		if !ok || err != nil {
+			continue
+		}
+		if slices.ContainsFunc(recs[name], func(r Record) bool { return formatZoneLine(name, r) == line }) {
+			return fmt.Errorf("can't remove %q: no zone line matches it, so the journal is kept", line)
+		}
+		log.Printf("Zone write-back: %q is no longer in the file", line)
+	}
+	return nil
+}
+
+// mergeZoneLines applies journal entries to the lines of a zone file. A
+// removal paired with an addition of the same owner and type in one
+// transaction rewrites the line in place; other additions follow the
+// owner's last line, or the end of the file. Lines are matched with $VAR
+// references expanded. It also returns the removals no line matched.
+func mergeZoneLines(text []string, entries []journalEntry) ([]string, []string) {
+	lines := make([]zoneLine, len(text))
+	vars := make(map[string]string)
+	for i, t := range text {
+		lines[i].text = t
+		if f := strings.Fields(t); len(f) == 3 && strings.EqualFold(f[0], "$VAR") {
+			vars[f[1]] = f[2]
+			continue
+		}
+		expanded, err := expandZoneVars(t, vars)
+		if err != nil {
+			continue
+		}
+		if name, rec, ok, err := parseZoneLine(expanded); ok && err == nil {
+			lines[i].key = formatZoneLine(name, rec)
+			lines[i].owner = name
+		}
+	}
+	find := func(key string) int {
+		return slices.IndexFunc(lines, func(l zoneLine) bool { return l.key == key })
+	}
+	ownerAndType := func(line string) string {
+		f := strings.Fields(line)
+		return dns.Fqdn(strings.ToLower(f[0])) + " " + f[3]
+	}
+
+	var missing []string
+	used := make([]bool, len(entries))
+	for i, e := range entries {
+		if used[i] || e.add {
+			continue
+		}
+		used[i] = true
+		at := find(e.line)
+		if at < 0 {
+			missing = append(missing, e.line)
+			continue
+		}
+		j := -1
+		for k, o := range entries {
+			if !used[k] && o.add && o.txn == e.txn && ownerAndType(o.line) == ownerAndType(e.line) {
+				j = k
+				break
+			}
+		}
+		if j >= 0 {
+			used[j] = true
+			lines[at].text = restyleLine(lines[at].text, entries[j].line)
+			lines[at].key = entries[j].line
+			continue
+		}
+		lines = slices.Delete(lines, at, at+1)
+	}
+	for i, e := range entries {
+		if used[i] || find(e.line) >= 0 {
+			continue
+		}
+		name, _, _, _ := parseZoneLine(e.line)
+		l := zoneLine{text: e.line, key: e.line, owner: name}
+		last := -1
+		for k := range lines {
+			if lines[k].owner == name {
+				last = k
+			}
+		}
+		if last < 0 {
+			// A new owner: borrow the layout of a similar record line.
+			n := len(strings.Fields(e.line))
+			for k := range lines {
+				if lines[k].key != "" && len(strings.Fields(lines[k].text)) == n {
+					l.text = restyleLine(lines[k].text, e.line)
+					break
+				}
+			}
+			lines = append(lines, l)
+			continue
+		}
+		l.text = restyleLine(lines[last].text, e.line)
+		lines = slices.Insert(lines, last+1, l)
+	}
+
+	out := make([]string, len(lines))
+	for i, l := range lines {
+		out[i] = l.text
+	}
+	return out, missing
+}
+
+// restyleLine returns line written with the spacing of model: when both
+// have the same number of fields, each field of model is swapped for the
+// corresponding one of line, keeping the owner as spelled in model.
+func restyleLine(model, line string) string {
+	tokens := lintTokens.FindAllString(model, -1)
+	fields := strings.Fields(line)
+	var at []int
+	for i, tok := range tokens {
+		if strings.TrimSpace(tok) != "" {
+			at = append(at, i)
+		}
+	}
+	if len(at) != len(fields) {
+		return line
+	}
+	for k, i := range at {
+		if k == 0 && dns.Fqdn(strings.ToLower(tokens[i])) == fields[0] {
+			continue
+		}
+		tokens[i] = fields[k]
+	}
+	return strings.Join(tokens, "")
+}
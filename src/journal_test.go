@@ -0,0 +1,159 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// withWriteBack sets up write-back of a fresh zone file holding content.
+func withWriteBack(t *testing.T, content string) string {
+	old := *config
+	t.Cleanup(func() {
+		if journalFile != nil {
+			journalFile.Close()
+		}
+		journalFile, journalPending, journalTxn = nil, nil, 0
+		*config = old
+	})
+	dir := t.TempDir()
+	path := filepath.Join(dir, "zones.txt")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config.Mode = modeHybrid
+	config.HostsFile = path
+	config.WriteBack = WriteBackConfig{Enabled: true}
+	config.Backup = BackupConfig{}
+	return path
+}
+
+func readZone(t *testing.T, path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestWriteBackVariables(t *testing.T) {
+	path := withWriteBack(t, `$VAR be 10.0.0.5
+www.example.   300 IN A ${be}
+api.example.   300 IN A ${be}
+other.example. 300 IN A 10.0.0.9
+`)
+	if err := setupWriteBack(); err != nil {
+		t.Fatal(err)
+	}
+	be := Record{Type: "A", TTL: 300, Data: "10.0.0.5"}
+	journalChange("test", map[string][]Record{"www.example.": {be}}, map[string][]Record{})
+	journalChange("test", map[string][]Record{"api.example.": {be}},
+		map[string][]Record{"api.example.": {{Type: "A", TTL: 300, Data: "10.0.0.6"}}})
+	if err := mergeJournal(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := readZone(t, path)
+	if strings.Contains(got, "www.example.") {
+		t.Errorf("deleted record from a ${var} line survived:\n%s", got)
+	}
+	if !strings.Contains(got, "api.example.   300 IN A 10.0.0.6") {
+		t.Errorf("changed record not rewritten in place:\n%s", got)
+	}
+	if len(journalPending) != 0 {
+		t.Errorf("%d entries left in the journal", len(journalPending))
+	}
+	recs, err := loadZoneFileIn(path, hostsFileSyntax())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := recs["www.example."]; ok {
+		t.Error("deleted record is back after a reload")
+	}
+}
+
+// A removal no line can carry out keeps the journal and reports an error
+// rather than letting the record come back on the next load.
+func TestWriteBackUnmatchedRemoval(t *testing.T) {
+	path := withWriteBack(t, "10.0.0.7 nas.example.\nother.example. 300 IN A 10.0.0.9\n")
+	if err := setupWriteBack(); err != nil {
+		t.Fatal(err)
+	}
+	journalChange("test", map[string][]Record{"nas.example.": {{Type: "A", TTL: defaultHostsTTL, Data: "10.0.0.7"}}}, map[string][]Record{})
+	if err := mergeJournal(); err == nil {
+		t.Error("merge reported success")
+	}
+	if len(journalPending) != 1 {
+		t.Errorf("journal holds %d entries, want the removal kept", len(journalPending))
+	}
+	if got := readZone(t, path); !strings.HasPrefix(got, "10.0.0.7 nas.example.") {
+		t.Errorf("zone file changed:\n%s", got)
+	}
+
+	// A record already removed from the file by hand is no error.
+	journalChange("test", map[string][]Record{"gone.example.": {{Type: "A", TTL: 300, Data: "10.0.0.1"}}}, map[string][]Record{})
+	journalPending = journalPending[1:]
+	if err := mergeJournal(); err != nil {
+		t.Errorf("removal of a record no longer in the file: %v", err)
+	}
+}
+
+func TestWriteBackRefusesIncludes(t *testing.T) {
+	path := withWriteBack(t, "$INCLUDE more.txt\n")
+	os.WriteFile(filepath.Join(filepath.Dir(path), "more.txt"), []byte("www.example. 300 IN A 10.0.0.5\n"), 0o644)
+	if err := setupWriteBack(); err == nil || !strings.Contains(err.Error(), "$INCLUDE") {
+		t.Errorf("setup: %v", err)
+	}
+}
+
+func TestWriteBackLayout(t *testing.T) {
+	path := withWriteBack(t, `; office hosts
+www.example.   300 IN A     10.0.0.1 ; web
+www.example.   300 IN AAAA  fd00::1
+
+db.example.    600 IN A     10.0.0.2
+`)
+	if err := setupWriteBack(); err != nil {
+		t.Fatal(err)
+	}
+	www := []Record{{Type: "A", TTL: 300, Data: "10.0.0.1"}, {Type: "AAAA", TTL: 300, Data: "fd00::1"}}
+	journalChange("test", map[string][]Record{"www.example.": www}, map[string][]Record{
+		"www.example.": append(www, Record{Type: "A", TTL: 300, Data: "10.0.0.3"}),
+	})
+	journalChange("test", map[string][]Record{"db.example.": {{Type: "A", TTL: 600, Data: "10.0.0.2"}}},
+		map[string][]Record{"db.example.": {{Type: "A", TTL: 600, Data: "10.0.0.4"}}})
+	journalChange("test", map[string][]Record{"mail.example.": nil}, map[string][]Record{
+		"mail.example.": {{Type: "A", TTL: 300, Data: "10.0.0.5"}},
+	})
+
+	// Unmerged changes survive a restart in the journal.
+	journalFile.Close()
+	journalFile, journalPending, journalTxn = nil, nil, 0
+	if err := setupWriteBack(); err != nil {
+		t.Fatal(err)
+	}
+	if len(journalPending) != 4 {
+		t.Fatalf("journal replayed %d entries, want 4", len(journalPending))
+	}
+
+	if err := mergeJournal(); err != nil {
+		t.Fatal(err)
+	}
+	want := `; office hosts
+www.example.   300 IN A     10.0.0.1 ; web
+www.example.   300 IN AAAA  fd00::1
+www.example.   300 IN A  10.0.0.3
+
+db.example.    600 IN A     10.0.0.4
+mail.example.   300 IN A  10.0.0.5
+`
+	// New lines copy the spacing of the line they follow, or of a similar
+	// line for a new owner.
+	if got := readZone(t, path); got != want {
+		t.Errorf("merged file:\n%s\nwant:\n%s", got, want)
+	}
+	if len(journalPending) != 0 {
+		t.Errorf("%d entries left in the journal", len(journalPending))
+	}
+}
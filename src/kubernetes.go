@@ -0,0 +1,624 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v2"
+)
+
+// KubernetesConfig enables a backend that publishes records for cluster
+// Services and Ingresses, following the CoreDNS naming scheme:
+//
+//	<svc>.<ns>.svc.<domain>                 A     cluster IP (or pod IPs if headless)
+//	_<port>._<proto>.<svc>.<ns>.svc.<domain> SRV  named service ports
+//	<ingress host>                          A     ingress load balancer IPs
+type KubernetesConfig struct {
+	Enabled    bool     `yaml:"enabled"`
+	Domain     string   `yaml:"domain"`
+	Kubeconfig string   `yaml:"kubeconfig"` // empty means in-cluster
+	Namespaces []string `yaml:"namespaces"` // empty means all
+	Ingresses  bool     `yaml:"ingresses"`
+	Interval   int      `yaml:"interval"` // seconds between full resyncs
+	TTL        uint32   `yaml:"ttl"`
+}
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	defaultKubeTTL    = 5
+)
+
+// kubeClient talks to the Kubernetes API with plain REST calls. Watches
+// go through stream, which has no overall timeout.
+type kubeClient struct {
+	server    string
+	token     string
+	tokenFile string // read for every request when set, as the kubelet rotates it
+	http      *http.Client
+	stream    *http.Client
+}
+
+func setupKubernetes() error {
+	cfg := &config.Kubernetes
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.Domain == "" {
+		cfg.Domain = "cluster.local"
+	}
+	cfg.Domain = dns.Fqdn(strings.ToLower(cfg.Domain))
+	if cfg.Interval <= 0 {
+		cfg.Interval = 300
+	}
+	if cfg.TTL == 0 {
+		cfg.TTL = defaultKubeTTL
+	}
+	return nil
+}
+
+func newKubeClient(cfg KubernetesConfig) (*kubeClient, error) {
+	if cfg.Kubeconfig != "" {
+		return kubeClientFromKubeconfig(cfg.Kubeconfig)
+	}
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a cluster and no kubeconfig set")
+	}
+	tokenFile := serviceAccountDir + "/token"
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg, err := kubeTLSConfig(ca, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := &kubeClient{
+		server:    "https://" + host + ":" + port,
+		token:     strings.TrimSpace(string(token)),
+		tokenFile: tokenFile,
+	}
+	client.setTransport(tlsCfg)
+	return client, nil
+}
+
+// kubeconfig is the subset of the kubeconfig format the backend understands.
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string `yaml:"token"`
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+			User    string `yaml:"user"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+}
+
+func kubeClientFromKubeconfig(path string) (*kubeClient, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var kc kubeconfig
+	if err := yaml.Unmarshal(data, &kc); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	var clusterName, userName string
+	for _, c := range kc.Contexts {
+		if c.Name == kc.CurrentContext {
+			clusterName, userName = c.Context.Cluster, c.Context.User
+		}
+	}
+	if clusterName == "" {
+		return nil, fmt.Errorf("%s: current context %q not found", path, kc.CurrentContext)
+	}
+
+	client := &kubeClient{}
+	var ca, cert, key []byte
+	insecure := false
+	for _, c := range kc.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+		client.server = strings.TrimSuffix(c.Cluster.Server, "/")
+		insecure = c.Cluster.InsecureSkipTLSVerify
+		if ca, err = fileOrData(c.Cluster.CertificateAuthority, c.Cluster.CertificateAuthorityData); err != nil {
+			return nil, err
+		}
+	}
+	for _, u := range kc.Users {
+		if u.Name != userName {
+			continue
+		}
+		client.token = u.User.Token
+		if cert, err = fileOrData(u.User.ClientCertificate, u.User.ClientCertificateData); err != nil {
+			return nil, err
+		}
+		if key, err = fileOrData(u.User.ClientKey, u.User.ClientKeyData); err != nil {
+			return nil, err
+		}
+	}
+	if client.server == "" {
+		return nil, fmt.Errorf("%s: cluster %q has no server", path, clusterName)
+	}
+
+	tlsCfg, err := kubeTLSConfig(ca, cert, key)
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg.InsecureSkipVerify = insecure
+	client.setTransport(tlsCfg)
+	return client, nil
+}
+
+func (c *kubeClient) setTransport(tlsCfg *tls.Config) {
+	transport := &http.Transport{TLSClientConfig: tlsCfg}
+	c.http = &http.Client{Timeout: 30 * time.Second, Transport: transport}
+	c.stream = &http.Client{Transport: transport}
+}
+
+// fileOrData resolves a kubeconfig field that may be a path or inline
+// base64 data.
+func fileOrData(path, data string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if path != "" {
+		return os.ReadFile(path)
+	}
+	return nil, nil
+}
+
+func kubeTLSConfig(ca, cert, key []byte) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if len(ca) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("invalid cluster CA certificate")
+		}
+		cfg.RootCAs = pool
+	}
+	if len(cert) > 0 && len(key) > 0 {
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{pair}
+	}
+	return cfg, nil
+}
+
+func (c *kubeClient) do(hc *http.Client, path string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", c.server+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	token := c.token
+	if c.tokenFile != "" {
+		// Service account tokens expire and are replaced in place.
+		b, err := os.ReadFile(c.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &kubeStatusError{path: path, code: resp.StatusCode, status: resp.Status}
+	}
+	return resp, nil
+}
+
+func (c *kubeClient) get(path string, out interface{}) error {
+	resp, err := c.do(c.http, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// kubePageSize is how many items a list request asks for; the API server
+// hands out the rest in further pages.
+const kubePageSize = 500
+
+// kubeListMeta is the list metadata naming the next page.
+type kubeListMeta struct {
+	Continue string `json:"continue"`
+}
+
+// pagePath is the request for the page of the collection at path that
+// cont, a continue token, points to; "" is the first page.
+func pagePath(path, cont string) string {
+	p := path + "?limit=" + strconv.Itoa(kubePageSize)
+	if cont != "" {
+		p += "&continue=" + url.QueryEscape(cont)
+	}
+	return p
+}
+
+// kubeStatusError is a non-200 reply from the API server.
+type kubeStatusError struct {
+	path   string
+	code   int
+	status string
+}
+
+func (e *kubeStatusError) Error() string {
+	return fmt.Sprintf("GET %s: %s", e.path, e.status)
+}
+
+type kubeMeta struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+}
+
+type kubeServiceList struct {
+	Metadata kubeListMeta `json:"metadata"`
+	Items    []struct {
+		Metadata kubeMeta `json:"metadata"`
+		Spec     struct {
+			ClusterIP string `json:"clusterIP"`
+			Ports     []struct {
+				Name     string `json:"name"`
+				Protocol string `json:"protocol"`
+				Port     int    `json:"port"`
+			} `json:"ports"`
+		} `json:"spec"`
+	} `json:"items"`
+}
+
+// serviceNameLabel ties an EndpointSlice to its Service.
+const serviceNameLabel = "kubernetes.io/service-name"
+
+type kubeEndpointSliceList struct {
+	Metadata kubeListMeta `json:"metadata"`
+	Items    []struct {
+		Metadata struct {
+			kubeMeta
+			Labels map[string]string `json:"labels"`
+		} `json:"metadata"`
+		AddressType string `json:"addressType"`
+		Endpoints   []struct {
+			Addresses  []string `json:"addresses"`
+			Conditions struct {
+				Ready *bool `json:"ready"`
+			} `json:"conditions"`
+		} `json:"endpoints"`
+	} `json:"items"`
+}
+
+type kubeIngressList struct {
+	Metadata kubeListMeta `json:"metadata"`
+	Items    []struct {
+		Spec struct {
+			Rules []struct {
+				Host string `json:"host"`
+			} `json:"rules"`
+		} `json:"spec"`
+		Status struct {
+			LoadBalancer struct {
+				Ingress []struct {
+					IP string `json:"ip"`
+				} `json:"ingress"`
+			} `json:"loadBalancer"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// namespacePaths expands an API collection path for each configured
+// namespace, or the cluster-wide path if none are configured.
+func namespacePaths(group, resource string, namespaces []string) []string {
+	if len(namespaces) == 0 {
+		return []string{group + "/" + resource}
+	}
+	var paths []string
+	for _, ns := range namespaces {
+		paths = append(paths, group+"/namespaces/"+ns+"/"+resource)
+	}
+	return paths
+}
+
+// syncKubernetes builds the full record set from the cluster's current state.
+func (c *kubeClient) syncKubernetes(cfg KubernetesConfig) (map[string][]Record, error) {
+	recs := make(map[string][]Record)
+	add := func(name string, rec Record) {
+		name = dns.Fqdn(strings.ToLower(name))
+		rec.TTL = cfg.TTL
+		recs[name] = append(recs[name], rec)
+	}
+
+	headless := make(map[string]bool)
+	for _, path := range namespacePaths("/api/v1", "services", cfg.Namespaces) {
+		for cont := ""; ; {
+			var list kubeServiceList
+			if err := c.get(pagePath(path, cont), &list); err != nil {
+				return nil, err
+			}
+			for _, svc := range list.Items {
+				fqdn := svc.Metadata.Name + "." + svc.Metadata.Namespace + ".svc." + cfg.Domain
+				switch svc.Spec.ClusterIP {
+				case "None":
+					headless[svc.Metadata.Namespace+"/"+svc.Metadata.Name] = true
+				case "":
+				default:
+					add(fqdn, Record{Type: "A", Data: svc.Spec.ClusterIP})
+				}
+				for _, p := range svc.Spec.Ports {
+					if p.Name == "" {
+						continue
+					}
+					srv := "_" + p.Name + "._" + strings.ToLower(p.Protocol) + "." + fqdn
+					add(srv, Record{Type: "SRV", Data: dns.Fqdn(fqdn), SrvWeight: 100, Port: uint16(p.Port)})
+				}
+			}
+			if cont = list.Metadata.Continue; cont == "" {
+				break
+			}
+		}
+	}
+
+	if len(headless) > 0 {
+		for _, path := range namespacePaths("/apis/discovery.k8s.io/v1", "endpointslices", cfg.Namespaces) {
+			for cont := ""; ; {
+				var list kubeEndpointSliceList
+				if err := c.get(pagePath(path, cont), &list); err != nil {
+					return nil, err
+				}
+				for _, slice := range list.Items {
+					svc := slice.Metadata.Labels[serviceNameLabel]
+					if svc == "" || !headless[slice.Metadata.Namespace+"/"+svc] {
+						continue
+					}
+					var rtype string
+					switch slice.AddressType {
+					case "IPv4":
+						rtype = "A"
+					case "IPv6":
+						rtype = "AAAA"
+					default:
+						continue
+					}
+					fqdn := svc + "." + slice.Metadata.Namespace + ".svc." + cfg.Domain
+					for _, ep := range slice.Endpoints {
+						// A missing ready condition means ready.
+						if ep.Conditions.Ready != nil && !*ep.Conditions.Ready {
+							continue
+						}
+						for _, addr := range ep.Addresses {
+							add(fqdn, Record{Type: rtype, Data: addr})
+						}
+					}
+				}
+				if cont = list.Metadata.Continue; cont == "" {
+					break
+				}
+			}
+		}
+	}
+
+	if cfg.Ingresses {
+		for _, path := range namespacePaths("/apis/networking.k8s.io/v1", "ingresses", cfg.Namespaces) {
+			for cont := ""; ; {
+				var list kubeIngressList
+				if err := c.get(pagePath(path, cont), &list); err != nil {
+					return nil, err
+				}
+				for _, ing := range list.Items {
+					for _, rule := range ing.Spec.Rules {
+						if rule.Host == "" || strings.HasPrefix(rule.Host, "*") {
+							continue
+						}
+						for _, lb := range ing.Status.LoadBalancer.Ingress {
+							if lb.IP != "" {
+								add(rule.Host, Record{Type: "A", Data: lb.IP})
+							}
+						}
+					}
+				}
+				if cont = list.Metadata.Continue; cont == "" {
+					break
+				}
+			}
+		}
+	}
+	return recs, nil
+}
+
+// watchPaths lists the collections syncKubernetes reads.
+func watchPaths(cfg KubernetesConfig) []string {
+	paths := namespacePaths("/api/v1", "services", cfg.Namespaces)
+	paths = append(paths, namespacePaths("/apis/discovery.k8s.io/v1", "endpointslices", cfg.Namespaces)...)
+	if cfg.Ingresses {
+		paths = append(paths, namespacePaths("/apis/networking.k8s.io/v1", "ingresses", cfg.Namespaces)...)
+	}
+	return paths
+}
+
+// kubeWatchEvent is one line of a watch stream. For ERROR events the
+// object is a Status and Code is set.
+type kubeWatchEvent struct {
+	Type   string `json:"type"`
+	Object struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Code int `json:"code"`
+	} `json:"object"`
+}
+
+// errKubeGone means the resource version being watched has been compacted
+// away and the collection must be listed again.
+var errKubeGone = fmt.Errorf("resource version too old")
+
+// listVersion returns the current resource version of a collection.
+func (c *kubeClient) listVersion(path string) (string, error) {
+	var list struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+	}
+	if err := c.get(path+"?limit=1", &list); err != nil {
+		return "", err
+	}
+	return list.Metadata.ResourceVersion, nil
+}
+
+// watchOnce follows one watch stream from rv until the server ends it,
+// calling changed for every added, modified or deleted object. It returns
+// the last resource version seen.
+func (c *kubeClient) watchOnce(path, rv string, changed func()) (string, error) {
+	resp, err := c.do(c.stream, path+"?watch=true&allowWatchBookmarks=true&timeoutSeconds=300&resourceVersion="+rv)
+	if err != nil {
+		if se, ok := err.(*kubeStatusError); ok && se.code == http.StatusGone {
+			return rv, errKubeGone
+		}
+		return rv, err
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev kubeWatchEvent
+		if err := dec.Decode(&ev); err != nil {
+			if err == io.EOF {
+				return rv, nil
+			}
+			return rv, err
+		}
+		switch ev.Type {
+		case "ERROR":
+			if ev.Object.Code == http.StatusGone {
+				return rv, errKubeGone
+			}
+			return rv, fmt.Errorf("watch %s: status %d", path, ev.Object.Code)
+		case "BOOKMARK":
+		default:
+			changed()
+		}
+		if ev.Object.Metadata.ResourceVersion != "" {
+			rv = ev.Object.Metadata.ResourceVersion
+		}
+	}
+}
+
+// watchCollection signals changed whenever the collection at path changes.
+// When the watched version expires it takes a fresh one and signals, since
+// events in between were lost.
+func (c *kubeClient) watchCollection(path string, changed func()) {
+	var rv string
+	for {
+		if rv == "" {
+			var err error
+			if rv, err = c.listVersion(path); err != nil {
+				log.Printf("Kubernetes watch %s: %v", path, err)
+				time.Sleep(5 * time.Second)
+				continue
+			}
+			changed()
+		}
+		var err error
+		rv, err = c.watchOnce(path, rv, changed)
+		switch {
+		case err == errKubeGone:
+			rv = ""
+		case err != nil:
+			log.Printf("Kubernetes watch %s: %v", path, err)
+			time.Sleep(5 * time.Second)
+		}
+	}
+}
+
+// watchKubernetes keeps the kubernetes record source in sync with the
+// cluster. Watches on every collection trigger a resync as soon as
+// something changes; a full resync also runs every Interval seconds.
+// Records from the last successful sync stay in place while the API server
+// is unreachable.
+func watchKubernetes() {
+	cfg := config.Kubernetes
+	client, err := newKubeClient(cfg)
+	if err != nil {
+		log.Printf("Kubernetes backend disabled: %v", err)
+		return
+	}
+	pending := make(chan struct{}, 1)
+	changed := func() {
+		select {
+		case pending <- struct{}{}:
+		default:
+		}
+	}
+	for _, path := range watchPaths(cfg) {
+		go client.watchCollection(path, changed)
+	}
+
+	lastCount := -1
+	for {
+		// Let a burst of events, such as a rollout, settle into one sync.
+		time.Sleep(time.Second)
+		select {
+		case <-pending:
+		default:
+		}
+		wait := time.Duration(cfg.Interval) * time.Second
+		recs, err := client.syncKubernetes(cfg)
+		if err != nil {
+			log.Printf("Kubernetes sync failed: %v", err)
+			wait = 10 * time.Second
+		} else {
+			records.setSource(sourceKubernetes, recs)
+			markWarm(warmKubernetes)
+			if len(recs) != lastCount {
+				log.Printf("Kubernetes sync: %d names", len(recs))
+				lastCount = len(recs)
+			}
+		}
+		select {
+		case <-pending:
+		case <-time.After(wait):
+		}
+	}
+}
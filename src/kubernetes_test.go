@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestKubeClient(t *testing.T, h http.HandlerFunc) *kubeClient {
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return &kubeClient{server: srv.URL, http: srv.Client(), stream: srv.Client()}
+}
+
+func TestSyncKubernetesEndpointSlices(t *testing.T) {
+	c := newTestKubeClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/services":
+			fmt.Fprint(w, `{"items":[
+				{"metadata":{"name":"web","namespace":"prod"},"spec":{"clusterIP":"10.96.0.10","ports":[{"name":"http","protocol":"TCP","port":80}]}},
+				{"metadata":{"name":"db","namespace":"prod"},"spec":{"clusterIP":"None"}}]}`)
+		case "/apis/discovery.k8s.io/v1/endpointslices":
+			fmt.Fprint(w, `{"items":[
+				{"metadata":{"name":"db-abc","namespace":"prod","labels":{"kubernetes.io/service-name":"db"}},"addressType":"IPv4",
+				 "endpoints":[{"addresses":["10.1.0.5"],"conditions":{"ready":true}},{"addresses":["10.1.0.6"],"conditions":{"ready":false}},{"addresses":["10.1.0.7"]}]},
+				{"metadata":{"name":"db-v6","namespace":"prod","labels":{"kubernetes.io/service-name":"db"}},"addressType":"IPv6",
+				 "endpoints":[{"addresses":["fd00::5"]}]},
+				{"metadata":{"name":"web-xyz","namespace":"prod","labels":{"kubernetes.io/service-name":"web"}},"addressType":"IPv4",
+				 "endpoints":[{"addresses":["10.1.0.9"]}]}]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	recs, err := c.syncKubernetes(KubernetesConfig{Domain: "cluster.local.", TTL: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range recs["db.prod.svc.cluster.local."] {
+		got = append(got, r.Type+" "+r.Data)
+	}
+	if fmt.Sprint(got) != "[A 10.1.0.5 A 10.1.0.7 AAAA fd00::5]" {
+		t.Errorf("headless service: %v", got)
+	}
+	if web := recs["web.prod.svc.cluster.local."]; len(web) != 1 || web[0].Data != "10.96.0.10" {
+		t.Errorf("cluster IP service: %v", web)
+	}
+	if srv := recs["_http._tcp.web.prod.svc.cluster.local."]; len(srv) != 1 || srv[0].Port != 80 {
+		t.Errorf("SRV: %v", srv)
+	}
+}
+
+func TestWatchOnce(t *testing.T) {
+	var query string
+	c := newTestKubeClient(t, func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		switch r.URL.Query().Get("resourceVersion") {
+		case "100":
+			fmt.Fprintln(w, `{"type":"ADDED","object":{"metadata":{"resourceVersion":"101"}}}`)
+			fmt.Fprintln(w, `{"type":"BOOKMARK","object":{"metadata":{"resourceVersion":"105"}}}`)
+			fmt.Fprintln(w, `{"type":"DELETED","object":{"metadata":{"resourceVersion":"107"}}}`)
+		case "1":
+			fmt.Fprintln(w, `{"type":"ERROR","object":{"kind":"Status","code":410}}`)
+		default:
+			w.WriteHeader(http.StatusGone)
+		}
+	})
+
+	changes := 0
+	rv, err := c.watchOnce("/api/v1/services", "100", func() { changes++ })
+	if err != nil || rv != "107" || changes != 2 {
+		t.Errorf("got rv %q, %d changes, %v; want 107, 2, nil", rv, changes, err)
+	}
+	if want := "watch=true&allowWatchBookmarks=true&timeoutSeconds=300&resourceVersion=100"; query != want {
+		t.Errorf("query %q", query)
+	}
+	if _, err := c.watchOnce("/api/v1/services", "1", func() {}); err != errKubeGone {
+		t.Errorf("ERROR 410 event: %v", err)
+	}
+	if _, err := c.watchOnce("/api/v1/services", "2", func() {}); err != errKubeGone {
+		t.Errorf("410 reply: %v", err)
+	}
+}
+
+func TestSyncKubernetesPages(t *testing.T) {
+	var tokens []string
+	c := newTestKubeClient(t, func(w http.ResponseWriter, r *http.Request) {
+		tokens = append(tokens, r.Header.Get("Authorization"))
+		if r.URL.Path != "/api/v1/services" || r.URL.Query().Get("limit") != "500" {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.URL.Query().Get("continue") {
+		case "":
+			fmt.Fprint(w, `{"metadata":{"continue":"page 2"},"items":[
+				{"metadata":{"name":"a","namespace":"prod"},"spec":{"clusterIP":"10.96.0.1"}}]}`)
+		case "page 2":
+			fmt.Fprint(w, `{"metadata":{},"items":[
+				{"metadata":{"name":"b","namespace":"prod"},"spec":{"clusterIP":"10.96.0.2"}}]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	c.tokenFile = filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(c.tokenFile, []byte("first\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	recs, err := c.syncKubernetes(KubernetesConfig{Domain: "cluster.local.", TTL: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs["a.prod.svc.cluster.local."]) != 1 || len(recs["b.prod.svc.cluster.local."]) != 1 {
+		t.Errorf("records from both pages expected, got %v", recs)
+	}
+
+	// A rotated token is used from the next request on.
+	if err := os.WriteFile(c.tokenFile, []byte("second\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.syncKubernetes(KubernetesConfig{Domain: "cluster.local.", TTL: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "[Bearer first Bearer first Bearer second Bearer second]"; fmt.Sprint(tokens) != want {
+		t.Errorf("sent %v, want %s", tokens, want)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// KVConfig enables a backend that loads records from Consul KV or etcd.
+// Keys have the form <prefix><zone>/<name> (use "@" for the zone apex) and
+// hold one JSON record or a JSON array of them, for example
+//
+//	/microdns/zones/example.com/www = {"type": "A", "ttl": 300, "value": "10.0.0.1"}
+type KVConfig struct {
+	Backend  string `yaml:"backend"` // "consul" or "etcd"
+	Address  string `yaml:"address"`
+	Prefix   string `yaml:"prefix"`
+	Token    string `yaml:"token"`
+	Interval int    `yaml:"interval"` // seconds; etcd poll interval and Consul blocking wait
+}
+
+// recordSpec is the JSON form of a record.
+type recordSpec struct {
+	Type     string `json:"type"`
+	TTL      uint32 `json:"ttl"`
+	Value    string `json:"value"`
+	Priority uint16 `json:"priority"` // MX preference or SRV priority
+	Weight   uint16 `json:"weight"`   // SRV only
+	Port     uint16 `json:"port"`     // SRV only
+}
+
+const defaultKVTTL = 300
+
+func setupKV() error {
+	cfg := &config.KV
+	if cfg.Backend == "" {
+		return nil
+	}
+	cfg.Backend = strings.ToLower(cfg.Backend)
+	switch cfg.Backend {
+	case "consul":
+		if cfg.Address == "" {
+			cfg.Address = "http://127.0.0.1:8500"
+		}
+	case "etcd":
+		if cfg.Address == "" {
+			cfg.Address = "http://127.0.0.1:2379"
+		}
+	default:
+		return fmt.Errorf("kv.backend: unknown backend %q (want consul or etcd)", cfg.Backend)
+	}
+	cfg.Address = strings.TrimSuffix(cfg.Address, "/")
+	if cfg.Prefix == "" {
+		cfg.Prefix = "/microdns/zones/"
+	}
+	if !strings.HasSuffix(cfg.Prefix, "/") {
+		cfg.Prefix += "/"
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 5
+	}
+	return nil
+}
+
+// toRecord validates a JSON record and converts it to the local form.
+func (spec recordSpec) toRecord() (Record, error) {
+	ttl := spec.TTL
+	if ttl == 0 {
+		ttl = defaultKVTTL
+	}
+	rtype := strings.ToUpper(spec.Type)
+	switch rtype {
+	case "A":
+		if ip := net.ParseIP(spec.Value); ip == nil || ip.To4() == nil {
+			return Record{}, fmt.Errorf("invalid IPv4 address %q", spec.Value)
+		}
+		return Record{Type: rtype, TTL: ttl, Data: spec.Value}, nil
+	case "AAAA":
+		if ip := net.ParseIP(spec.Value); ip == nil || ip.To4() != nil {
+			return Record{}, fmt.Errorf("invalid IPv6 address %q", spec.Value)
+		}
+		return Record{Type: rtype, TTL: ttl, Data: spec.Value}, nil
+	case "TXT":
+		return Record{Type: rtype, TTL: ttl, Data: spec.Value}, nil
+	case "CNAME", "PTR", "NS", "MX", "SRV":
+		target := dns.Fqdn(spec.Value)
+		if _, ok := dns.IsDomainName(target); !ok || spec.Value == "" {
+			return Record{}, fmt.Errorf("invalid %s target %q", rtype, spec.Value)
+		}
+		rec := Record{Type: rtype, TTL: ttl, Data: target}
+		if rtype == "MX" || rtype == "SRV" {
+			rec.Pref = spec.Priority
+		}
+		if rtype == "SRV" {
+			if spec.Port == 0 {
+				return Record{}, fmt.Errorf("SRV record needs a port")
+			}
+			rec.SrvWeight, rec.Port = spec.Weight, spec.Port
+		}
+		return rec, nil
+	}
+	if rdataTypes[rtype] {
+		return parseRdata(rtype, ttl, spec.Value)
+	}
+	return Record{}, fmt.Errorf("unsupported record type %q", spec.Type)
+}
+
+// kvOwner maps a key below the prefix to an owner name.
+func kvOwner(prefix, key string) (string, bool) {
+	rel := strings.TrimPrefix(strings.TrimPrefix(key, "/"), strings.TrimPrefix(prefix, "/"))
+	zone, name, ok := strings.Cut(rel, "/")
+	if !ok || zone == "" || name == "" {
+		return "", false
+	}
+	zone = dns.Fqdn(strings.ToLower(zone))
+	if name == "@" {
+		return zone, true
+	}
+	return strings.ToLower(strings.ReplaceAll(name, "/", ".")) + "." + zone, true
+}
+
+// parseKVValue decodes one key's value into records.
+func parseKVValue(value []byte) ([]Record, error) {
+	var specs []recordSpec
+	trimmed := bytes.TrimSpace(value)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &specs); err != nil {
+			return nil, err
+		}
+	} else {
+		var spec recordSpec
+		if err := json.Unmarshal(trimmed, &spec); err != nil {
+			return nil, err
+		}
+		specs = []recordSpec{spec}
+	}
+	var recs []Record
+	for _, spec := range specs {
+		rec, err := spec.toRecord()
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
+
+// addKVPair converts one key/value pair, logging and skipping bad entries
+// so one malformed key doesn't hide the rest.
+func addKVPair(recs map[string][]Record, prefix, key string, value []byte) {
+	owner, ok := kvOwner(prefix, key)
+	if !ok {
+		return
+	}
+	parsed, err := parseKVValue(value)
+	if err != nil {
+		log.Printf("Invalid KV record %s: %v", key, err)
+		return
+	}
+	recs[owner] = append(recs[owner], parsed...)
+}
+
+var kvHTTP = &http.Client{Timeout: 5 * time.Minute}
+
+// fetchConsul lists the prefix, blocking until it changes past index.
+func fetchConsul(cfg KVConfig, index string) (map[string][]Record, string, error) {
+	url := fmt.Sprintf("%s/v1/kv/%s?recurse=true&wait=%ds", cfg.Address, strings.TrimPrefix(cfg.Prefix, "/"), cfg.Interval*12)
+	if index != "" {
+		url += "&index=" + index
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if cfg.Token != "" {
+		req.Header.Set("X-Consul-Token", cfg.Token)
+	}
+	resp, err := kvHTTP.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	recs := make(map[string][]Record)
+	newIndex := resp.Header.Get("X-Consul-Index")
+	if resp.StatusCode == http.StatusNotFound {
+		return recs, newIndex, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("consul: %s", resp.Status)
+	}
+	var pairs []struct {
+		Key   string `json:"Key"`
+		Value string `json:"Value"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&pairs); err != nil {
+		return nil, "", err
+	}
+	for _, p := range pairs {
+		value, err := base64.StdEncoding.DecodeString(p.Value)
+		if err != nil || len(value) == 0 {
+			continue
+		}
+		addKVPair(recs, cfg.Prefix, p.Key, value)
+	}
+	return recs, newIndex, nil
+}
+
+// fetchEtcd lists the prefix through the etcd v3 JSON gateway.
+func fetchEtcd(cfg KVConfig) (map[string][]Record, error) {
+	start := []byte(cfg.Prefix)
+	end := append([]byte(nil), start...)
+	end[len(end)-1]++ // range_end: first key after the prefix
+	body, _ := json.Marshal(map[string]string{
+		"key":       base64.StdEncoding.EncodeToString(start),
+		"range_end": base64.StdEncoding.EncodeToString(end),
+	})
+
+	req, err := http.NewRequest("POST", cfg.Address+"/v3/kv/range", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Token != "" {
+		req.Header.Set("Authorization", cfg.Token)
+	}
+	resp, err := kvHTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("etcd: %s", resp.Status)
+	}
+	var out struct {
+		Kvs []struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+		} `json:"kvs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+
+	recs := make(map[string][]Record)
+	for _, kv := range out.Kvs {
+		key, err1 := base64.StdEncoding.DecodeString(kv.Key)
+		value, err2 := base64.StdEncoding.DecodeString(kv.Value)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		addKVPair(recs, cfg.Prefix, string(key), value)
+	}
+	return recs, nil
+}
+
+// watchKV keeps the kv record source current. Consul is watched with
+// blocking queries so changes show up immediately; etcd is polled. The last
+// good record set is kept while the store is unreachable.
+func watchKV() {
+	cfg := config.KV
+	index := ""
+	for {
+		var recs map[string][]Record
+		var err error
+		if cfg.Backend == "consul" {
+			var next string
+			recs, next, err = fetchConsul(cfg, index)
+			if err == nil {
+				// Consul asks clients to reset an index that goes backwards.
+				prev, _ := strconv.ParseUint(index, 10, 64)
+				if n, _ := strconv.ParseUint(next, 10, 64); n < prev {
+					next = ""
+				}
+				if next == index && index != "" {
+					// Blocking query timed out without changes; Consul
+					// recommends rate limiting the retry.
+					time.Sleep(time.Second)
+					continue
+				}
+				index = next
+			}
+		} else {
+			recs, err = fetchEtcd(cfg)
+		}
+
+		if err != nil {
+			log.Printf("KV sync from %s failed: %v", cfg.Backend, err)
+			index = ""
+			time.Sleep(time.Duration(cfg.Interval) * time.Second)
+			continue
+		}
+		records.setSource(sourceKV, recs)
+		markWarm(warmKV)
+		if cfg.Backend == "etcd" {
+			time.Sleep(time.Duration(cfg.Interval) * time.Second)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// latencyBounds are the upper bounds of the response time buckets; a last,
+// unbounded bucket catches the rest.
+var latencyBounds = []time.Duration{
+	250 * time.Microsecond, 500 * time.Microsecond,
+	time.Millisecond, 2 * time.Millisecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 20 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 200 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2 * time.Second,
+}
+
+// heatmapMinutes is how much history the heatmap keeps, one column per
+// minute.
+const heatmapMinutes = 60
+
+type latencyKey struct {
+	qtype  string
+	source string
+}
+
+// latencyHist is a response time histogram for one qtype and source.
+type latencyHist struct {
+	buckets [14]atomic.Uint64 // len(latencyBounds)+1
+	count   atomic.Uint64
+	sumUs   atomic.Uint64
+}
+
+type heatmapColumn struct {
+	minute int64 // unix minute
+	counts [14]uint64
+}
+
+var (
+	latencyHists sync.Map // latencyKey -> *latencyHist
+
+	heatmapMu sync.Mutex
+	heatmap   [heatmapMinutes]heatmapColumn
+)
+
+func latencyBucket(d time.Duration) int {
+	return sort.Search(len(latencyBounds), func(i int) bool { return d <= latencyBounds[i] })
+}
+
+// observeLatency records how long a query of qtype took to answer from
+// source.
+func observeLatency(qtype uint16, source string, d time.Duration) {
+	key := latencyKey{dns.TypeToString[qtype], source}
+	v, ok := latencyHists.Load(key)
+	if !ok {
+		v, _ = latencyHists.LoadOrStore(key, &latencyHist{})
+	}
+	h := v.(*latencyHist)
+	b := latencyBucket(d)
+	h.buckets[b].Add(1)
+	h.count.Add(1)
+	h.sumUs.Add(uint64(d.Microseconds()))
+
+	minute := time.Now().Unix() / 60
+	heatmapMu.Lock()
+	col := &heatmap[minute%heatmapMinutes]
+	if col.minute != minute {
+		*col = heatmapColumn{minute: minute}
+	}
+	col.counts[b]++
+	heatmapMu.Unlock()
+}
+
+// latencyBoundsMs returns the bucket bounds in milliseconds; the last
+// bucket has no bound and is reported as -1.
+func latencyBoundsMs() []float64 {
+	out := make([]float64, 0, len(latencyBounds)+1)
+	for _, b := range latencyBounds {
+		out = append(out, float64(b.Microseconds())/1000)
+	}
+	return append(out, -1)
+}
+
+type latencyReport struct {
+	Qtype   string   `json:"qtype"`
+	Source  string   `json:"source"`
+	Count   uint64   `json:"count"`
+	MeanMs  float64  `json:"mean_ms"`
+	Buckets []uint64 `json:"buckets"` // per bucket of latency_bounds_ms, not cumulative
+}
+
+func latencyReports() []latencyReport {
+	var out []latencyReport
+	latencyHists.Range(func(k, v any) bool {
+		key, h := k.(latencyKey), v.(*latencyHist)
+		r := latencyReport{Qtype: key.qtype, Source: key.source, Count: h.count.Load()}
+		if r.Count > 0 {
+			r.MeanMs = float64(h.sumUs.Load()) / float64(r.Count) / 1000
+		}
+		for i := range h.buckets {
+			r.Buckets = append(r.Buckets, h.buckets[i].Load())
+		}
+		out = append(out, r)
+		return true
+	})
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Qtype != out[j].Qtype {
+			return out[i].Qtype < out[j].Qtype
+		}
+		return out[i].Source < out[j].Source
+	})
+	return out
+}
+
+type heatmapReport struct {
+	Start  time.Time `json:"start"`
+	Counts []uint64  `json:"counts"`
+}
+
+// handleHeatmap returns per-minute latency histograms for the last hour,
+// oldest first; minutes without queries are included as zeros.
+func handleHeatmap(w http.ResponseWriter, _ *http.Request) {
+	now := time.Now().Unix() / 60
+	columns := make([]heatmapReport, 0, heatmapMinutes)
+	heatmapMu.Lock()
+	for m := now - heatmapMinutes + 1; m <= now; m++ {
+		col := heatmap[m%heatmapMinutes]
+		r := heatmapReport{Start: time.Unix(m*60, 0).UTC(), Counts: make([]uint64, len(col.counts))}
+		if col.minute == m {
+			copy(r.Counts, col.counts[:])
+		}
+		columns = append(columns, r)
+	}
+	heatmapMu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{"latency_bounds_ms": latencyBoundsMs(), "minutes": columns})
+}
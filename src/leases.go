@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DHCPLeasesConfig points at the DHCP server's lease file, so clients can
+// be told apart by hardware address rather than by an address that
+// changes. dnsmasq, ISC dhcpd and Kea (memfile CSV) lease files are
+// recognised by their content. The file is reread when it changes.
+//
+// With Domain set, every active lease with a hostname also gets an A
+// record under it (laptop.lan) and a PTR record back, served from the
+// "dhcp" source and dropped when the lease ends. Of two leases claiming a
+// hostname, the one that runs longest wins, as in dnsmasq.
+type DHCPLeasesConfig struct {
+	File   string `yaml:"file"`
+	Domain string `yaml:"domain"`
+	TTL    uint32 `yaml:"ttl"` // of lease records, default 60
+}
+
+const sourceDHCP = "dhcp"
+
+type lease struct {
+	ip       net.IP
+	mac      net.HardwareAddr
+	hostname string
+	expires  time.Time // zero for an infinite lease
+}
+
+func (l *lease) active(now time.Time) bool {
+	return l.expires.IsZero() || l.expires.After(now)
+}
+
+// leaseTable is the parsed lease file, keyed by client address.
+type leaseTable struct {
+	byIP  map[string]*lease
+	mtime time.Time
+	next  time.Time // when a published lease next ends; zero if none
+}
+
+var leases atomic.Pointer[leaseTable]
+
+func setupLeases() error {
+	cfg := &config.DHCPLeases
+	if cfg.File == "" {
+		if cfg.Domain != "" {
+			return fmt.Errorf("dhcp_leases.domain needs dhcp_leases.file")
+		}
+		return nil
+	}
+	if cfg.Domain != "" {
+		cfg.Domain = dns.CanonicalName(cfg.Domain)
+		if _, ok := dns.IsDomainName(cfg.Domain); !ok {
+			return fmt.Errorf("dhcp_leases.domain: invalid name %q", cfg.Domain)
+		}
+	}
+	if cfg.TTL == 0 {
+		cfg.TTL = 60
+	}
+	if err := loadLeases(); err != nil {
+		return fmt.Errorf("dhcp_leases: %v", err)
+	}
+	return nil
+}
+
+func loadLeases() error {
+	path := config.DHCPLeases.File
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	list, err := readLeases(path)
+	if err != nil {
+		return err
+	}
+	t := &leaseTable{byIP: make(map[string]*lease), mtime: info.ModTime()}
+	for _, l := range list {
+		// Later entries supersede earlier ones, as in dhcpd's journal.
+		t.byIP[l.ip.String()] = l
+	}
+	publishLeases(t)
+	leases.Store(t)
+	log.Printf("Loaded %d DHCP lease(s) from %s", len(t.byIP), path)
+	return nil
+}
+
+// publishLeases installs the records of t's active leases, when
+// dhcp_leases.domain asks for them, and notes when the first one ends.
+func publishLeases(t *leaseTable) {
+	domain := config.DHCPLeases.Domain
+	if domain == "" {
+		return
+	}
+	now := time.Now()
+	t.next = time.Time{}
+	owners := make(map[string]*lease)
+	for _, l := range t.byIP {
+		if !l.active(now) || l.ip.To4() == nil {
+			continue
+		}
+		name := leaseName(l.hostname, domain)
+		if name == "" {
+			continue
+		}
+		if cur := owners[name]; cur != nil && !outlasts(l, cur) {
+			continue
+		}
+		owners[name] = l
+	}
+	ttl := config.DHCPLeases.TTL
+	recs := make(map[string][]Record)
+	for name, l := range owners {
+		recs[name] = append(recs[name], Record{Type: "A", TTL: ttl, Data: l.ip.String()})
+		rev, _ := dns.ReverseAddr(l.ip.String())
+		recs[rev] = append(recs[rev], Record{Type: "PTR", TTL: ttl, Data: name})
+		if !l.expires.IsZero() && (t.next.IsZero() || l.expires.Before(t.next)) {
+			t.next = l.expires
+		}
+	}
+	records.setSource(sourceDHCP, recs)
+	announceLeases(recs)
+}
+
+// outlasts reports whether lease a ends after b.
+func outlasts(a, b *lease) bool {
+	switch {
+	case b.expires.IsZero():
+		return false
+	case a.expires.IsZero():
+		return true
+	}
+	return a.expires.After(b.expires)
+}
+
+// leaseName returns the owner name for a lease's hostname under domain, or
+// "" for a hostname that can't be one. A fully qualified hostname keeps
+// its first label.
+func leaseName(hostname, domain string) string {
+	label, _, _ := strings.Cut(strings.ToLower(hostname), ".")
+	if label == "" || len(label) > 63 {
+		return ""
+	}
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' && i > 0 && i < len(label)-1) {
+			return ""
+		}
+	}
+	return label + "." + domain
+}
+
+// watchLeases rereads the lease file as the DHCP server rewrites it. A
+// file that fails to parse leaves the previous leases in place.
+func watchLeases() {
+	for {
+		time.Sleep(time.Duration(config.PollFreq) * time.Second)
+		info, err := os.Stat(config.DHCPLeases.File)
+		if err != nil || !info.ModTime().After(leases.Load().mtime) {
+			if t := *leases.Load(); !t.next.IsZero() && time.Now().After(t.next) {
+				// A lease ended without the file changing.
+				publishLeases(&t)
+				leases.Store(&t)
+			}
+			continue
+		}
+		if err := loadLeases(); err != nil {
+			log.Printf("Failed to reload DHCP leases: %v", err)
+			t := *leases.Load()
+			t.mtime = info.ModTime()
+			leases.Store(&t)
+		}
+	}
+}
+
+// leaseFor returns client's active lease, or nil.
+func leaseFor(client net.IP) *lease {
+	t := leases.Load()
+	if t == nil || client == nil {
+		return nil
+	}
+	if l := t.byIP[client.String()]; l != nil && l.active(time.Now()) {
+		return l
+	}
+	return nil
+}
+
+func readLeases(path string) ([]*lease, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	text := string(data)
+	switch {
+	case strings.HasPrefix(text, "address,"):
+		return parseKeaLeases(text)
+	case strings.Contains(text, "lease ") && strings.Contains(text, "{"):
+		return parseISCLeases(text)
+	default:
+		return parseDnsmasqLeases(text)
+	}
+}
+
+// parseDnsmasqLeases reads "expiry mac ip hostname client-id" lines. IPv6
+// leases, listed after a "duid" line, carry no hardware address and are
+// skipped.
+func parseDnsmasqLeases(text string) ([]*lease, error) {
+	var out []*lease
+	sc := bufio.NewScanner(strings.NewReader(text))
+	for n := 1; sc.Scan(); n++ {
+		f := strings.Fields(sc.Text())
+		if len(f) == 0 || f[0] == "duid" {
+			continue
+		}
+		if len(f) < 4 {
+			return nil, fmt.Errorf("line %d: too few fields", n)
+		}
+		expiry, err := strconv.ParseInt(f[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: bad expiry %q", n, f[0])
+		}
+		mac, err := net.ParseMAC(f[1])
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(f[2])
+		if ip == nil {
+			return nil, fmt.Errorf("line %d: bad address %q", n, f[2])
+		}
+		l := &lease{ip: ip, mac: mac}
+		if f[3] != "*" {
+			l.hostname = f[3]
+		}
+		if expiry != 0 {
+			l.expires = time.Unix(expiry, 0)
+		}
+		out = append(out, l)
+	}
+	return out, nil
+}
+
+// parseISCLeases reads dhcpd.leases "lease <ip> { ... }" blocks. Only
+// leases in the active binding state count.
+func parseISCLeases(text string) ([]*lease, error) {
+	var out []*lease
+	var cur *lease
+	state := ""
+	sc := bufio.NewScanner(strings.NewReader(text))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if rest, ok := strings.CutPrefix(line, "lease "); ok && cur == nil {
+			ip := net.ParseIP(strings.TrimSpace(strings.TrimSuffix(rest, "{")))
+			if ip == nil {
+				return nil, fmt.Errorf("line %d: bad lease address", n)
+			}
+			cur, state = &lease{ip: ip}, ""
+			continue
+		}
+		if cur == nil {
+			continue // server-duid, authoring-byte-order ...
+		}
+		if line == "}" {
+			if state == "active" && cur.mac != nil {
+				out = append(out, cur)
+			}
+			cur = nil
+			continue
+		}
+		f := strings.Fields(strings.TrimSuffix(line, ";"))
+		switch {
+		case len(f) >= 3 && f[0] == "hardware" && f[1] == "ethernet":
+			cur.mac, _ = net.ParseMAC(f[2])
+		case len(f) >= 3 && f[0] == "binding" && f[1] == "state":
+			state = f[2]
+		case len(f) >= 2 && f[0] == "client-hostname":
+			cur.hostname = strings.Trim(f[1], `"`)
+		case len(f) >= 4 && f[0] == "ends":
+			// ends <weekday> yyyy/mm/dd hh:mm:ss, in UTC
+			if t, err := time.Parse("2006/01/02 15:04:05", f[2]+" "+f[3]); err == nil {
+				cur.expires = t
+			}
+		}
+	}
+	if cur != nil {
+		return nil, fmt.Errorf("unterminated lease block for %s", cur.ip)
+	}
+	return out, nil
+}
+
+// parseKeaLeases reads Kea's memfile CSV, whose header names the columns.
+// Only leases in the default (assigned) state count.
+func parseKeaLeases(text string) ([]*lease, error) {
+	var out []*lease
+	sc := bufio.NewScanner(strings.NewReader(text))
+	col := make(map[string]int)
+	for n := 1; sc.Scan(); n++ {
+		f := strings.Split(sc.Text(), ",")
+		if n == 1 {
+			for i, name := range f {
+				col[name] = i
+			}
+			for _, name := range []string{"address", "hwaddr", "expire", "hostname", "state"} {
+				if _, ok := col[name]; !ok {
+					return nil, fmt.Errorf("header: no %s column", name)
+				}
+			}
+			continue
+		}
+		if len(f) < len(col) {
+			continue
+		}
+		if f[col["state"]] != "0" {
+			continue
+		}
+		ip := net.ParseIP(f[col["address"]])
+		mac, err := net.ParseMAC(f[col["hwaddr"]])
+		if ip == nil || err != nil {
+			continue
+		}
+		l := &lease{ip: ip, mac: mac, hostname: strings.TrimSuffix(f[col["hostname"]], ".")}
+		if expiry, err := strconv.ParseInt(f[col["expire"]], 10, 64); err == nil && expiry != 0 {
+			l.expires = time.Unix(expiry, 0)
+		}
+		out = append(out, l)
+	}
+	return out, nil
+}
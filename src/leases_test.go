@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadLeases(t *testing.T) {
+	future := time.Now().Add(time.Hour).Unix()
+	dir := writeZoneFiles(t, map[string]string{
+		"dnsmasq.leases": fmt.Sprintf("%d aa:bb:cc:00:00:01 10.0.0.10 laptop 01:aa:bb:cc:00:00:01\n"+
+			"0 aa:bb:cc:00:00:02 10.0.0.11 * *\n"+
+			"duid 00:01:00:01:2c:1f\n"+
+			"%d 1234 fd00::10 phone 00:01\n", future, future),
+		"dhcpd.leases": `# The format of this file is documented in dhcpd.leases(5).
+authoring-byte-order little-endian;
+lease 10.0.0.20 {
+  starts 3 2026/10/14 10:00:00;
+  ends 3 2036/10/14 10:00:00;
+  binding state active;
+  hardware ethernet aa:bb:cc:00:00:03;
+  client-hostname "printer";
+}
+lease 10.0.0.21 {
+  binding state free;
+  hardware ethernet aa:bb:cc:00:00:04;
+}
+`,
+		"kea-leases4.csv": "address,hwaddr,client_id,valid_lifetime,expire,subnet_id,fqdn_fwd,fqdn_rev,hostname,state\n" +
+			fmt.Sprintf("10.0.0.30,aa:bb:cc:00:00:05,,3600,%d,1,0,0,tv.lan.,0\n", future) +
+			fmt.Sprintf("10.0.0.31,aa:bb:cc:00:00:06,,3600,%d,1,0,0,old,2\n", future),
+	})
+	for file, want := range map[string]string{
+		"dnsmasq.leases":  "[10.0.0.10 aa:bb:cc:00:00:01 laptop true 10.0.0.11 aa:bb:cc:00:00:02  false]",
+		"dhcpd.leases":    "[10.0.0.20 aa:bb:cc:00:00:03 printer true]",
+		"kea-leases4.csv": "[10.0.0.30 aa:bb:cc:00:00:05 tv.lan true]",
+	} {
+		list, err := readLeases(filepath.Join(dir, file))
+		if err != nil {
+			t.Errorf("%s: %v", file, err)
+			continue
+		}
+		var got []string
+		for _, l := range list {
+			got = append(got, fmt.Sprintf("%s %s %s %v", l.ip, l.mac, l.hostname, !l.expires.IsZero()))
+		}
+		if fmt.Sprint(got) != want {
+			t.Errorf("%s: %v\nwant %s", file, got, want)
+		}
+	}
+
+	bad := writeZoneFiles(t, map[string]string{
+		"short":        "1700000000 aa:bb:cc:00:00:01 10.0.0.10\n",
+		"unterminated": "lease 10.0.0.20 {\n  binding state active;\n",
+		"kea":          "address,hwaddr\n10.0.0.30,aa:bb:cc:00:00:05\n",
+	})
+	for _, file := range []string{"short", "unterminated", "kea"} {
+		if _, err := readLeases(filepath.Join(bad, file)); err == nil {
+			t.Errorf("%s: accepted", file)
+		}
+	}
+}
+
+func TestPublishLeases(t *testing.T) {
+	withRecords(t)
+	old, oldLeases := *config, leases.Load()
+	t.Cleanup(func() { *config = old; leases.Store(oldLeases) })
+
+	now := time.Now()
+	dir := writeZoneFiles(t, map[string]string{
+		"dnsmasq.leases": fmt.Sprintf("%d aa:bb:cc:00:00:01 10.0.0.10 laptop *\n", now.Add(time.Hour).Unix()) +
+			// Two leases claim nas; the one that runs longer wins.
+			fmt.Sprintf("%d aa:bb:cc:00:00:02 10.0.0.11 NAS *\n", now.Add(time.Hour).Unix()) +
+			"0 aa:bb:cc:00:00:03 10.0.0.12 nas *\n" +
+			fmt.Sprintf("%d aa:bb:cc:00:00:04 10.0.0.13 gone *\n", now.Add(-time.Hour).Unix()) +
+			fmt.Sprintf("%d aa:bb:cc:00:00:05 10.0.0.14 bad_name *\n", now.Add(time.Hour).Unix()),
+	})
+	config.DHCPLeases = DHCPLeasesConfig{File: filepath.Join(dir, "dnsmasq.leases"), Domain: "LAN"}
+	if err := setupLeases(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{
+		"laptop.lan.":             "[{A 60 10.0.0.10}]",
+		"nas.lan.":                "[{A 60 10.0.0.12}]",
+		"12.0.0.10.in-addr.arpa.": "[{PTR 60 nas.lan.}]",
+		"11.0.0.10.in-addr.arpa.": "[]",
+		"gone.lan.":               "[]",
+		"bad_name.lan.":           "[]",
+	} {
+		var got []string
+		for _, r := range records.lookup(name) {
+			got = append(got, fmt.Sprintf("{%s %d %s}", r.Type, r.TTL, r.Data))
+		}
+		if fmt.Sprint(got) != want {
+			t.Errorf("%s: %v, want %s", name, got, want)
+		}
+	}
+
+	if l := leaseFor(net.ParseIP("10.0.0.11")); l == nil || l.mac.String() != "aa:bb:cc:00:00:02" {
+		t.Errorf("lease for 10.0.0.11: %v", l)
+	}
+	if l := leaseFor(net.ParseIP("10.0.0.13")); l != nil {
+		t.Errorf("expired lease returned: %v", l)
+	}
+	if next := leases.Load().next; !next.Equal(time.Unix(now.Add(time.Hour).Unix(), 0)) {
+		t.Errorf("next expiry %v", next)
+	}
+
+	config.DHCPLeases = DHCPLeasesConfig{Domain: "lan"}
+	if err := setupLeases(); err == nil {
+		t.Error("domain without a lease file accepted")
+	}
+}
+
+func TestLeaseName(t *testing.T) {
+	for hostname, want := range map[string]string{
+		"Laptop":                "laptop.lan.",
+		"laptop.example.com":    "laptop.lan.",
+		"my-pc":                 "my-pc.lan.",
+		"-pc":                   "",
+		"pc-":                   "",
+		"bad_name":              "",
+		"":                      "",
+		fmt.Sprintf("%064d", 0): "",
+	} {
+		if got := leaseName(hostname, "lan."); got != want {
+			t.Errorf("%q: %q, want %q", hostname, got, want)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// TTLs outside this range are almost always typos or forgotten test values.
+const (
+	lintMinTTL = 30
+	lintMaxTTL = 7 * 24 * 3600
+)
+
+// lintFinding is one problem found in a file. fixed is set when -fix
+// corrected it.
+type lintFinding struct {
+	line  int
+	rule  string
+	msg   string
+	fixed bool
+}
+
+// targetField is the index of the domain-name target in a zone line, per
+// record type.
+var targetField = map[string]int{"CNAME": 4, "PTR": 4, "NS": 4, "MX": 5, "SRV": 7}
+
+var lintTokens = regexp.MustCompile(`\S+|\s+`)
+
+// runLint implements "micro-dns lint": it checks the config and zone file
+// for mistakes that load but probably don't do what was meant, and with
+// -fix rewrites the zone file with the mechanical ones corrected.
+func runLint(args []string) int {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "Path to config file")
+	fix := fs.Bool("fix", false, "Rewrite the zone file with fixable findings corrected")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: micro-dns lint [flags] [zone file]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	}
+
+	remaining := 0
+	report := func(path string, findings []lintFinding) {
+		for _, f := range findings {
+			note := ""
+			if f.fixed {
+				note = " (fixed)"
+			} else {
+				remaining++
+			}
+			if f.line > 0 {
+				fmt.Printf("%s:%d: %s: %s%s\n", path, f.line, f.rule, f.msg, note)
+			} else {
+				fmt.Printf("%s: %s: %s%s\n", path, f.rule, f.msg, note)
+			}
+		}
+	}
+
+	zonePath := fs.Arg(0)
+	var backup BackupConfig
+	var defaultTTL uint32
+	if data, err := os.ReadFile(*configPath); err == nil {
+		cfg := &Config{}
+		report(*configPath, lintConfig(data, cfg))
+		if zonePath == "" {
+			zonePath = cfg.HostsFile
+		}
+		backup = cfg.Backup
+		defaultTTL = cfg.DefaultTTL
+	} else if fs.NArg() == 0 || *configPath != "config.yaml" {
+		fmt.Fprintf(os.Stderr, "lint: %v\n", err)
+		return 1
+	}
+	if zonePath == "" {
+		fmt.Fprintln(os.Stderr, "lint: no zone file given and none configured")
+		return 1
+	}
+
+	if isStructuredZone(zonePath) {
+		fmt.Fprintf(os.Stderr, "lint: %s is a structured record file; check it with check-zone\n", zonePath)
+		return 1
+	}
+	if isRemoteZone(zonePath) {
+		fmt.Fprintf(os.Stderr, "lint: %s is a URL; lint a downloaded copy\n", zonePath)
+		return 1
+	}
+	data, err := os.ReadFile(zonePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "lint: %v\n", err)
+		return 1
+	}
+	lines, findings := lintZone(strings.Split(string(data), "\n"), *fix, defaultTTL)
+	if *fix && backup.Dir != "" {
+		if backup.Keep <= 0 {
+			backup.Keep = defaultBackupKeep
+		}
+		if _, err := backupFile(backup, zonePath, "lint-fix"); err != nil {
+			fmt.Fprintf(os.Stderr, "lint: backup: %v\n", err)
+			return 1
+		}
+	}
+	if *fix {
+		if err := writeFileAtomic(zonePath, []byte(strings.Join(lines, "\n"))); err != nil {
+			fmt.Fprintf(os.Stderr, "lint: %v\n", err)
+			return 1
+		}
+	}
+	report(zonePath, findings)
+	if remaining > 0 {
+		return 1
+	}
+	return 0
+}
+
+// lintConfig reports keys the server would silently ignore and values it
+// would reject or misread. cfg receives the parsed config.
+func lintConfig(data []byte, cfg *Config) []lintFinding {
+	var findings []lintFinding
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		// UnmarshalStrict reports every unknown key but still fills in
+		// the known ones.
+		for _, msg := range strings.Split(err.Error(), "\n") {
+			msg = strings.TrimSpace(msg)
+			if msg == "" || strings.HasPrefix(msg, "yaml: unmarshal errors:") {
+				continue
+			}
+			findings = append(findings, lintFinding{rule: "unknown-key", msg: msg})
+		}
+	}
+	if cfg.PollFreq < 0 {
+		findings = append(findings, lintFinding{rule: "bad-value", msg: fmt.Sprintf("poll_freq is negative (%d)", cfg.PollFreq)})
+	}
+	if cfg.Mode != "" && cfg.Mode != modeHybrid && cfg.Mode != modeAuthoritative && cfg.Mode != modeForwarder {
+		findings = append(findings, lintFinding{rule: "bad-value", msg: fmt.Sprintf("unknown mode %q", cfg.Mode)})
+	}
+	return findings
+}
+
+// lintZone checks zone file lines and returns them, with fixes applied if
+// fix is set, along with the findings. Formatting and comments are kept;
+// only the offending tokens change. Lines may leave out the TTL when
+// defaultTTL is set.
+func lintZone(lines []string, fix bool, defaultTTL uint32) ([]string, []lintFinding) {
+	zs := zoneSyntax{defaultTTL: defaultTTL}
+	var findings []lintFinding
+	var out []string
+	seen := make(map[string]int)
+	ttls := make(map[string]uint32)
+	vars := make(map[string]string)
+
+	for i, line := range lines {
+		num := i + 1
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, ";") || strings.HasPrefix(trimmed, "#") {
+			out = append(out, line)
+			continue
+		}
+		// Directives are checked by the loader; only $VAR matters here.
+		if f := strings.Fields(trimmed); strings.HasPrefix(f[0], "$") {
+			if strings.EqualFold(f[0], "$VAR") && len(f) == 3 {
+				vars[f[1]] = f[2]
+			}
+			out = append(out, line)
+			continue
+		}
+		if f := strings.Fields(trimmed); isHostsLine(f) {
+			expanded, err := expandZoneVars(line, vars)
+			if err == nil {
+				_, err = zoneSyntax{}.parseHostsLine(expanded)
+			}
+			if err != nil {
+				findings = append(findings, lintFinding{line: num, rule: "invalid", msg: err.Error()})
+			}
+			out = append(out, line)
+			continue
+		}
+		// Lines using variables are checked as expanded, but not fixed:
+		// the tokens to correct may be in the definition.
+		templated := zoneVarRef.MatchString(line)
+
+		// Tokens alternate between fields and whitespace; fields[k]
+		// indexes the k'th field in tokens.
+		tokens := lintTokens.FindAllString(line, -1)
+		var fields []int
+		for t, tok := range tokens {
+			if strings.TrimSpace(tok) != "" {
+				fields = append(fields, t)
+			}
+		}
+		// A line relying on defaultTTL gets a placeholder for its TTL
+		// column, which the checks below never touch, so field k is the
+		// same column either way.
+		if len(fields) > 1 && defaultTTL > 0 {
+			if _, err := strconv.ParseUint(tokens[fields[1]], 10, 32); err != nil {
+				fields = slices.Insert(fields, 1, -1)
+			}
+		}
+		field := func(k int) string { return tokens[fields[k]] }
+		correct := func(k int, rule, msg, value string) {
+			findings = append(findings, lintFinding{line: num, rule: rule, msg: msg, fixed: fix})
+			if fix {
+				tokens[fields[k]] = value
+			}
+		}
+
+		if len(fields) >= 4 && !templated {
+			for _, k := range []int{2, 3} {
+				if up := strings.ToUpper(field(k)); up != field(k) {
+					correct(k, "deprecated-syntax", fmt.Sprintf("lowercase %q; write %s", field(k), up), up)
+				}
+			}
+			if !strings.HasSuffix(field(0), ".") {
+				correct(0, "missing-trailing-dot", fmt.Sprintf("owner %q is not fully qualified", field(0)), field(0)+".")
+			}
+			if k, ok := targetField[strings.ToUpper(field(3))]; ok && k < len(fields) && !strings.HasSuffix(field(k), ".") {
+				correct(k, "missing-trailing-dot", fmt.Sprintf("target %q is not fully qualified", field(k)), field(k)+".")
+			}
+		}
+		for k := 5; k < len(fields); k++ {
+			if val, ok := strings.CutPrefix(field(k), "canary="); ok && strings.HasSuffix(val, "%") {
+				correct(k, "deprecated-syntax", fmt.Sprintf("%q; the percent sign is implied", field(k)), "canary="+strings.TrimSuffix(val, "%"))
+			}
+		}
+
+		fixedLine := strings.Join(tokens, "")
+		expanded, err := expandZoneVars(fixedLine, vars)
+		var name string
+		var rec Record
+		if err == nil {
+			name, rec, _, err = zs.parseLine(expanded)
+		}
+		if err != nil {
+			findings = append(findings, lintFinding{line: num, rule: "invalid", msg: err.Error()})
+			out = append(out, fixedLine)
+			continue
+		}
+
+		if rec.TTL < lintMinTTL || rec.TTL > lintMaxTTL {
+			findings = append(findings, lintFinding{line: num, rule: "ttl-outlier",
+				msg: fmt.Sprintf("TTL %d is outside %d-%d", rec.TTL, lintMinTTL, lintMaxTTL)})
+		}
+		rrset := name + " " + rec.Type
+		if ttl, ok := ttls[rrset]; ok && ttl != rec.TTL {
+			findings = append(findings, lintFinding{line: num, rule: "ttl-outlier",
+				msg: fmt.Sprintf("TTL %d differs from %d used earlier for %s", rec.TTL, ttl, rrset)})
+		} else if !ok {
+			ttls[rrset] = rec.TTL
+		}
+
+		dup := rec
+		dup.TTL = 0
+		key := fmt.Sprintf("%s %+v", name, dup)
+		if first, ok := seen[key]; ok {
+			findings = append(findings, lintFinding{line: num, rule: "duplicate",
+				msg: fmt.Sprintf("same record as line %d", first), fixed: fix})
+			if fix {
+				continue
+			}
+		} else {
+			seen[key] = num
+		}
+		out = append(out, fixedLine)
+	}
+	return out, findings
+}
+
+// writeFileAtomic replaces path with data so readers, including the zone
+// reload loop, never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestLintZone(t *testing.T) {
+	zone := []string{
+		"; hosts",
+		"www.example. 300 in a 10.0.0.1",
+		"alias.example 300 IN CNAME www.example",
+		"www.example. 600 IN A 10.0.0.1",
+		"tiny.example. 5 IN A 10.0.0.2",
+		"app.example. 300 IN A 10.0.0.3 canary=10%",
+		"bad.example. 300 IN A not-an-address",
+	}
+	var got []string
+	_, findings := lintZone(zone, false, 0)
+	for _, f := range findings {
+		got = append(got, fmt.Sprintf("%d %s", f.line, f.rule))
+	}
+	want := "[2 deprecated-syntax 2 deprecated-syntax 3 missing-trailing-dot 3 missing-trailing-dot " +
+		"4 ttl-outlier 4 duplicate 5 ttl-outlier 6 deprecated-syntax 7 invalid]"
+	if fmt.Sprint(got) != want {
+		t.Errorf("findings %v\nwant %s", got, want)
+	}
+
+	fixed, findings := lintZone(zone, true, 0)
+	wantLines := []string{
+		"; hosts",
+		"www.example. 300 IN A 10.0.0.1",
+		"alias.example. 300 IN CNAME www.example.",
+		"tiny.example. 5 IN A 10.0.0.2",
+		"app.example. 300 IN A 10.0.0.3 canary=10",
+		"bad.example. 300 IN A not-an-address",
+	}
+	if strings.Join(fixed, "\n") != strings.Join(wantLines, "\n") {
+		t.Errorf("fixed zone:\n%s", strings.Join(fixed, "\n"))
+	}
+	remaining := 0
+	for _, f := range findings {
+		if !f.fixed {
+			remaining++
+		}
+	}
+	// The TTL outliers and the invalid line need a person.
+	if remaining != 3 {
+		t.Errorf("%d findings left unfixed, want 3", remaining)
+	}
+}
+
+func TestLintConfig(t *testing.T) {
+	findings := lintConfig([]byte("hosts_file: zones.txt\nmode: hybird\npoll_frequency: 5\n"), &Config{})
+	var rules []string
+	for _, f := range findings {
+		rules = append(rules, f.rule)
+	}
+	if fmt.Sprint(rules) != "[unknown-key bad-value]" {
+		t.Errorf("findings %+v", findings)
+	}
+}
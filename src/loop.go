@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Forwarding loop detection. Once the listener is up, a query for a random
+// name is sent through each upstream; if it comes back to this server the
+// upstream (directly, or via another forwarder) forwards to us and every
+// miss would circle until it times out.
+
+var (
+	loopProbesMu sync.Mutex
+	loopProbes   = map[string]bool{} // outstanding probe names
+	loopHits     = map[string]bool{}
+)
+
+func newLoopProbe() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	name := hex.EncodeToString(b[:4]) + "." + hex.EncodeToString(b[4:]) + "."
+	loopProbesMu.Lock()
+	loopProbes[name] = true
+	loopProbesMu.Unlock()
+	return name
+}
+
+// catchLoopProbe answers one of our own probes and records the hit. It
+// reports whether r was a probe.
+func catchLoopProbe(w dns.ResponseWriter, r *dns.Msg) bool {
+	if len(r.Question) != 1 || r.Question[0].Qtype != dns.TypeHINFO {
+		return false
+	}
+	name := dns.CanonicalName(r.Question[0].Name)
+	loopProbesMu.Lock()
+	probe := loopProbes[name]
+	if probe {
+		loopHits[name] = true
+	}
+	loopProbesMu.Unlock()
+	if !probe {
+		return false
+	}
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeNameError)
+	w.WriteMsg(m)
+	return true
+}
+
+// forgetLoopProbe retires a probe name and reports whether it reached us.
+func forgetLoopProbe(name string) bool {
+	loopProbesMu.Lock()
+	defer loopProbesMu.Unlock()
+	hit := loopHits[name]
+	delete(loopProbes, name)
+	delete(loopHits, name)
+	return hit
+}
+
+// checkForwardingLoops probes every upstream and exits if one loops back.
+func checkForwardingLoops() {
+	for _, u := range activeUpstreams() {
+		name := newLoopProbe()
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeHINFO)
+		_, err := exchangeUpstream(u, q)
+		if forgetLoopProbe(name) {
+			log.Fatalf("Invalid configuration: forwarding loop: upstream %s sends queries back to this server", u.name)
+		}
+		if err != nil {
+			log.Printf("Loop check for upstream %s inconclusive: %v", u.name, err)
+		} else {
+			markWarm(warmUpstreams)
+		}
+	}
+}
@@ -1,14 +1,17 @@
 package main
 
 import (
-	"bufio"
+	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"log"
 	"net"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -16,24 +19,122 @@ import (
 )
 
 type Config struct {
-	ListenPort  string `yaml:"listen_port"`
-	HostsFile   string `yaml:"hosts_file"`
-	LogLevel    string `yaml:"log_level"`
-	PollFreq    int    `yaml:"poll_freq"`
-	FallbackDNS string `yaml:"fallback_dns"`
+	ListenPort   string   `yaml:"listen_port"`
+	ListenAddrs  []string `yaml:"listen_addrs"` // each bound over UDP and TCP; a bare IP uses listen_port
+	HostsFile    string   `yaml:"hosts_file"`
+	LogLevel     string   `yaml:"log_level"`
+	PollFreq     int      `yaml:"poll_freq"`
+	FallbackDNS  string   `yaml:"fallback_dns"`
+	BootstrapDNS []string `yaml:"bootstrap_dns"`
+	Mode         string   `yaml:"mode"`
+	ChaseCNAME   bool     `yaml:"chase_cname"`
+	// Rcode for queries nothing can answer while no records are loaded:
+	// servfail (default), refused, nxdomain or noerror.
+	EmptyZoneRcode string `yaml:"empty_zone_rcode"`
+	// How local names answer qtype ANY: all (default) or hinfo.
+	AnyResponse string `yaml:"any_response"`
+	// REFUSED, rather than an empty NOERROR, for names that have no local
+	// records and lie in no authoritative zone. Needs no fallback_dns.
+	RefuseOutOfZone bool `yaml:"refuse_out_of_zone"`
+	// TTL for hosts_file lines that leave the column out; 0 requires one.
+	DefaultTTL uint32 `yaml:"default_ttl"`
+	// Bounds on the TTLs of every answer, local and forwarded; 0 is none.
+	MinTTL uint32 `yaml:"min_ttl"`
+	MaxTTL uint32 `yaml:"max_ttl"`
+
+	RateLimit     RateLimitConfig     `yaml:"rate_limit"`
+	NeighborCheck NeighborCheckConfig `yaml:"neighbor_check"`
+	ACL           ACLConfig           `yaml:"acl"`
+	Update        UpdateConfig        `yaml:"update"`
+	EDNS          EDNSConfig          `yaml:"edns"`
+	AnswerOrder   AnswerOrderConfig   `yaml:"answer_order"`
+	AnswerLimit   AnswerLimitConfig   `yaml:"answer_limit"`
+	HealthChecks  []HealthCheckConfig `yaml:"health_checks"`
+	Kubernetes    KubernetesConfig    `yaml:"kubernetes"`
+	Services      []ServiceConfig     `yaml:"services"`
+	Docker        DockerConfig        `yaml:"docker"`
+	KV            KVConfig            `yaml:"kv"`
+	Database      DatabaseConfig      `yaml:"database"`
+	ACME          ACMEConfig          `yaml:"acme"`
+	Anycast       AnycastConfig       `yaml:"anycast"`
+	Readiness     ReadinessConfig     `yaml:"readiness"`
+	DNS64         DNS64Config         `yaml:"dns64"`
+	RPZ           []RPZConfig         `yaml:"rpz"`
+	BlockResponse BlockResponseConfig `yaml:"block_response"`
+	Rules         []RuleConfig        `yaml:"rules"`
+	Policies      []PolicyConfig      `yaml:"policies"`
+	DHCPLeases    DHCPLeasesConfig    `yaml:"dhcp_leases"`
+	HostsEntries  HostsEntriesConfig  `yaml:"hosts_entries"`
+	Fingerprint   FingerprintConfig   `yaml:"fingerprint"`
+	ClientGroups  map[string][]string `yaml:"client_groups"`
+	Restrict      []RestrictConfig    `yaml:"restrict"`
+	QtypeFilters  []QtypeFilterConfig `yaml:"qtype_filters"`
+	SLO           SLOConfig           `yaml:"slo"`
+	Analytics     AnalyticsConfig     `yaml:"analytics"`
+	Dnsmasq       DnsmasqConfig       `yaml:"dnsmasq"`
+	UDP           UDPConfig           `yaml:"udp"`
+	Sortlist      SortlistConfig      `yaml:"sortlist"`
+	Splits        []SplitConfig       `yaml:"splits"`
+	Chaos         ChaosConfig         `yaml:"chaos"`
+	Cluster       ClusterConfig       `yaml:"cluster"`
+	Privacy       PrivacyConfig       `yaml:"privacy"`
+	Trace         TraceConfig         `yaml:"trace"`
+	GeoIP         GeoIPConfig         `yaml:"geoip"`
+	MDNS          MDNSConfig          `yaml:"mdns"`
+	DNSSEC        DNSSECConfig        `yaml:"dnssec"`
+	Sandbox       SandboxConfig       `yaml:"sandbox"`
+	Admin         AdminConfig         `yaml:"admin"`
+	Cache         CacheConfig         `yaml:"cache"`
+	Forward       ForwardConfig       `yaml:"forward"`
+	Privileges    PrivilegesConfig    `yaml:"privileges"`
+	WriteBack     WriteBackConfig     `yaml:"write_back"`
+	Backup        BackupConfig        `yaml:"backup"`
+	Views         []ViewConfig        `yaml:"views"`
+	Zones         []ZoneConfig        `yaml:"zones"`
+	ZoneWorkers   int                 `yaml:"zone_workers"` // zone files loaded at once; default: CPUs
 }
 
+// Operating profiles. Hybrid serves the local zone and forwards misses,
+// authoritative never forwards, and forwarder never loads a zone.
+const (
+	modeHybrid        = "hybrid"
+	modeAuthoritative = "authoritative"
+	modeForwarder     = "forwarder"
+)
+
 type Record struct {
-	Type string
-	TTL  uint32
-	Data string
-	Pref uint16
+	Type   string
+	TTL    uint32
+	Data   string
+	Pref   uint16
+	Canary int // percent of clients served this variant; 0 for the base set
+	Weight int // relative share under weighted answer order; 0 means 1
+
+	// TXT only; when set, each string is sent separately instead of Data.
+	Strings []string
+
+	// SRV only; Pref holds the priority.
+	SrvWeight uint16
+	Port      uint16
+
+	// Served only to clients GeoIP places in one of these; see GeoIPConfig.
+	Countries  []string
+	Continents []string
+
+	// The wire form, built once when the record reaches the store; see
+	// prepareRecords.
+	wire *wireRR
 }
 
 var (
-	records          map[string]Record
+	records          = newRecordStore()
 	hostsFileModTime time.Time
 	config           = &Config{}
+	configFile       string
+	staleReport      bool
+	checkOnly        bool
+	fallbackFlag     string // -fallback, which a reload keeps
+	emptyZoneRcode   = dns.RcodeServerFailure
 )
 
 func loadConfig(path string) error {
@@ -44,16 +145,31 @@ func loadConfig(path string) error {
 	return yaml.Unmarshal(data, config)
 }
 
-func parseFlags() {
+func parseFlags() error {
 	configPath := flag.String("config", "config.yaml", "Path to config file")
 	port := flag.String("port", "", "Listen port")
 	zones := flag.String("zones", "", "Zone file path")
 	fallback := flag.String("fallback", "", "Fallback DNS (e.g. 8.8.8.8:53)")
 	poll := flag.Int("poll", 0, "Zone file reload frequency (seconds)")
+	mode := flag.String("mode", "", "Operating mode: hybrid, authoritative or forwarder")
+	runAs := flag.String("user", "", "User to switch to after binding")
+	chroot := flag.String("chroot", "", "Directory to chroot into after binding")
+	flag.BoolVar(&staleReport, "stale-report", false, "Print A and AAAA records missing from the neighbor tables and exit")
+	flag.BoolVar(&checkOnly, "check-config", false, "Validate the configuration and zone files, then exit")
 
 	flag.Parse()
 
-	_ = loadConfig(*configPath)
+	configFile = *configPath
+	if err := loadConfig(*configPath); err != nil {
+		explicit := false
+		flag.Visit(func(f *flag.Flag) { explicit = explicit || f.Name == "config" })
+		// Without a config file the flags and defaults still make a
+		// server, as in the Docker image; a broken one is never ignored.
+		if !errors.Is(err, fs.ErrNotExist) || explicit {
+			return fmt.Errorf("%s: %v", *configPath, err)
+		}
+		log.Printf("No %s; using flags and defaults", *configPath)
+	}
 
 	// Env var PORT overrides everything else
 	if envPort := os.Getenv("PORT"); envPort != "" {
@@ -67,211 +183,1185 @@ func parseFlags() {
 	}
 	if *fallback != "" {
 		config.FallbackDNS = *fallback
+		fallbackFlag = *fallback
 	}
 	if *poll > 0 {
 		config.PollFreq = *poll
 	}
+	if *mode != "" {
+		config.Mode = *mode
+	}
+	if *runAs != "" {
+		config.Privileges.User = *runAs
+	}
+	if *chroot != "" {
+		config.Privileges.Chroot = *chroot
+	}
+	return nil
 }
 
-func loadZoneFile(path string) (map[string]Record, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		return nil, err
+// applyMode normalizes config.Mode and disables the subsystems that the
+// selected profile doesn't use.
+func applyMode() error {
+	config.Mode = strings.ToLower(strings.TrimSpace(config.Mode))
+	// fallback_dns doubles as "forwarding is enabled" from here on.
+	if config.FallbackDNS == "" && len(config.Forward.Upstreams) > 0 {
+		config.FallbackDNS = config.Forward.Upstreams[0]
+	}
+	switch config.Mode {
+	case "", modeHybrid:
+		config.Mode = modeHybrid
+	case modeAuthoritative:
+		if config.FallbackDNS != "" {
+			log.Printf("Authoritative mode: ignoring fallback_dns %s", config.FallbackDNS)
+			config.FallbackDNS = ""
+			config.Forward.Upstreams = nil
+		}
+	case modeForwarder:
+		if config.FallbackDNS == "" {
+			return fmt.Errorf("forwarder mode requires fallback_dns")
+		}
+	default:
+		return fmt.Errorf("unknown mode %q (want hybrid, authoritative or forwarder)", config.Mode)
 	}
-	defer file.Close()
 
-	recs := make(map[string]Record)
-	scanner := bufio.NewScanner(file)
-	lineNum := 0
+	switch strings.ToLower(config.EmptyZoneRcode) {
+	case "", "servfail":
+		emptyZoneRcode = dns.RcodeServerFailure
+	case "refused":
+		emptyZoneRcode = dns.RcodeRefused
+	case "nxdomain":
+		emptyZoneRcode = dns.RcodeNameError
+	case "noerror":
+		emptyZoneRcode = dns.RcodeSuccess
+	default:
+		return fmt.Errorf("empty_zone_rcode must be servfail, refused, nxdomain or noerror, got %q", config.EmptyZoneRcode)
+	}
 
-	for scanner.Scan() {
-		lineNum++
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "#") {
-			continue
+	config.AnyResponse = strings.ToLower(config.AnyResponse)
+	switch config.AnyResponse {
+	case "":
+		config.AnyResponse = anyAll
+	case anyAll, anyHINFO:
+	default:
+		return fmt.Errorf("any_response must be all or hinfo, got %q", config.AnyResponse)
+	}
+	if config.RefuseOutOfZone && config.FallbackDNS != "" {
+		return fmt.Errorf("refuse_out_of_zone needs a server that doesn't forward; remove fallback_dns or use authoritative mode")
+	}
+	return nil
+}
+
+// Defaults for settings that have no usable zero value.
+const (
+	defaultListenPort = "53"
+	defaultPollFreq   = 5
+)
+
+// validateConfig checks the core settings once flags and the mode are
+// applied, filling in defaults where a zero value would misbehave (an
+// empty port, or a zero poll_freq spinning the reload loop).
+func validateConfig() error {
+	if config.ListenPort == "" {
+		config.ListenPort = defaultListenPort
+	}
+	if port, err := strconv.Atoi(config.ListenPort); err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("listen_port must be a port number from 1 to 65535, got %q", config.ListenPort)
+	}
+	switch {
+	case config.PollFreq < 0:
+		return fmt.Errorf("poll_freq must not be negative, got %d", config.PollFreq)
+	case config.PollFreq == 0:
+		config.PollFreq = defaultPollFreq
+	}
+	for i, addr := range config.ListenAddrs {
+		addr = withDefaultPort(addr, config.ListenPort)
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("listen_addrs[%d]: %v", i, err)
 		}
-		fields := strings.Fields(line)
-		if len(fields) < 5 {
-			log.Printf("Invalid line %d: too few fields", lineNum)
-			continue
+		if host != "" && net.ParseIP(host) == nil {
+			return fmt.Errorf("listen_addrs[%d]: %q is not an IP address", i, host)
 		}
-		name := dns.Fqdn(fields[0])
-		ttl, err := strconv.ParseUint(fields[1], 10, 32)
-		if err != nil {
-			log.Printf("Invalid TTL on line %d: %v", lineNum, err)
-			continue
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("listen_addrs[%d]: bad port %q", i, port)
 		}
-		class := strings.ToUpper(fields[2])
-		rtype := strings.ToUpper(fields[3])
-		if class != "IN" {
-			log.Printf("Unsupported class on line %d: %s", lineNum, class)
-			continue
+		config.ListenAddrs[i] = addr
+	}
+	if config.Mode != modeForwarder && config.HostsFile == "" {
+		return fmt.Errorf("hosts_file is required unless mode is forwarder")
+	}
+	return nil
+}
+
+func loadZoneFile(path string) (map[string][]Record, error) {
+	if isRemoteZone(path) {
+		return fetchRemoteZone(path, hostsFileSyntax(), false)
+	}
+	return loadZoneFileIn(path, hostsFileSyntax())
+}
+
+// hostsFileSyntax is how hosts_file lines are read: the flat format, with
+// default_ttl standing in for a missing TTL.
+func hostsFileSyntax() zoneSyntax {
+	return zoneSyntax{defaultTTL: config.DefaultTTL}
+}
+
+// zoneSyntax holds what a zone file's lines are read relative to. The zero
+// value reads the flat hosts_file format: every name is absolute and every
+// line has a TTL.
+type zoneSyntax struct {
+	origin     string // relative names and "@" are completed with it
+	defaultTTL uint32 // used when a line has no TTL; 0 requires one
+}
+
+// qualify makes name absolute.
+func (zs zoneSyntax) qualify(name string) string {
+	if zs.origin == "" || strings.HasSuffix(name, ".") {
+		return dns.Fqdn(name)
+	}
+	if name == "@" {
+		return zs.origin
+	}
+	return name + "." + zs.origin
+}
+
+// parseZoneLine parses one line of hosts_file. ok is false for blank and
+// comment lines.
+func parseZoneLine(line string) (name string, rec Record, ok bool, err error) {
+	return hostsFileSyntax().parseLine(line)
+}
+
+func (zs zoneSyntax) parseLine(line string) (name string, rec Record, ok bool, err error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "#") {
+		return "", Record{}, false, nil
+	}
+	fields := strings.Fields(line)
+	if zs.defaultTTL > 0 && len(fields) > 1 {
+		if _, err := strconv.ParseUint(fields[1], 10, 32); err != nil {
+			fields = slices.Insert(fields, 1, strconv.FormatUint(uint64(zs.defaultTTL), 10))
 		}
+	}
+	fields, opts, err := splitRecordOptions(fields)
+	if err != nil {
+		return "", Record{}, false, fmt.Errorf("invalid option: %v", err)
+	}
+	if len(fields) < 5 {
+		return "", Record{}, false, fmt.Errorf("too few fields")
+	}
+	name = zs.qualify(fields[0])
+	if zs.origin != "" && !dns.IsSubDomain(zs.origin, strings.ToLower(name)) {
+		return "", Record{}, false, fmt.Errorf("%s is outside zone %s", name, zs.origin)
+	}
+	ttl, err := strconv.ParseUint(fields[1], 10, 32)
+	if err != nil {
+		return "", Record{}, false, fmt.Errorf("invalid TTL: %v", err)
+	}
+	class := strings.ToUpper(fields[2])
+	rtype := strings.ToUpper(fields[3])
+	if class != "IN" {
+		return "", Record{}, false, fmt.Errorf("unsupported class %s", class)
+	}
 
-		switch rtype {
-		case "A":
-			if net.ParseIP(fields[4]) == nil {
-				log.Printf("Invalid IP on line %d: %s", lineNum, fields[4])
-				continue
+	switch rtype {
+	case "A":
+		if net.ParseIP(fields[4]) == nil {
+			return "", Record{}, false, fmt.Errorf("invalid IP %s", fields[4])
+		}
+		rec = Record{Type: "A", TTL: uint32(ttl), Data: fields[4]}
+	case "AAAA":
+		if ip := net.ParseIP(fields[4]); ip == nil || ip.To4() != nil {
+			return "", Record{}, false, fmt.Errorf("invalid IPv6 address %s", fields[4])
+		}
+		rec = Record{Type: "AAAA", TTL: uint32(ttl), Data: fields[4]}
+	case "CNAME":
+		target := zs.qualify(fields[4])
+		if _, ok := dns.IsDomainName(target); !ok {
+			return "", Record{}, false, fmt.Errorf("invalid CNAME target %s", target)
+		}
+		rec = Record{Type: "CNAME", TTL: uint32(ttl), Data: target}
+	case "PTR":
+		target := zs.qualify(fields[4])
+		if _, ok := dns.IsDomainName(target); !ok {
+			return "", Record{}, false, fmt.Errorf("invalid PTR target %s", target)
+		}
+		rec = Record{Type: "PTR", TTL: uint32(ttl), Data: target}
+	case "NS":
+		target := zs.qualify(fields[4])
+		if _, ok := dns.IsDomainName(target); !ok {
+			return "", Record{}, false, fmt.Errorf("invalid NS target %s", target)
+		}
+		rec = Record{Type: "NS", TTL: uint32(ttl), Data: target}
+	case "TXT":
+		txt := strings.Join(fields[4:], " ")
+		rec = Record{Type: "TXT", TTL: uint32(ttl), Data: txt}
+	case "MX":
+		if len(fields) < 6 {
+			return "", Record{}, false, fmt.Errorf("invalid MX: missing preference/host")
+		}
+		pref, err := strconv.Atoi(fields[4])
+		if err != nil {
+			return "", Record{}, false, fmt.Errorf("invalid MX preference: %v", err)
+		}
+		host := zs.qualify(fields[5])
+		if _, ok := dns.IsDomainName(host); !ok {
+			return "", Record{}, false, fmt.Errorf("invalid MX host %s", host)
+		}
+		rec = Record{Type: "MX", TTL: uint32(ttl), Data: host, Pref: uint16(pref)}
+	case "SRV":
+		if len(fields) < 8 {
+			return "", Record{}, false, fmt.Errorf("invalid SRV: want priority weight port target")
+		}
+		var nums [3]uint16
+		for i := range nums {
+			n, err := strconv.ParseUint(fields[4+i], 10, 16)
+			if err != nil {
+				return "", Record{}, false, fmt.Errorf("invalid SRV field: %v", err)
 			}
-			recs[name] = Record{Type: "A", TTL: uint32(ttl), Data: fields[4]}
-		case "CNAME":
-			target := dns.Fqdn(fields[4])
-			_, ok := dns.IsDomainName(target)
-			if !ok {
-				log.Printf("Invalid CNAME target on line %d: %s", lineNum, target)
-				continue
+			nums[i] = uint16(n)
+		}
+		target := zs.qualify(fields[7])
+		if _, ok := dns.IsDomainName(target); !ok {
+			return "", Record{}, false, fmt.Errorf("invalid SRV target %s", target)
+		}
+		rec = Record{Type: "SRV", TTL: uint32(ttl), Data: target, Pref: nums[0], SrvWeight: nums[1], Port: nums[2]}
+	default:
+		if !rdataTypes[rtype] {
+			return "", Record{}, false, fmt.Errorf("unsupported record type %s", rtype)
+		}
+		rec, err = parseRdata(rtype, uint32(ttl), strings.Join(fields[4:], " "))
+		if err != nil {
+			return "", Record{}, false, fmt.Errorf("invalid %s: %v", rtype, err)
+		}
+	}
+	rec.Canary = opts.canary
+	rec.Weight = opts.weight
+	rec.Countries = opts.countries
+	rec.Continents = opts.continents
+	return name, rec, true, nil
+}
+
+// recordOptions are the trailing key=value settings of a zone line.
+type recordOptions struct {
+	canary int // serve the record to this percent of queries
+	weight int // relative share under weighted answer order
+
+	countries, continents []string // GeoIP tags
+}
+
+// splitRecordOptions removes trailing key=value options from a zone line and
+// returns the remaining fields.
+func splitRecordOptions(fields []string) ([]string, recordOptions, error) {
+	var opts recordOptions
+	for len(fields) > 5 {
+		key, val, ok := strings.Cut(fields[len(fields)-1], "=")
+		if !ok {
+			break
+		}
+		switch key {
+		case "canary":
+			pct, err := strconv.Atoi(strings.TrimSuffix(val, "%"))
+			if err != nil || pct <= 0 || pct > 100 {
+				return nil, opts, fmt.Errorf("canary must be a percentage between 1 and 100, got %q", val)
 			}
-			recs[name] = Record{Type: "CNAME", TTL: uint32(ttl), Data: target}
-		case "TXT":
-			txt := strings.Join(fields[4:], " ")
-			recs[name] = Record{Type: "TXT", TTL: uint32(ttl), Data: txt}
-		case "MX":
-			if len(fields) < 6 {
-				log.Printf("Invalid MX on line %d: missing preference/host", lineNum)
-				continue
+			opts.canary = pct
+		case "weight":
+			w, err := strconv.Atoi(val)
+			if err != nil || w <= 0 {
+				return nil, opts, fmt.Errorf("weight must be a positive integer, got %q", val)
 			}
-			pref, err := strconv.Atoi(fields[4])
+			opts.weight = w
+		case "country", "continent":
+			codes, err := parseGeoCodes(key, val)
 			if err != nil {
-				log.Printf("Invalid MX preference on line %d: %v", lineNum, err)
-				continue
+				return nil, opts, err
 			}
-			host := dns.Fqdn(fields[5])
-			_, ok := dns.IsDomainName(host)
-			if !ok {
-				log.Printf("Invalid MX host on line %d: %s", lineNum, host)
-				continue
+			if key == "country" {
+				opts.countries = codes
+			} else {
+				opts.continents = codes
 			}
-			recs[name] = Record{Type: "MX", TTL: uint32(ttl), Data: host, Pref: uint16(pref)}
 		default:
-			log.Printf("Unsupported record type on line %d: %s", lineNum, rtype)
+			return fields, opts, nil
 		}
+		fields = fields[:len(fields)-1]
 	}
-	return recs, scanner.Err()
+	return fields, opts, nil
 }
 
 func reloadZoneIfChanged() {
 	for {
 		time.Sleep(time.Duration(config.PollFreq) * time.Second)
-		info, err := os.Stat(config.HostsFile)
-		if err == nil && info.ModTime().After(hostsFileModTime) {
-			newRecords, err := loadZoneFile(config.HostsFile)
-			if err == nil {
-				records = newRecords
-				hostsFileModTime = info.ModTime()
-				log.Println("Reloaded zone file")
+		if isRemoteZone(config.HostsFile) {
+			reloadRemoteZone()
+			continue
+		}
+		zoneFileMu.Lock()
+		reloadZoneFile()
+		zoneFileMu.Unlock()
+	}
+}
+
+func handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
+	answerQuery(w, r, records)
+}
+
+// answerQuery serves r from store: the main record set, or a view's.
+func answerQuery(w dns.ResponseWriter, r *dns.Msg, store *recordStore) {
+	w = checkedWriter{w, r}
+	q := &Query{W: w, R: r, Client: clientIP(w), Listener: listenerLabel(w), store: store, logq: queryLogf}
+	q.stats = statsFor(q.Listener)
+	q.stats.queries.Add(1)
+	queryChain(q)
+}
+
+func serveRateLimit(q *Query, next func(*Query)) {
+	if limiter != nil && !limiter.allowQuery(q.Client) {
+		q.stats.dropped.Add(1)
+		return
+	}
+	next(q)
+}
+
+func serveACL(q *Query, next func(*Query)) {
+	if !activeFilters().queryACL.permits(q.Client) {
+		m := new(dns.Msg)
+		m.SetRcode(q.R, dns.RcodeRefused)
+		refusedEDE(q.R, m, "query not allowed")
+		q.W.WriteMsg(m)
+		q.stats.refused.Add(1)
+		log.Printf("[%s] Refused query from %s", q.Listener, clientLabel(q.Client))
+		return
+	}
+	next(q)
+}
+
+func serveEDNSCheck(q *Query, next func(*Query)) {
+	if rcode, reason := checkEDNS(q.R); rcode != dns.RcodeSuccess {
+		m := new(dns.Msg)
+		m.SetRcode(q.R, rcode)
+		if rcode == dns.RcodeBadVers {
+			// BADVERS needs an OPT to carry it; it advertises version 0.
+			finishEDNS(q.R, m)
+		}
+		q.W.WriteMsg(m)
+		name := dns.RcodeToString[rcode]
+		if rcode == dns.RcodeBadVers {
+			name = "BADVERS" // shares its code with BADSIG
+		}
+		log.Printf("[%s] %s from %s: %s", q.Listener, name, clientLabel(q.Client), reason)
+		return
+	}
+	next(q)
+}
+
+func serveCookie(q *Query, next func(*Query)) {
+	var refused bool
+	if q.W, refused = checkCookie(q.W, q.R, q.Client); refused {
+		q.stats.refused.Add(1)
+		return
+	}
+	next(q)
+}
+
+// serveOpcode hands UPDATE and NOTIFY to their handlers and lets only
+// plain queries go further.
+func serveOpcode(q *Query, next func(*Query)) {
+	r := q.R
+	switch {
+	case r.Opcode == dns.OpcodeUpdate:
+		handleUpdate(q.W, r)
+	case r.Opcode == dns.OpcodeNotify:
+		handleNotify(q.W, r)
+	// A query asks exactly one question (RFC 9619); the accept func
+	// turns others away, but not every path goes through it.
+	case r.Opcode != dns.OpcodeQuery || len(r.Question) != 1:
+		m := new(dns.Msg)
+		rcode := dns.RcodeFormatError
+		if r.Opcode != dns.OpcodeQuery {
+			rcode = dns.RcodeNotImplemented
+		}
+		m.SetRcode(r, rcode)
+		q.W.WriteMsg(m)
+	default:
+		next(q)
+	}
+}
+
+func serveChaosClass(q *Query, next func(*Query)) {
+	if q.R.Question[0].Qclass == dns.ClassCHAOS {
+		answerChaos(q.W, q.R, q.Listener)
+		return
+	}
+	next(q)
+}
+
+// serveSpecialQtype handles zone transfers, meta-queries and ANY from
+// clients not allowed it.
+func serveSpecialQtype(q *Query, next func(*Query)) {
+	switch qtype := q.R.Question[0].Qtype; {
+	case qtype == dns.TypeAXFR || qtype == dns.TypeIXFR:
+		serveTransfer(q.W, q.R, q.Client)
+	case metaQtype(qtype):
+		m := new(dns.Msg)
+		m.SetRcode(q.R, dns.RcodeNotImplemented)
+		q.W.WriteMsg(m)
+		log.Printf("[%s] Meta-query %s from %s not implemented", q.Listener, dns.TypeToString[qtype], clientLabel(q.Client))
+	case qtype == dns.TypeANY && !activeFilters().anyACL.permits(q.Client):
+		m := new(dns.Msg)
+		m.SetRcode(q.R, dns.RcodeRefused)
+		refusedEDE(q.R, m, "ANY not allowed")
+		q.W.WriteMsg(m)
+		q.stats.refused.Add(1)
+		log.Printf("[%s] Refused ANY query from %s", q.Listener, clientLabel(q.Client))
+	default:
+		next(q)
+	}
+}
+
+func serveLoopProbe(q *Query, next func(*Query)) {
+	if catchLoopProbe(q.W, q.R) {
+		return
+	}
+	next(q)
+}
+
+// serveLog sets the query up for the plugins that answer it and, once they
+// have, counts, traces and logs the outcome.
+func serveLog(q *Query, next func(*Query)) {
+	r, client := q.R, q.Client
+	q.recursion = config.FallbackDNS != "" && activeFilters().recursionACL.permits(client)
+	// Quiet queries are answered but left out of logs and statistics.
+	q.quiet = privacy.quiet(r.Question[0].Name, client)
+	if q.quiet {
+		q.logq = func(string, ...any) {}
+	}
+	q.pol = clientPolicy(client)
+	if fingerprints != nil && !q.quiet {
+		fingerprints.observe(client, q.Name())
+	}
+
+	start := time.Now()
+	q.source = answerLocal
+	q.rcode = dns.RcodeSuccess
+	q.trace = newAnswerTrace(r, client, q.Listener, q.quiet)
+	defer func() {
+		q.trace.finish(q.rcode)
+		q.stats.countResponse(q.source, q.rcode)
+		if !q.quiet {
+			debugLogf("[%s] %s %s from %s: %s, answered by %s", q.Listener, dns.TypeToString[r.Question[0].Qtype],
+				r.Question[0].Name, clientLabel(client), dns.RcodeToString[q.rcode], q.trace.via)
+		}
+		observeLatency(r.Question[0].Qtype, q.source, time.Since(start))
+		if q.quiet {
+			observeTop(nil, "", q.source, q.blocked)
+		} else {
+			observeTop(client, r.Question[0].Name, q.source, q.blocked)
+		}
+		if slo != nil {
+			slo.observe(q.Listener, q.source, time.Since(start))
+		}
+		if analytics != nil && !q.quiet {
+			analytics.record(client, q.Listener, r.Question[0], q.rcode, q.source, time.Since(start))
+		}
+	}()
+
+	q.Msg = new(dns.Msg)
+	q.Msg.SetReply(r)
+	q.Msg.Authoritative = true
+	q.loc = locateClient(client, r)
+	q.logq("[%s] Received query: %s %s", q.Listener, dns.TypeToString[r.Question[0].Qtype], r.Question[0].Name)
+	next(q)
+}
+
+// serveRewrite installs the writers that adjust every answer: rule TTL
+// clamps, sortlist ordering and DNS64 synthesis.
+func serveRewrite(q *Query, next func(*Query)) {
+	if len(activeFilters().rules) > 0 {
+		if ru := matchRule(q.Name(), q.Client, q.pol); ru != nil && ru.clampsTTL() {
+			q.W = ruleWriter{q.W, ru}
+		}
+	}
+	if sortlist != nil && q.Client != nil {
+		q.W = sortWriter{q.W, q.Client}
+	}
+	if dns64 != nil && dns64.appliesTo(q.R, q.Client) {
+		q.W = dns64Writer{q.W, q.R, q.store, q.loc, q.recursion}
+	}
+	next(q)
+}
+
+func serveRestrict(q *Query, next func(*Query)) {
+	name := q.Name()
+	if !hidden(name, 0, q.Client) {
+		next(q)
+		return
+	}
+	q.Msg.Rcode = dns.RcodeNameError
+	if z := authoritativeZone(name); z != nil && q.store == records {
+		q.Msg.Ns = append(q.Msg.Ns, z.soa())
+	}
+	// No EDE: it would give the name away.
+	q.trace.set("restriction")
+	q.Reply()
+}
+
+func serveQtypeFilter(q *Query, next func(*Query)) {
+	qtype, name := q.R.Question[0].Qtype, q.Name()
+	qf := matchQtypeFilter(qtype, q.Client)
+	if qf == nil {
+		next(q)
+		return
+	}
+	q.blocked = true
+	text := dns.TypeToString[qtype] + " filtered"
+	q.logq("[%s] Query type filter: %s for %s %s from %s", q.Listener, qf.action, dns.TypeToString[qtype], name, clientLabel(q.Client))
+	switch qf.action {
+	case qtypeDrop:
+		q.trace.stage("dropped", text)
+		return
+	case qtypeRefuse:
+		q.Msg.Rcode = dns.RcodeRefused
+		q.trace.explain("query type filter", dns.ExtendedErrorCodeProhibited, text)
+	default:
+		if z := authoritativeZone(name); z != nil && q.store == records {
+			q.Msg.Ns = append(q.Msg.Ns, z.soa())
+		}
+		q.trace.explain("query type filter", dns.ExtendedErrorCodeFiltered, text)
+	}
+	q.Reply()
+}
+
+func serveRPZ(q *Query, next func(*Query)) {
+	name, m := q.Name(), q.Msg
+	p, z := rpzMatch(name, q.pol)
+	if p == nil || p.action == rpzPassthru {
+		next(q)
+		return
+	}
+	z.hits.Add(1)
+	q.blocked = p.action != rpzTCPOnly
+	q.logq("[%s] Policy zone %s: %s for %s from %s", q.Listener, z.origin, rpzActionNames[p.action], name, clientLabel(q.Client))
+	if q.blocked {
+		q.trace.explain("policy zone "+z.origin, dns.ExtendedErrorCodeBlocked, "policy zone "+z.origin)
+	}
+	switch p.action {
+	case rpzDrop:
+		q.trace.stage("dropped", "policy zone "+z.origin)
+		return
+	case rpzNXDomain, rpzNoData:
+		if z.block != nil {
+			z.block.answer(m, q.R.Question[0])
+		} else if p.action == rpzNXDomain {
+			m.Rcode = dns.RcodeNameError
+		}
+	case rpzTCPOnly:
+		_, udp := q.W.RemoteAddr().(*net.UDPAddr)
+		m.Truncated = udp
+		q.trace.stagef("policy zone "+z.origin, "TCP only, truncated: %v", udp)
+		if !udp {
+			next(q)
+			return
+		}
+	case rpzLocalData:
+		question := q.R.Question[0]
+		answers := p.localData(question)
+		m.Answer = append(m.Answer, answers...)
+		if len(answers) == 1 && question.Qtype != dns.TypeCNAME {
+			if cname, ok := answers[0].(*dns.CNAME); ok {
+				m.Answer = append(m.Answer, rpzChase(q.store, cname.Target, question.Qtype, q.loc, q.recursion)...)
 			}
 		}
 	}
+	q.Reply()
 }
 
-func forwardToFallback(r *dns.Msg) (*dns.Msg, error) {
-	c := &dns.Client{Net: "udp"}
-	resp, _, err := c.Exchange(r, config.FallbackDNS)
-	return resp, err
+func serveRules(q *Query, next func(*Query)) {
+	question := q.R.Question[0]
+	ru := matchRule(q.Name(), q.Client, q.pol)
+	if ru == nil || !ru.intercepts(question) {
+		next(q)
+		return
+	}
+	if len(ru.v4)+len(ru.v6) > 0 || ru.NXDomain {
+		q.blocked = true
+		q.trace.explain("rule "+ru.label(), dns.ExtendedErrorCodeBlocked, "rule "+ru.label())
+	} else {
+		q.trace.explain("rule "+ru.label(), dns.ExtendedErrorCodeForgedAnswer, "rule "+ru.label())
+	}
+	ru.answer(q.Msg, question, q.store, q.recursion, q.loc)
+	q.Reply()
 }
 
-func handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
-	m := new(dns.Msg)
-	m.SetReply(r)
-	m.Authoritative = true
-
-	answered := false
-
-	for _, q := range r.Question {
-		log.Printf("Received query: %s %s", dns.TypeToString[q.Qtype], q.Name)
-
-		name := dns.Fqdn(strings.ToLower(q.Name))
-		rec, found := records[name]
-		if found {
-			switch q.Qtype {
-			case dns.TypeA:
-				if rec.Type == "A" {
-					m.Answer = append(m.Answer, &dns.A{
-						Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: rec.TTL},
-						A:   net.ParseIP(rec.Data).To4(),
-					})
-					answered = true
-				} else if rec.Type == "CNAME" {
-					m.Answer = append(m.Answer, &dns.CNAME{
-						Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: rec.TTL},
-						Target: rec.Data,
-					})
-					answered = true
-				}
-			case dns.TypeCNAME:
-				if rec.Type == "CNAME" {
-					m.Answer = append(m.Answer, &dns.CNAME{
-						Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: rec.TTL},
-						Target: rec.Data,
-					})
-					answered = true
-				}
-			case dns.TypeTXT:
-				if rec.Type == "TXT" {
-					m.Answer = append(m.Answer, &dns.TXT{
-						Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: rec.TTL},
-						Txt: []string{rec.Data},
-					})
-					answered = true
-				}
-			case dns.TypeMX:
-				if rec.Type == "MX" {
-					m.Answer = append(m.Answer, &dns.MX{
-						Hdr:        dns.RR_Header{Name: q.Name, Rrtype: dns.TypeMX, Class: dns.ClassINET, Ttl: rec.TTL},
-						Preference: rec.Pref,
-						Mx:         rec.Data,
-					})
-					answered = true
-				}
-			default:
-				m.Rcode = dns.RcodeNotImplemented
+func serveSigned(q *Query, next func(*Query)) {
+	if q.store != records || signer == nil || !signer.covers(q.Name()) {
+		next(q)
+		return
+	}
+	signer.answer(q.Msg, q.R.Question[0], dnssecOK(q.R), q.recursion, q.loc)
+	q.trace.set("signed zone")
+	q.Reply()
+}
+
+// serveLocal answers from the local records. A name below a delegation
+// or in a stub zone is left to those plugins.
+func serveLocal(q *Query, next func(*Query)) {
+	question, name, m := q.R.Question[0], q.Name(), q.Msg
+	var authZone *zone
+	if q.store == records {
+		authZone = authoritativeZone(name)
+	}
+	if authZone != nil && question.Qtype == dns.TypeSOA && name == authZone.origin {
+		m.Answer = append(m.Answer, authZone.soa())
+		q.Reply()
+		return
+	}
+	if authZone != nil {
+		if d := delegationFor(q.store, name, authZone); d != nil && !(question.Qtype == dns.TypeDS && name == d.cut) {
+			q.deleg = d
+			next(q)
+			return
+		}
+	}
+	recs := q.store.lookup(name)
+	q.trace.stagef("local lookup", "%d record(s) at %s", len(recs), name)
+	if len(recs) == 0 {
+		answered := false
+		if config.MDNS.Bridge && isMDNSName(name) {
+			if answers := bridgeMDNS(question); len(answers) > 0 {
+				m.Answer = append(m.Answer, answers...)
+				q.trace.set("mDNS")
+				answered = true
+			}
+		}
+		if authZone != nil {
+			// Ours to answer: never forwarded.
+			if !authZone.exists(name) {
+				m.Rcode = dns.RcodeNameError
 			}
+			m.Ns = append(m.Ns, authZone.soa())
+			q.trace.set("zone " + authZone.origin)
+			answered = true
+		} else {
+			q.stub = stubZoneFor(name)
 		}
+		if answered {
+			q.Reply()
+		} else {
+			next(q)
+		}
+		return
+	}
+	if question.Qtype == dns.TypeANY {
+		m.Answer = append(m.Answer, answerAny(q.store, question.Name, authZone, q.loc)...)
+		q.Reply()
+		return
+	}
+	if !servedType(question.Qtype) {
+		m.Rcode = dns.RcodeNotImplemented
+		next(q)
+		return
+	}
+	answers, external := resolveLocal(q.store, question.Name, question.Qtype, q.loc)
+	if external != "" && config.ChaseCNAME && q.recursion {
+		answers = append(answers, chaseExternal(external, question.Qtype)...)
+	}
+	m.Answer = append(m.Answer, answers...)
+	if len(answers) == 0 && authZone != nil {
+		m.Ns = append(m.Ns, authZone.soa())
 	}
+	// The name is hosted here: an empty answer is NODATA, not a reason
+	// to ask the fallback.
+	q.Reply()
+}
 
-	if !answered && config.FallbackDNS != "" {
-		resp, err := forwardToFallback(r)
+func serveDelegation(q *Query, next func(*Query)) {
+	deleg, m := q.deleg, q.Msg
+	if deleg == nil {
+		next(q)
+		return
+	}
+	q.trace.set("delegation " + deleg.cut)
+	if q.recursion && q.R.RecursionDesired {
+		q.source = answerForward
+		resp, err := deleg.resolve(subnetRequest(q.R, q.Client), q.store)
 		if err == nil {
-			w.WriteMsg(resp)
-			for _, rr := range resp.Answer {
-				log.Printf("Forwarded response: %s", rr.String())
-			}
+			finishEDNS(q.R, resp)
+			q.rcode = resp.Rcode
+			writeLimited(q.W, resp)
 			return
 		}
-		m.Rcode = dns.RcodeServerFailure
+		if !errors.Is(err, errNoGlue) {
+			log.Printf("[%s] Delegation %s: %v", q.Listener, deleg.cut, err)
+			m.Rcode = dns.RcodeServerFailure
+			q.trace.explain("delegation "+deleg.cut, dns.ExtendedErrorCodeNoReachableAuthority, "no delegated server answered")
+		}
 	}
+	if m.Rcode == dns.RcodeSuccess {
+		deleg.refer(m, q.store)
+	}
+	q.Reply()
+}
 
-	w.WriteMsg(m)
+func serveStub(q *Query, next func(*Query)) {
+	stub := q.stub
+	if stub == nil {
+		next(q)
+		return
+	}
+	q.trace.set("stub zone " + stub.origin)
+	if !activeFilters().recursionACL.permits(q.Client) {
+		q.Msg.Rcode = dns.RcodeRefused
+		q.trace.explain("stub zone "+stub.origin, dns.ExtendedErrorCodeProhibited, "recursion not allowed")
+		q.Reply()
+		return
+	}
+	q.source = answerForward
+	resp, err := stub.exchange(subnetRequest(q.R, q.Client))
+	if err == nil {
+		finishEDNS(q.R, resp)
+		q.rcode = resp.Rcode
+		if !writeLimited(q.W, resp) {
+			return
+		}
+		for _, rr := range resp.Answer {
+			q.logq("[%s] Stub zone %s response: %s", q.Listener, stub.origin, rr.String())
+		}
+		return
+	}
+	log.Printf("[%s] Stub zone %s: %v", q.Listener, stub.origin, err)
+	q.Msg.Rcode = dns.RcodeServerFailure
+	q.trace.explain("stub zone "+stub.origin, dns.ExtendedErrorCodeNoReachableAuthority, "no master answered")
+	q.Reply()
+}
+
+// serveRefuse answers what no local data has and can't be forwarded:
+// names this server doesn't serve, and clients not allowed recursion.
+func serveRefuse(q *Query, next func(*Query)) {
+	m := q.Msg
+	switch {
+	case config.FallbackDNS == "" && len(q.store.snapshot()) == 0:
+		// Nothing is loaded yet, e.g. the zone awaits its first
+		// transfer: an empty NOERROR would claim the name exists.
+		m.Rcode = emptyZoneRcode
+		q.trace.explain("nothing loaded", dns.ExtendedErrorCodeNotReady, "")
+	case config.FallbackDNS == "" && config.RefuseOutOfZone:
+		// Not a name this server is authoritative for.
+		m.Rcode = dns.RcodeRefused
+		m.Authoritative = false
+		q.trace.explain("refuse_out_of_zone", dns.ExtendedErrorCodeNotAuthoritative, "")
+	case config.FallbackDNS != "" && !q.recursion:
+		// Forwarding exists but this client may not use it.
+		m.Rcode = dns.RcodeRefused
+		q.trace.explain("recursion ACL", dns.ExtendedErrorCodeProhibited, "recursion not allowed")
+		q.Reply()
+		return
+	case config.FallbackDNS != "":
+		if _, ok := upstreamsFor(q.R.Question[0].Name); !ok {
+			// In a forward.domains entry without upstreams: only the
+			// local records have it.
+			m.Rcode = dns.RcodeNameError
+			q.trace.set("local domain")
+			q.Reply()
+			return
+		}
+	}
+	next(q)
+}
+
+func serveCache(q *Query, next func(*Query)) {
+	if config.FallbackDNS == "" {
+		next(q)
+		return
+	}
+	fr := subnetRequest(q.R, q.Client)
+	if resp := cache.lookup(fr); resp != nil {
+		q.source = answerCache
+		q.trace.set("cache")
+		finishEDNS(q.R, resp)
+		q.rcode = resp.Rcode
+		if writeLimited(q.W, resp) {
+			q.logq("[%s] Answered %s from the cache", q.Listener, dns.RcodeToString[resp.Rcode])
+		}
+		return
+	}
+	if resp := cache.staleWhileDown(fr); resp != nil {
+		q.source = answerCache
+		q.trace.explain("stale cache", dns.ExtendedErrorCodeStaleAnswer, "upstreams down")
+		finishEDNS(q.R, resp)
+		q.trace.attach(resp)
+		q.rcode = resp.Rcode
+		if writeLimited(q.W, resp) {
+			log.Printf("[%s] Upstreams down: answered %s from the stale cache", q.Listener, dns.RcodeToString[resp.Rcode])
+		}
+		return
+	}
+	q.trace.stage("cache", "miss")
+	next(q)
+}
 
-	for _, rr := range m.Answer {
-		log.Printf("Responded with: %s", rr.String())
+func serveForward(q *Query, next func(*Query)) {
+	if config.FallbackDNS == "" {
+		next(q)
+		return
+	}
+	r := q.R
+	// fr is r as forwarded and cached, with the client subnet upstreams
+	// get to see.
+	fr := subnetRequest(r, q.Client)
+	q.source = answerForward
+	q.trace.set("upstream")
+	uq := upstreamQuery(fr)
+	if config.DNSSEC.Validate {
+		dnssecUpstream(uq)
+	}
+	fwdStart := time.Now()
+	resp, err := forwardToFallback(uq)
+	if err != nil {
+		q.trace.stagef("forwarded", "failed after %s: %v", time.Since(fwdStart).Round(time.Microsecond), err)
+	} else {
+		q.trace.stagef("forwarded", "%s, %d answer(s) in %s", dns.RcodeToString[resp.Rcode], len(resp.Answer), time.Since(fwdStart).Round(time.Microsecond))
+	}
+	if err == nil && config.DNSSEC.Validate && !dnssecFinish(r, resp) {
+		err = errBogus
+	}
+	if err == nil {
+		cache.storeNegative(fr, resp)
+		cache.storePositive(fr, resp)
+	}
+	if err != nil {
+		code, text := forwardFailureEDE(err)
+		q.trace.explain("upstream", code, text)
 	}
+	if stale := cache.staleOnFailure(fr, resp, err); stale != nil {
+		resp, err = stale, nil
+		q.source = answerCache
+		q.trace.explain("stale cache", dns.ExtendedErrorCodeStaleAnswer, "upstreams failed")
+		log.Printf("[%s] Upstreams failed: answering from the stale cache", q.Listener)
+	}
+	if err != nil {
+		q.Msg.Rcode = dns.RcodeServerFailure
+		q.Reply()
+		return
+	}
+	finishEDNS(r, resp)
+	q.trace.attach(resp)
+	q.rcode = resp.Rcode
+	if !writeLimited(q.W, resp) {
+		return
+	}
+	for _, rr := range resp.Answer {
+		q.logq("[%s] Forwarded response: %s", q.Listener, rr.String())
+	}
+}
+
+// subcommands run instead of the server when named by the first argument.
+var subcommands = map[string]func(args []string) int{
+	"replay":     runReplay,
+	"lint":       runLint,
+	"check-zone": runCheckZone,
+	"db-import":  runDBImport,
+	"apply":      runApply,
+	"dump":       runDump,
+	"query":      runQuery,
+	"bench":      runBench,
+}
+
+// setupSteps check the configuration and prepare each subsystem, in order:
+// later steps rely on what earlier ones set up.
+var setupSteps = []func() error{
+	setupDnsmasq,
+	applyMode,
+	validateConfig,
+	setupLogLevel,
+	setupPlugins,
+	setupPrivacy,
+	setupTrace,
+	setupUDP,
+	setupTTL,
+	setupOutbound,
+	setupForwarding,
+	setupBootstrap,
+	setupRateLimit,
+	setupLeases,
+	setupFilters,
+	setupFingerprints,
+	setupUpdates,
+	setupCluster,
+	setupChaos,
+	setupSortlist,
+	setupDNS64,
+	setupEDNS,
+	setupClientSubnet,
+	setupCookies,
+	setupGeoIP,
+	setupAnswerOrder,
+	setupAnswerLimits,
+	setupSplits,
+	setupHealthChecks,
+	setupKubernetes,
+	setupDocker,
+	setupKV,
+	setupDatabase,
+	setupACME,
+	setupAnycast,
+	setupSLO,
+	setupAnalytics,
+	setupMDNS,
+	setupDNSSEC,
+	setupAdmin,
+	setupCache,
+	setupHostsEntries,
+	setupZones,
+	setupViews,
+	setupPrivileges,
+	setupWriteBack,
+	setupBackup,
+	setupReadiness,
 }
 
 func main() {
 	log.SetOutput(os.Stdout)
 
-	parseFlags()
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(run(os.Args[2:]))
+		}
+		if serviceCommands[os.Args[1]] {
+			os.Exit(runService(os.Args[1], os.Args[2:]))
+		}
+	}
 
-	var err error
-	records, err = loadZoneFile(config.HostsFile)
+	if err := parseFlags(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	startServiceHandler()
+	for _, setup := range setupSteps {
+		if err := setup(); err != nil {
+			log.Fatalf("Invalid configuration: %v", err)
+		}
+	}
+	serviceRecords, err := buildServiceRecords(config.Services)
 	if err != nil {
-		log.Fatalf("Failed to load zone file: %v", err)
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if checkOnly {
+		if config.Mode != modeForwarder {
+			if _, err := loadZoneFile(config.HostsFile); err != nil {
+				log.Fatalf("Failed to load zone file: %v", err)
+			}
+		}
+		fmt.Println("Configuration OK")
+		return
 	}
 
-	info, err := os.Stat(config.HostsFile)
-	if err == nil {
-		hostsFileModTime = info.ModTime()
+	// Forwarder-only: no zone file is read or watched.
+	if config.Mode != modeForwarder {
+		recs, err := loadZoneFile(config.HostsFile)
+		if err != nil {
+			log.Fatalf("Failed to load zone file: %v", err)
+		}
+		installZone(recs)
+		if len(serviceRecords) > 0 {
+			records.setSource(sourceServices, serviceRecords)
+		}
+
+		if staleReport {
+			stale, err := findStaleRecords()
+			if err != nil {
+				log.Fatalf("Neighbor check failed: %v", err)
+			}
+			fmt.Println(formatStaleReport(stale))
+			return
+		}
+
+		if mtime, err := zoneModTime(config.HostsFile); err == nil {
+			hostsFileModTime = mtime
+		}
+	}
+
+	pcs, ls, err := systemdSockets()
+	if err != nil {
+		log.Fatalf("Socket activation failed: %v", err)
+	}
+	if err := setupNotify(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	inherited := len(pcs)+len(ls) > 0
+	if !inherited {
+		// Bind now: privileges may be dropped before serving starts.
+		if len(config.ListenAddrs) == 0 {
+			udp, err := listenUDP(":" + config.ListenPort)
+			if err != nil {
+				log.Fatalf("Failed to start server: %v", err)
+			}
+			pcs = append(pcs, udp...)
+		}
+		for _, addr := range config.ListenAddrs {
+			udp, err := listenUDP(addr)
+			if err != nil {
+				log.Fatalf("Failed to start server: %v", err)
+			}
+			l, err := net.Listen("tcp", addr)
+			if err != nil {
+				log.Fatalf("Failed to start server: %v", err)
+			}
+			pcs = append(pcs, udp...)
+			ls = append(ls, l)
+		}
+		for _, v := range views {
+			udp, err := listenUDP(":" + v.port)
+			if err != nil {
+				log.Fatalf("Failed to start view %s: %v", v.name, err)
+			}
+			pcs = append(pcs, udp...)
+		}
+	}
+
+	// dropPrivileges rewrites the configured paths for the chroot, so it
+	// runs before any watcher reads them.
+	dropPrivileges()
+
+	if config.Mode != modeForwarder {
+		go reloadZoneIfChanged()
+		if config.WriteBack.Enabled {
+			go watchZoneJournal()
+		}
+		if config.NeighborCheck.Enabled {
+			go watchNeighbors()
+		}
+		startHealthChecks()
+		if config.Kubernetes.Enabled {
+			go watchKubernetes()
+		}
+		if config.Docker.Enabled {
+			go watchDocker()
+		}
+		if config.KV.Backend != "" {
+			go watchKV()
+		}
+	}
+
+	// Zone files, per-zone files and views are all loaded by now.
+	markWarm(warmZones)
+
+	for _, z := range zones {
+		go z.watch()
+	}
+	for _, s := range stubZones {
+		go s.watch()
+	}
+	if len(views) > 0 {
+		go watchViews()
+	}
+	if slo != nil {
+		go watchSLO()
+	}
+	if analytics != nil {
+		go analytics.run()
+	}
+	if config.GeoIP.Database != "" {
+		go watchGeoIP(config.GeoIP.Database)
+	}
+	go watchRPZ()
+	if config.DHCPLeases.File != "" {
+		go watchLeases()
+	}
+	if config.MDNS.Responder {
+		go serveMDNS()
+	}
+	if anycastEnabled() {
+		go monitorInstance()
+		if config.Anycast.HealthListen != "" {
+			go serveInstanceHealth()
+		}
+	}
+	if clusterEnabled() {
+		go serveCluster()
+	}
+	if config.Admin.Listen != "" {
+		go serveAdmin()
+	}
+	go watchReloadSignal()
+	if config.FallbackDNS != "" && config.Forward.ProbeInterval > 0 {
+		go probeUpstreams()
+	}
+	if cache != nil && config.Cache.File != "" {
+		go saveCacheOnExit()
 	}
 
-	go reloadZoneIfChanged()
+	applySandbox()
 
 	dns.HandleFunc(".", handleDNSRequest)
-	server := &dns.Server{Addr: ":" + config.ListenPort, Net: "udp"}
-	fmt.Printf("DNS resolver listening on UDP port %s\n", config.ListenPort)
-	if err := server.ListenAndServe(); err != nil {
+	newServer := func() *dns.Server {
+		return &dns.Server{
+			TsigSecret:     tsigSecrets(),
+			DecorateReader: decorateReader,
+			MsgAcceptFunc:  acceptMsg,
+			MsgInvalidFunc: logInvalidMsg,
+		}
+	}
+	var servers []*dns.Server
+	for _, pc := range pcs {
+		s := newServer()
+		s.PacketConn = pc
+		if v := viewFor(pc.LocalAddr()); v != nil {
+			s.Handler = v.handler()
+		}
+		servers = append(servers, s)
+	}
+	for _, l := range ls {
+		s := newServer()
+		s.Listener = l
+		if v := viewFor(l.Addr()); v != nil {
+			s.Handler = v.handler()
+		}
+		servers = append(servers, s)
+	}
+
+	// Once every listener is up: check for loops and tell systemd.
+	var pending atomic.Int32
+	pending.Store(int32(len(servers)))
+	for _, s := range servers {
+		s.NotifyStartedFunc = func() {
+			if pending.Add(-1) != 0 {
+				return
+			}
+			markWarm(warmListeners)
+			if len(activeUpstreams()) > 0 {
+				go func() {
+					checkForwardingLoops()
+					warmUpUpstreams()
+				}()
+			}
+			sdNotify("READY=1")
+			if interval := watchdogInterval(); interval > 0 {
+				first := servers[0]
+				if first.PacketConn != nil {
+					go watchSystemdWatchdog("udp", probeAddr(first.PacketConn.LocalAddr()), interval)
+				} else {
+					go watchSystemdWatchdog("tcp", probeAddr(first.Listener.Addr()), interval)
+				}
+			}
+		}
+	}
+
+	if inherited {
+		fmt.Printf("DNS resolver (%s mode) serving %d sockets from systemd\n", config.Mode, len(servers))
+	} else if len(config.ListenAddrs) > 0 {
+		fmt.Printf("DNS resolver (%s mode) listening on UDP and TCP %s\n", config.Mode, strings.Join(config.ListenAddrs, ", "))
+	} else {
+		fmt.Printf("DNS resolver (%s mode) listening on UDP port %s\n", config.Mode, config.ListenPort)
+	}
+	for _, s := range servers[1:] {
+		go func(s *dns.Server) {
+			if err := s.ActivateAndServe(); err != nil {
+				log.Fatalf("Failed to start server: %v", err)
+			}
+		}(s)
+	}
+	if err := servers[0].ActivateAndServe(); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
-
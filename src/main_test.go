@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseLine(t *testing.T) {
+	flat := zoneSyntax{}
+	zone := zoneSyntax{origin: "example.com.", defaultTTL: 300}
+	tests := []struct {
+		zs   zoneSyntax
+		line string
+		name string
+		rec  string // fmt %v of the interesting fields; "" for a skipped line
+		err  string
+	}{
+		{flat, "", "", "", ""},
+		{flat, "  ; comment", "", "", ""},
+		{flat, "# comment", "", "", ""},
+		{flat, "web.local. 300 IN A 10.0.0.1", "web.local.", "A 300 10.0.0.1", ""},
+		{flat, "web.local 300 in a 10.0.0.1", "web.local.", "A 300 10.0.0.1", ""},
+		{flat, "v6.local. 60 IN AAAA fd00::1", "v6.local.", "AAAA 60 fd00::1", ""},
+		{flat, "alias.local. 60 IN CNAME web.local", "alias.local.", "CNAME 60 web.local.", ""},
+		{flat, `txt.local. 60 IN TXT "hello world"`, "txt.local.", `TXT 60 "hello world"`, ""},
+		{flat, "mail.local. 60 IN MX 10 mx.local.", "mail.local.", "MX 60 mx.local. pref=10", ""},
+		{flat, "_sip._tcp.local. 60 IN SRV 10 5 5060 sip.local.", "_sip._tcp.local.", "SRV 60 sip.local. pref=10 weight=5 port=5060", ""},
+		{flat, "1.0.0.10.in-addr.arpa. 60 IN PTR web.local.", "1.0.0.10.in-addr.arpa.", "PTR 60 web.local.", ""},
+		{flat, "app.local. 60 IN A 10.0.0.20 canary=5%", "app.local.", "A 60 10.0.0.20 canary=5", ""},
+		{flat, "pool.local. 60 IN A 10.0.1.1 weight=3", "pool.local.", "A 60 10.0.1.1 weight=3", ""},
+		{flat, "api.local. 60 IN A 10.0.2.1 country=us,ca", "api.local.", "A 60 10.0.2.1 countries=[US CA]", ""},
+
+		{zone, "@ IN A 192.0.2.1", "example.com.", "A 300 192.0.2.1", ""},
+		{zone, "www IN CNAME @", "www.example.com.", "CNAME 300 example.com.", ""},
+		{zone, "mail 60 IN MX 10 mx", "mail.example.com.", "MX 60 mx.example.com. pref=10", ""},
+		{zone, "other.org. IN A 192.0.2.1", "", "", "outside zone"},
+
+		{flat, "web.local. IN A 10.0.0.1", "", "", "too few fields"},
+		{flat, "web.local. x IN A 10.0.0.1", "", "", "invalid TTL"},
+		{flat, "web.local. 60 CH A 10.0.0.1", "", "", "unsupported class"},
+		{flat, "web.local. 60 IN A 10.0.0.300", "", "", "invalid IP"},
+		{flat, "web.local. 60 IN AAAA 10.0.0.1", "", "", "invalid IPv6"},
+		{flat, "mail.local. 60 IN MX mx.local.", "", "", "missing preference"},
+		{flat, "mail.local. 60 IN MX ten mx.local.", "", "", "invalid MX preference"},
+		{flat, "_s._tcp.local. 60 IN SRV 10 5 sip.local.", "", "", "want priority"},
+		{flat, "web.local. 60 IN A 10.0.0.1 canary=0", "", "", "canary must be"},
+		{flat, "web.local. 60 IN A 10.0.0.1 weight=-1", "", "", "weight must be"},
+		{flat, "web.local. 60 IN WKS 10.0.0.1", "", "", "unsupported record type"},
+	}
+	for _, tt := range tests {
+		name, rec, ok, err := tt.zs.parseLine(tt.line)
+		switch {
+		case tt.err != "":
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%q: error %v, want %q", tt.line, err, tt.err)
+			}
+		case err != nil:
+			t.Errorf("%q: %v", tt.line, err)
+		case ok != (tt.rec != ""):
+			t.Errorf("%q: ok %v", tt.line, ok)
+		case ok && (name != tt.name || describeRecord(rec) != tt.rec):
+			t.Errorf("%q: got %s %s, want %s %s", tt.line, name, describeRecord(rec), tt.name, tt.rec)
+		}
+	}
+}
+
+func describeRecord(rec Record) string {
+	s := fmt.Sprintf("%s %d %s", rec.Type, rec.TTL, rec.Data)
+	if rec.Pref != 0 {
+		s += fmt.Sprintf(" pref=%d", rec.Pref)
+	}
+	if rec.Type == "SRV" {
+		s += fmt.Sprintf(" weight=%d port=%d", rec.SrvWeight, rec.Port)
+	}
+	if rec.Canary != 0 {
+		s += fmt.Sprintf(" canary=%d", rec.Canary)
+	}
+	if rec.Weight != 0 {
+		s += fmt.Sprintf(" weight=%d", rec.Weight)
+	}
+	if len(rec.Countries) > 0 {
+		s += fmt.Sprintf(" countries=%v", rec.Countries)
+	}
+	return s
+}
+
+func TestLocalNameNoData(t *testing.T) {
+	withRecords(t)
+	records.setSource(sourceZone, map[string][]Record{
+		"app.local.": {{Type: "A", TTL: 60, Data: "10.0.0.1"}},
+	})
+	oldRegistered, oldChain := registeredPlugins, queryChain
+	t.Cleanup(func() { registeredPlugins, queryChain = oldRegistered, oldChain })
+
+	// Anything that gets past the local data ends up here instead of
+	// being forwarded.
+	var reached []string
+	registeredPlugins = nil
+	RegisterPlugin(namePlugin{&reached}, "cache")
+	if err := setupPlugins(); err != nil {
+		t.Fatal(err)
+	}
+
+	ask := func(name string, qtype uint16) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion(name, qtype)
+		w := &recordingWriter{}
+		answerQuery(w, r, records)
+		if len(w.written) != 1 {
+			t.Fatalf("%s: wrote %d replies", name, len(w.written))
+		}
+		return w.written[0]
+	}
+	// A hosted name without records of the type is NODATA, not forwarded.
+	if m := ask("app.local.", dns.TypeTXT); m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 {
+		t.Errorf("TXT app.local.: %v", m)
+	}
+	if m := ask("app.local.", dns.TypeA); len(m.Answer) != 1 {
+		t.Errorf("A app.local.: %v", m)
+	}
+	ask("other.example.", dns.TypeTXT)
+	if fmt.Sprint(reached) != "[other.example.]" {
+		t.Errorf("passed on to forwarding: %v", reached)
+	}
+}
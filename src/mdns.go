@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// MDNSConfig enables multicast DNS. The responder answers mDNS queries on
+// 224.0.0.251:5353 for local records under .local; the bridge resolves
+// unicast queries for .local names that aren't in the local records by
+// asking the mDNS group.
+type MDNSConfig struct {
+	Responder bool   `yaml:"responder"`
+	Bridge    bool   `yaml:"bridge"`
+	Interface string `yaml:"interface"` // empty means the system default
+	TimeoutMs int    `yaml:"timeout_ms"`
+}
+
+const (
+	mdnsDomain     = "local."
+	mdnsCacheFlush = 1 << 15 // top bit of the class field in mDNS answers
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+func setupMDNS() error {
+	cfg := &config.MDNS
+	if cfg.TimeoutMs <= 0 {
+		cfg.TimeoutMs = 1000
+	}
+	if cfg.Interface != "" {
+		if _, err := net.InterfaceByName(cfg.Interface); err != nil {
+			return fmt.Errorf("mdns.interface: %v", err)
+		}
+	}
+	return nil
+}
+
+func isMDNSName(name string) bool {
+	return dns.IsSubDomain(mdnsDomain, strings.ToLower(name))
+}
+
+func mdnsInterface() *net.Interface {
+	if config.MDNS.Interface == "" {
+		return nil
+	}
+	ifi, _ := net.InterfaceByName(config.MDNS.Interface)
+	return ifi
+}
+
+// serveMDNS runs the multicast responder.
+func serveMDNS() {
+	conn, err := net.ListenMulticastUDP("udp4", mdnsInterface(), mdnsGroup)
+	if err != nil {
+		log.Printf("mDNS responder disabled: %v", err)
+		return
+	}
+	defer conn.Close()
+	log.Printf("mDNS responder listening on %s", mdnsGroup)
+
+	announceMDNS(conn)
+
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Printf("mDNS read failed: %v", err)
+			return
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(buf[:n]); err != nil || req.Response || req.Opcode != dns.OpcodeQuery {
+			continue
+		}
+		resp := mdnsAnswer(req)
+		if resp == nil {
+			continue
+		}
+
+		dst := mdnsGroup
+		if src.Port != mdnsGroup.Port {
+			// Legacy unicast query (RFC 6762 section 6.7): reply directly,
+			// echoing the ID and question.
+			resp.Id = req.Id
+			resp.Question = req.Question
+			dst = src
+		}
+		out, err := resp.Pack()
+		if err != nil {
+			continue
+		}
+		conn.WriteToUDP(out, dst)
+	}
+}
+
+// mdnsAnswer builds a response for the questions we hold records for, or
+// nil if there is nothing to say.
+func mdnsAnswer(req *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.Response = true
+	resp.Authoritative = true
+	for _, q := range req.Question {
+		if !isMDNSName(q.Name) {
+			continue
+		}
+		qtype := q.Qtype
+		if qtype == dns.TypeANY {
+			for _, rec := range records.lookup(dns.Fqdn(strings.ToLower(q.Name))) {
+				resp.Answer = append(resp.Answer, mdnsRR(q.Name, rec))
+			}
+			continue
+		}
+		answers, _ := resolveLocal(records, q.Name, qtype, geoLocation{})
+		for _, rr := range answers {
+			rr.Header().Class |= mdnsCacheFlush
+		}
+		resp.Answer = append(resp.Answer, answers...)
+	}
+	if len(resp.Answer) == 0 {
+		return nil
+	}
+	return resp
+}
+
+func mdnsRR(name string, rec Record) dns.RR {
+	rr := recordToRR(name, rec)
+	rr.Header().Class |= mdnsCacheFlush
+	return rr
+}
+
+// announceMDNS sends one unsolicited response with every .local record so
+// listeners learn about them without asking (RFC 6762 section 8.3).
+func announceMDNS(conn *net.UDPConn) {
+	resp := new(dns.Msg)
+	resp.Response = true
+	resp.Authoritative = true
+	for name, recs := range records.snapshot() {
+		if !isMDNSName(name) {
+			continue
+		}
+		for _, rec := range recs {
+			resp.Answer = append(resp.Answer, mdnsRR(name, rec))
+		}
+	}
+	if len(resp.Answer) == 0 {
+		return
+	}
+	out, err := resp.Pack()
+	if err != nil {
+		log.Printf("mDNS announcement too large: %v", err)
+		return
+	}
+	conn.WriteToUDP(out, mdnsGroup)
+}
+
+// bridgeMDNS resolves a unicast question through the mDNS group using a
+// legacy unicast query (RFC 6762 section 6.7), returning the first
+// responder's answers. The socket must stay unconnected since replies come
+// from each responder's own address, not the group's.
+func bridgeMDNS(q dns.Question) []dns.RR {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+
+	m := new(dns.Msg)
+	m.SetQuestion(q.Name, q.Qtype)
+	m.RecursionDesired = false
+	out, err := m.Pack()
+	if err != nil {
+		return nil
+	}
+	if _, err := conn.WriteToUDP(out, mdnsGroup); err != nil {
+		return nil
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Duration(config.MDNS.TimeoutMs) * time.Millisecond))
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil
+		}
+		resp := new(dns.Msg)
+		if resp.Unpack(buf[:n]) != nil || !resp.Response || resp.Id != m.Id {
+			continue
+		}
+		var answers []dns.RR
+		for _, rr := range resp.Answer {
+			rr.Header().Class &^= mdnsCacheFlush
+			answers = append(answers, rr)
+		}
+		return answers
+	}
+}
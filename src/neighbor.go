@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NeighborCheckConfig enables periodic comparison of local A and AAAA
+// records against the kernel's ARP and NDP neighbor tables.
+type NeighborCheckConfig struct {
+	Enabled  bool `yaml:"enabled"`
+	Interval int  `yaml:"interval"` // seconds between checks
+}
+
+const arpTablePath = "/proc/net/arp"
+
+// staleRecord is an A or AAAA record on a directly connected subnet whose
+// address has not been seen in the neighbor table.
+type staleRecord struct {
+	Name     string
+	Type     string
+	Addr     string
+	LastSeen time.Time // zero if never seen since startup
+}
+
+var (
+	neighborMu       sync.Mutex
+	neighborLastSeen = make(map[string]time.Time)
+)
+
+// readNeighbors returns the set of addresses with a resolved link-layer
+// address in the ARP table and, for IPv6, the NDP table.
+func readNeighbors() (map[string]bool, error) {
+	present, err := readNeighbors6()
+	if err != nil {
+		return nil, fmt.Errorf("reading the IPv6 neighbor table: %v", err)
+	}
+	f, err := os.Open(arpTablePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		// Flags 0x0 marks an incomplete entry.
+		if fields[2] == "0x0" || fields[3] == "00:00:00:00:00:00" {
+			continue
+		}
+		present[fields[0]] = true
+	}
+	return present, scanner.Err()
+}
+
+// localNetworks returns the subnets of this host's interfaces along with
+// the host's own addresses, which never appear in the neighbor tables.
+// Link-local networks are left out: zones don't publish those addresses.
+func localNetworks() ([]*net.IPNet, map[string]bool, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, nil, err
+	}
+	var nets []*net.IPNet
+	own := make(map[string]bool)
+	for _, a := range addrs {
+		ipn, ok := a.(*net.IPNet)
+		if !ok || ipn.IP.IsLoopback() || ipn.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		nets = append(nets, ipn)
+		own[ipn.IP.String()] = true
+	}
+	return nets, own, nil
+}
+
+// findStaleRecords checks every local A and AAAA record on a connected subnet
+// against the neighbor table and returns those that are absent.
+func findStaleRecords() ([]staleRecord, error) {
+	present, err := readNeighbors()
+	if err != nil {
+		return nil, err
+	}
+	nets, own, err := localNetworks()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	neighborMu.Lock()
+	defer neighborMu.Unlock()
+
+	var stale []staleRecord
+	for name, recs := range records.snapshot() {
+		for _, rec := range recs {
+			if rec.Type != "A" && rec.Type != "AAAA" {
+				continue
+			}
+			ip := net.ParseIP(rec.Data)
+			if ip == nil || own[ip.String()] || !onNetworks(ip, nets) {
+				continue
+			}
+			// The tables hold canonical forms; zone files may not.
+			addr := ip.String()
+			if present[addr] {
+				neighborLastSeen[addr] = now
+				continue
+			}
+			stale = append(stale, staleRecord{Name: name, Type: rec.Type, Addr: rec.Data, LastSeen: neighborLastSeen[addr]})
+		}
+	}
+	sort.Slice(stale, func(i, j int) bool { return stale[i].Name < stale[j].Name })
+	return stale, nil
+}
+
+func onNetworks(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// formatStaleReport renders the stale record list for logs and the CLI.
+func formatStaleReport(stale []staleRecord) string {
+	if len(stale) == 0 {
+		return "No possibly stale records"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d possibly stale record(s):", len(stale))
+	for _, s := range stale {
+		seen := "never seen"
+		if !s.LastSeen.IsZero() {
+			seen = "last seen " + s.LastSeen.Format(time.RFC3339)
+		}
+		fmt.Fprintf(&b, "\n  %s %s %s (%s)", s.Name, s.Type, s.Addr, seen)
+	}
+	return b.String()
+}
+
+// watchNeighbors logs a stale record report every check interval.
+func watchNeighbors() {
+	interval := time.Duration(config.NeighborCheck.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+	for {
+		time.Sleep(interval)
+		stale, err := findStaleRecords()
+		if err != nil {
+			log.Printf("Neighbor check failed: %v", err)
+			continue
+		}
+		if len(stale) > 0 {
+			log.Println(formatStaleReport(stale))
+		}
+	}
+}
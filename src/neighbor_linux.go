@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// readNeighbors6 returns the IPv6 addresses with a resolved link-layer
+// address in the kernel's NDP neighbor table, dumped over netlink.
+func readNeighbors6() (map[string]bool, error) {
+	rib, err := syscall.NetlinkRIB(unix.RTM_GETNEIGH, unix.AF_INET6)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return nil, err
+	}
+	present := make(map[string]bool)
+	for _, m := range msgs {
+		if m.Header.Type != unix.RTM_NEWNEIGH || len(m.Data) < unix.SizeofNdMsg {
+			continue
+		}
+		family := m.Data[0]
+		state := binary.NativeEndian.Uint16(m.Data[8:10])
+		if family != unix.AF_INET6 || state&(unix.NUD_INCOMPLETE|unix.NUD_FAILED) != 0 || state == unix.NUD_NONE {
+			continue
+		}
+		var dst net.IP
+		var lladdr bool
+		for attrs := m.Data[unix.SizeofNdMsg:]; len(attrs) >= 4; {
+			n := int(binary.NativeEndian.Uint16(attrs))
+			if n < 4 || n > len(attrs) {
+				break
+			}
+			switch binary.NativeEndian.Uint16(attrs[2:]) {
+			case unix.NDA_DST:
+				dst = net.IP(attrs[4:n])
+			case unix.NDA_LLADDR:
+				lladdr = n > 4
+			}
+			attrs = attrs[min((n+3)&^3, len(attrs)):]
+		}
+		if len(dst) == net.IPv6len && lladdr {
+			present[dst.String()] = true
+		}
+	}
+	return present, nil
+}
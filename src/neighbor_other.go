@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+func readNeighbors6() (map[string]bool, error) {
+	return nil, fmt.Errorf("the neighbor table can only be read on Linux")
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// normalizeRequest selects zone records by owner glob and type and sets
+// their TTL and/or rewrites their data. Changes apply to the in-memory
+// zone, like dynamic updates, until the zone file next changes.
+type normalizeRequest struct {
+	Name    string  `json:"name"` // glob over owner names, e.g. "*.staging.lan"
+	Type    string  `json:"type"` // empty matches every type
+	TTL     *uint32 `json:"ttl"`
+	Rewrite *struct {
+		Pattern     string `json:"pattern"` // regexp over record data
+		Replacement string `json:"replacement"`
+	} `json:"rewrite"`
+	DryRun bool `json:"dry_run"`
+}
+
+type normalizeChange struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	OldTTL  uint32 `json:"old_ttl"`
+	NewTTL  uint32 `json:"new_ttl"`
+	OldData string `json:"old_data"`
+	NewData string `json:"new_data"`
+}
+
+type normalizeResult struct {
+	Matched int               `json:"matched"`
+	DryRun  bool              `json:"dry_run"`
+	Changes []normalizeChange `json:"changes"`
+}
+
+func handleNormalize(w http.ResponseWriter, r *http.Request) {
+	var req normalizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	res, err := normalizeZone(req)
+	if err != nil {
+		auditf(r, "normalize name=%q type=%q rejected: %v", req.Name, req.Type, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	verb := "changed"
+	if req.DryRun {
+		verb = "would change"
+	}
+	auditf(r, "normalize name=%q type=%q: %d matched, %s %d", req.Name, req.Type, res.Matched, verb, len(res.Changes))
+	for _, c := range res.Changes {
+		auditf(r, "  %s %s ttl %d->%d data %q->%q", c.Name, c.Type, c.OldTTL, c.NewTTL, c.OldData, c.NewData)
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// normalizeZone applies req to the zone records, or only reports what it
+// would change for a dry run.
+func normalizeZone(req normalizeRequest) (normalizeResult, error) {
+	res := normalizeResult{DryRun: req.DryRun, Changes: []normalizeChange{}}
+	if req.Name == "" {
+		return res, fmt.Errorf("name is required")
+	}
+	pattern := dns.Fqdn(strings.ToLower(req.Name))
+	if _, err := path.Match(pattern, ""); err != nil {
+		return res, fmt.Errorf("name: %v", err)
+	}
+	rtype := strings.ToUpper(req.Type)
+	if req.TTL == nil && req.Rewrite == nil {
+		return res, fmt.Errorf("nothing to do: set ttl and/or rewrite")
+	}
+	var re *regexp.Regexp
+	if req.Rewrite != nil {
+		var err error
+		if re, err = regexp.Compile(req.Rewrite.Pattern); err != nil {
+			return res, fmt.Errorf("rewrite.pattern: %v", err)
+		}
+	}
+
+	plan := func(recs map[string][]Record) (map[string][]Record, error) {
+		updated := make(map[string][]Record)
+		for name, list := range recs {
+			if ok, _ := path.Match(pattern, name); !ok {
+				continue
+			}
+			var next []Record
+			for i, rec := range list {
+				if rtype != "" && rec.Type != rtype {
+					continue
+				}
+				res.Matched++
+				nr := rec
+				if req.TTL != nil {
+					nr.TTL = *req.TTL
+				}
+				if re != nil {
+					nr.Data = re.ReplaceAllString(rec.Data, req.Rewrite.Replacement)
+					if rec.Strings != nil {
+						nr.Strings = make([]string, len(rec.Strings))
+						for j, s := range rec.Strings {
+							nr.Strings[j] = re.ReplaceAllString(s, req.Rewrite.Replacement)
+						}
+					}
+					if err := checkRecordData(&nr); err != nil {
+						return nil, fmt.Errorf("%s %s: rewritten data %q: %v", name, rec.Type, nr.Data, err)
+					}
+				}
+				if nr.TTL == rec.TTL && nr.Data == rec.Data && strings.Join(nr.Strings, "\x00") == strings.Join(rec.Strings, "\x00") {
+					continue
+				}
+				if next == nil {
+					next = append([]Record(nil), list...)
+				}
+				next[i] = nr
+				res.Changes = append(res.Changes, normalizeChange{
+					Name: name, Type: rec.Type,
+					OldTTL: rec.TTL, NewTTL: nr.TTL,
+					OldData: rec.Data, NewData: nr.Data,
+				})
+			}
+			if next != nil {
+				updated[name] = next
+			}
+		}
+		return updated, nil
+	}
+
+	var err error
+	if req.DryRun {
+		_, err = plan(records.source(sourceZone))
+	} else if err = backupZoneFile("normalize"); err == nil {
+		records.updateSource(sourceZone, func(recs map[string][]Record) {
+			var updated map[string][]Record
+			if updated, err = plan(recs); err != nil {
+				return
+			}
+			old := make(map[string][]Record)
+			for name, list := range updated {
+				old[name] = recs[name]
+				recs[name] = list
+			}
+			recordChange("admin normalize", old, recs)
+			snapshotZone("admin normalize", recs)
+		})
+	}
+	if err != nil {
+		return normalizeResult{DryRun: req.DryRun, Changes: []normalizeChange{}}, err
+	}
+	sort.SliceStable(res.Changes, func(i, j int) bool { return res.Changes[i].Name < res.Changes[j].Name })
+	return res, nil
+}
+
+// checkRecordData validates (and canonicalizes) rewritten record data.
+func checkRecordData(rec *Record) error {
+	switch rec.Type {
+	case "A":
+		if ip := net.ParseIP(rec.Data); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("not an IPv4 address")
+		}
+	case "AAAA":
+		if ip := net.ParseIP(rec.Data); ip == nil || ip.To4() != nil {
+			return fmt.Errorf("not an IPv6 address")
+		}
+	case "CNAME", "PTR", "NS", "MX", "SRV":
+		rec.Data = dns.Fqdn(rec.Data)
+		if _, ok := dns.IsDomainName(rec.Data); !ok {
+			return fmt.Errorf("not a domain name")
+		}
+	}
+	return nil
+}
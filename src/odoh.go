@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Oblivious DoH (RFC 9230) upstreams, "odoh://odoh.example.net/dns-query"
+// or an ODoH target stamp (sdns://…). Each query is encrypted to the
+// target's public key with HPKE and posted through forward.odoh_relay, so
+// the relay learns who asks but not what, and the target what is asked but
+// not by whom. Without a relay queries go to the target directly, which
+// hides nothing from it. The target's key is fetched from its
+// /.well-known/odohconfigs, refreshed hourly and refetched at once when the
+// target stops accepting it.
+
+const (
+	odohConfigRefresh = time.Hour
+	odohContentType   = "application/oblivious-dns-message"
+
+	odohVersion     = 0x0001
+	odohTypeQuery   = 0x01
+	odohTypeAnswer  = 0x02
+	odohQueryPadTo  = 128 // RFC 8467 block padding for queries
+	odohNonceSize   = 16  // max(Nn, Nk) of AES-128-GCM
+	odohMaxResponse = 65535 + 512
+)
+
+// HPKE suite supported: DHKEM(X25519, HKDF-SHA256), HKDF-SHA256,
+// AES-128-GCM.
+const (
+	hpkeKEMX25519 = 0x0020
+	hpkeKDFSHA256 = 0x0001
+	hpkeAES128GCM = 0x0001
+)
+
+var errODoHKey = errors.New("the ODoH target no longer accepts its published key")
+
+// odohTarget is one ODoH upstream.
+type odohTarget struct {
+	url   string // the target's DoH endpoint
+	relay string // the relay's URL, or "" to post to the target directly
+	http  *http.Client
+
+	mu      sync.Mutex
+	config  *odohConfig
+	fetched time.Time
+}
+
+// odohConfig is a target's public key, as published.
+type odohConfig struct {
+	contents []byte // ObliviousDoHConfigContents, which the key ID hashes
+	keyID    []byte
+	pub      *ecdh.PublicKey
+}
+
+func newODoHTarget(target, relay string, client *http.Client) (*odohTarget, error) {
+	parsed, err := url.Parse(target)
+	if err != nil || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid ODoH target %q", target)
+	}
+	parsed.Scheme = "https"
+	return &odohTarget{url: parsed.String(), relay: relay, http: client}, nil
+}
+
+// exchange sends r to the target, through the relay if there is one.
+func (t *odohTarget) exchange(ctx context.Context, r *dns.Msg) (*dns.Msg, error) {
+	for attempt := 0; ; attempt++ {
+		cfg, err := t.currentConfig(ctx)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := t.post(ctx, cfg, r)
+		if errors.Is(err, errODoHKey) && attempt == 0 {
+			t.mu.Lock()
+			if t.config == cfg {
+				t.config = nil
+			}
+			t.mu.Unlock()
+			continue
+		}
+		return resp, err
+	}
+}
+
+// currentConfig returns the target's key, fetching it when missing or due
+// for a refresh. A failed refresh keeps the old key.
+func (t *odohTarget) currentConfig(ctx context.Context) (*odohConfig, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.config != nil && time.Since(t.fetched) < odohConfigRefresh {
+		return t.config, nil
+	}
+	cfg, err := t.fetchConfig(ctx)
+	if err != nil {
+		if t.config != nil {
+			return t.config, nil
+		}
+		return nil, fmt.Errorf("fetching ODoH configs: %v", err)
+	}
+	t.config, t.fetched = cfg, time.Now()
+	return cfg, nil
+}
+
+func (t *odohTarget) fetchConfig(ctx context.Context) (*odohConfig, error) {
+	parsed, _ := url.Parse(t.url)
+	wellKnown := "https://" + parsed.Host + "/.well-known/odohconfigs"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, wellKnown, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", wellKnown, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	return parseODoHConfigs(data)
+}
+
+// parseODoHConfigs picks the first config in the suite supported.
+func parseODoHConfigs(data []byte) (*odohConfig, error) {
+	list, ok := readVector16(&data)
+	if !ok {
+		return nil, fmt.Errorf("malformed odohconfigs")
+	}
+	for len(list) > 0 {
+		if len(list) < 2 {
+			return nil, fmt.Errorf("malformed odohconfigs")
+		}
+		version := binary.BigEndian.Uint16(list)
+		list = list[2:]
+		contents, ok := readVector16(&list)
+		if !ok {
+			return nil, fmt.Errorf("malformed odohconfigs")
+		}
+		if version != odohVersion || len(contents) < 8 {
+			continue
+		}
+		kem := binary.BigEndian.Uint16(contents[0:])
+		kdf := binary.BigEndian.Uint16(contents[2:])
+		aead := binary.BigEndian.Uint16(contents[4:])
+		if kem != hpkeKEMX25519 || kdf != hpkeKDFSHA256 || aead != hpkeAES128GCM {
+			continue
+		}
+		rest := contents[6:]
+		key, ok := readVector16(&rest)
+		if !ok {
+			return nil, fmt.Errorf("malformed odohconfigs")
+		}
+		pub, err := ecdh.X25519().NewPublicKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("odohconfigs: %v", err)
+		}
+		keyID := hkdfExpand(hkdfExtract(nil, contents), []byte("odoh key id"), sha256.Size)
+		return &odohConfig{contents: contents, keyID: keyID, pub: pub}, nil
+	}
+	return nil, fmt.Errorf("no odohconfig with X25519, HKDF-SHA256 and AES-128-GCM")
+}
+
+// post encrypts r to cfg, sends it and decrypts the answer.
+func (t *odohTarget) post(ctx context.Context, cfg *odohConfig, r *dns.Msg) (*dns.Msg, error) {
+	q := r.Copy()
+	q.Id = 0
+	wire, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+	plain := odohPlaintext(wire, odohQueryPadTo)
+	enc, hc, err := hpkeSetupSender(nil, cfg.pub, []byte("odoh query"))
+	if err != nil {
+		return nil, err
+	}
+	aad := odohAAD(odohTypeQuery, cfg.keyID)
+	sealed := append(enc, hc.seal(aad, plain)...)
+	body := odohMessage(odohTypeQuery, cfg.keyID, sealed)
+
+	target := t.url
+	if t.relay != "" {
+		parsed, _ := url.Parse(t.url)
+		relay, _ := url.Parse(t.relay)
+		values := relay.Query()
+		values.Set("targethost", parsed.Host)
+		values.Set("targetpath", parsed.EscapedPath())
+		relay.RawQuery = values.Encode()
+		target = relay.String()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", odohContentType)
+	req.Header.Set("Accept", odohContentType)
+	httpResp, err := t.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	switch {
+	case httpResp.StatusCode == http.StatusUnauthorized:
+		return nil, errODoHKey
+	case httpResp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("%s returned %s", target, httpResp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(httpResp.Body, odohMaxResponse))
+	if err != nil {
+		return nil, err
+	}
+	answer, err := openODoHAnswer(hc, plain, data)
+	if err != nil {
+		return nil, err
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(answer); err != nil {
+		return nil, err
+	}
+	resp.Id = r.Id
+	return resp, nil
+}
+
+// openODoHAnswer decrypts an ObliviousDoHMessage answering the query whose
+// plaintext was query.
+func openODoHAnswer(hc *hpkeContext, query, data []byte) ([]byte, error) {
+	if len(data) < 1 || data[0] != odohTypeAnswer {
+		return nil, fmt.Errorf("malformed ODoH answer")
+	}
+	rest := data[1:]
+	nonce, ok := readVector16(&rest)
+	if !ok || len(nonce) != odohNonceSize {
+		return nil, fmt.Errorf("malformed ODoH answer")
+	}
+	sealed, ok := readVector16(&rest)
+	if !ok {
+		return nil, fmt.Errorf("malformed ODoH answer")
+	}
+	secret := hc.export([]byte("odoh response"), 16)
+	salt := append(append(append([]byte(nil), query...), byte(len(nonce)>>8), byte(len(nonce))), nonce...)
+	prk := hkdfExtract(salt, secret)
+	block, _ := aes.NewCipher(hkdfExpand(prk, []byte("odoh key"), 16))
+	aead, _ := cipher.NewGCM(block)
+	plain, err := aead.Open(nil, hkdfExpand(prk, []byte("odoh nonce"), 12), sealed, odohAAD(odohTypeAnswer, nonce))
+	if err != nil {
+		return nil, fmt.Errorf("ODoH answer: %v", err)
+	}
+	msg, ok := readVector16(&plain)
+	if !ok {
+		return nil, fmt.Errorf("malformed ODoH answer")
+	}
+	return msg, nil
+}
+
+// odohPlaintext is ObliviousDoHMessagePlaintext: the message and zero
+// padding, the whole a multiple of padTo long.
+func odohPlaintext(msg []byte, padTo int) []byte {
+	pad := (padTo - (len(msg)+4)%padTo) % padTo
+	out := binary.BigEndian.AppendUint16(nil, uint16(len(msg)))
+	out = append(out, msg...)
+	out = binary.BigEndian.AppendUint16(out, uint16(pad))
+	return append(out, make([]byte, pad)...)
+}
+
+func odohMessage(typ byte, keyID, sealed []byte) []byte {
+	out := []byte{typ}
+	out = binary.BigEndian.AppendUint16(out, uint16(len(keyID)))
+	out = append(out, keyID...)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(sealed)))
+	return append(out, sealed...)
+}
+
+func odohAAD(typ byte, keyID []byte) []byte {
+	out := binary.BigEndian.AppendUint16([]byte{typ}, uint16(len(keyID)))
+	return append(out, keyID...)
+}
+
+// readVector16 reads a vector with a 16-bit length from the front of data.
+func readVector16(data *[]byte) ([]byte, bool) {
+	if len(*data) < 2 {
+		return nil, false
+	}
+	n := int(binary.BigEndian.Uint16(*data))
+	if len(*data) < 2+n {
+		return nil, false
+	}
+	v := (*data)[2 : 2+n]
+	*data = (*data)[2+n:]
+	return v, true
+}
+
+// hpkeContext is the sender side of an HPKE base mode context (RFC 9180)
+// that seals a single message.
+type hpkeContext struct {
+	aead     cipher.AEAD
+	nonce    []byte
+	exporter []byte
+}
+
+// hpkeSetupSender encapsulates a key to pkR, with an ephemeral key skE, or
+// a fresh one if nil.
+func hpkeSetupSender(skE *ecdh.PrivateKey, pkR *ecdh.PublicKey, info []byte) ([]byte, *hpkeContext, error) {
+	if skE == nil {
+		var err error
+		if skE, err = ecdh.X25519().GenerateKey(rand.Reader); err != nil {
+			return nil, nil, err
+		}
+	}
+	dh, err := skE.ECDH(pkR)
+	if err != nil {
+		return nil, nil, err
+	}
+	enc := skE.PublicKey().Bytes()
+	kemSuite := []byte{'K', 'E', 'M', hpkeKEMX25519 >> 8, hpkeKEMX25519 & 0xff}
+	prk := hpkeLabeledExtract(kemSuite, nil, "eae_prk", dh)
+	shared := hpkeLabeledExpand(kemSuite, prk, "shared_secret", append(append([]byte(nil), enc...), pkR.Bytes()...), 32)
+
+	suite := []byte{'H', 'P', 'K', 'E', 0, hpkeKEMX25519, 0, hpkeKDFSHA256, 0, hpkeAES128GCM}
+	keyContext := []byte{0} // mode base
+	keyContext = append(keyContext, hpkeLabeledExtract(suite, nil, "psk_id_hash", nil)...)
+	keyContext = append(keyContext, hpkeLabeledExtract(suite, nil, "info_hash", info)...)
+	secret := hpkeLabeledExtract(suite, shared, "secret", nil)
+	block, _ := aes.NewCipher(hpkeLabeledExpand(suite, secret, "key", keyContext, 16))
+	aead, _ := cipher.NewGCM(block)
+	return enc, &hpkeContext{
+		aead:     aead,
+		nonce:    hpkeLabeledExpand(suite, secret, "base_nonce", keyContext, 12),
+		exporter: hpkeLabeledExpand(suite, secret, "exp", keyContext, 32),
+	}, nil
+}
+
+// seal encrypts the context's only message, so the sequence number is 0
+// and the nonce the base nonce.
+func (c *hpkeContext) seal(aad, plain []byte) []byte {
+	return c.aead.Seal(nil, c.nonce, plain, aad)
+}
+
+func (c *hpkeContext) export(exporterContext []byte, n int) []byte {
+	suite := []byte{'H', 'P', 'K', 'E', 0, hpkeKEMX25519, 0, hpkeKDFSHA256, 0, hpkeAES128GCM}
+	return hpkeLabeledExpand(suite, c.exporter, "sec", exporterContext, n)
+}
+
+func hpkeLabeledExtract(suite, salt []byte, label string, ikm []byte) []byte {
+	labeled := append([]byte("HPKE-v1"), suite...)
+	labeled = append(labeled, label...)
+	return hkdfExtract(salt, append(labeled, ikm...))
+}
+
+func hpkeLabeledExpand(suite, prk []byte, label string, info []byte, n int) []byte {
+	labeled := binary.BigEndian.AppendUint16(nil, uint16(n))
+	labeled = append(labeled, "HPKE-v1"...)
+	labeled = append(labeled, suite...)
+	labeled = append(labeled, label...)
+	return hkdfExpand(prk, append(labeled, info...), n)
+}
+
+// hkdfExtract and hkdfExpand are HKDF-SHA256 (RFC 5869).
+func hkdfExtract(salt, ikm []byte) []byte {
+	return hkdf.Extract(sha256.New, ikm, salt)
+}
+
+func hkdfExpand(prk, info []byte, n int) []byte {
+	out := make([]byte, n)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, info), out); err != nil {
+		panic(err) // n is far below HKDF's limit of 255 blocks
+	}
+	return out
+}
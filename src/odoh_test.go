@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"testing"
+)
+
+// RFC 9180 appendix A.1.1: DHKEM(X25519, HKDF-SHA256), HKDF-SHA256,
+// AES-128-GCM, base mode.
+func TestHPKEBaseVector(t *testing.T) {
+	skE, err := ecdh.X25519().NewPrivateKey(mustHex(t, "52c4a758a802cd8b936eceea314432798d5baf2d7e9235dc084ab1b9cfa2f736"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkR, err := ecdh.X25519().NewPublicKey(mustHex(t, "3948cfe0ad1ddb695d780e59077195da6c56506b027329794ab02bca80815c4d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, c, err := hpkeSetupSender(skE, pkR, mustHex(t, "4f6465206f6e2061204772656369616e2055726e"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(what string, got []byte, want string) {
+		t.Helper()
+		if w := mustHex(t, want); !bytes.Equal(got, w) {
+			t.Errorf("%s:\n got %x\nwant %x", what, got, w)
+		}
+	}
+	check("enc", enc, "37fda3567bdbd628e88668c3c8d7e97d1d1253b6d4ea6d44c150f741f1bf4431")
+	check("base_nonce", c.nonce, "56d890e5accaaf011cff4b7d")
+	check("exporter_secret", c.exporter, "45ff1c2e220db587171952c0592d5f5ebe103f1561a2614e38f2ffd47e99e3f8")
+	check("sequence 0 ciphertext", c.seal(mustHex(t, "436f756e742d30"), mustHex(t, "4265617574792069732074727574682c20747275746820626561757479")),
+		"f938558b5d72f1a23810b4be2ab4f84331acc02fc97babc53a52ae8218a355a96d8770ac83d07bea87e13c512a")
+	check("export of empty context", c.export(nil, 32), "3853fe2b4035195a573ffc53856e77058e15d9ea064de3e59f4961d0095250ee")
+}
+
+// RFC 5869 test case 1, for the HKDF under HPKE and the ODoH response key.
+func TestHKDF(t *testing.T) {
+	prk := hkdfExtract(mustHex(t, "000102030405060708090a0b0c"), mustHex(t, "0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b"))
+	if want := mustHex(t, "077709362c2e32df0ddc3f0dc47bba6390b6c73bb50f9c3122ec844ad7c2b3e5"); !bytes.Equal(prk, want) {
+		t.Errorf("extract: got %x, want %x", prk, want)
+	}
+	okm := hkdfExpand(prk, mustHex(t, "f0f1f2f3f4f5f6f7f8f9"), 42)
+	if want := mustHex(t, "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865"); !bytes.Equal(okm, want) {
+		t.Errorf("expand: got %x, want %x", okm, want)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// AnswerOrderConfig selects how multi-record answers are presented:
+// "all" returns every record in zone file order, "shuffle" returns every
+// record in random order, and "weighted" returns a single record picked by
+// its weight= option.
+type AnswerOrderConfig struct {
+	Default string            `yaml:"default"`
+	Names   map[string]string `yaml:"names"`
+}
+
+const (
+	orderAll      = "all"
+	orderShuffle  = "shuffle"
+	orderWeighted = "weighted"
+)
+
+func setupAnswerOrder() error {
+	cfg := &config.AnswerOrder
+	if cfg.Default == "" {
+		cfg.Default = orderAll
+	}
+	if !validOrder(cfg.Default) {
+		return fmt.Errorf("answer_order.default: unknown mode %q", cfg.Default)
+	}
+	names := make(map[string]string, len(cfg.Names))
+	for name, mode := range cfg.Names {
+		if !validOrder(mode) {
+			return fmt.Errorf("answer_order.names.%s: unknown mode %q", name, mode)
+		}
+		names[dns.Fqdn(strings.ToLower(name))] = mode
+	}
+	cfg.Names = names
+	return nil
+}
+
+func validOrder(mode string) bool {
+	return mode == orderAll || mode == orderShuffle || mode == orderWeighted
+}
+
+// orderAnswers applies the answer order configured for name to an RRset.
+// The input slice is never modified.
+func orderAnswers(name string, recs []Record) []Record {
+	if len(recs) < 2 {
+		return recs
+	}
+	mode, ok := config.AnswerOrder.Names[name]
+	if !ok {
+		mode = config.AnswerOrder.Default
+	}
+
+	switch mode {
+	case orderShuffle:
+		out := append([]Record(nil), recs...)
+		rand.Shuffle(len(out), func(i, j int) { out[i], out[j] = out[j], out[i] })
+		return out
+	case orderWeighted:
+		total := 0
+		for _, rec := range recs {
+			total += recordWeight(rec)
+		}
+		roll := rand.IntN(total)
+		for _, rec := range recs {
+			if roll < recordWeight(rec) {
+				return []Record{rec}
+			}
+			roll -= recordWeight(rec)
+		}
+	}
+	return recs
+}
+
+func recordWeight(rec Record) int {
+	if rec.Weight <= 0 {
+		return 1
+	}
+	return rec.Weight
+}
+
+// AnswerLimitConfig caps how many records of one type go into an answer.
+// Names with more records rotate through the full set across queries.
+type AnswerLimitConfig struct {
+	Default int            `yaml:"default"`
+	Types   map[string]int `yaml:"types"`
+}
+
+var (
+	answerLimits  = map[uint16]int{}
+	rotateOffsets sync.Map // name/type -> *atomic.Uint32
+)
+
+func setupAnswerLimits() error {
+	cfg := config.AnswerLimit
+	if cfg.Default < 0 {
+		return fmt.Errorf("answer_limit.default must not be negative")
+	}
+	for name, n := range cfg.Types {
+		t, ok := dns.StringToType[strings.ToUpper(name)]
+		if !ok {
+			return fmt.Errorf("answer_limit.types: unknown type %q", name)
+		}
+		if n < 0 {
+			return fmt.Errorf("answer_limit.types.%s must not be negative", name)
+		}
+		answerLimits[t] = n
+	}
+	return nil
+}
+
+// limitAnswers trims an RRset to the configured cap for qtype, starting
+// each query where the previous one left off.
+func limitAnswers(name string, qtype uint16, recs []Record) []Record {
+	limit, ok := answerLimits[qtype]
+	if !ok {
+		limit = config.AnswerLimit.Default
+	}
+	if limit <= 0 || len(recs) <= limit {
+		return recs
+	}
+
+	key := fmt.Sprintf("%s/%d", name, qtype)
+	v, _ := rotateOffsets.LoadOrStore(key, new(atomic.Uint32))
+	start := int(v.(*atomic.Uint32).Add(uint32(limit))-uint32(limit)) % len(recs)
+
+	out := make([]Record, 0, limit)
+	for i := 0; i < limit; i++ {
+		out = append(out, recs[(start+i)%len(recs)])
+	}
+	return out
+}
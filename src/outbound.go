@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// Outbound queries (to upstreams, stub zone servers and delegated child
+// zones) normally leave by whatever route the OS picks. forward.
+// source_addresses pins their source address, one per address family, so
+// they take e.g. a VPN tunnel while the listeners stay on the LAN. On Linux
+// forward.interface also binds them to a device (SO_BINDTODEVICE) and
+// forward.mark sets a firewall mark (SO_MARK) for policy routing; the mark
+// takes CAP_NET_ADMIN, which privileges.user gives up.
+
+var (
+	outboundV4, outboundV6 net.IP
+	outboundDevice         string
+	outboundMark           int
+)
+
+func setupOutbound() error {
+	cfg := config.Forward
+	for _, s := range cfg.SourceAddresses {
+		ip := net.ParseIP(s)
+		switch {
+		case ip == nil:
+			return fmt.Errorf("forward.source_addresses: %q is not an IP address", s)
+		case ip.To4() != nil:
+			if outboundV4 != nil {
+				return fmt.Errorf("forward.source_addresses: more than one IPv4 address")
+			}
+			outboundV4 = ip.To4()
+		default:
+			if outboundV6 != nil {
+				return fmt.Errorf("forward.source_addresses: more than one IPv6 address")
+			}
+			outboundV6 = ip
+		}
+	}
+	if (cfg.Interface != "" || cfg.Mark != 0) && !socketOptionsSupported {
+		return fmt.Errorf("forward.interface and forward.mark are only supported on Linux")
+	}
+	if cfg.Mark < 0 {
+		return fmt.Errorf("forward.mark must not be negative")
+	}
+	if cfg.Interface != "" {
+		if _, err := net.InterfaceByName(cfg.Interface); err != nil {
+			// A tunnel may come up after the server does.
+			log.Printf("Warning: forward.interface %s: %v", cfg.Interface, err)
+		}
+	}
+	outboundDevice, outboundMark = cfg.Interface, cfg.Mark
+	if outboundMark != 0 && config.Privileges.User != "" {
+		log.Printf("Warning: forward.mark needs CAP_NET_ADMIN, which is dropped with privileges.user")
+	}
+	return nil
+}
+
+// outboundSource is the source address for queries to host, an address or
+// a name, or nil for the OS to choose. A name takes the IPv4 source if there
+// is one; Go then resolves it to addresses of that family only.
+func outboundSource(host string) net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() != nil {
+			return outboundV4
+		}
+		return outboundV6
+	}
+	if outboundV4 != nil {
+		return outboundV4
+	}
+	return outboundV6
+}
+
+// outboundDialer returns a dialer for outbound queries to addr (host:port)
+// over network, "udp" or "tcp".
+func outboundDialer(network, addr string, timeout time.Duration) *net.Dialer {
+	d := &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}
+	if ip := outboundSource(hostOnly(addr)); ip != nil {
+		if network == "udp" {
+			d.LocalAddr = &net.UDPAddr{IP: ip}
+		} else {
+			d.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+	}
+	if outboundDevice != "" || outboundMark != 0 {
+		d.Control = outboundControl
+	}
+	return d
+}
+
+// dialOutbound dials like outboundDialer, for HTTP transports.
+func dialOutbound(timeout time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return outboundDialer(network, addr, timeout).DialContext(ctx, network, addr)
+	}
+}
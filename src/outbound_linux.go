@@ -0,0 +1,29 @@
+package main
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const socketOptionsSupported = true
+
+// outboundControl binds an outbound socket to forward.interface and marks
+// it with forward.mark before it connects.
+func outboundControl(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		if outboundDevice != "" {
+			if serr = unix.BindToDevice(int(fd), outboundDevice); serr != nil {
+				return
+			}
+		}
+		if outboundMark != 0 {
+			serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, outboundMark)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+const socketOptionsSupported = false
+
+func outboundControl(network, address string, c syscall.RawConn) error {
+	return fmt.Errorf("outbound socket options are not supported on this platform")
+}
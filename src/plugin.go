@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Queries are answered by a chain of plugins, each doing one step: access
+// control, policy, local zones, the cache, forwarding. A plugin either
+// answers the query itself or hands it to the next one; at the end of the
+// chain the reply built from local data (Query.Msg) is written.
+//
+// More plugins can be compiled in, CoreDNS style: add a file to this
+// package whose init function calls RegisterPlugin. A plugin that wants to
+// see or change every response wraps Query.W, as the built-in writers do.
+
+// A Plugin is one step of answering a query. It answers q, or does nothing
+// so the query is dropped, or calls next to pass q on.
+type Plugin interface {
+	Name() string
+	ServeDNS(q *Query, next func(*Query))
+}
+
+// Query is a query on its way through the plugin chain.
+type Query struct {
+	W        dns.ResponseWriter
+	R        *dns.Msg
+	Client   net.IP
+	Listener string
+	// Msg is the reply being built from local data, from the log plugin
+	// on. It is what the end of the chain writes.
+	Msg *dns.Msg
+
+	store     *recordStore
+	stats     *listenerCounters
+	quiet     bool
+	logq      func(format string, args ...any)
+	recursion bool
+	pol       *policy
+	loc       geoLocation
+	trace     answerTrace
+	source    string // answerLocal, answerCache or answerForward
+	rcode     int    // as written, for statistics
+	blocked   bool
+	deleg     *delegation // set by local for the delegation plugin
+	stub      *stubZone   // set by local for the stub plugin
+}
+
+// Name is the query name, lowercase and fully qualified. Plugins ahead of
+// "opcode" may see messages without a question; for those it is "".
+func (q *Query) Name() string {
+	if len(q.R.Question) == 0 {
+		return ""
+	}
+	return dns.Fqdn(strings.ToLower(q.R.Question[0].Name))
+}
+
+// pluginFunc is a Plugin made of a function.
+type pluginFunc struct {
+	name  string
+	serve func(q *Query, next func(*Query))
+}
+
+func (p pluginFunc) Name() string                         { return p.name }
+func (p pluginFunc) ServeDNS(q *Query, next func(*Query)) { p.serve(q, next) }
+
+// builtinPlugins is the chain as shipped, in order.
+var builtinPlugins = []Plugin{
+	pluginFunc{"ratelimit", serveRateLimit},
+	pluginFunc{"acl", serveACL},
+	pluginFunc{"edns", serveEDNSCheck},
+	pluginFunc{"cookie", serveCookie},
+	pluginFunc{"opcode", serveOpcode},
+	pluginFunc{"chaos", serveChaosClass},
+	pluginFunc{"qtype", serveSpecialQtype},
+	pluginFunc{"loopdetect", serveLoopProbe},
+	pluginFunc{"log", serveLog},
+	pluginFunc{"rewrite", serveRewrite},
+	pluginFunc{"restrict", serveRestrict},
+	pluginFunc{"qtypefilter", serveQtypeFilter},
+	pluginFunc{"rpz", serveRPZ},
+	pluginFunc{"rules", serveRules},
+	pluginFunc{"signer", serveSigned},
+	pluginFunc{"local", serveLocal},
+	pluginFunc{"delegation", serveDelegation},
+	pluginFunc{"stub", serveStub},
+	pluginFunc{"refuse", serveRefuse},
+	pluginFunc{"cache", serveCache},
+	pluginFunc{"forward", serveForward},
+}
+
+type registeredPlugin struct {
+	plugin Plugin
+	before string
+}
+
+var (
+	registeredPlugins []registeredPlugin
+	queryChain        func(*Query) // the first plugin's entry point
+)
+
+// RegisterPlugin adds p to the chain just before the plugin named before,
+// or at the end if before is "". Call it from an init function. Queries a
+// plugin placed ahead of "log" answers or drops are left out of statistics,
+// traces and the query log, as those of the access checks are.
+func RegisterPlugin(p Plugin, before string) {
+	registeredPlugins = append(registeredPlugins, registeredPlugin{p, before})
+}
+
+// setupPlugins assembles the chain.
+func setupPlugins() error {
+	chain := append([]Plugin(nil), builtinPlugins...)
+	for _, rp := range registeredPlugins {
+		at := len(chain)
+		if rp.before != "" {
+			at = -1
+			for i, p := range chain {
+				if p.Name() == rp.before {
+					at = i
+					break
+				}
+			}
+			if at < 0 {
+				return fmt.Errorf("plugin %s: no plugin %q to go before", rp.plugin.Name(), rp.before)
+			}
+		}
+		chain = append(chain[:at], append([]Plugin{rp.plugin}, chain[at:]...)...)
+	}
+	// Link the plugins back to front once, so a query allocates nothing
+	// to get through them.
+	next := func(q *Query) { q.Reply() }
+	for i := len(chain) - 1; i >= 0; i-- {
+		p, rest := chain[i], next
+		next = func(q *Query) { p.ServeDNS(q, rest) }
+	}
+	queryChain = next
+	if len(registeredPlugins) > 0 {
+		names := make([]string, len(chain))
+		for i, p := range chain {
+			names[i] = p.Name()
+		}
+		log.Printf("Query plugins: %s", strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// Reply writes Msg, the reply built from local data. A plugin that
+// answers from Msg calls it instead of next. Ahead of "log" there is no Msg
+// yet, and Reply starts an empty one.
+func (q *Query) Reply() {
+	if q.Msg == nil {
+		q.Msg = new(dns.Msg)
+		q.Msg.SetReply(q.R)
+	}
+	m := q.Msg
+	m.Answer = withoutHidden(m.Answer, q.Client)
+	m.Extra = withoutHidden(m.Extra, q.Client)
+	if q.store == records && signer != nil && dnssecOK(q.R) {
+		signer.signMsg(m)
+	}
+	finishEDNS(q.R, m)
+	q.trace.attach(m)
+	q.rcode = m.Rcode
+	if !writeLimited(q.W, m) {
+		return
+	}
+	for _, rr := range m.Answer {
+		q.logq("[%s] Responded with: %s", q.Listener, rr.String())
+	}
+}
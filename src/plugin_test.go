@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// answerPlugin answers every query with an A record from Msg.
+type answerPlugin struct{ name string }
+
+func (p answerPlugin) Name() string { return p.name }
+
+func (p answerPlugin) ServeDNS(q *Query, next func(*Query)) {
+	q.Reply()
+}
+
+func TestEarlyPluginReply(t *testing.T) {
+	oldRegistered, oldChain := registeredPlugins, queryChain
+	t.Cleanup(func() { registeredPlugins, queryChain = oldRegistered, oldChain })
+
+	for _, before := range []string{"ratelimit", "acl", "loopdetect"} {
+		registeredPlugins = nil
+		RegisterPlugin(answerPlugin{"early"}, before)
+		if err := setupPlugins(); err != nil {
+			t.Fatal(err)
+		}
+		r := new(dns.Msg)
+		r.SetQuestion("early.example.", dns.TypeA)
+		w := &recordingWriter{}
+		queryChain(&Query{W: w, R: r, Client: net.IPv4(192, 0, 2, 7), Listener: "test", logq: func(string, ...any) {}})
+		if len(w.written) != 1 || w.written[0].Id != r.Id || w.written[0].Rcode != dns.RcodeSuccess {
+			t.Errorf("before %s: wrote %v", before, w.written)
+		}
+	}
+}
+
+func TestRegisterPluginUnknownTarget(t *testing.T) {
+	oldRegistered, oldChain := registeredPlugins, queryChain
+	t.Cleanup(func() { registeredPlugins, queryChain = oldRegistered, oldChain })
+
+	registeredPlugins = nil
+	RegisterPlugin(answerPlugin{"lost"}, "nosuchplugin")
+	if err := setupPlugins(); err == nil {
+		t.Error("setupPlugins accepted a plugin placed before one that doesn't exist")
+	}
+}
+
+// namePlugin records the query name and passes the query on.
+type namePlugin struct{ seen *[]string }
+
+func (namePlugin) Name() string { return "name" }
+
+func (p namePlugin) ServeDNS(q *Query, next func(*Query)) {
+	*p.seen = append(*p.seen, q.Name())
+	next(q)
+}
+
+func TestPluginBeforeOpcodeWithoutQuestion(t *testing.T) {
+	oldRegistered, oldChain := registeredPlugins, queryChain
+	t.Cleanup(func() { registeredPlugins, queryChain = oldRegistered, oldChain })
+
+	var seen []string
+	registeredPlugins = nil
+	RegisterPlugin(namePlugin{&seen}, "opcode")
+	if err := setupPlugins(); err != nil {
+		t.Fatal(err)
+	}
+	r := new(dns.Msg)
+	r.Id = dns.Id()
+	w := &recordingWriter{}
+	queryChain(&Query{W: w, R: r, Client: net.IPv4(192, 0, 2, 7), Listener: "test", logq: func(string, ...any) {}})
+	if len(seen) != 1 || seen[0] != "" {
+		t.Errorf("plugin saw names %q", seen)
+	}
+	if len(w.written) != 1 || w.written[0].Rcode != dns.RcodeFormatError {
+		t.Errorf("wrote %v, want FORMERR", w.written)
+	}
+}
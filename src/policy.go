@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// PolicyConfig is a filtering profile for some clients, e.g. family
+// filtering for the kids' devices. Clients are picked by address (CIDRs or
+// client_groups names) or by hardware address, which takes dhcp_leases to
+// map to the address the device has now. The first policy a client belongs
+// to is its policy.
+//
+// A policy selects the RPZ zones (by name) and rules (by name) it turns
+// on. Zones and rules that some policy names apply only to the clients of
+// the policies naming them; those no policy names apply to everyone.
+// SafeSearch enforcement is a rule with rewrite_to, e.g. www.google.com to
+// forcesafesearch.google.com.
+type PolicyConfig struct {
+	Name    string   `yaml:"name"`
+	Clients []string `yaml:"clients"` // CIDRs or client_groups names
+	MACs    []string `yaml:"macs"`
+	RPZ     []string `yaml:"rpz"`
+	Rules   []string `yaml:"rules"`
+}
+
+type policy struct {
+	name string
+	nets []*net.IPNet
+	macs map[string]bool
+}
+
+// loadPolicies runs after loadRPZ and loadRules, and limits the zones and
+// rules the policies name to those policies.
+func (f *filterSet) loadPolicies(c *Config) error {
+	groups, err := clientGroups(c)
+	if err != nil {
+		return err
+	}
+	zonesByName := make(map[string]*rpzZone)
+	for _, z := range f.rpzZones {
+		zonesByName[z.origin] = z
+	}
+	rulesByName := make(map[string]*rule)
+	for _, r := range f.rules {
+		if r.Name != "" {
+			rulesByName[r.Name] = r
+		}
+	}
+	seen := make(map[string]bool)
+	for i, cfg := range c.Policies {
+		key := fmt.Sprintf("policies[%d]", i)
+		if cfg.Name == "" {
+			return fmt.Errorf("%s: name is required", key)
+		}
+		if seen[cfg.Name] {
+			return fmt.Errorf("%s: duplicate policy %q", key, cfg.Name)
+		}
+		seen[cfg.Name] = true
+		p := &policy{name: cfg.Name, macs: make(map[string]bool)}
+		for _, c := range cfg.Clients {
+			if nets, ok := groups[c]; ok {
+				p.nets = append(p.nets, nets...)
+				continue
+			}
+			nets, err := parseCIDRs(key+".clients", []string{c})
+			if err != nil {
+				return err
+			}
+			p.nets = append(p.nets, nets...)
+		}
+		for _, m := range cfg.MACs {
+			mac, err := net.ParseMAC(m)
+			if err != nil {
+				return fmt.Errorf("%s.macs: %v", key, err)
+			}
+			p.macs[mac.String()] = true
+		}
+		if len(p.macs) > 0 && c.DHCPLeases.File == "" {
+			return fmt.Errorf("%s.macs: dhcp_leases.file is required to match hardware addresses", key)
+		}
+		for _, name := range cfg.RPZ {
+			z := zonesByName[dns.CanonicalName(name)]
+			if z == nil {
+				return fmt.Errorf("%s.rpz: no policy zone %q", key, name)
+			}
+			if z.policies == nil {
+				z.policies = make(map[*policy]bool)
+			}
+			z.policies[p] = true
+		}
+		for _, name := range cfg.Rules {
+			r := rulesByName[name]
+			if r == nil {
+				return fmt.Errorf("%s.rules: no rule named %q", key, name)
+			}
+			if r.policies == nil {
+				r.policies = make(map[*policy]bool)
+			}
+			r.policies[p] = true
+		}
+		f.policies = append(f.policies, p)
+	}
+	if len(f.policies) > 0 {
+		log.Printf("Loaded %d client policy profile(s)", len(f.policies))
+	}
+	return nil
+}
+
+// clientPolicy returns the policy client belongs to, or nil.
+func clientPolicy(client net.IP) *policy {
+	policies := activeFilters().policies
+	if len(policies) == 0 || client == nil {
+		return nil
+	}
+	var mac string
+	if l := leaseFor(client); l != nil {
+		mac = l.mac.String()
+	}
+	for _, p := range policies {
+		if onNetworks(client, p.nets) || (mac != "" && p.macs[mac]) {
+			return p
+		}
+	}
+	return nil
+}
+
+// policyApplies reports whether something limited to set (nil for everyone)
+// applies to clients of pol.
+func policyApplies(set map[*policy]bool, pol *policy) bool {
+	return set == nil || set[pol]
+}
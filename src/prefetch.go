@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// PrefetchConfig refreshes popular cache entries shortly before they
+// expire, so hot names are never answered at upstream latency. An entry
+// looked up at least MinHits times since it was stored is refreshed in the
+// background on the first lookup within the last Window percent of its TTL.
+type PrefetchConfig struct {
+	Enabled bool `yaml:"enabled"`
+	MinHits int  `yaml:"min_hits"` // default 5
+	Window  int  `yaml:"window"`   // percent of the TTL; default 10
+}
+
+const (
+	defaultPrefetchHits   = 5
+	defaultPrefetchWindow = 10
+)
+
+func setupPrefetch(cfg *PrefetchConfig) error {
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.MinHits < 0 || cfg.Window < 0 || cfg.Window > 100 {
+		return fmt.Errorf("cache.prefetch: min_hits must not be negative and window must be 0-100")
+	}
+	if cfg.MinHits == 0 {
+		cfg.MinHits = defaultPrefetchHits
+	}
+	if cfg.Window == 0 {
+		cfg.Window = defaultPrefetchWindow
+	}
+	return nil
+}
+
+// cachesPositive reports whether successful answers are cached, not just
+// negative ones.
+func cachesPositive() bool {
+	return config.Cache.ServeStale.Enabled || config.Cache.Prefetch.Enabled
+}
+
+// duePrefetch reports whether the entry, just looked up, should be
+// refreshed now, and marks it so that happens once.
+func (e *cacheEntry) duePrefetch(now time.Time) bool {
+	cfg := config.Cache.Prefetch
+	if !cfg.Enabled || e.prefetched || e.hits < cfg.MinHits {
+		return false
+	}
+	ttl, left := e.expires.Sub(e.stored), e.expires.Sub(now)
+	if left*100 > ttl*time.Duration(cfg.Window) {
+		return false
+	}
+	e.prefetched = true
+	return true
+}
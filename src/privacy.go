@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// PrivacyConfig keeps what clients look up out of the logs and statistics.
+//
+// Queries for QuietNames (globs) or from QuietClients (CIDRs or
+// client_groups names) are answered as usual but never logged, traced,
+// sent to analytics, counted by name or client in /stats/top, or used as
+// fingerprint evidence; they still count toward totals. HashClients shows
+// client addresses in query logs and statistics as a keyed hash instead:
+// the same client keeps the same hash until the server restarts, but the
+// address can't be read back. RetentionHours drops traces and fingerprints
+// not updated for that long.
+type PrivacyConfig struct {
+	QuietNames     []string `yaml:"quiet_names"`
+	QuietClients   []string `yaml:"quiet_clients"`
+	HashClients    bool     `yaml:"hash_clients"`
+	RetentionHours int      `yaml:"retention_hours"` // 0 keeps them until evicted
+}
+
+type privacyPolicy struct {
+	names   []string // lowercase, fully qualified globs
+	clients []*net.IPNet
+	hashKey []byte // nil unless hashing clients
+}
+
+var privacy = &privacyPolicy{}
+
+func setupPrivacy() error {
+	cfg := config.Privacy
+	p := &privacyPolicy{}
+	for _, n := range cfg.QuietNames {
+		glob := dns.Fqdn(strings.ToLower(n))
+		if _, err := path.Match(glob, ""); err != nil {
+			return fmt.Errorf("privacy.quiet_names: %v", err)
+		}
+		p.names = append(p.names, glob)
+	}
+	groups, err := clientGroups(config)
+	if err != nil {
+		return err
+	}
+	for _, c := range cfg.QuietClients {
+		if nets, ok := groups[c]; ok {
+			p.clients = append(p.clients, nets...)
+			continue
+		}
+		nets, err := parseCIDRs("privacy.quiet_clients", []string{c})
+		if err != nil {
+			return err
+		}
+		p.clients = append(p.clients, nets...)
+	}
+	if cfg.HashClients {
+		p.hashKey = make([]byte, 32)
+		rand.Read(p.hashKey)
+	}
+	if cfg.RetentionHours < 0 {
+		return fmt.Errorf("privacy.retention_hours must not be negative")
+	}
+	privacy = p
+	if cfg.RetentionHours > 0 {
+		go scrubStats(time.Duration(cfg.RetentionHours) * time.Hour)
+	}
+	return nil
+}
+
+// quiet reports whether a query for name (any case) from client must be
+// left out of logs and statistics.
+func (p *privacyPolicy) quiet(name string, client net.IP) bool {
+	if client != nil && len(p.clients) > 0 && onNetworks(client, p.clients) {
+		return true
+	}
+	if len(p.names) == 0 {
+		return false
+	}
+	name = dns.Fqdn(strings.ToLower(name))
+	for _, glob := range p.names {
+		if ok, _ := path.Match(glob, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// clientLabel is how client appears in query logs and statistics: its
+// address, or its hash with hash_clients.
+func clientLabel(client net.IP) string {
+	if client == nil {
+		return "<nil>"
+	}
+	if privacy.hashKey == nil {
+		return client.String()
+	}
+	mac := hmac.New(sha256.New, privacy.hashKey)
+	mac.Write(client.To16())
+	return "client-" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// scrubStats drops traces and fingerprints older than keep, every minute.
+func scrubStats(keep time.Duration) {
+	log.Printf("Dropping traces and client fingerprints after %s", keep)
+	for range time.Tick(time.Minute) {
+		cutoff := time.Now().Add(-keep)
+		if traces != nil {
+			traces.mu.Lock()
+			for i, rec := range traces.ring {
+				if rec != nil && rec.Time.Before(cutoff) {
+					traces.ring[i] = nil
+				}
+			}
+			traces.mu.Unlock()
+		}
+		if fingerprints != nil {
+			fingerprints.mu.Lock()
+			for key, c := range fingerprints.clients {
+				if c.lastSeen.Before(cutoff) {
+					delete(fingerprints.clients, key)
+				}
+			}
+			fingerprints.mu.Unlock()
+		}
+	}
+}
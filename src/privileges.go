@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// PrivilegesConfig lets the server start as root, bind its sockets and
+// then continue as an unprivileged user, optionally confined to a chroot.
+// Files read after startup (zone files) must then be readable by that
+// user and, with chroot, lie inside the chroot directory.
+type PrivilegesConfig struct {
+	User   string `yaml:"user"`
+	Group  string `yaml:"group"` // defaults to the user's primary group
+	Chroot string `yaml:"chroot"`
+}
+
+// privilegeTarget is the resolved identity to switch to.
+type privilegeTarget struct {
+	uid, gid int
+	chroot   string
+	wd       string // where relative paths in a reloaded config start
+}
+
+var privTarget *privilegeTarget
+
+// setupPrivileges resolves the user and group while /etc/passwd is still
+// reachable.
+func setupPrivileges() error {
+	cfg := config.Privileges
+	if cfg.User == "" && cfg.Group == "" && cfg.Chroot == "" {
+		return nil
+	}
+	t := &privilegeTarget{uid: -1, gid: -1}
+	if cfg.User != "" {
+		u, err := user.Lookup(cfg.User)
+		if err != nil {
+			if u, err = user.LookupId(cfg.User); err != nil {
+				return fmt.Errorf("privileges.user: %v", err)
+			}
+		}
+		t.uid, _ = strconv.Atoi(u.Uid)
+		t.gid, _ = strconv.Atoi(u.Gid)
+		if t.uid == 0 {
+			return fmt.Errorf("privileges.user %q is root", cfg.User)
+		}
+	}
+	if cfg.Group != "" {
+		g, err := user.LookupGroup(cfg.Group)
+		if err != nil {
+			if g, err = user.LookupGroupId(cfg.Group); err != nil {
+				return fmt.Errorf("privileges.group: %v", err)
+			}
+		}
+		t.gid, _ = strconv.Atoi(g.Gid)
+	}
+	if cfg.Chroot != "" {
+		root, err := filepath.Abs(cfg.Chroot)
+		if err != nil {
+			return fmt.Errorf("privileges.chroot: %v", err)
+		}
+		t.chroot = root
+		if t.wd, err = os.Getwd(); err != nil {
+			return fmt.Errorf("privileges.chroot: %v", err)
+		}
+		for _, path := range chrootedPaths() {
+			if _, err := chrootPath(root, *path); err != nil {
+				return err
+			}
+		}
+	}
+	privTarget = t
+	return nil
+}
+
+// chrootPath translates path to what it is called inside root.
+func chrootPath(root, path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("%s is outside the chroot %s", path, root)
+	}
+	return "/" + rel, nil
+}
+
+// chrootedPaths are the files still opened by path after the chroot.
+func chrootedPaths() []*string {
+	paths := zoneFilePaths()
+	if config.Cache.File != "" {
+		paths = append(paths, &config.Cache.File)
+	}
+	if config.Backup.Dir != "" {
+		paths = append(paths, &config.Backup.Dir)
+	}
+	if config.GeoIP.Database != "" {
+		paths = append(paths, &config.GeoIP.Database)
+	}
+	if config.DHCPLeases.File != "" {
+		paths = append(paths, &config.DHCPLeases.File)
+	}
+	if config.Database.File != "" {
+		paths = append(paths, &config.Database.File)
+	}
+	if config.ACME.AccountsFile != "" {
+		paths = append(paths, &config.ACME.AccountsFile)
+	}
+	if config.Dnsmasq.Path != "" {
+		paths = append(paths, &config.Dnsmasq.Path)
+	}
+	return paths
+}
+
+// chrootConfigErr is set when the config file is outside the chroot and
+// can't be reread once inside it.
+var chrootConfigErr error
+
+// chrootReloaded maps the paths a reload reads from c into the chroot, as
+// dropPrivileges did for the startup config.
+func chrootReloaded(c *Config) error {
+	t := privTarget
+	if t == nil || t.chroot == "" {
+		return nil
+	}
+	paths := []*string{&c.Dnsmasq.Path}
+	for i := range c.RPZ {
+		paths = append(paths, &c.RPZ[i].File)
+	}
+	for _, path := range paths {
+		if *path == "" {
+			continue
+		}
+		if !filepath.IsAbs(*path) {
+			*path = filepath.Join(t.wd, *path)
+		}
+		p, err := chrootPath(t.chroot, *path)
+		if err != nil {
+			return err
+		}
+		*path = p
+	}
+	return nil
+}
+
+// dropPrivileges enters the chroot and switches user once every socket is
+// bound. It runs before the sandbox, which forbids both.
+func dropPrivileges() {
+	t := privTarget
+	if t == nil {
+		return
+	}
+	if t.chroot != "" {
+		for _, path := range chrootedPaths() {
+			*path, _ = chrootPath(t.chroot, *path)
+		}
+		if path, err := chrootPath(t.chroot, configFile); err != nil {
+			chrootConfigErr = err
+			log.Printf("Config reload is off: %v", err)
+		} else {
+			configFile = path
+		}
+		if err := enterChroot(t.chroot); err != nil {
+			log.Fatalf("Failed to chroot to %s: %v", t.chroot, err)
+		}
+		log.Printf("Chrooted to %s", t.chroot)
+	}
+	if t.uid >= 0 || t.gid >= 0 {
+		if err := switchUser(t.uid, t.gid); err != nil {
+			log.Fatalf("Failed to drop privileges: %v", err)
+		}
+		log.Printf("Dropped privileges to uid %d gid %d", t.uid, t.gid)
+	}
+}
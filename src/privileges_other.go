@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import "fmt"
+
+func enterChroot(dir string) error {
+	return fmt.Errorf("chroot is not supported on this platform")
+}
+
+func switchUser(uid, gid int) error {
+	return fmt.Errorf("dropping privileges is not supported on this platform")
+}
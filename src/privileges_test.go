@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestChrootReloaded(t *testing.T) {
+	old := privTarget
+	t.Cleanup(func() { privTarget = old })
+	privTarget = &privilegeTarget{uid: -1, gid: -1, chroot: "/var/lib/micro-dns", wd: "/var/lib/micro-dns/etc"}
+
+	next := &Config{
+		RPZ:     []RPZConfig{{Name: "rpz.local", File: "/var/lib/micro-dns/rpz/block.zone"}},
+		Dnsmasq: DnsmasqConfig{Path: "dnsmasq.d"},
+	}
+	if err := chrootReloaded(next); err != nil {
+		t.Fatal(err)
+	}
+	if next.RPZ[0].File != "/rpz/block.zone" {
+		t.Errorf("policy zone file mapped to %s", next.RPZ[0].File)
+	}
+	if next.Dnsmasq.Path != "/etc/dnsmasq.d" {
+		t.Errorf("relative dnsmasq path mapped to %s", next.Dnsmasq.Path)
+	}
+
+	outside := &Config{RPZ: []RPZConfig{{Name: "rpz.local", File: "/etc/rpz.zone"}}}
+	if err := chrootReloaded(outside); err == nil {
+		t.Error("reloaded a policy zone outside the chroot")
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// With forward.probe_interval set, every upstream is asked for the A
+// record of forward.probe_name on that interval, whether or not queries
+// are going to it, and the result feeds the smoothed RTT and failure rate
+// that rank upstreams. An upstream that degrades sinks below the others;
+// one that recovers rises back to the top even if failover had stopped
+// sending it anything. Probes are counted apart from queries in /stats.
+
+func probeUpstreams() {
+	for {
+		time.Sleep(time.Duration(config.Forward.ProbeInterval) * time.Second)
+		for _, u := range activeUpstreams() {
+			go u.probe()
+		}
+		for _, u := range allDomainUpstreams() {
+			if !containsUpstream(activeUpstreams(), u) {
+				go u.probe()
+			}
+		}
+	}
+}
+
+// probe sends one probe query to u.
+func (u *upstream) probe() {
+	q := new(dns.Msg)
+	q.SetQuestion(config.Forward.ProbeName, dns.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.Forward.TimeoutMs)*time.Millisecond)
+	defer cancel()
+	wasFailing := u.failing()
+	start := time.Now()
+	_, err := u.exchange(ctx, q)
+	u.probes.Add(1)
+	if err != nil {
+		u.probeFails.Add(1)
+	}
+	u.smooth(time.Since(start), err)
+	switch failing := u.failing(); {
+	case failing && !wasFailing:
+		log.Printf("Upstream %s is failing: %v", u.name, err)
+	case !failing && wasFailing:
+		log.Printf("Upstream %s has recovered", u.name)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// QtypeFilterConfig keeps some query types from being answered, for every
+// client or only some (CIDRs or client_groups names): e.g. AAAA for a
+// network whose IPv6 is broken, or ANY and HINFO. A filtered query is
+// never looked up or forwarded; it gets, by Action:
+//
+//   - nodata: an empty NOERROR answer (the default)
+//   - refuse: REFUSED
+//   - drop: no response at all
+//
+// The first filter that matches the query type and client applies.
+type QtypeFilterConfig struct {
+	Types   []string `yaml:"types"`
+	Clients []string `yaml:"clients"` // CIDRs or client_groups names; empty is every client
+	Action  string   `yaml:"action"`
+}
+
+const (
+	qtypeNoData = "nodata"
+	qtypeRefuse = "refuse"
+	qtypeDrop   = "drop"
+)
+
+type qtypeFilter struct {
+	types   map[uint16]bool
+	clients []*net.IPNet
+	action  string
+}
+
+func (f *filterSet) loadQtypeFilters(c *Config) error {
+	groups, err := clientGroups(c)
+	if err != nil {
+		return err
+	}
+	for i, cfg := range c.QtypeFilters {
+		key := fmt.Sprintf("qtype_filters[%d]", i)
+		if len(cfg.Types) == 0 {
+			return fmt.Errorf("%s: types is required", key)
+		}
+		qf := &qtypeFilter{types: make(map[uint16]bool), action: strings.ToLower(cfg.Action)}
+		for _, t := range cfg.Types {
+			qtype, ok := dns.StringToType[strings.ToUpper(t)]
+			if !ok {
+				return fmt.Errorf("%s.types: unknown type %q", key, t)
+			}
+			qf.types[qtype] = true
+		}
+		for _, cl := range cfg.Clients {
+			if nets, ok := groups[cl]; ok {
+				qf.clients = append(qf.clients, nets...)
+				continue
+			}
+			nets, err := parseCIDRs(key+".clients", []string{cl})
+			if err != nil {
+				return err
+			}
+			qf.clients = append(qf.clients, nets...)
+		}
+		switch qf.action {
+		case "":
+			qf.action = qtypeNoData
+		case qtypeNoData, qtypeRefuse, qtypeDrop:
+		default:
+			return fmt.Errorf("%s.action: %q is not nodata, refuse or drop", key, cfg.Action)
+		}
+		f.qtypeFilters = append(f.qtypeFilters, qf)
+	}
+	if len(f.qtypeFilters) > 0 {
+		log.Printf("Loaded %d query type filter(s)", len(f.qtypeFilters))
+	}
+	return nil
+}
+
+// matchQtypeFilter returns the first filter for qtype queries from client,
+// or nil. Clients of unknown address match only filters for everyone.
+func matchQtypeFilter(qtype uint16, client net.IP) *qtypeFilter {
+	for _, qf := range activeFilters().qtypeFilters {
+		if !qf.types[qtype] {
+			continue
+		}
+		if len(qf.clients) == 0 || (client != nil && onNetworks(client, qf.clients)) {
+			return qf
+		}
+	}
+	return nil
+}
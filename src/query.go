@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v2"
+)
+
+// queryRR is a record in "micro-dns query -json" output.
+type queryRR struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	TTL  uint32 `json:"ttl"`
+	Data string `json:"data"`
+}
+
+type queryOutput struct {
+	Server     string    `json:"server"`
+	Transport  string    `json:"transport"`
+	RTTMs      float64   `json:"rtt_ms"`
+	ID         uint16    `json:"id"`
+	Rcode      string    `json:"rcode"`
+	Flags      []string  `json:"flags"`
+	Name       string    `json:"name"`
+	Type       string    `json:"type"`
+	Answer     []queryRR `json:"answer"`
+	Authority  []queryRR `json:"authority"`
+	Additional []queryRR `json:"additional"`
+}
+
+// runQuery implements "micro-dns query", a small dig: it sends one query
+// and prints the response. It exits 0 when a response arrived, whatever
+// its rcode, and 1 when none did.
+func runQuery(args []string) int {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "Config file to take the default port from")
+	asJSON := fs.Bool("json", false, "Print the response as JSON")
+	useTCP := fs.Bool("tcp", false, "Query over TCP instead of UDP")
+	dnssec := fs.Bool("dnssec", false, "Set the DO bit")
+	noRecurse := fs.Bool("norecurse", false, "Clear the RD bit")
+	reverse := fs.Bool("x", false, "Reverse lookup: the name is an IP address")
+	timeout := fs.Duration("timeout", 2*time.Second, "Time to wait for the response")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: micro-dns query [flags] <name> [type] [@server[:port]]")
+		fs.PrintDefaults()
+	}
+	// Flags may come after the name, type and server, as with dig.
+	var positional []string
+	for {
+		fs.Parse(args)
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+
+	var name, server string
+	qtype := dns.TypeA
+	for _, arg := range positional {
+		if s, ok := strings.CutPrefix(arg, "@"); ok {
+			server = s
+		} else if t, ok := dns.StringToType[strings.ToUpper(arg)]; ok && name != "" {
+			qtype = t
+		} else if name == "" {
+			name = arg
+		} else {
+			fs.Usage()
+			return 2
+		}
+	}
+	if name == "" {
+		fs.Usage()
+		return 2
+	}
+	if *reverse {
+		arpa, err := dns.ReverseAddr(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "query: %v\n", err)
+			return 2
+		}
+		name, qtype = arpa, dns.TypePTR
+	}
+	if server == "" {
+		port := "53"
+		cfg := &Config{}
+		if data, err := os.ReadFile(*configPath); err == nil && yaml.Unmarshal(data, cfg) == nil && cfg.ListenPort != "" {
+			port = cfg.ListenPort
+		}
+		server = net.JoinHostPort("127.0.0.1", port)
+	}
+	server = withDefaultPort(server, "53")
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	m.RecursionDesired = !*noRecurse
+	m.SetEdns0(dns.DefaultMsgSize, *dnssec)
+	transport := "udp"
+	if *useTCP {
+		transport = "tcp"
+	}
+	resp, rtt, err := (&dns.Client{Net: transport, Timeout: *timeout}).Exchange(m, server)
+	if err == nil && resp.Truncated && transport == "udp" {
+		transport = "tcp"
+		resp, rtt, err = (&dns.Client{Net: transport, Timeout: *timeout}).Exchange(m, server)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "query: %s: %v\n", server, err)
+		return 1
+	}
+
+	out := queryOutput{
+		Server:     server,
+		Transport:  transport,
+		RTTMs:      float64(rtt.Microseconds()) / 1000,
+		ID:         resp.Id,
+		Rcode:      dns.RcodeToString[resp.Rcode],
+		Flags:      queryFlags(resp),
+		Name:       dns.Fqdn(name),
+		Type:       dns.TypeToString[qtype],
+		Answer:     queryRRs(resp.Answer),
+		Authority:  queryRRs(resp.Ns),
+		Additional: queryRRs(resp.Extra),
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(out)
+		return 0
+	}
+	fmt.Printf(";; %s %s: %s, id %d, flags: %s\n", out.Name, out.Type, out.Rcode, out.ID, strings.Join(out.Flags, " "))
+	for _, section := range []struct {
+		title string
+		rrs   []queryRR
+	}{{"ANSWER", out.Answer}, {"AUTHORITY", out.Authority}, {"ADDITIONAL", out.Additional}} {
+		if len(section.rrs) == 0 {
+			continue
+		}
+		fmt.Printf("\n;; %s\n", section.title)
+		for _, rr := range section.rrs {
+			fmt.Printf("%-30s %7d IN %-6s %s\n", rr.Name, rr.TTL, rr.Type, rr.Data)
+		}
+	}
+	fmt.Printf("\n;; %s over %s in %.1fms\n", out.Server, out.Transport, out.RTTMs)
+	return 0
+}
+
+// queryFlags lists the header flags set in m, dig style.
+func queryFlags(m *dns.Msg) []string {
+	flags := []string{}
+	for _, f := range []struct {
+		set  bool
+		name string
+	}{
+		{m.Response, "qr"}, {m.Authoritative, "aa"}, {m.Truncated, "tc"},
+		{m.RecursionDesired, "rd"}, {m.RecursionAvailable, "ra"},
+		{m.AuthenticatedData, "ad"}, {m.CheckingDisabled, "cd"},
+	} {
+		if f.set {
+			flags = append(flags, f.name)
+		}
+	}
+	return flags
+}
+
+// queryRRs converts records for output, leaving out the OPT record.
+func queryRRs(rrs []dns.RR) []queryRR {
+	out := []queryRR{}
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeOPT {
+			continue
+		}
+		out = append(out, queryRR{
+			Name: h.Name,
+			Type: dns.TypeToString[h.Rrtype],
+			TTL:  h.Ttl,
+			Data: strings.TrimPrefix(rr.String(), h.String()),
+		})
+	}
+	return out
+}
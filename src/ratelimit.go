@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RateLimitConfig controls per-client query limits and response rate
+// limiting (RRL). A zero QPS or ResponsesPerSecond disables that limit.
+type RateLimitConfig struct {
+	QPS                float64  `yaml:"qps"`
+	Burst              int      `yaml:"burst"`
+	ResponsesPerSecond int      `yaml:"responses_per_second"`
+	Slip               int      `yaml:"slip"`
+	Exempt             []string `yaml:"exempt"`
+}
+
+// limiter is nil when rate limiting is disabled.
+var limiter *rateLimiter
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rrlEntry struct {
+	second int64
+	count  int
+	slip   int
+}
+
+type rateLimiter struct {
+	cfg    RateLimitConfig
+	exempt []*net.IPNet
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	rrl     map[string]*rrlEntry
+}
+
+func setupRateLimit() error {
+	cfg := config.RateLimit
+	if cfg.QPS <= 0 && cfg.ResponsesPerSecond <= 0 {
+		return nil
+	}
+	if cfg.Burst <= 0 {
+		cfg.Burst = int(cfg.QPS) * 2
+		if cfg.Burst < 1 {
+			cfg.Burst = 1
+		}
+	}
+	if cfg.Slip < 0 {
+		return fmt.Errorf("rate_limit.slip must not be negative")
+	}
+
+	rl := &rateLimiter{
+		cfg:     cfg,
+		buckets: make(map[string]*bucket),
+		rrl:     make(map[string]*rrlEntry),
+	}
+	var err error
+	if rl.exempt, err = parseCIDRs("rate_limit.exempt", cfg.Exempt); err != nil {
+		return err
+	}
+	limiter = rl
+	go rl.sweep()
+	return nil
+}
+
+func (rl *rateLimiter) isExempt(ip net.IP) bool {
+	return onNetworks(ip, rl.exempt)
+}
+
+// allowQuery charges one token from the client's bucket.
+func (rl *rateLimiter) allowQuery(ip net.IP) bool {
+	if rl.cfg.QPS <= 0 || ip == nil || rl.isExempt(ip) {
+		return true
+	}
+	now := time.Now()
+	key := ip.String()
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(rl.cfg.Burst), last: now}
+		rl.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rl.cfg.QPS
+	if b.tokens > float64(rl.cfg.Burst) {
+		b.tokens = float64(rl.cfg.Burst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Response rate limiting verdicts.
+const (
+	rrlSend = iota
+	rrlDrop
+	rrlSlip
+)
+
+// checkResponse applies RRL to an outgoing response. Identical responses to
+// the same client network beyond the configured rate are dropped, except
+// every Slip-th one, which is sent truncated so a legitimate client retries
+// over TCP while a spoofed victim receives no amplification.
+func (rl *rateLimiter) checkResponse(ip net.IP, m *dns.Msg) int {
+	if rl.cfg.ResponsesPerSecond <= 0 || ip == nil || rl.isExempt(ip) {
+		return rrlSend
+	}
+	key := rrlKey(ip, m)
+	sec := time.Now().Unix()
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	e, ok := rl.rrl[key]
+	if !ok || e.second != sec {
+		e = &rrlEntry{second: sec}
+		rl.rrl[key] = e
+	}
+	e.count++
+	if e.count <= rl.cfg.ResponsesPerSecond {
+		return rrlSend
+	}
+	if rl.cfg.Slip > 0 {
+		e.slip++
+		if e.slip%rl.cfg.Slip == 0 {
+			return rrlSlip
+		}
+	}
+	return rrlDrop
+}
+
+// rrlKey groups responses by client network (/24 or /56) and answer identity.
+func rrlKey(ip net.IP, m *dns.Msg) string {
+	var network string
+	if v4 := ip.To4(); v4 != nil {
+		network = v4.Mask(net.CIDRMask(24, 32)).String()
+	} else {
+		network = ip.Mask(net.CIDRMask(56, 128)).String()
+	}
+	var qname, qtype string
+	if len(m.Question) > 0 {
+		qname = strings.ToLower(m.Question[0].Name)
+		qtype = dns.TypeToString[m.Question[0].Qtype]
+	}
+	return fmt.Sprintf("%s|%s|%s|%d", network, qname, qtype, m.Rcode)
+}
+
+// sweep periodically forgets idle clients so the tables stay bounded.
+func (rl *rateLimiter) sweep() {
+	for {
+		time.Sleep(time.Minute)
+		now := time.Now()
+		rl.mu.Lock()
+		for k, b := range rl.buckets {
+			if now.Sub(b.last) > time.Minute {
+				delete(rl.buckets, k)
+			}
+		}
+		for k, e := range rl.rrl {
+			if now.Unix()-e.second > 60 {
+				delete(rl.rrl, k)
+			}
+		}
+		rl.mu.Unlock()
+	}
+}
+
+// clientIP extracts the source address of a request.
+func clientIP(w dns.ResponseWriter) net.IP {
+	switch addr := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// writeLimited sends m unless RRL suppresses it. It reports whether the
+// full response was sent. RRL is against reflection, which needs a spoofed
+// source, so only UDP is limited; a TC reply over TCP would also send the
+// client round in circles. Clients with a valid DNS cookie are exempt.
+func writeLimited(w dns.ResponseWriter, m *dns.Msg) bool {
+	if _, udp := w.RemoteAddr().(*net.UDPAddr); udp && limiter != nil && !cookieVerified(w) {
+		switch limiter.checkResponse(clientIP(w), m) {
+		case rrlDrop:
+			return false
+		case rrlSlip:
+			tc := new(dns.Msg)
+			tc.SetReply(m)
+			tc.Rcode = m.Rcode
+			tc.Truncated = true
+			w.WriteMsg(tc)
+			return false
+		}
+	}
+	w.WriteMsg(m)
+	return true
+}
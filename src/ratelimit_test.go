@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestWriteLimitedTransports(t *testing.T) {
+	old := limiter
+	t.Cleanup(func() { limiter = old })
+	limiter = &rateLimiter{
+		cfg:     RateLimitConfig{ResponsesPerSecond: 2, Slip: 2},
+		buckets: make(map[string]*bucket),
+		rrl:     make(map[string]*rrlEntry),
+	}
+
+	r := new(dns.Msg)
+	r.SetQuestion("flood.example.", dns.TypeA)
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	tests := []struct {
+		name   string
+		remote net.Addr
+		full   func(n int) bool // acceptable count of full responses out of 10
+	}{
+		// Two a second; the writes may straddle a second boundary.
+		{"udp", &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 5353}, func(n int) bool { return n <= 4 }},
+		{"tcp", &net.TCPAddr{IP: net.IPv4(198, 51, 100, 2), Port: 5353}, func(n int) bool { return n == 10 }},
+	}
+	for _, tt := range tests {
+		w := &recordingWriter{remote: tt.remote}
+		full := 0
+		for i := 0; i < 10; i++ {
+			if writeLimited(w, m) {
+				full++
+			}
+		}
+		truncated := 0
+		for _, sent := range w.written {
+			if sent.Truncated {
+				truncated++
+			}
+		}
+		if !tt.full(full) {
+			t.Errorf("%s: %d of 10 responses sent in full", tt.name, full)
+		}
+		if tt.name == "tcp" && truncated > 0 {
+			t.Errorf("tcp: %d responses slipped as truncated", truncated)
+		}
+		if tt.name == "udp" && truncated == 0 {
+			t.Errorf("udp: no responses slipped")
+		}
+	}
+}
+
+func TestAllowQuery(t *testing.T) {
+	exempt, err := parseCIDRs("exempt", []string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl := &rateLimiter{
+		cfg:     RateLimitConfig{QPS: 1, Burst: 3},
+		exempt:  exempt,
+		buckets: make(map[string]*bucket),
+		rrl:     make(map[string]*rrlEntry),
+	}
+	client := net.IPv4(198, 51, 100, 1)
+	for i := 0; i < 3; i++ {
+		if !rl.allowQuery(client) {
+			t.Fatalf("query %d within the burst refused", i+1)
+		}
+	}
+	if rl.allowQuery(client) {
+		t.Error("query past the burst allowed")
+	}
+	if !rl.allowQuery(net.IPv4(198, 51, 100, 2)) {
+		t.Error("another client shares the bucket")
+	}
+	for i := 0; i < 10; i++ {
+		if !rl.allowQuery(net.IPv4(10, 1, 2, 3)) {
+			t.Fatal("exempt client limited")
+		}
+	}
+
+	// Two seconds at 1 qps buy two more queries.
+	rl.buckets[client.String()].last = time.Now().Add(-2 * time.Second)
+	if !rl.allowQuery(client) || !rl.allowQuery(client) {
+		t.Error("bucket didn't refill")
+	}
+	if rl.allowQuery(client) {
+		t.Error("bucket refilled past the elapsed time")
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// rdataTypes are stored with their whole RDATA in presentation format in
+// Record.Data and built with the miekg parser, since their fields don't fit
+// the A/MX/SRV-shaped Record.
+var rdataTypes = map[string]bool{
+	"CAA":   true,
+	"NAPTR": true,
+	"HTTPS": true,
+	"SVCB":  true,
+}
+
+// servedType reports whether local records answer qtype.
+func servedType(qtype uint16) bool {
+	switch qtype {
+	case dns.TypeA, dns.TypeAAAA, dns.TypeCNAME, dns.TypeTXT, dns.TypeMX, dns.TypeSRV, dns.TypePTR, dns.TypeNS:
+		return true
+	}
+	return rdataTypes[dns.TypeToString[qtype]]
+}
+
+// parseRdata validates rdata for one of rdataTypes and returns the record
+// with the RDATA in canonical presentation form.
+func parseRdata(rtype string, ttl uint32, rdata string) (Record, error) {
+	rr, err := dns.NewRR(fmt.Sprintf(". %d IN %s %s", ttl, rtype, rdata))
+	if err != nil {
+		return Record{}, err
+	}
+	if rr == nil {
+		return Record{}, fmt.Errorf("empty %s record", rtype)
+	}
+	return Record{Type: rtype, TTL: ttl, Data: rdataString(rr)}, nil
+}
+
+// rdataString returns the RDATA part of rr in presentation format.
+func rdataString(rr dns.RR) string {
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
+
+// rdataToRR builds an rdataTypes record owned by name.
+func rdataToRR(name string, rec Record) dns.RR {
+	rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(name), rec.TTL, rec.Type, rec.Data))
+	if err != nil {
+		return nil
+	}
+	return rr
+}
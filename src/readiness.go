@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ReadinessConfig decides when /readyz (on anycast.health_listen) starts
+// passing, so a load balancer holds traffic back from a cold instance. The
+// listeners must always be up; Require adds subsystems that must have
+// finished their first load too. Readiness, once reached, is kept: later
+// trouble is what /health reports.
+type ReadinessConfig struct {
+	Require []string `yaml:"require"` // default: [zones]
+}
+
+// Subsystems that can be required to be warm.
+const (
+	warmListeners  = "listeners"
+	warmZones      = "zones"      // hosts_file, zones and views loaded
+	warmUpstreams  = "upstreams"  // an upstream has answered
+	warmStubZones  = "stub_zones" // every stub zone has learned its servers
+	warmKubernetes = "kubernetes"
+	warmDocker     = "docker"
+	warmKV         = "kv"
+)
+
+// upstreamWarmupInterval spaces probes while no upstream has answered.
+const upstreamWarmupInterval = 5 * time.Second
+
+var (
+	warmMu sync.Mutex
+	warm   = make(map[string]bool)
+	ready  bool
+)
+
+func setupReadiness() error {
+	cfg := &config.Readiness
+	if cfg.Require == nil {
+		cfg.Require = []string{warmZones}
+	}
+	enabled := map[string]bool{
+		warmZones:      true,
+		warmUpstreams:  config.FallbackDNS != "",
+		warmStubZones:  len(stubZones) > 0,
+		warmKubernetes: config.Kubernetes.Enabled && config.Mode != modeForwarder,
+		warmDocker:     config.Docker.Enabled && config.Mode != modeForwarder,
+		warmKV:         config.KV.Backend != "" && config.Mode != modeForwarder,
+	}
+	for i, name := range cfg.Require {
+		name = strings.ToLower(name)
+		on, known := enabled[name]
+		if !known {
+			return fmt.Errorf("readiness.require: unknown subsystem %q", name)
+		}
+		if !on {
+			return fmt.Errorf("readiness.require: %s is not enabled", name)
+		}
+		cfg.Require[i] = name
+	}
+	cfg.Require = append(cfg.Require, warmListeners)
+	return nil
+}
+
+// markWarm records that a subsystem finished its first load.
+func markWarm(name string) {
+	warmMu.Lock()
+	defer warmMu.Unlock()
+	if warm[name] {
+		return
+	}
+	warm[name] = true
+	if !ready && len(coldLocked()) == 0 {
+		ready = true
+		log.Printf("Ready: %s warm", strings.Join(config.Readiness.Require, ", "))
+	}
+}
+
+// coldLocked lists the required subsystems that aren't warm yet.
+func coldLocked() []string {
+	var cold []string
+	for _, name := range config.Readiness.Require {
+		if !warm[name] {
+			cold = append(cold, name)
+		}
+	}
+	return cold
+}
+
+// handleReadyz answers 200 once every required subsystem is warm and 503
+// with the missing ones until then.
+func handleReadyz(w http.ResponseWriter, _ *http.Request) {
+	warmMu.Lock()
+	cold := coldLocked()
+	warmMu.Unlock()
+	if len(cold) > 0 {
+		http.Error(w, "waiting for: "+strings.Join(cold, ", "), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ready")
+}
+
+// warmUpUpstreams probes the upstreams until one answers, when only
+// readiness is waiting on it: a cold instance gets no traffic to forward.
+func warmUpUpstreams() {
+	if !slices.Contains(config.Readiness.Require, warmUpstreams) {
+		return
+	}
+	for {
+		warmMu.Lock()
+		done := warm[warmUpstreams]
+		warmMu.Unlock()
+		if done {
+			return
+		}
+		for _, u := range activeUpstreams() {
+			q := new(dns.Msg)
+			q.SetQuestion(".", dns.TypeNS)
+			if _, err := exchangeUpstream(u, q); err == nil {
+				markWarm(warmUpstreams)
+				break
+			}
+		}
+		time.Sleep(upstreamWarmupInterval)
+	}
+}
+
+// stubZonesLearned reports whether every stub zone has its servers.
+func stubZonesLearned() bool {
+	for _, s := range stubZones {
+		s.mu.Lock()
+		n := len(s.servers)
+		s.mu.Unlock()
+		if n == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// A zone file whose name ends in .json, .yaml or .yml is a list of record
+// objects instead of zone lines, for records generated by scripts:
+//
+//	[{"name": "www", "type": "A", "ttl": 300, "value": "10.0.0.1"},
+//	 {"name": "@", "type": "MX", "priority": 10, "value": "mail"}]
+//
+// The fields are those of the admin API and KV records (recordSpec) plus
+// the owner name, relative to the zone like in a zone file. A missing ttl
+// takes the zone's default_ttl and is an error without one. Unknown fields
+// are errors, so a typo doesn't silently change a record. Canary, weight
+// and GeoIP options need the zone line format.
+
+// fileRecord is one record in a structured record file.
+type fileRecord struct {
+	Name       string `json:"name" yaml:"name"`
+	recordSpec `yaml:",inline"`
+}
+
+// isStructuredZone reports whether path names a structured record file.
+func isStructuredZone(p string) bool {
+	p, _, _ = strings.Cut(p, "?") // a remote zone's query string
+	switch strings.ToLower(path.Ext(p)) {
+	case ".json", ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
+// readRecords reads a structured record file. JSON is read as YAML, of
+// which it is a subset. A record that doesn't validate is skipped like a
+// bad zone line; a file that doesn't parse fails the load.
+func (zr *zoneReader) readRecords(path string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	var list []fileRecord
+	if err := yaml.UnmarshalStrict(data, &list); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	for i, fr := range list {
+		if fr.Name == "" {
+			zr.skipRecord(path, i+1, fmt.Errorf("name is required"))
+			continue
+		}
+		if fr.TTL == 0 {
+			if zr.zs.defaultTTL == 0 {
+				zr.skipRecord(path, i+1, fmt.Errorf("%s: ttl is required (or set default_ttl)", fr.Name))
+				continue
+			}
+			fr.TTL = zr.zs.defaultTTL
+		}
+		if zr.zs.origin != "" && fr.Value != "" && !strings.HasSuffix(fr.Value, ".") && takesName(fr.Type) {
+			fr.Value = zr.zs.qualify(fr.Value)
+		}
+		rec, err := fr.toRecord()
+		if err != nil {
+			zr.skipRecord(path, i+1, fmt.Errorf("%s: %v", fr.Name, err))
+			continue
+		}
+		zr.add(zr.zs.qualify(fr.Name), rec, path, i+1)
+	}
+	return nil
+}
+
+// takesName reports whether a record type's value is a domain name, which
+// is relative to the zone when not fully qualified.
+func takesName(rtype string) bool {
+	switch strings.ToUpper(rtype) {
+	case "CNAME", "PTR", "NS", "MX", "SRV":
+		return true
+	}
+	return false
+}
+
+func (zr *zoneReader) skipRecord(path string, n int, err error) {
+	if zr.problem != nil {
+		zr.problem(path, n, err)
+		return
+	}
+	if zr.strict {
+		if zr.failed == nil {
+			zr.failed = fmt.Errorf("%s record %d: %v", path, n, err)
+		}
+		return
+	}
+	log.Printf("Skipping %s record %d: %v", path, n, err)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"gopkg.in/yaml.v2"
+)
+
+// A running server rereads its config file on SIGHUP or POST /config/reload
+// and applies, without touching the listeners, the settings that decide how
+// queries are answered: acl, client_groups, restrict, qtype_filters, rpz, rules, policies,
+// the forwarding upstreams (fallback_dns and forward.upstreams) and
+// log_level. A reload is all or nothing: if any of them is invalid, or an
+// RPZ file can't be read, the running settings stay and the error is
+// logged. Everything else, including turning forwarding on or off, still
+// takes a restart.
+
+// filterSet is the client and name filtering configuration. Its parts refer
+// to each other (policies to zones and rules), so a reload replaces it as a
+// whole.
+type filterSet struct {
+	queryACL     accessList
+	recursionACL accessList
+	anyACL       accessList
+	restrictions []*restriction
+	qtypeFilters []*qtypeFilter
+	rpzZones     []*rpzZone
+	rules        []*rule
+	policies     []*policy
+}
+
+var filters atomic.Pointer[filterSet]
+
+// activeFilters returns the filtering configuration in force.
+func activeFilters() *filterSet {
+	if f := filters.Load(); f != nil {
+		return f
+	}
+	return &filterSet{}
+}
+
+// buildFilters parses and loads the filtering sections of cfg.
+func buildFilters(cfg *Config) (*filterSet, error) {
+	f := &filterSet{}
+	for _, load := range []func(*Config) error{f.loadACLs, f.loadRestrictions, f.loadQtypeFilters, f.loadRPZ, f.loadRules, f.loadPolicies} {
+		if err := load(cfg); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func setupFilters() error {
+	f, err := buildFilters(config)
+	if err != nil {
+		return err
+	}
+	filters.Store(f)
+	return nil
+}
+
+// Log levels. debug and info log every query, as the replay command
+// expects; warn logs only events and problems.
+const (
+	logDebug = "debug"
+	logInfo  = "info"
+	logWarn  = "warn"
+)
+
+var (
+	logLevel     atomic.Value // string
+	queryLogging atomic.Bool
+)
+
+func parseLogLevel(s string) (string, error) {
+	switch level := strings.ToLower(strings.TrimSpace(s)); level {
+	case "":
+		return logInfo, nil
+	case logDebug, logInfo, logWarn:
+		return level, nil
+	default:
+		return "", fmt.Errorf("log_level must be debug, info or warn, got %q", s)
+	}
+}
+
+func setupLogLevel() error {
+	level, err := parseLogLevel(config.LogLevel)
+	if err != nil {
+		return err
+	}
+	setLogLevel(level)
+	return nil
+}
+
+func setLogLevel(level string) {
+	logLevel.Store(level)
+	queryLogging.Store(level != logWarn)
+}
+
+// queryLogf logs a line about a single query, unless log_level is warn.
+func queryLogf(format string, args ...any) {
+	if queryLogging.Load() {
+		log.Printf(format, args...)
+	}
+}
+
+// debugLogf logs a line only at log_level debug.
+func debugLogf(format string, args ...any) {
+	if logLevel.Load() == logDebug {
+		log.Printf(format, args...)
+	}
+}
+
+// reloadMu serializes reloads.
+var reloadMu sync.Mutex
+
+// reloadConfig rereads the config file and applies what can change while
+// serving.
+func reloadConfig() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	if chrootConfigErr != nil {
+		return chrootConfigErr
+	}
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return err
+	}
+	next := &Config{}
+	if err := yaml.Unmarshal(data, next); err != nil {
+		return fmt.Errorf("%s: %v", configFile, err)
+	}
+	if err := chrootReloaded(next); err != nil {
+		return err
+	}
+	level, err := parseLogLevel(next.LogLevel)
+	if err != nil {
+		return err
+	}
+	next.DHCPLeases = config.DHCPLeases // not reloaded; policies check it
+	dnsmasqRecs, err := loadDnsmasq(next)
+	if err != nil {
+		return err
+	}
+	f, err := buildFilters(next)
+	if err != nil {
+		return err
+	}
+
+	old := activeUpstreams()
+	list := old
+	var domains map[string][]*upstream
+	if config.Mode != modeAuthoritative {
+		fallback := next.FallbackDNS
+		if fallbackFlag != "" {
+			fallback = fallbackFlag
+		}
+		if fallback == "" && len(next.Forward.Upstreams) > 0 {
+			fallback = next.Forward.Upstreams[0]
+		}
+		if (fallback == "") != (config.FallbackDNS == "") {
+			return fmt.Errorf("turning forwarding on or off takes a restart")
+		}
+		if fallback != "" {
+			if list, err = buildUpstreams(fallback, next.Forward.Upstreams, old); err != nil {
+				return err
+			}
+			var oldDomains map[string][]*upstream
+			if p := domainUpstreams.Load(); p != nil {
+				oldDomains = *p
+			}
+			if domains, err = buildDomainUpstreams(next.Forward.Domains, oldDomains); err != nil {
+				return err
+			}
+		} else if len(next.Forward.Domains) > 0 {
+			return fmt.Errorf("forward.domains needs forwarding (fallback_dns or forward.upstreams)")
+		}
+	}
+
+	oldDomains := allDomainUpstreams()
+	filters.Store(f)
+	upstreams.Store(&list)
+	domainUpstreams.Store(&domains)
+	for _, u := range append(old, oldDomains...) {
+		if !containsUpstream(list, u) && !containsUpstream(allDomainUpstreams(), u) {
+			u.closeIdle()
+		}
+	}
+	if next.Dnsmasq.Path != "" || config.Dnsmasq.Path != "" {
+		records.setSource(sourceDnsmasq, dnsmasqRecs)
+	}
+	setLogLevel(level)
+	log.Printf("Reloaded %s: %d rule(s), %d policy zone(s), %d client policies, %d upstream(s), log_level %s",
+		configFile, len(f.rules), len(f.rpzZones), len(f.policies), len(list), level)
+	return nil
+}
+
+func containsUpstream(list []*upstream, u *upstream) bool {
+	for _, v := range list {
+		if v == u {
+			return true
+		}
+	}
+	return false
+}
+
+// watchReloadSignal reloads the configuration on every SIGHUP.
+func watchReloadSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		if err := reloadConfig(); err != nil {
+			log.Printf("Config reload failed; keeping the running settings: %v", err)
+		}
+	}
+}
+
+// handleReload serves POST /config/reload.
+func handleReload(w http.ResponseWriter, r *http.Request) {
+	if err := reloadConfig(); err != nil {
+		auditf(r, "config reload failed: %v", err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	auditf(r, "config reloaded")
+	f := activeFilters()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"rules":     len(f.rules),
+		"rpz":       len(f.rpzZones),
+		"policies":  len(f.policies),
+		"upstreams": len(activeUpstreams()),
+		"log_level": logLevel.Load(),
+	})
+}
+
+// handleLogLevel serves POST /config/log_level {"level": "warn"}. The
+// change lasts until the next reload or restart.
+func handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Level string `json:"level"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	level, err := parseLogLevel(req.Level)
+	if err != nil || req.Level == "" {
+		http.Error(w, "level must be debug, info or warn", http.StatusBadRequest)
+		return
+	}
+	setLogLevel(level)
+	auditf(r, "log level set to %s", level)
+	writeJSON(w, http.StatusOK, map[string]string{"log_level": level})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A hosts_file may be an http:// or https:// URL, e.g. a raw file in a Git
+// repository or on an internal web server. It is fetched at startup and
+// then every poll_freq seconds with If-None-Match and If-Modified-Since, so
+// an unchanged zone costs a 304; a changed one replaces the records in one
+// swap, and a failed fetch keeps the records being served. $INCLUDE is not
+// available in a remote zone, and write_back and backup need a local file.
+
+// maxRemoteZoneSize bounds a fetched zone.
+const maxRemoteZoneSize = 64 << 20
+
+var remoteZoneClient = &http.Client{Timeout: 30 * time.Second}
+
+// remoteValidators are the cache validators of the last fetch that
+// changed the zone.
+var remoteValidators struct {
+	sync.Mutex
+	etag, lastModified string
+}
+
+// isRemoteZone reports whether path is a URL rather than a file.
+func isRemoteZone(path string) bool {
+	return strings.HasPrefix(path, "https://") || strings.HasPrefix(path, "http://")
+}
+
+// fetchRemoteZone fetches and parses a remote zone. When conditional is
+// set and the server says the zone hasn't changed since the last fetch, it
+// returns nil records and no error.
+func fetchRemoteZone(url string, zs zoneSyntax, conditional bool) (map[string][]Record, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "micro-dns")
+	remoteValidators.Lock()
+	if conditional {
+		if remoteValidators.etag != "" {
+			req.Header.Set("If-None-Match", remoteValidators.etag)
+		}
+		if remoteValidators.lastModified != "" {
+			req.Header.Set("If-Modified-Since", remoteValidators.lastModified)
+		}
+	}
+	remoteValidators.Unlock()
+
+	resp, err := remoteZoneClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && conditional {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRemoteZoneSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", url, err)
+	}
+	if len(body) > maxRemoteZoneSize {
+		return nil, fmt.Errorf("%s: zone is larger than %d bytes", url, maxRemoteZoneSize)
+	}
+	// A reload keeps the zone in service unless the new one parses whole.
+	zr := &zoneReader{zs: zs, vars: make(map[string]string), recs: make(map[string][]Record), strict: conditional}
+	if err := zr.readFrom(url, bytes.NewReader(body)); err != nil {
+		return nil, err
+	}
+	if zr.failed != nil {
+		return nil, zr.failed
+	}
+	// Validators are kept only for a zone that parsed, so a broken one is
+	// fetched again in full rather than reported unchanged.
+	remoteValidators.Lock()
+	remoteValidators.etag = resp.Header.Get("ETag")
+	remoteValidators.lastModified = resp.Header.Get("Last-Modified")
+	remoteValidators.Unlock()
+	return zr.recs, nil
+}
+
+// reloadRemoteZone re-fetches a remote hosts_file and installs it if it
+// changed.
+func reloadRemoteZone() {
+	zoneFileMu.Lock()
+	defer zoneFileMu.Unlock()
+	recs, err := fetchRemoteZone(config.HostsFile, hostsFileSyntax(), true)
+	zoneLoadFailed.Store(err != nil)
+	if err != nil {
+		lastZoneReload.Store(&zoneReloadStatus{Time: time.Now(), Error: err.Error(), Records: countRecords(records.source(sourceZone))})
+		log.Printf("Failed to reload zone from %s, still serving the last good zone: %v", config.HostsFile, err)
+		return
+	}
+	if recs == nil {
+		return
+	}
+	installReloaded(recs, config.HostsFile)
+}
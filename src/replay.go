@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// replayQuery is one query read from a log or capture.
+type replayQuery struct {
+	at    time.Time
+	name  string
+	qtype uint16
+}
+
+type replayResult struct {
+	rcode   int
+	answers []string
+	rtt     time.Duration
+	err     error
+}
+
+// runReplay implements "micro-dns replay": it re-sends the queries of a
+// query log or pcap to a server, at the original pace or faster, and
+// reports latency and rcodes. With -compare every query also goes to a
+// second server and differing answers are printed.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	target := fs.String("target", "127.0.0.1:53", "Server to replay against")
+	compare := fs.String("compare", "", "Second server whose answers are compared")
+	format := fs.String("format", "auto", "Input format: auto, log, json or pcap")
+	speed := fs.Float64("speed", 1, "Pace multiplier; 0 sends as fast as possible")
+	workers := fs.Int("workers", 64, "Maximum queries in flight")
+	timeout := fs.Duration("timeout", 2*time.Second, "Per-query timeout")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: micro-dns replay [flags] <query log | pcap>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	queries, err := readReplayInput(fs.Arg(0), *format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+		return 1
+	}
+	if len(queries) == 0 {
+		fmt.Fprintln(os.Stderr, "replay: no queries found")
+		return 1
+	}
+	fmt.Printf("Replaying %d queries against %s\n", len(queries), *target)
+
+	client := &dns.Client{Net: "udp", Timeout: *timeout}
+	exchange := func(server string, q replayQuery) replayResult {
+		m := new(dns.Msg)
+		m.SetQuestion(dns.Fqdn(q.name), q.qtype)
+		resp, rtt, err := client.Exchange(m, server)
+		if err != nil {
+			return replayResult{err: err, rtt: rtt}
+		}
+		res := replayResult{rcode: resp.Rcode, rtt: rtt}
+		for _, rr := range resp.Answer {
+			rr.Header().Ttl = 0
+			res.answers = append(res.answers, rr.String())
+		}
+		sort.Strings(res.answers)
+		return res
+	}
+
+	var (
+		mu        sync.Mutex
+		results   []replayResult
+		mismatch  int
+		wg        sync.WaitGroup
+		sem       = make(chan struct{}, *workers)
+		start     = time.Now()
+		firstSeen = queries[0].at
+	)
+	for _, q := range queries {
+		if *speed > 0 && !q.at.IsZero() && !firstSeen.IsZero() {
+			due := start.Add(time.Duration(float64(q.at.Sub(firstSeen)) / *speed))
+			time.Sleep(time.Until(due))
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(q replayQuery) {
+			defer func() { <-sem; wg.Done() }()
+			res := exchange(*target, q)
+			var diff string
+			if *compare != "" {
+				other := exchange(*compare, q)
+				diff = replayDiff(res, other)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			results = append(results, res)
+			if diff != "" {
+				mismatch++
+				fmt.Printf("MISMATCH %s %s: %s\n", q.name, dns.TypeToString[q.qtype], diff)
+			}
+		}(q)
+	}
+	wg.Wait()
+
+	printReplaySummary(results, time.Since(start))
+	if *compare != "" {
+		fmt.Printf("Mismatches against %s: %d\n", *compare, mismatch)
+		if mismatch > 0 {
+			return 1
+		}
+	}
+	return 0
+}
+
+func replayDiff(a, b replayResult) string {
+	switch {
+	case a.err != nil || b.err != nil:
+		if (a.err == nil) != (b.err == nil) {
+			return fmt.Sprintf("error %v vs %v", a.err, b.err)
+		}
+		return ""
+	case a.rcode != b.rcode:
+		return fmt.Sprintf("rcode %s vs %s", dns.RcodeToString[a.rcode], dns.RcodeToString[b.rcode])
+	case strings.Join(a.answers, "\n") != strings.Join(b.answers, "\n"):
+		return fmt.Sprintf("answers %q vs %q", a.answers, b.answers)
+	}
+	return ""
+}
+
+func printReplaySummary(results []replayResult, elapsed time.Duration) {
+	rcodes := make(map[string]int)
+	var rtts []time.Duration
+	failed := 0
+	for _, r := range results {
+		if r.err != nil {
+			failed++
+			continue
+		}
+		rcodes[dns.RcodeToString[r.rcode]]++
+		rtts = append(rtts, r.rtt)
+	}
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	pct := func(p float64) time.Duration {
+		if len(rtts) == 0 {
+			return 0
+		}
+		return rtts[int(p*float64(len(rtts)-1))]
+	}
+
+	fmt.Printf("Sent %d queries in %s (%.0f qps), %d failed\n",
+		len(results), elapsed.Round(time.Millisecond), float64(len(results))/elapsed.Seconds(), failed)
+	names := make([]string, 0, len(rcodes))
+	for name := range rcodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("  %-10s %d\n", name, rcodes[name])
+	}
+	fmt.Printf("Latency p50 %s, p90 %s, p99 %s, max %s\n", pct(0.5), pct(0.9), pct(0.99), pct(1))
+}
+
+// readReplayInput loads queries from path, detecting the format unless
+// one is given.
+func readReplayInput(path, format string) ([]replayQuery, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+
+	if format == "auto" {
+		head, _ := br.Peek(4)
+		switch {
+		case len(head) == 4 && isPcapMagic(head):
+			format = "pcap"
+		case len(head) > 0 && head[0] == '{':
+			format = "json"
+		default:
+			format = "log"
+		}
+	}
+	switch format {
+	case "pcap":
+		return readPcapQueries(br)
+	case "json":
+		return readJSONQueries(br)
+	case "log":
+		return readLogQueries(br)
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+// logQueryLine matches the server's own "Received query" log lines.
+var logQueryLine = regexp.MustCompile(`^(\d{4}/\d\d/\d\d \d\d:\d\d:\d\d(?:\.\d+)?) (?:\[\S*\] )?Received query: (\S+) (\S+)`)
+
+func readLogQueries(r io.Reader) ([]replayQuery, error) {
+	var out []replayQuery
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		m := logQueryLine.FindStringSubmatch(sc.Text())
+		if m == nil {
+			continue
+		}
+		qtype, ok := dns.StringToType[m[2]]
+		if !ok {
+			continue
+		}
+		at, _ := time.ParseInLocation("2006/01/02 15:04:05.999999", m[1], time.Local)
+		out = append(out, replayQuery{at: at, name: m[3], qtype: qtype})
+	}
+	return out, sc.Err()
+}
+
+// readJSONQueries reads one object per line with "name", "type" and an
+// optional "time" (RFC 3339).
+func readJSONQueries(r io.Reader) ([]replayQuery, error) {
+	var out []replayQuery
+	dec := json.NewDecoder(r)
+	for {
+		var line struct {
+			Time string `json:"time"`
+			Name string `json:"name"`
+			Type string `json:"type"`
+		}
+		if err := dec.Decode(&line); err == io.EOF {
+			break
+		} else if err != nil {
+			return out, err
+		}
+		qtype, ok := dns.StringToType[strings.ToUpper(line.Type)]
+		if !ok || line.Name == "" {
+			continue
+		}
+		at, _ := time.Parse(time.RFC3339Nano, line.Time)
+		out = append(out, replayQuery{at: at, name: line.Name, qtype: qtype})
+	}
+	return out, nil
+}
+
+func isPcapMagic(b []byte) bool {
+	switch binary.LittleEndian.Uint32(b) {
+	case 0xa1b2c3d4, 0xd4c3b2a1, 0xa1b23c4d, 0x4d3cb2a1:
+		return true
+	}
+	return false
+}
+
+// Link types understood by readPcapQueries.
+const (
+	linkNull     = 0
+	linkEthernet = 1
+	linkRaw      = 101
+	linkLinuxSLL = 113
+)
+
+// readPcapQueries extracts DNS queries sent over UDP from a classic pcap
+// file.
+func readPcapQueries(r io.Reader) ([]replayQuery, error) {
+	var hdr [24]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("pcap header: %v", err)
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	magic := order.Uint32(hdr[:4])
+	if magic == 0xd4c3b2a1 || magic == 0x4d3cb2a1 {
+		order = binary.BigEndian
+		magic = order.Uint32(hdr[:4])
+	}
+	nanos := magic == 0xa1b23c4d
+	link := order.Uint32(hdr[20:24])
+
+	var out []replayQuery
+	var rec [16]byte
+	for {
+		if _, err := io.ReadFull(r, rec[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return out, nil
+			}
+			return out, fmt.Errorf("pcap record: %v", err)
+		}
+		sec, frac := order.Uint32(rec[0:4]), order.Uint32(rec[4:8])
+		data := make([]byte, order.Uint32(rec[8:12]))
+		if _, err := io.ReadFull(r, data); err != nil {
+			return out, fmt.Errorf("pcap record: %v", err)
+		}
+		payload := udpPayload(link, data)
+		if payload == nil {
+			continue
+		}
+		m := new(dns.Msg)
+		if m.Unpack(payload) != nil || m.Response || len(m.Question) != 1 {
+			continue
+		}
+		ns := int64(frac) * 1000
+		if nanos {
+			ns = int64(frac)
+		}
+		q := m.Question[0]
+		out = append(out, replayQuery{at: time.Unix(int64(sec), ns), name: q.Name, qtype: q.Qtype})
+	}
+}
+
+// udpPayload returns the payload of a UDP datagram to port 53 in a frame
+// of the given link type, or nil.
+func udpPayload(link uint32, frame []byte) []byte {
+	var ip []byte
+	switch link {
+	case linkEthernet:
+		if len(frame) < 14 {
+			return nil
+		}
+		etherType, off := binary.BigEndian.Uint16(frame[12:14]), 14
+		if etherType == 0x8100 && len(frame) >= 18 { // VLAN tag
+			etherType, off = binary.BigEndian.Uint16(frame[16:18]), 18
+		}
+		ip = frame[off:]
+	case linkLinuxSLL:
+		if len(frame) < 16 {
+			return nil
+		}
+		ip = frame[16:]
+	case linkNull:
+		if len(frame) < 4 {
+			return nil
+		}
+		ip = frame[4:]
+	case linkRaw:
+		ip = frame
+	default:
+		return nil
+	}
+	if len(ip) < 1 {
+		return nil
+	}
+
+	var udp []byte
+	switch ip[0] >> 4 {
+	case 4:
+		ihl := int(ip[0]&0x0f) * 4
+		if len(ip) < ihl || ihl < 20 || ip[9] != 17 {
+			return nil
+		}
+		udp = ip[ihl:]
+	case 6:
+		if len(ip) < 40 || ip[6] != 17 { // no extension header support
+			return nil
+		}
+		udp = ip[40:]
+	default:
+		return nil
+	}
+	if len(udp) < 8 || binary.BigEndian.Uint16(udp[2:4]) != 53 {
+		return nil
+	}
+	return udp[8:]
+}
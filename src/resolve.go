@@ -0,0 +1,321 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// maxCNAMEChain bounds how many CNAMEs are followed for a single query.
+const maxCNAMEChain = 8
+
+// wireRR is a record's pre-built wire form: an empty owner name and the
+// record's own TTL, with the fields it was made from, so a record copied
+// out of the store and changed isn't answered with the old form.
+type wireRR struct {
+	rr   dns.RR
+	from Record
+}
+
+// current reports whether w was built from rec as it is now.
+func (w *wireRR) current(rec Record) bool {
+	f := &w.from
+	return f.Type == rec.Type && f.TTL == rec.TTL && f.Data == rec.Data && f.Pref == rec.Pref &&
+		f.SrvWeight == rec.SrvWeight && f.Port == rec.Port && slices.Equal(f.Strings, rec.Strings)
+}
+
+// recordToRR returns the wire record for rec owned by name. A record from
+// the store is copied from its pre-built form, sharing the rdata, which
+// must not be modified in place.
+func recordToRR(name string, rec Record) dns.RR {
+	if rec.wire == nil || !rec.wire.current(rec) {
+		rr := buildRR(name, rec)
+		if rr != nil {
+			rr.Header().Ttl = clampTTL(rec.TTL, config.MinTTL, config.MaxTTL)
+		}
+		return rr
+	}
+	var rr dns.RR
+	switch w := rec.wire.rr.(type) {
+	case *dns.A:
+		c := *w
+		rr = &c
+	case *dns.AAAA:
+		c := *w
+		rr = &c
+	case *dns.CNAME:
+		c := *w
+		rr = &c
+	case *dns.PTR:
+		c := *w
+		rr = &c
+	case *dns.NS:
+		c := *w
+		rr = &c
+	case *dns.TXT:
+		c := *w
+		rr = &c
+	case *dns.MX:
+		c := *w
+		rr = &c
+	case *dns.SRV:
+		c := *w
+		rr = &c
+	default:
+		rr = dns.Copy(w)
+	}
+	h := rr.Header()
+	h.Name = name
+	h.Ttl = clampTTL(h.Ttl, config.MinTTL, config.MaxTTL)
+	return rr
+}
+
+// prepareRecords builds the wire form of the records in recs that lack a
+// current one, so answering doesn't parse addresses or rdata per query.
+// Records already published have theirs and aren't written to.
+func prepareRecords(recs map[string][]Record) {
+	for _, list := range recs {
+		for i := range list {
+			rec := &list[i]
+			if rec.wire != nil && rec.wire.current(*rec) {
+				continue
+			}
+			if rr := buildRR("", *rec); rr != nil {
+				from := *rec
+				from.wire = nil
+				rec.wire = &wireRR{rr: rr, from: from}
+			}
+		}
+	}
+}
+
+// rrtype returns the record's type code.
+func (rec Record) rrtype() uint16 {
+	if rec.wire != nil && rec.wire.from.Type == rec.Type {
+		return rec.wire.rr.Header().Rrtype
+	}
+	return dns.StringToType[rec.Type]
+}
+
+// buildRR makes the wire record for rec owned by name, with its own TTL.
+func buildRR(name string, rec Record) dns.RR {
+	switch rec.Type {
+	case "A":
+		return &dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: rec.TTL},
+			A:   net.ParseIP(rec.Data).To4(),
+		}
+	case "AAAA":
+		return &dns.AAAA{
+			Hdr:  dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: rec.TTL},
+			AAAA: net.ParseIP(rec.Data),
+		}
+	case "CNAME":
+		return &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: rec.TTL},
+			Target: rec.Data,
+		}
+	case "PTR":
+		return &dns.PTR{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: rec.TTL},
+			Ptr: rec.Data,
+		}
+	case "NS":
+		return &dns.NS{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: rec.TTL},
+			Ns:  rec.Data,
+		}
+	case "TXT":
+		txt := rec.Strings
+		if txt == nil {
+			txt = []string{rec.Data}
+		}
+		return &dns.TXT{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: rec.TTL},
+			Txt: txt,
+		}
+	case "MX":
+		return &dns.MX{
+			Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeMX, Class: dns.ClassINET, Ttl: rec.TTL},
+			Preference: rec.Pref,
+			Mx:         rec.Data,
+		}
+	case "SRV":
+		return &dns.SRV{
+			Hdr:      dns.RR_Header{Name: name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: rec.TTL},
+			Priority: rec.Pref,
+			Weight:   rec.SrvWeight,
+			Port:     rec.Port,
+			Target:   rec.Data,
+		}
+	}
+	if rdataTypes[rec.Type] {
+		return rdataToRR(name, rec)
+	}
+	return nil
+}
+
+// resolveLocal answers qname/qtype from the local records, following CNAMEs
+// through the zone. If the chain leaves the zone, the unresolved target is
+// returned so the caller can decide whether to chase it upstream. store is
+// the record set of the listener the query came in on, and loc where
+// GeoIP places the client.
+func resolveLocal(store *recordStore, qname string, qtype uint16, loc geoLocation) (answers []dns.RR, external string) {
+	owner := qname
+	var seen [maxCNAMEChain + 1]string
+
+	for depth := 0; depth <= maxCNAMEChain; depth++ {
+		key := dns.Fqdn(strings.ToLower(owner))
+		if slices.Contains(seen[:depth], key) {
+			log.Printf("CNAME loop detected at %s while resolving %s", owner, qname)
+			return answers, ""
+		}
+		seen[depth] = key
+
+		recs := store.lookup(key)
+		if len(recs) == 0 {
+			if depth > 0 {
+				return answers, owner
+			}
+			return nil, ""
+		}
+
+		// Usually every record is of the queried type, or a CNAME;
+		// then recs is used as is instead of copied.
+		var cnames, matches []Record
+		n, nc := 0, 0
+		for _, rec := range recs {
+			switch rec.rrtype() {
+			case qtype:
+				n++
+			case dns.TypeCNAME:
+				nc++
+			}
+		}
+		switch {
+		case n == len(recs):
+			matches = recs
+		case nc == len(recs):
+			cnames = recs
+		default:
+			for _, rec := range recs {
+				if t := rec.rrtype(); t == qtype {
+					matches = append(matches, rec)
+				} else if t == dns.TypeCNAME {
+					cnames = append(cnames, rec)
+				}
+			}
+		}
+		if len(matches) > 0 {
+			matches = limitAnswers(key, qtype, orderAnswers(key, pickVariant(key, loc.client, pickGeo(pickSplit(key, filterHealthy(key, matches)), loc))))
+			if answers == nil {
+				answers = make([]dns.RR, 0, len(matches))
+			}
+			for _, rec := range matches {
+				answers = append(answers, recordToRR(owner, rec))
+			}
+			return answers, ""
+		}
+		if len(cnames) == 0 {
+			return answers, ""
+		}
+
+		// Several CNAMEs only make sense as GeoIP alternatives.
+		cnames = pickGeo(cnames, loc)
+		cname := cnames[len(cnames)-1]
+		answers = append(answers, recordToRR(owner, cname))
+		owner = cname.Data
+	}
+
+	log.Printf("CNAME chain for %s exceeds %d hops", qname, maxCNAMEChain)
+	return answers, ""
+}
+
+// chaseExternal resolves a CNAME target that lies outside the local zone
+// through the fallback server.
+func chaseExternal(target string, qtype uint16) []dns.RR {
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(target), qtype)
+	resp, err := forwardToFallback(q)
+	if err != nil {
+		log.Printf("Failed to chase CNAME target %s: %v", target, err)
+		return nil
+	}
+	return resp.Answer
+}
+
+// pickVariant chooses which records of name's RRset to serve. Records
+// carrying a canary percentage are each served to that share of clients;
+// the remaining clients get the base records, or every record when all
+// are canaries. A client keeps its variant: its network (/24 or /56) and
+// the name pick its share. Without a client each query draws at random.
+func pickVariant(name string, client net.IP, recs []Record) []Record {
+	if !slices.ContainsFunc(recs, func(rec Record) bool { return rec.Canary > 0 }) {
+		return recs
+	}
+	var base []Record
+	total := 0
+	for _, rec := range recs {
+		if rec.Canary > 0 {
+			total += rec.Canary
+		} else {
+			base = append(base, rec)
+		}
+	}
+	if total == 0 {
+		return recs
+	}
+
+	roll := canaryBucket(name, client)
+	for _, rec := range recs {
+		if rec.Canary == 0 {
+			continue
+		}
+		if roll < rec.Canary {
+			return []Record{rec}
+		}
+		roll -= rec.Canary
+	}
+	if len(base) == 0 {
+		return recs
+	}
+	return base
+}
+
+// checkCanaries rejects canary percentages for one of name's types that
+// add up to more than 100: the variants listed last would get less than
+// their share, or nobody at all.
+func checkCanaries(name string, recs []Record) error {
+	totals := make(map[string]int)
+	for _, rec := range recs {
+		totals[rec.Type] += rec.Canary
+	}
+	for _, rec := range recs {
+		if total := totals[rec.Type]; total > 100 {
+			return fmt.Errorf("%s %s: canary percentages add up to %d%%", name, rec.Type, total)
+		}
+	}
+	return nil
+}
+
+// canaryBucket places client's network in one of 100 buckets for name.
+func canaryBucket(name string, client net.IP) int {
+	if client == nil {
+		return rand.IntN(100)
+	}
+	if v4 := client.To4(); v4 != nil {
+		client = v4.Mask(net.CIDRMask(24, 32))
+	} else {
+		client = client.Mask(net.CIDRMask(56, 128))
+	}
+	h := fnv.New32a()
+	h.Write(client)
+	h.Write([]byte(name))
+	return int(h.Sum32() % 100)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestPickVariantSticky(t *testing.T) {
+	recs := []Record{
+		{Type: "A", Data: "10.0.0.10"},
+		{Type: "A", Data: "10.0.0.20", Canary: 10},
+	}
+	canaries := 0
+	const clients = 2000
+	for i := 0; i < clients; i++ {
+		client := net.IPv4(10, byte(i>>8), byte(i), 1)
+		first := pickVariant("app.local.", client, recs)
+		for j := 0; j < 5; j++ {
+			// Another host in the same /24 gets the same variant.
+			neighbor := net.IPv4(10, byte(i>>8), byte(i), byte(2+j))
+			if got := pickVariant("app.local.", neighbor, recs); len(got) != len(first) || got[0].Data != first[0].Data {
+				t.Fatalf("%s got %v, then %s got %v", client, first, neighbor, got)
+			}
+		}
+		if first[0].Canary > 0 {
+			canaries++
+		}
+	}
+	if share := canaries * 100 / clients; share < 7 || share > 13 {
+		t.Errorf("%d%% of client networks got the 10%% canary", share)
+	}
+}
+
+func TestPrepareRecords(t *testing.T) {
+	old := *config
+	t.Cleanup(func() { *config = old })
+	config.MinTTL, config.MaxTTL = 0, 0
+
+	s := newRecordStore()
+	s.setSource(sourceZone, map[string][]Record{
+		"mail.local.": {{Type: "MX", TTL: 60, Data: "mx.local.", Pref: 10}},
+	})
+	rec := s.lookup("mail.local.")[0]
+	if rec.wire == nil {
+		t.Fatal("record reached the store without a wire form")
+	}
+	rr := recordToRR("MAIL.local.", rec)
+	mx, ok := rr.(*dns.MX)
+	if !ok || mx.Hdr.Name != "MAIL.local." || mx.Preference != 10 || mx.Mx != "mx.local." || mx.Hdr.Ttl != 60 {
+		t.Fatalf("built %v", rr)
+	}
+	// The copy handed out must not alias the pre-built header.
+	mx.Hdr.Ttl = 1
+	if again := recordToRR("mail.local.", rec); again.Header().Ttl != 60 {
+		t.Error("changing an answer changed the pre-built record")
+	}
+
+	// A record changed after it was prepared is rebuilt, not served stale.
+	rec.Data = "mx2.local."
+	if got := recordToRR("mail.local.", rec).(*dns.MX).Mx; got != "mx2.local." {
+		t.Errorf("changed record served as %s", got)
+	}
+
+	// TTL clamps apply to pre-built records too.
+	config.MinTTL = 120
+	if ttl := recordToRR("mail.local.", s.lookup("mail.local.")[0]).Header().Ttl; ttl != 120 {
+		t.Errorf("TTL %d under min_ttl 120", ttl)
+	}
+}
+
+func TestPickVariantAllCanaries(t *testing.T) {
+	recs := []Record{
+		{Type: "A", Data: "10.0.0.20", Canary: 10},
+		{Type: "A", Data: "10.0.0.30", Canary: 20},
+	}
+	for i := 0; i < 500; i++ {
+		got := pickVariant("app.local.", net.IPv4(10, byte(i>>8), byte(i), 1), recs)
+		if len(got) == 0 {
+			t.Fatal("client outside every canary got no records")
+		}
+	}
+
+	if err := checkCanaries("app.local.", recs); err != nil {
+		t.Error(err)
+	}
+	over := append(recs, Record{Type: "A", Data: "10.0.0.40", Canary: 80})
+	if err := checkCanaries("app.local.", over); err == nil {
+		t.Error("canary shares adding up to 110% accepted")
+	}
+	// Shares are per type.
+	mixed := append(recs, Record{Type: "AAAA", Data: "fd00::1", Canary: 80})
+	if err := checkCanaries("app.local.", mixed); err != nil {
+		t.Error(err)
+	}
+
+	dir := writeZoneFiles(t, map[string]string{"zone.txt": `app.local. 60 IN A 10.0.0.10 canary=60
+app.local. 60 IN A 10.0.0.20 canary=60
+`})
+	if _, err := loadZoneFileIn(filepath.Join(dir, "zone.txt"), zoneSyntax{}); err == nil {
+		t.Error("zone with 120% of canaries loaded")
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !unix || solaris
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+const reusePortSupported = false
+
+func reusePort(network, address string, c syscall.RawConn) error {
+	return fmt.Errorf("SO_REUSEPORT is not supported on this platform")
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RPZConfig is one response policy zone, as published by threat
+// intelligence feeds, read from a master-format file. Each name under the
+// policy zone's origin is a trigger for the same name outside it
+// ("bad.example.rpz.example." matches bad.example, "*.bad.example..." its
+// subdomains) and its records say what to do:
+//
+//   - CNAME .              NXDOMAIN
+//   - CNAME *.             NODATA
+//   - CNAME rpz-passthru.  answer normally (an allow list entry)
+//   - CNAME rpz-drop.      no response at all
+//   - CNAME rpz-tcp-only.  truncated over UDP, so the client retries on TCP
+//   - anything else        answered instead of the real data, e.g. a CNAME
+//     to a walled garden
+//
+// Policies apply before rules, local records and forwarding. Zones are
+// consulted in order and the first with a trigger for the name decides;
+// within a zone an exact trigger beats a wildcard. IP, NSDNAME and
+// client-IP triggers are not supported and are counted as skipped. Files
+// are reloaded when they change.
+type RPZConfig struct {
+	Name     string              `yaml:"name"` // the policy zone's origin, e.g. rpz.example
+	File     string              `yaml:"file"`
+	Response BlockResponseConfig `yaml:"response"` // default: block_response
+}
+
+type rpzAction int
+
+const (
+	rpzNXDomain rpzAction = iota
+	rpzNoData
+	rpzPassthru
+	rpzDrop
+	rpzTCPOnly
+	rpzLocalData
+)
+
+var rpzActionNames = map[rpzAction]string{
+	rpzNXDomain: "NXDOMAIN", rpzNoData: "NODATA", rpzPassthru: "PASSTHRU",
+	rpzDrop: "DROP", rpzTCPOnly: "TCP-only", rpzLocalData: "local data",
+}
+
+// rpzSpecialTargets are the CNAME targets that name an action.
+var rpzSpecialTargets = map[string]rpzAction{
+	".":             rpzNXDomain,
+	"*.":            rpzNoData,
+	"rpz-passthru.": rpzPassthru,
+	"rpz-drop.":     rpzDrop,
+	"rpz-tcp-only.": rpzTCPOnly,
+}
+
+type rpzPolicy struct {
+	action rpzAction
+	rrs    []dns.RR // local data, owned by the trigger
+}
+
+// rpzRules is the parsed content of one policy zone file.
+type rpzRules struct {
+	exact   map[string]*rpzPolicy
+	wild    map[string]*rpzPolicy // by the name below "*."
+	skipped int
+}
+
+type rpzZone struct {
+	RPZConfig
+	origin   string
+	rules    atomic.Pointer[rpzRules]
+	hits     atomic.Uint64
+	mtime    time.Time
+	policies map[*policy]bool // nil: for every client
+	block    *blockResponse   // nil: as the zone says
+}
+
+func (f *filterSet) loadRPZ(c *Config) error {
+	block, err := parseBlockResponse("block_response", c.BlockResponse)
+	if err != nil {
+		return err
+	}
+	for i, cfg := range c.RPZ {
+		if cfg.Name == "" || cfg.File == "" {
+			return fmt.Errorf("rpz[%d]: name and file are required", i)
+		}
+		z := &rpzZone{RPZConfig: cfg, origin: dns.CanonicalName(cfg.Name), block: block}
+		if cfg.Response.Style != "" || len(cfg.Response.IPs) > 0 {
+			if z.block, err = parseBlockResponse(fmt.Sprintf("rpz[%d].response", i), cfg.Response); err != nil {
+				return err
+			}
+		}
+		if err := z.load(); err != nil {
+			return fmt.Errorf("rpz %s: %v", z.origin, err)
+		}
+		f.rpzZones = append(f.rpzZones, z)
+	}
+	return nil
+}
+
+func (z *rpzZone) load() error {
+	info, err := os.Stat(z.File)
+	if err != nil {
+		return err
+	}
+	rules, err := readRPZ(z.File, z.origin)
+	if err != nil {
+		return err
+	}
+	z.rules.Store(rules)
+	z.mtime = info.ModTime()
+	msg := fmt.Sprintf("Loaded policy zone %s: %d trigger(s)", z.origin, len(rules.exact)+len(rules.wild))
+	if rules.skipped > 0 {
+		msg += fmt.Sprintf(", %d unsupported record(s) skipped", rules.skipped)
+	}
+	log.Print(msg)
+	return nil
+}
+
+// watchRPZ reloads policy zone files as they change. A file that fails to
+// parse leaves the previous policies in force.
+func watchRPZ() {
+	for {
+		time.Sleep(time.Duration(config.PollFreq) * time.Second)
+		for _, z := range activeFilters().rpzZones {
+			if info, err := os.Stat(z.File); err == nil && info.ModTime().After(z.mtime) {
+				if err := z.load(); err != nil {
+					log.Printf("Failed to reload policy zone %s: %v", z.origin, err)
+					z.mtime = info.ModTime()
+				}
+			}
+		}
+	}
+}
+
+func readRPZ(path, origin string) (*rpzRules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rules := &rpzRules{exact: make(map[string]*rpzPolicy), wild: make(map[string]*rpzPolicy)}
+	zp := dns.NewZoneParser(f, origin, path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		owner := dns.CanonicalName(rr.Header().Name)
+		if owner == origin || !dns.IsSubDomain(origin, owner) {
+			continue // the SOA and NS records, or stray data
+		}
+		trigger := strings.TrimSuffix(owner, origin)
+		labels := dns.SplitDomainName(trigger)
+		if strings.HasPrefix(labels[len(labels)-1], "rpz-") {
+			rules.skipped++ // rpz-ip, rpz-nsdname, rpz-client-ip ...
+			continue
+		}
+		set := rules.exact
+		if rest, ok := strings.CutPrefix(trigger, "*."); ok {
+			set, trigger = rules.wild, rest
+		}
+		p := set[trigger]
+		if p == nil {
+			p = &rpzPolicy{action: rpzLocalData}
+			set[trigger] = p
+		}
+		if cname, ok := rr.(*dns.CNAME); ok {
+			if action, special := rpzSpecialTargets[dns.CanonicalName(cname.Target)]; special {
+				p.action, p.rrs = action, nil
+				continue
+			}
+		}
+		if p.action == rpzLocalData {
+			p.rrs = append(p.rrs, rr)
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// rpzMatch returns the policy for name (lowercase, fully qualified) asked
+// by a client of pol and the zone it comes from, or nil.
+func rpzMatch(name string, pol *policy) (*rpzPolicy, *rpzZone) {
+	for _, z := range activeFilters().rpzZones {
+		if !policyApplies(z.policies, pol) {
+			continue
+		}
+		rules := z.rules.Load()
+		if p := rules.exact[name]; p != nil {
+			return p, z
+		}
+		for i, end := dns.NextLabel(name, 0); !end; i, end = dns.NextLabel(name, i) {
+			if p := rules.wild[name[i:]]; p != nil {
+				return p, z
+			}
+		}
+	}
+	return nil, nil
+}
+
+// localData returns the policy's records for q, under the queried name. A
+// CNAME answers every type.
+func (p *rpzPolicy) localData(q dns.Question) []dns.RR {
+	var out []dns.RR
+	for _, rr := range p.rrs {
+		t := rr.Header().Rrtype
+		if t == q.Qtype || q.Qtype == dns.TypeANY || t == dns.TypeCNAME {
+			rr = dns.Copy(rr)
+			rr.Header().Name = q.Name
+			rr.Header().Ttl = clampTTL(rr.Header().Ttl, config.MinTTL, config.MaxTTL)
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+// rpzChase resolves a walled-garden CNAME target: from the local records
+// if it is there, else through the fallback when the client may recurse.
+func rpzChase(store *recordStore, target string, qtype uint16, loc geoLocation, recursion bool) []dns.RR {
+	if len(store.lookup(dns.CanonicalName(target))) > 0 {
+		answers, _ := resolveLocal(store, target, qtype, loc)
+		return answers
+	}
+	if recursion {
+		return chaseExternal(target, qtype)
+	}
+	return nil
+}
+
+type rpzReport struct {
+	Zone     string `json:"zone"`
+	Triggers int    `json:"triggers"`
+	Skipped  int    `json:"skipped"`
+	Hits     uint64 `json:"hits"`
+}
+
+func rpzReports() []rpzReport {
+	var out []rpzReport
+	for _, z := range activeFilters().rpzZones {
+		rules := z.rules.Load()
+		out = append(out, rpzReport{Zone: z.origin, Triggers: len(rules.exact) + len(rules.wild), Skipped: rules.skipped, Hits: z.hits.Load()})
+	}
+	return out
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testRPZ = `$TTL 300
+@                         SOA  ns.rpz.example. hostmaster.rpz.example. 1 3600 600 86400 60
+@                         NS   ns.rpz.example.
+bad.example               CNAME .
+*.bad.example             CNAME *.
+good.bad.example          CNAME rpz-passthru.
+drop.example              CNAME rpz-drop.
+tcp.example               CNAME rpz-tcp-only.
+garden.example            CNAME walled.garden.
+landing.example           A    192.0.2.80
+landing.example           AAAA 2001:db8::80
+32.1.2.0.192.rpz-ip       CNAME .
+ns.evil.rpz-nsdname       CNAME .
+`
+
+// withFilters installs f for the test.
+func withFilters(t *testing.T, f *filterSet) {
+	old := filters.Load()
+	filters.Store(f)
+	t.Cleanup(func() { filters.Store(old) })
+}
+
+func TestRPZ(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rpz.zone")
+	if err := os.WriteFile(path, []byte(testRPZ), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f := &filterSet{}
+	if err := f.loadRPZ(&Config{RPZ: []RPZConfig{{Name: "rpz.example", File: path}}}); err != nil {
+		t.Fatal(err)
+	}
+	withFilters(t, f)
+
+	rules := f.rpzZones[0].rules.Load()
+	if rules.skipped != 2 {
+		t.Errorf("%d IP/NSDNAME triggers skipped, want 2", rules.skipped)
+	}
+	tests := []struct {
+		name   string
+		action rpzAction
+		match  bool
+	}{
+		{"bad.example.", rpzNXDomain, true},
+		{"www.bad.example.", rpzNoData, true},
+		{"a.b.bad.example.", rpzNoData, true},
+		{"good.bad.example.", rpzPassthru, true},
+		{"drop.example.", rpzDrop, true},
+		{"tcp.example.", rpzTCPOnly, true},
+		{"garden.example.", rpzLocalData, true},
+		{"landing.example.", rpzLocalData, true},
+		{"www.drop.example.", 0, false},
+		{"example.", 0, false},
+		{"notbad.example.", 0, false},
+	}
+	for _, tt := range tests {
+		p, z := rpzMatch(tt.name, nil)
+		if (p != nil) != tt.match {
+			t.Errorf("%s: matched %v", tt.name, p != nil)
+			continue
+		}
+		if p != nil && (p.action != tt.action || z.origin != "rpz.example.") {
+			t.Errorf("%s: %s from %s, want %s", tt.name, rpzActionNames[p.action], z.origin, rpzActionNames[tt.action])
+		}
+	}
+
+	p, _ := rpzMatch("landing.example.", nil)
+	got := p.localData(dns.Question{Name: "Landing.Example.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET})
+	if len(got) != 1 || got[0].Header().Name != "Landing.Example." || got[0].(*dns.AAAA).AAAA.String() != "2001:db8::80" {
+		t.Errorf("AAAA local data %v", got)
+	}
+	if got := p.localData(dns.Question{Name: "landing.example.", Qtype: dns.TypeMX, Qclass: dns.ClassINET}); len(got) != 0 {
+		t.Errorf("MX local data %v", got)
+	}
+	p, _ = rpzMatch("garden.example.", nil)
+	if got := p.localData(dns.Question{Name: "garden.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}); len(got) != 1 || got[0].(*dns.CNAME).Target != "walled.garden." {
+		t.Errorf("CNAME local data %v", got)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// RuleConfig overrides answers for matching names without touching the
+// zone. A rule matches a query name by glob (Names) or regular expression
+// (Regex), optionally only for some clients, and then does any of:
+//
+//   - answer: serve these addresses for A/AAAA and NODATA otherwise
+//     (e.g. 0.0.0.0 for telemetry hosts)
+//   - rewrite_to: answer from another name, under the queried name
+//     (qname rewrite, CNAME flattening)
+//   - strip_aaaa: answer AAAA queries with NODATA
+//   - min_ttl/max_ttl: clamp the TTLs of the final answer
+//
+// The first matching rule applies. Name is for policies to refer to.
+type RuleConfig struct {
+	Name      string   `yaml:"name"`
+	Names     []string `yaml:"names"` // globs, e.g. "*.telemetry.example"
+	Regex     string   `yaml:"regex"`
+	Clients   []string `yaml:"clients"` // CIDRs; empty matches every client
+	Answer    []string `yaml:"answer"`
+	RewriteTo string   `yaml:"rewrite_to"`
+	StripAAAA bool     `yaml:"strip_aaaa"`
+	NXDomain  bool     `yaml:"nxdomain"`
+	TTL       uint32   `yaml:"ttl"` // of answer records, default 60
+	MinTTL    uint32   `yaml:"min_ttl"`
+	MaxTTL    uint32   `yaml:"max_ttl"`
+}
+
+type rule struct {
+	RuleConfig
+	names    []string
+	re       *regexp.Regexp
+	clients  []*net.IPNet
+	v4, v6   []net.IP
+	target   string
+	policies map[*policy]bool // nil: for every client
+}
+
+func (f *filterSet) loadRules(c *Config) error {
+	named := make(map[string]bool)
+	for i, cfg := range c.Rules {
+		key := fmt.Sprintf("rules[%d]", i)
+		if cfg.Name != "" && named[cfg.Name] {
+			return fmt.Errorf("%s: duplicate rule name %q", key, cfg.Name)
+		}
+		named[cfg.Name] = true
+		r := &rule{RuleConfig: cfg}
+		for _, n := range cfg.Names {
+			glob := dns.Fqdn(strings.ToLower(n))
+			if _, err := path.Match(glob, ""); err != nil {
+				return fmt.Errorf("%s.names: %v", key, err)
+			}
+			r.names = append(r.names, glob)
+		}
+		if cfg.Regex != "" {
+			re, err := regexp.Compile(cfg.Regex)
+			if err != nil {
+				return fmt.Errorf("%s.regex: %v", key, err)
+			}
+			r.re = re
+		}
+		if len(r.names) == 0 && r.re == nil {
+			return fmt.Errorf("%s: names or regex is required", key)
+		}
+		var err error
+		if r.clients, err = parseCIDRs(key+".clients", cfg.Clients); err != nil {
+			return err
+		}
+		for _, a := range cfg.Answer {
+			ip := net.ParseIP(a)
+			switch {
+			case ip == nil:
+				return fmt.Errorf("%s.answer: %q is not an IP address", key, a)
+			case ip.To4() != nil:
+				r.v4 = append(r.v4, ip.To4())
+			default:
+				r.v6 = append(r.v6, ip)
+			}
+		}
+		if cfg.RewriteTo != "" {
+			if len(cfg.Answer) > 0 {
+				return fmt.Errorf("%s: answer and rewrite_to are exclusive", key)
+			}
+			r.target = dns.Fqdn(strings.ToLower(cfg.RewriteTo))
+			if _, ok := dns.IsDomainName(r.target); !ok {
+				return fmt.Errorf("%s.rewrite_to: invalid name %q", key, cfg.RewriteTo)
+			}
+		}
+		if cfg.MaxTTL > 0 && cfg.MinTTL > cfg.MaxTTL {
+			return fmt.Errorf("%s: min_ttl is above max_ttl", key)
+		}
+		if cfg.NXDomain && (len(cfg.Answer) > 0 || r.target != "") {
+			return fmt.Errorf("%s: nxdomain excludes answer and rewrite_to", key)
+		}
+		if len(cfg.Answer) == 0 && r.target == "" && !cfg.StripAAAA && !cfg.NXDomain && cfg.MinTTL == 0 && cfg.MaxTTL == 0 {
+			return fmt.Errorf("%s: no action (answer, rewrite_to, strip_aaaa, nxdomain, min_ttl or max_ttl)", key)
+		}
+		if r.TTL == 0 {
+			r.TTL = 60
+		}
+		f.rules = append(f.rules, r)
+	}
+	if len(f.rules) > 0 {
+		log.Printf("Loaded %d answer rule(s)", len(f.rules))
+	}
+	return nil
+}
+
+// matchRule returns the first rule for name (lowercase, fully qualified)
+// asked by client, a client of pol, or nil.
+func matchRule(name string, client net.IP, pol *policy) *rule {
+	for _, r := range activeFilters().rules {
+		if len(r.clients) > 0 && (client == nil || !onNetworks(client, r.clients)) {
+			continue
+		}
+		if !policyApplies(r.policies, pol) {
+			continue
+		}
+		for _, glob := range r.names {
+			if ok, _ := path.Match(glob, name); ok {
+				return r
+			}
+		}
+		if r.re != nil && r.re.MatchString(name) {
+			return r
+		}
+	}
+	return nil
+}
+
+// intercepts reports whether the rule answers q itself.
+func (r *rule) intercepts(q dns.Question) bool {
+	return len(r.v4)+len(r.v6) > 0 || r.target != "" || r.NXDomain || (r.StripAAAA && q.Qtype == dns.TypeAAAA)
+}
+
+// answer fills m for q according to the rule. recursion says whether a
+// rewrite target outside the local records may be looked up upstream.
+func (r *rule) answer(m *dns.Msg, q dns.Question, store *recordStore, recursion bool, loc geoLocation) {
+	switch {
+	case r.NXDomain:
+		m.Rcode = dns.RcodeNameError
+	case r.StripAAAA && q.Qtype == dns.TypeAAAA:
+		// NODATA
+	case len(r.v4)+len(r.v6) > 0:
+		hdr := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: r.TTL}
+		switch q.Qtype {
+		case dns.TypeA:
+			hdr.Rrtype = dns.TypeA
+			for _, ip := range r.v4 {
+				m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: ip})
+			}
+		case dns.TypeAAAA:
+			hdr.Rrtype = dns.TypeAAAA
+			for _, ip := range r.v6 {
+				m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+	case r.target != "":
+		m.Answer = append(m.Answer, r.rewrite(m, q, store, recursion, loc)...)
+	}
+}
+
+// rewrite resolves the rule's target and returns its records of the
+// queried type under the queried name, dropping the CNAMEs in between.
+func (r *rule) rewrite(m *dns.Msg, q dns.Question, store *recordStore, recursion bool, loc geoLocation) []dns.RR {
+	var answers []dns.RR
+	if len(store.lookup(r.target)) > 0 {
+		answers, _ = resolveLocal(store, r.target, q.Qtype, loc)
+	} else if recursion {
+		uq := new(dns.Msg)
+		uq.SetQuestion(r.target, q.Qtype)
+		resp, err := forwardToFallback(uq)
+		if err != nil {
+			log.Printf("Rule rewrite of %s to %s failed: %v", q.Name, r.target, err)
+			m.Rcode = dns.RcodeServerFailure
+			return nil
+		}
+		m.Rcode = resp.Rcode
+		answers = resp.Answer
+	} else {
+		m.Rcode = dns.RcodeNameError
+		return nil
+	}
+	var flat []dns.RR
+	for _, rr := range answers {
+		if rr.Header().Rrtype != q.Qtype {
+			continue
+		}
+		rr = dns.Copy(rr)
+		rr.Header().Name = q.Name
+		flat = append(flat, rr)
+	}
+	return flat
+}
+
+// clampsTTL reports whether the rule adjusts answer TTLs.
+func (r *rule) clampsTTL() bool {
+	return r.MinTTL > 0 || r.MaxTTL > 0
+}
+
+// ruleWriter clamps the TTLs of every response written through it.
+type ruleWriter struct {
+	dns.ResponseWriter
+	rule *rule
+}
+
+func (w ruleWriter) WriteMsg(m *dns.Msg) error {
+	// Responses may be shared with the cache; clamp a copy.
+	m = m.Copy()
+	clampTTLs(m, w.rule.MinTTL, w.rule.MaxTTL)
+	return w.ResponseWriter.WriteMsg(m)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestLoadRulesErrors(t *testing.T) {
+	tests := []struct {
+		rule RuleConfig
+		err  string
+	}{
+		{RuleConfig{Answer: []string{"0.0.0.0"}}, "names or regex is required"},
+		{RuleConfig{Names: []string{"[x"}, Answer: []string{"0.0.0.0"}}, "names"},
+		{RuleConfig{Regex: "(", Answer: []string{"0.0.0.0"}}, "regex"},
+		{RuleConfig{Names: []string{"a.example"}, Answer: []string{"nowhere"}}, "not an IP address"},
+		{RuleConfig{Names: []string{"a.example"}, Answer: []string{"0.0.0.0"}, RewriteTo: "b.example"}, "exclusive"},
+		{RuleConfig{Names: []string{"a.example"}, MinTTL: 600, MaxTTL: 60}, "min_ttl is above max_ttl"},
+		{RuleConfig{Names: []string{"a.example"}, NXDomain: true, RewriteTo: "b.example"}, "nxdomain excludes"},
+		{RuleConfig{Names: []string{"a.example"}}, "no action"},
+	}
+	for _, tt := range tests {
+		f := &filterSet{}
+		if err := f.loadRules(&Config{Rules: []RuleConfig{tt.rule}}); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%+v: %v, want %q", tt.rule, err, tt.err)
+		}
+	}
+	f := &filterSet{}
+	dup := RuleConfig{Name: "x", Names: []string{"a.example"}, StripAAAA: true}
+	if err := f.loadRules(&Config{Rules: []RuleConfig{dup, dup}}); err == nil || !strings.Contains(err.Error(), "duplicate") {
+		t.Errorf("duplicate names: %v", err)
+	}
+}
+
+func TestMatchRule(t *testing.T) {
+	f := &filterSet{}
+	err := f.loadRules(&Config{Rules: []RuleConfig{
+		{Name: "kids", Names: []string{"*.games.example"}, Clients: []string{"10.0.5.0/24"}, NXDomain: true},
+		{Name: "telemetry", Names: []string{"*.Telemetry.example", "telemetry.example"}, Answer: []string{"0.0.0.0", "::"}},
+		{Name: "cdn", Regex: `^img[0-9]+\.cdn\.example\.$`, RewriteTo: "cdn.example"},
+		{Name: "v4only", Names: []string{"*"}, StripAAAA: true},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	withFilters(t, f)
+
+	kid, adult := net.ParseIP("10.0.5.9"), net.ParseIP("10.0.6.9")
+	tests := []struct {
+		name   string
+		client net.IP
+		want   string
+	}{
+		{"play.games.example.", kid, "kids"},
+		{"play.games.example.", adult, "v4only"},
+		{"play.games.example.", nil, "v4only"},
+		{"telemetry.example.", adult, "telemetry"},
+		{"a.telemetry.example.", adult, "telemetry"},
+		{"img12.cdn.example.", adult, "cdn"},
+		{"imgx.cdn.example.", adult, "v4only"},
+		{"example.", adult, "v4only"},
+	}
+	for _, tt := range tests {
+		r := matchRule(tt.name, tt.client, nil)
+		if r == nil || r.Name != tt.want {
+			t.Errorf("%s from %v: %v, want %s", tt.name, tt.client, r, tt.want)
+		}
+	}
+
+	strip := matchRule("example.", adult, nil)
+	if strip.intercepts(dns.Question{Name: "example.", Qtype: dns.TypeA}) || !strip.intercepts(dns.Question{Name: "example.", Qtype: dns.TypeAAAA}) {
+		t.Error("strip_aaaa should intercept AAAA only")
+	}
+	tel := matchRule("telemetry.example.", adult, nil)
+	if len(tel.v4) != 1 || len(tel.v6) != 1 || tel.TTL != 60 {
+		t.Errorf("answer rule %+v", tel)
+	}
+}
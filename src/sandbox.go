@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/x509"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// SandboxConfig restricts the process once it has finished starting up.
+// On Linux a seccomp filter blocks syscalls a DNS server never needs and
+// landlock limits filesystem access to the paths below plus the ones the
+// enabled features use. It is off unless enabled, since it can get in the
+// way of hooks and paths a deployment relies on.
+type SandboxConfig struct {
+	Enabled       bool     `yaml:"enabled"`
+	ReadPaths     []string `yaml:"read_paths"`
+	WritablePaths []string `yaml:"writable_paths"`
+}
+
+// sandboxReadPaths are always readable: resolver and TLS configuration for
+// outgoing requests, and /proc for the neighbor table.
+var sandboxReadPaths = []string{
+	"/etc/resolv.conf",
+	"/etc/hosts",
+	"/etc/nsswitch.conf",
+	"/etc/ssl",
+	"/etc/pki",
+	"/etc/ca-certificates",
+	"/usr/share/ca-certificates",
+	"/proc",
+	"/dev/urandom",
+}
+
+// sandboxExecPaths hold the shell and libraries anycast hooks run with.
+var sandboxExecPaths = []string{"/bin", "/sbin", "/usr", "/lib", "/lib64"}
+
+type sandboxPolicy struct {
+	read, write, exec []string
+}
+
+// sandboxPolicyFor collects the paths the current configuration touches
+// after startup.
+func sandboxPolicyFor() sandboxPolicy {
+	p := sandboxPolicy{
+		read:  append(append([]string{}, sandboxReadPaths...), config.Sandbox.ReadPaths...),
+		write: append([]string{"/dev/null"}, config.Sandbox.WritablePaths...),
+	}
+	// Custom CA locations for TLS clients (DoT/DoH upstreams, webhooks).
+	for _, env := range []string{"SSL_CERT_FILE", "SSL_CERT_DIR"} {
+		for _, path := range filepath.SplitList(os.Getenv(env)) {
+			if path != "" {
+				p.read = append(p.read, path)
+			}
+		}
+	}
+	if abs, err := filepath.Abs(configFile); err == nil {
+		// Reloads reread the configuration.
+		p.read = append(p.read, filepath.Dir(abs))
+	}
+	for _, path := range zoneFilePaths() {
+		// The directory, so reloads still work when editors replace the file.
+		if abs, err := filepath.Abs(*path); err == nil {
+			p.read = append(p.read, filepath.Dir(abs))
+		}
+	}
+	// Files pulled in by $INCLUDE at startup; includes added later must be
+	// in one of the granted directories.
+	zoneIncludesMu.Lock()
+	for _, included := range zoneIncludes {
+		for _, path := range included {
+			if abs, err := filepath.Abs(path); err == nil {
+				p.read = append(p.read, filepath.Dir(abs))
+			}
+		}
+	}
+	zoneIncludesMu.Unlock()
+	if config.GeoIP.Database != "" {
+		// The updater replaces the database file.
+		if abs, err := filepath.Abs(config.GeoIP.Database); err == nil {
+			p.read = append(p.read, filepath.Dir(abs))
+		}
+	}
+	if config.DHCPLeases.File != "" {
+		// DHCP servers rewrite the lease file through a temporary one.
+		if abs, err := filepath.Abs(config.DHCPLeases.File); err == nil {
+			p.read = append(p.read, filepath.Dir(abs))
+		}
+	}
+	if config.Dnsmasq.Path != "" {
+		// Reloads reread it, and the files it points at.
+		p.read = append(p.read, config.Dnsmasq.Path)
+	}
+	if config.WriteBack.Enabled {
+		// Write-back replaces the zone file through a temporary one, and
+		// truncates the journal once merged.
+		for _, path := range []string{config.HostsFile, config.WriteBack.Journal} {
+			if abs, err := filepath.Abs(path); err == nil {
+				p.write = append(p.write, filepath.Dir(abs))
+			}
+		}
+	}
+	if config.Database.File != "" {
+		// Compaction replaces the database file.
+		if abs, err := filepath.Abs(config.Database.File); err == nil {
+			p.write = append(p.write, filepath.Dir(abs))
+		}
+	}
+	for _, z := range zones {
+		if z.secondary && z.File != "" {
+			// The saved copy of a transferred zone.
+			if abs, err := filepath.Abs(z.File); err == nil {
+				p.write = append(p.write, filepath.Dir(abs))
+			}
+		}
+	}
+	if config.Backup.Dir != "" {
+		if abs, err := filepath.Abs(config.Backup.Dir); err == nil {
+			p.write = append(p.write, abs)
+		}
+	}
+	if config.ACME.Enabled && config.ACME.AccountsFile != "" {
+		// Registrations replace the accounts file.
+		if abs, err := filepath.Abs(config.ACME.AccountsFile); err == nil {
+			p.write = append(p.write, filepath.Dir(abs))
+		}
+	}
+	if config.Cache.File != "" {
+		// The cache is saved through a temporary file too.
+		if abs, err := filepath.Abs(config.Cache.File); err == nil {
+			p.write = append(p.write, filepath.Dir(abs))
+		}
+	}
+	if anycastEnabled() && (config.Anycast.OnHealthy != "" || config.Anycast.OnUnhealthy != "") {
+		p.exec = sandboxExecPaths
+	}
+	return p
+}
+
+func applySandbox() {
+	if !config.Sandbox.Enabled {
+		return
+	}
+	// TLS clients load the system roots on first use; do it while the
+	// files are still reachable.
+	x509.SystemCertPool()
+	if err := enterSandbox(sandboxPolicyFor()); err != nil {
+		log.Printf("Sandbox not fully applied: %v", err)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// auditArch maps GOARCH to the AUDIT_ARCH value seccomp reports.
+var auditArch = map[string]uint32{
+	"amd64":   0xc000003e,
+	"arm64":   0xc00000b7,
+	"386":     0x40000003,
+	"arm":     0x40000028,
+	"riscv64": 0xc00000f3,
+}
+
+// deniedSyscalls fail with EPERM once the sandbox is up.
+var deniedSyscalls = []uintptr{
+	unix.SYS_PTRACE,
+	unix.SYS_PROCESS_VM_READV,
+	unix.SYS_PROCESS_VM_WRITEV,
+	unix.SYS_MOUNT,
+	unix.SYS_UMOUNT2,
+	unix.SYS_PIVOT_ROOT,
+	unix.SYS_CHROOT,
+	unix.SYS_SETNS,
+	unix.SYS_UNSHARE,
+	unix.SYS_KEXEC_LOAD,
+	unix.SYS_INIT_MODULE,
+	unix.SYS_FINIT_MODULE,
+	unix.SYS_DELETE_MODULE,
+	unix.SYS_BPF,
+	unix.SYS_PERF_EVENT_OPEN,
+	unix.SYS_REBOOT,
+	unix.SYS_SWAPON,
+	unix.SYS_SWAPOFF,
+	unix.SYS_ACCT,
+	unix.SYS_ADD_KEY,
+	unix.SYS_REQUEST_KEY,
+	unix.SYS_KEYCTL,
+	unix.SYS_USERFAULTFD,
+	unix.SYS_OPEN_BY_HANDLE_AT,
+	unix.SYS_SETUID,
+	unix.SYS_SETGID,
+	unix.SYS_SETGROUPS,
+	unix.SYS_SETRESUID,
+	unix.SYS_SETRESGID,
+}
+
+// execSyscalls are denied as well unless hooks need to run.
+var execSyscalls = []uintptr{unix.SYS_EXECVE, unix.SYS_EXECVEAT}
+
+func enterSandbox(p sandboxPolicy) error {
+	// Required for unprivileged seccomp and landlock; inherited by hooks.
+	if _, _, e := syscall.AllThreadsSyscall(unix.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0); e != 0 {
+		if e != syscall.ENOTSUP {
+			return fmt.Errorf("no_new_privs: %v", e)
+		}
+		if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+			return fmt.Errorf("no_new_privs: %v", err)
+		}
+	}
+
+	var errs []error
+	if err := applyLandlock(p); err != nil {
+		errs = append(errs, fmt.Errorf("landlock: %v", err))
+	} else {
+		log.Printf("Sandbox: landlock restricts filesystem access to %d paths", len(p.read)+len(p.write)+len(p.exec))
+	}
+	denied := deniedSyscalls
+	if len(p.exec) == 0 {
+		denied = append(append([]uintptr{}, denied...), execSyscalls...)
+	}
+	if err := applySeccomp(denied); err != nil {
+		errs = append(errs, fmt.Errorf("seccomp: %v", err))
+	} else {
+		log.Printf("Sandbox: seccomp blocks %d syscalls", len(denied))
+	}
+	return errors.Join(errs...)
+}
+
+func applySeccomp(denied []uintptr) error {
+	arch, ok := auditArch[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("unsupported architecture %s", runtime.GOARCH)
+	}
+	const (
+		ldAbs = unix.BPF_LD | unix.BPF_W | unix.BPF_ABS
+		jeq   = unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K
+		ret   = unix.BPF_RET | unix.BPF_K
+	)
+	n := len(denied)
+	prog := []unix.SockFilter{
+		{Code: ldAbs, K: 4}, // seccomp_data.arch
+		{Code: jeq, Jt: 1, K: arch},
+		{Code: ret, K: unix.SECCOMP_RET_KILL_PROCESS},
+		{Code: ldAbs, K: 0}, // seccomp_data.nr
+	}
+	for i, nr := range denied {
+		// Jump to the EPERM return at the end on a match.
+		prog = append(prog, unix.SockFilter{Code: jeq, Jt: uint8(n - i), K: uint32(nr)})
+	}
+	prog = append(prog,
+		unix.SockFilter{Code: ret, K: unix.SECCOMP_RET_ALLOW},
+		unix.SockFilter{Code: ret, K: unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM)},
+	)
+	fprog := unix.SockFprog{Len: uint16(len(prog)), Filter: &prog[0]}
+	// TSYNC applies the filter to every thread the runtime has started.
+	_, _, e := unix.Syscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER, unix.SECCOMP_FILTER_FLAG_TSYNC, uintptr(unsafe.Pointer(&fprog)))
+	runtime.KeepAlive(prog)
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+const (
+	llRead  = unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR
+	llWrite = llRead | unix.LANDLOCK_ACCESS_FS_WRITE_FILE | unix.LANDLOCK_ACCESS_FS_TRUNCATE |
+		unix.LANDLOCK_ACCESS_FS_MAKE_REG | unix.LANDLOCK_ACCESS_FS_REMOVE_FILE | unix.LANDLOCK_ACCESS_FS_REFER
+	llExec = llRead | unix.LANDLOCK_ACCESS_FS_EXECUTE
+	// Rights that make sense on a file rather than a directory.
+	llFileRights = unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_TRUNCATE
+)
+
+func applyLandlock(p sandboxPolicy) error {
+	abi, _, e := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if e != 0 {
+		return fmt.Errorf("not supported by this kernel: %v", e)
+	}
+	handled := uint64(unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_DIR | unix.LANDLOCK_ACCESS_FS_REMOVE_FILE |
+		unix.LANDLOCK_ACCESS_FS_MAKE_CHAR | unix.LANDLOCK_ACCESS_FS_MAKE_DIR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_REG | unix.LANDLOCK_ACCESS_FS_MAKE_SOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_FIFO | unix.LANDLOCK_ACCESS_FS_MAKE_BLOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SYM)
+	if abi >= 2 {
+		handled |= unix.LANDLOCK_ACCESS_FS_REFER
+	}
+	if abi >= 3 {
+		handled |= unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+
+	attr := unix.LandlockRulesetAttr{Access_fs: handled}
+	fd, _, e := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr.Access_fs), 0)
+	if e != 0 {
+		return fmt.Errorf("create ruleset: %v", e)
+	}
+	defer unix.Close(int(fd))
+
+	rules := []struct {
+		paths  []string
+		access uint64
+	}{{p.read, llRead}, {p.write, llWrite}, {p.exec, llExec}}
+	for _, r := range rules {
+		for _, path := range r.paths {
+			if err := landlockAllow(int(fd), path, r.access&handled); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, _, e = syscall.AllThreadsSyscall(unix.SYS_LANDLOCK_RESTRICT_SELF, fd, 0, 0)
+	if e == syscall.ENOTSUP {
+		return fmt.Errorf("cannot restrict all threads in a cgo build; build with CGO_ENABLED=0")
+	}
+	if e != 0 {
+		return fmt.Errorf("restrict self: %v", e)
+	}
+	return nil
+}
+
+// landlockAllow adds a rule for path; missing paths are skipped.
+func landlockAllow(ruleset int, path string, access uint64) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+	if !info.IsDir() {
+		access &= llFileRights
+	}
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("open %s: %v", path, err)
+	}
+	defer unix.Close(fd)
+	rule := unix.LandlockPathBeneathAttr{Allowed_access: access, Parent_fd: int32(fd)}
+	_, _, e := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(ruleset), unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&rule)), 0, 0, 0)
+	if e != 0 {
+		return fmt.Errorf("add rule for %s: %v", path, e)
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+func enterSandbox(p sandboxPolicy) error {
+	return fmt.Errorf("sandboxing is only supported on Linux")
+}
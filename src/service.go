@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// serviceCommands manage micro-dns as a system service: a systemd unit on
+// Linux, a launchd daemon on macOS and a service on Windows.
+var serviceCommands = map[string]bool{
+	"install":   true,
+	"uninstall": true,
+	"start":     true,
+	"stop":      true,
+}
+
+// serviceSpec is what a service is registered with.
+type serviceSpec struct {
+	name   string
+	exe    string // absolute path of this binary
+	config string // absolute path of the config file
+	dir    string // working directory: the config file's
+}
+
+var errServiceUnsupported = fmt.Errorf("services are not supported on %s", runtime.GOOS)
+
+// startServiceHandler talks to the service manager when the server runs
+// under one that needs it; only Windows does.
+var startServiceHandler = func() {}
+
+func runService(cmd string, args []string) int {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "Path to config file (install only)")
+	name := fs.String("name", "micro-dns", "Service name")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: micro-dns %s [flags]\n", cmd)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 || *name == "" {
+		fs.Usage()
+		return 2
+	}
+
+	var err error
+	switch cmd {
+	case "install":
+		var s serviceSpec
+		if s, err = newServiceSpec(*name, *configPath); err == nil {
+			err = installService(s)
+		}
+	case "uninstall":
+		err = uninstallService(*name)
+	case "start":
+		err = startService(*name)
+	case "stop":
+		err = stopService(*name)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", cmd, err)
+		return 1
+	}
+	fmt.Printf("%s: %s done\n", *name, cmd)
+	return 0
+}
+
+// newServiceSpec registers this binary with the config at configPath,
+// checked to load first so a typo doesn't make a service that won't start.
+func newServiceSpec(name, configPath string) (serviceSpec, error) {
+	s := serviceSpec{name: name}
+	exe, err := os.Executable()
+	if err != nil {
+		return s, err
+	}
+	if s.exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return s, err
+	}
+	if s.config, err = filepath.Abs(configPath); err != nil {
+		return s, err
+	}
+	if err := loadConfig(s.config); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return s, fmt.Errorf("no config file at %s", s.config)
+		}
+		return s, fmt.Errorf("%s: %v", s.config, err)
+	}
+	s.dir = filepath.Dir(s.config)
+	return s, nil
+}
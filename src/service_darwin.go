@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// launchdDir is where installed system daemons go.
+const launchdDir = "/Library/LaunchDaemons"
+
+func launchdPlistPath(name string) string {
+	return filepath.Join(launchdDir, name+".plist")
+}
+
+// installService writes a launchd daemon that starts at boot and is
+// restarted if it fails, but not after a clean stop.
+func installService(s serviceSpec) error {
+	esc := func(v string) string {
+		var b bytes.Buffer
+		xml.EscapeText(&b, []byte(v))
+		return b.String()
+	}
+	logPath := filepath.Join("/var/log", s.name+".log")
+	plist := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>%s</string>
+	<key>ProgramArguments</key>
+	<array>
+		<string>%s</string>
+		<string>--config</string>
+		<string>%s</string>
+	</array>
+	<key>WorkingDirectory</key>
+	<string>%s</string>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<dict>
+		<key>SuccessfulExit</key>
+		<false/>
+	</dict>
+	<key>StandardOutPath</key>
+	<string>%s</string>
+	<key>StandardErrorPath</key>
+	<string>%s</string>
+</dict>
+</plist>
+`, esc(s.name), esc(s.exe), esc(s.config), esc(s.dir), esc(logPath), esc(logPath))
+	path := launchdPlistPath(s.name)
+	if err := os.WriteFile(path, []byte(plist), 0644); err != nil {
+		return err
+	}
+	return launchctl("load", "-w", path)
+}
+
+func uninstallService(name string) error {
+	path := launchdPlistPath(name)
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	if err := launchctl("unload", "-w", path); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func startService(name string) error {
+	return launchctl("start", name)
+}
+
+func stopService(name string) error {
+	return launchctl("stop", name)
+}
+
+func launchctl(args ...string) error {
+	out, err := exec.Command("launchctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("launchctl %v: %v: %s", args, err, out)
+	}
+	return nil
+}
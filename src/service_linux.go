@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+// systemdUnitDir is where installed units go.
+const systemdUnitDir = "/etc/systemd/system"
+
+func systemdUnitPath(name string) string {
+	return filepath.Join(systemdUnitDir, name+".service")
+}
+
+// installService writes a Type=notify unit, so systemd knows when the
+// server is ready, and enables it at boot.
+func installService(s serviceSpec) error {
+	unit := fmt.Sprintf(`[Unit]
+Description=micro-dns DNS server
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=notify
+ExecStart=%s --config %s
+WorkingDirectory=%s
+Restart=on-failure
+AmbientCapabilities=CAP_NET_BIND_SERVICE
+
+[Install]
+WantedBy=multi-user.target
+`, strconv.Quote(s.exe), strconv.Quote(s.config), s.dir)
+	if err := os.WriteFile(systemdUnitPath(s.name), []byte(unit), 0644); err != nil {
+		return err
+	}
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	return systemctl("enable", s.name)
+}
+
+func uninstallService(name string) error {
+	path := systemdUnitPath(name)
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	if err := systemctl("disable", "--now", name); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	return systemctl("daemon-reload")
+}
+
+func startService(name string) error {
+	return systemctl("start", name)
+}
+
+func stopService(name string) error {
+	return systemctl("stop", name)
+}
+
+func systemctl(args ...string) error {
+	out, err := exec.Command("systemctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl %v: %v: %s", args, err, out)
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+func installService(serviceSpec) error { return errServiceUnsupported }
+func uninstallService(string) error    { return errServiceUnsupported }
+func startService(string) error        { return errServiceUnsupported }
+func stopService(string) error         { return errServiceUnsupported }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+func init() {
+	startServiceHandler = startWindowsService
+}
+
+func installService(s serviceSpec) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if existing, err := m.OpenService(s.name); err == nil {
+		existing.Close()
+		return fmt.Errorf("service %s already exists", s.name)
+	}
+	service, err := m.CreateService(s.name, s.exe, mgr.Config{
+		DisplayName: "micro-dns DNS server",
+		Description: "Lightweight DNS server (" + s.config + ")",
+		StartType:   mgr.StartAutomatic,
+	}, "--config", s.config)
+	if err != nil {
+		return err
+	}
+	defer service.Close()
+	return service.SetRecoveryActions([]mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 5 * time.Second},
+	}, 86400)
+}
+
+func uninstallService(name string) error {
+	return withService(name, func(s *mgr.Service) error {
+		stopWindowsService(s)
+		return s.Delete()
+	})
+}
+
+func startService(name string) error {
+	return withService(name, func(s *mgr.Service) error { return s.Start() })
+}
+
+func stopService(name string) error {
+	return withService(name, stopWindowsService)
+}
+
+func withService(name string, f func(*mgr.Service) error) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("service %s: %v", name, err)
+	}
+	defer s.Close()
+	return f(s)
+}
+
+// stopWindowsService asks s to stop and waits up to 10 seconds for it.
+func stopWindowsService(s *mgr.Service) error {
+	status, err := s.Query()
+	if err != nil || status.State == svc.Stopped {
+		return err
+	}
+	if status, err = s.Control(svc.Stop); err != nil {
+		return err
+	}
+	for deadline := time.Now().Add(10 * time.Second); status.State != svc.Stopped; {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("service did not stop within 10s")
+		}
+		time.Sleep(300 * time.Millisecond)
+		if status, err = s.Query(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startWindowsService reports to the service control manager when running
+// as a service. Services start in the system directory with no console, so
+// relative paths in the config are taken from its directory, and the log
+// goes to micro-dns.log there.
+func startWindowsService() {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return
+	}
+	dir := filepath.Dir(configFile)
+	if abs, err := filepath.Abs(configFile); err == nil {
+		dir = filepath.Dir(abs)
+	}
+	if f, err := os.OpenFile(filepath.Join(dir, "micro-dns.log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err == nil {
+		log.SetOutput(f)
+	}
+	if err := os.Chdir(dir); err != nil {
+		log.Printf("Failed to change to %s: %v", dir, err)
+	}
+	go func() {
+		if err := svc.Run("micro-dns", windowsService{}); err != nil {
+			log.Printf("Windows service failed: %v", err)
+		}
+		os.Exit(0)
+	}()
+}
+
+type windowsService struct{}
+
+func (windowsService) Execute(_ []string, req <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for c := range req {
+		switch c.Cmd {
+		case svc.Interrogate:
+			status <- c.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			status <- svc.Status{State: svc.StopPending}
+			saveCacheFile("service stop")
+			return false, 0
+		}
+	}
+	return false, 0
+}
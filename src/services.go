@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ServiceConfig describes one advertised service instance. It expands into
+// DNS-SD (RFC 6763) records:
+//
+//	<name>._<service>._<protocol>.<domain>  SRV  one per target
+//	<name>._<service>._<protocol>.<domain>  TXT  metadata as key=value strings
+//	<target host>                           A    for targets with an address
+//	_<service>._<protocol>.<domain>         PTR  the instance, for browsing
+//	_services._dns-sd._udp.<domain>         PTR  each service type (RFC 6763 section 9)
+type ServiceConfig struct {
+	Name     string            `yaml:"name"`     // instance name, may contain spaces
+	Service  string            `yaml:"service"`  // e.g. "ipp" or "_ipp"
+	Protocol string            `yaml:"protocol"` // "tcp" or "udp"
+	Domain   string            `yaml:"domain"`
+	Port     uint16            `yaml:"port"`
+	TTL      uint32            `yaml:"ttl"`
+	Targets  []ServiceTarget   `yaml:"targets"`
+	Metadata map[string]string `yaml:"metadata"`
+}
+
+// ServiceTarget is a host providing a service.
+type ServiceTarget struct {
+	Host     string `yaml:"host"`
+	Address  string `yaml:"address"` // optional; publishes an A record for Host
+	Priority uint16 `yaml:"priority"`
+	Weight   uint16 `yaml:"weight"`
+}
+
+const defaultServiceTTL = 120
+
+// escapeLabel renders a raw label (such as a DNS-SD instance name) in the
+// escaped presentation form used for owner names.
+func escapeLabel(label string) string {
+	var b strings.Builder
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		switch {
+		case strings.IndexByte(".\\ '@;()\"", c) >= 0:
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&b, "\\%03d", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// serviceType returns "_<service>._<protocol>.<domain>" for svc.
+func serviceType(svc ServiceConfig) string {
+	return "_" + strings.TrimPrefix(svc.Service, "_") + "._" + strings.ToLower(svc.Protocol) + "." + svc.Domain
+}
+
+// buildServiceRecords validates the services config and expands it into a
+// record set.
+func buildServiceRecords(services []ServiceConfig) (map[string][]Record, error) {
+	recs := make(map[string][]Record)
+	add := func(name string, rec Record) {
+		name = strings.ToLower(name)
+		recs[name] = append(recs[name], rec)
+	}
+
+	for i, svc := range services {
+		if svc.Name == "" || svc.Service == "" || svc.Domain == "" {
+			return nil, fmt.Errorf("services[%d]: name, service and domain are required", i)
+		}
+		if p := strings.ToLower(svc.Protocol); p != "tcp" && p != "udp" {
+			return nil, fmt.Errorf("services[%d]: protocol must be tcp or udp", i)
+		}
+		if svc.Port == 0 {
+			return nil, fmt.Errorf("services[%d]: port is required", i)
+		}
+		if len(svc.Targets) == 0 {
+			return nil, fmt.Errorf("services[%d]: at least one target is required", i)
+		}
+		svc.Domain = dns.Fqdn(svc.Domain)
+		if svc.TTL == 0 {
+			svc.TTL = defaultServiceTTL
+		}
+
+		instance := escapeLabel(svc.Name) + "." + serviceType(svc)
+		if _, ok := dns.IsDomainName(instance); !ok {
+			return nil, fmt.Errorf("services[%d]: invalid name %s", i, instance)
+		}
+
+		for _, t := range svc.Targets {
+			host := dns.Fqdn(t.Host)
+			if _, ok := dns.IsDomainName(host); !ok || t.Host == "" {
+				return nil, fmt.Errorf("services[%d]: invalid target host %q", i, t.Host)
+			}
+			add(instance, Record{Type: "SRV", TTL: svc.TTL, Data: host, Pref: t.Priority, SrvWeight: t.Weight, Port: svc.Port})
+			if t.Address != "" {
+				ip := net.ParseIP(t.Address)
+				if ip == nil || ip.To4() == nil {
+					return nil, fmt.Errorf("services[%d]: invalid IPv4 address %q", i, t.Address)
+				}
+				add(host, Record{Type: "A", TTL: svc.TTL, Data: t.Address})
+			}
+		}
+
+		keys := make([]string, 0, len(svc.Metadata))
+		for k := range svc.Metadata {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		txt := []string{}
+		for _, k := range keys {
+			txt = append(txt, k+"="+svc.Metadata[k])
+		}
+		if len(txt) == 0 {
+			// RFC 6763 section 6.1: an empty TXT record holds one empty string.
+			txt = []string{""}
+		}
+		add(instance, Record{Type: "TXT", TTL: svc.TTL, Strings: txt})
+
+		stype := serviceType(svc)
+		add(stype, Record{Type: "PTR", TTL: svc.TTL, Data: instance})
+		enum := "_services._dns-sd._udp." + svc.Domain
+		if !hasRecord(recs[strings.ToLower(enum)], "PTR", stype) {
+			add(enum, Record{Type: "PTR", TTL: svc.TTL, Data: stype})
+		}
+	}
+	return recs, nil
+}
+
+func hasRecord(recs []Record, rtype, data string) bool {
+	for _, rec := range recs {
+		if rec.Type == rtype && strings.EqualFold(rec.Data, data) {
+			return true
+		}
+	}
+	return false
+}
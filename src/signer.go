@@ -0,0 +1,358 @@
+package main
+
+import (
+	"crypto"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// SigningConfig serves one local zone DNSSEC-signed. Answers are signed on
+// the fly, so canary, ordering and health filtering keep working, and the
+// NSEC chain is rebuilt whenever the records change.
+type SigningConfig struct {
+	Zone   string `yaml:"zone"`
+	KeyDir string `yaml:"key_dir"` // K<zone>+013+<tag>.{key,private}; generated if missing
+}
+
+const (
+	signAlgorithm   = dns.ECDSAP256SHA256
+	signValidity    = 7 * 24 * time.Hour
+	signNegativeTTL = 300
+	signKeyTTL      = 3600
+	signCacheMax    = 10000
+)
+
+type signingKey struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+// zoneSigner holds the keys of the signed zone, cached signatures and the
+// NSEC chain for the current record snapshot.
+type zoneSigner struct {
+	zone     string
+	ksk, zsk signingKey
+
+	mu      sync.Mutex
+	sigs    map[string]signatureEntry
+	chainOf *map[string][]Record
+	names   []string // zone names in canonical order
+	types   map[string][]uint16
+	serial  uint32
+}
+
+type signatureEntry struct {
+	sig     *dns.RRSIG
+	refresh time.Time
+}
+
+var signer *zoneSigner
+
+func setupSigning() error {
+	cfg := &config.DNSSEC.Sign
+	if cfg.Zone == "" {
+		return nil
+	}
+	cfg.Zone = dns.Fqdn(strings.ToLower(cfg.Zone))
+	s := &zoneSigner{zone: cfg.Zone, sigs: make(map[string]signatureEntry)}
+	var err error
+	if s.ksk, err = loadOrGenerateKey(cfg.KeyDir, cfg.Zone, dns.ZONE|dns.SEP); err != nil {
+		return fmt.Errorf("dnssec.sign: %v", err)
+	}
+	if s.zsk, err = loadOrGenerateKey(cfg.KeyDir, cfg.Zone, dns.ZONE); err != nil {
+		return fmt.Errorf("dnssec.sign: %v", err)
+	}
+	if cfg.KeyDir == "" {
+		log.Printf("DNSSEC: no key_dir set, signing %s with keys that change on restart", cfg.Zone)
+	}
+	log.Printf("DNSSEC: signing %s; DS for the parent: %s", cfg.Zone, s.ksk.key.ToDS(dns.SHA256))
+	signer = s
+	return nil
+}
+
+// loadOrGenerateKey returns the first key in dir for zone with the given
+// flags, generating and saving one if there is none.
+func loadOrGenerateKey(dir, zone string, flags uint16) (signingKey, error) {
+	if dir != "" {
+		paths, _ := filepath.Glob(filepath.Join(dir, fmt.Sprintf("K%s+%03d+*.key", zone, signAlgorithm)))
+		sort.Strings(paths)
+		for _, path := range paths {
+			k, err := readSigningKey(path)
+			if err != nil {
+				return signingKey{}, err
+			}
+			if k.key.Flags == flags {
+				return k, nil
+			}
+		}
+	}
+
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: signKeyTTL},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: signAlgorithm,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		return signingKey{}, err
+	}
+	if dir != "" {
+		base := filepath.Join(dir, fmt.Sprintf("K%s+%03d+%05d", zone, signAlgorithm, key.KeyTag()))
+		if err := os.WriteFile(base+".key", []byte(key.String()+"\n"), 0644); err != nil {
+			return signingKey{}, err
+		}
+		if err := os.WriteFile(base+".private", []byte(key.PrivateKeyString(priv)), 0600); err != nil {
+			return signingKey{}, err
+		}
+		log.Printf("DNSSEC: generated key %s", base)
+	}
+	return signingKey{key, priv.(crypto.Signer)}, nil
+}
+
+func readSigningKey(path string) (signingKey, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return signingKey{}, err
+	}
+	defer f.Close()
+	rr, err := dns.ReadRR(f, path)
+	if err != nil {
+		return signingKey{}, err
+	}
+	key, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return signingKey{}, fmt.Errorf("%s: not a DNSKEY", path)
+	}
+	privPath := strings.TrimSuffix(path, ".key") + ".private"
+	pf, err := os.Open(privPath)
+	if err != nil {
+		return signingKey{}, err
+	}
+	defer pf.Close()
+	priv, err := key.ReadPrivateKey(pf, privPath)
+	if err != nil {
+		return signingKey{}, err
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return signingKey{}, fmt.Errorf("%s: unsupported private key", privPath)
+	}
+	return signingKey{key, signer}, nil
+}
+
+func (s *zoneSigner) covers(name string) bool {
+	return dns.IsSubDomain(s.zone, name)
+}
+
+// refreshChain rebuilds the NSEC chain if the record snapshot changed.
+// Callers must hold s.mu.
+func (s *zoneSigner) refreshChain() {
+	snap := records.snap.Load()
+	if snap == s.chainOf {
+		return
+	}
+	types := map[string][]uint16{s.zone: {dns.TypeSOA, dns.TypeDNSKEY}}
+	for name, recs := range *snap {
+		if !s.covers(name) {
+			continue
+		}
+		for _, rec := range recs {
+			if t, ok := dns.StringToType[rec.Type]; ok && !typeInBitmap(types[name], t) {
+				types[name] = append(types[name], t)
+			}
+		}
+	}
+	names := make([]string, 0, len(types))
+	for name, ts := range types {
+		names = append(names, name)
+		ts = append(ts, dns.TypeRRSIG, dns.TypeNSEC)
+		sort.Slice(ts, func(i, j int) bool { return ts[i] < ts[j] })
+		types[name] = ts
+	}
+	sort.Slice(names, func(i, j int) bool { return canonicalLess(names[i], names[j]) })
+
+	s.chainOf, s.names, s.types = snap, names, types
+	s.serial = uint32(time.Now().Unix())
+}
+
+func (s *zoneSigner) soa() dns.RR {
+	s.mu.Lock()
+	s.refreshChain()
+	serial := s.serial
+	s.mu.Unlock()
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: s.zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: signNegativeTTL},
+		Ns:      s.zone,
+		Mbox:    "hostmaster." + s.zone,
+		Serial:  serial,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  604800,
+		Minttl:  signNegativeTTL,
+	}
+}
+
+func (s *zoneSigner) dnskeys() []dns.RR {
+	return []dns.RR{s.ksk.key, s.zsk.key}
+}
+
+// nsecFor returns the NSEC owned by name, or the one covering it.
+func (s *zoneSigner) nsecFor(name string) (nsec *dns.NSEC, exact bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refreshChain()
+	i := sort.Search(len(s.names), func(i int) bool { return !canonicalLess(s.names[i], name) })
+	if i < len(s.names) && s.names[i] == name {
+		return s.nsecAt(i), true
+	}
+	// The predecessor; the apex sorts first, so i is at least 1 here.
+	return s.nsecAt(i - 1), false
+}
+
+func (s *zoneSigner) nsecAt(i int) *dns.NSEC {
+	owner := s.names[i]
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: owner, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: signNegativeTTL},
+		NextDomain: s.names[(i+1)%len(s.names)],
+		TypeBitMap: s.types[owner],
+	}
+}
+
+// hasDescendants reports whether name is an empty non-terminal.
+func (s *zoneSigner) hasDescendants(name string) bool {
+	nsec, _ := s.nsecFor(name)
+	return dns.IsSubDomain(name, nsec.NextDomain) && nsec.NextDomain != name
+}
+
+// answer resolves q inside the signed zone, which is authoritative for all
+// of it: names and types without records get NXDOMAIN or NODATA with the
+// SOA and, for DNSSEC-aware clients, the NSEC proof.
+func (s *zoneSigner) answer(m *dns.Msg, q dns.Question, do, chase bool, loc geoLocation) {
+	name := dns.CanonicalName(q.Name)
+	switch {
+	case name == s.zone && q.Qtype == dns.TypeSOA:
+		m.Answer = append(m.Answer, s.soa())
+		return
+	case name == s.zone && q.Qtype == dns.TypeDNSKEY:
+		m.Answer = append(m.Answer, s.dnskeys()...)
+		return
+	}
+
+	if len(records.lookup(name)) > 0 {
+		if servedType(q.Qtype) {
+			answers, external := resolveLocal(records, q.Name, q.Qtype, loc)
+			if external != "" && config.ChaseCNAME && chase {
+				answers = append(answers, chaseExternal(external, q.Qtype)...)
+			}
+			if len(answers) > 0 {
+				m.Answer = append(m.Answer, answers...)
+				return
+			}
+		}
+	}
+
+	m.Ns = append(m.Ns, s.soa())
+	nsec, exact := s.nsecFor(name)
+	if !exact && !s.hasDescendants(name) {
+		m.Rcode = dns.RcodeNameError
+	}
+	if !do {
+		return
+	}
+	m.Ns = append(m.Ns, nsec)
+	if m.Rcode == dns.RcodeNameError {
+		// Also deny a wildcard at the closest existing ancestor.
+		ce := name
+		for ce != s.zone {
+			ce = dns.Fqdn(strings.Join(dns.SplitDomainName(ce)[1:], "."))
+			if _, ok := s.nsecFor(ce); ok || s.hasDescendants(ce) {
+				break
+			}
+		}
+		if wild, _ := s.nsecFor("*." + ce); wild.Hdr.Name != nsec.Hdr.Name {
+			m.Ns = append(m.Ns, wild)
+		}
+	}
+}
+
+// signMsg adds RRSIGs for every in-zone RRset of the answer and authority
+// sections.
+func (s *zoneSigner) signMsg(m *dns.Msg) {
+	m.Answer = s.signSection(m.Answer)
+	m.Ns = s.signSection(m.Ns)
+}
+
+func (s *zoneSigner) signSection(section []dns.RR) []dns.RR {
+	sets, _ := splitRRsets(section)
+	out := section
+	// Sign in section order so output is stable.
+	done := make(map[rrsetKey]bool)
+	for _, rr := range section {
+		k := rrsetKey{dns.CanonicalName(rr.Header().Name), rr.Header().Rrtype}
+		if done[k] || k.rtype == dns.TypeRRSIG || !s.covers(k.name) {
+			continue
+		}
+		done[k] = true
+		if sig := s.sign(sets[k]); sig != nil {
+			out = append(out, sig)
+		}
+	}
+	return out
+}
+
+// sign returns a signature over rrset, reusing a cached one while it has
+// more than half its validity left.
+func (s *zoneSigner) sign(rrset []dns.RR) *dns.RRSIG {
+	k := s.zsk
+	if rrset[0].Header().Rrtype == dns.TypeDNSKEY {
+		k = s.ksk
+	}
+	parts := make([]string, len(rrset))
+	for i, rr := range rrset {
+		parts[i] = strings.ToLower(rr.String())
+	}
+	sort.Strings(parts)
+	cacheKey := strings.Join(parts, "\n")
+
+	now := time.Now()
+	s.mu.Lock()
+	if e, ok := s.sigs[cacheKey]; ok && now.Before(e.refresh) {
+		s.mu.Unlock()
+		return e.sig
+	}
+	s.mu.Unlock()
+
+	hdr := rrset[0].Header()
+	sig := &dns.RRSIG{
+		Hdr:         dns.RR_Header{Name: hdr.Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: hdr.Ttl},
+		TypeCovered: hdr.Rrtype,
+		Algorithm:   k.key.Algorithm,
+		Labels:      uint8(dns.CountLabel(hdr.Name)),
+		OrigTtl:     hdr.Ttl,
+		Expiration:  uint32(now.Add(signValidity).Unix()),
+		Inception:   uint32(now.Add(-time.Hour).Unix()),
+		KeyTag:      k.key.KeyTag(),
+		SignerName:  s.zone,
+	}
+	if err := sig.Sign(k.priv, rrset); err != nil {
+		log.Printf("DNSSEC: signing %s %s failed: %v", hdr.Name, dns.TypeToString[hdr.Rrtype], err)
+		return nil
+	}
+
+	s.mu.Lock()
+	if len(s.sigs) >= signCacheMax {
+		s.sigs = make(map[string]signatureEntry)
+	}
+	s.sigs[cacheKey] = signatureEntry{sig: sig, refresh: now.Add(signValidity / 2)}
+	s.mu.Unlock()
+	return sig
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SLOConfig defines a latency objective such as "99% of queries answered
+// within 50ms" over a rolling window. Violations and recoveries are logged
+// and, if a webhook is set, POSTed to it as JSON.
+type SLOConfig struct {
+	Target      float64 `yaml:"target"`       // e.g. 0.99
+	ThresholdMs int     `yaml:"threshold_ms"` // e.g. 50
+	Window      int     `yaml:"window"`       // seconds
+	MinQueries  int     `yaml:"min_queries"`  // don't judge smaller samples
+	Interval    int     `yaml:"interval"`     // seconds between evaluations
+	Webhook     string  `yaml:"webhook"`
+}
+
+// Answer sources used to break down latency and statistics.
+const (
+	answerLocal   = "local"
+	answerForward = "forward"
+	answerCache   = "cache"
+)
+
+var sloSources = []string{answerLocal, answerForward, answerCache}
+
+type sloCounts struct {
+	total int
+	slow  int
+}
+
+type sloBucket struct {
+	sec       int64
+	counts    map[string]*sloCounts
+	listeners map[string]*sloCounts
+}
+
+// sloTracker counts fast and slow queries in one-second buckets.
+type sloTracker struct {
+	mu        sync.Mutex
+	buckets   []sloBucket
+	threshold time.Duration
+}
+
+var slo *sloTracker
+
+func setupSLO() error {
+	cfg := &config.SLO
+	if cfg.Target == 0 {
+		return nil
+	}
+	if cfg.Target <= 0 || cfg.Target >= 1 {
+		return fmt.Errorf("slo.target must be between 0 and 1, got %v", cfg.Target)
+	}
+	if cfg.ThresholdMs <= 0 {
+		return fmt.Errorf("slo.threshold_ms must be positive")
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = 300
+	}
+	if cfg.MinQueries <= 0 {
+		cfg.MinQueries = 100
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 30
+	}
+	slo = &sloTracker{
+		buckets:   make([]sloBucket, cfg.Window),
+		threshold: time.Duration(cfg.ThresholdMs) * time.Millisecond,
+	}
+	return nil
+}
+
+// observe records the latency of one query received on listener and
+// answered from source.
+func (t *sloTracker) observe(listener, source string, d time.Duration) {
+	now := time.Now().Unix()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := &t.buckets[now%int64(len(t.buckets))]
+	if b.sec != now {
+		b.sec = now
+		b.counts = make(map[string]*sloCounts)
+		b.listeners = make(map[string]*sloCounts)
+	}
+	for _, key := range []struct {
+		m    map[string]*sloCounts
+		name string
+	}{{b.counts, source}, {b.listeners, listener}} {
+		c := key.m[key.name]
+		if c == nil {
+			c = &sloCounts{}
+			key.m[key.name] = c
+		}
+		c.total++
+		if d > t.threshold {
+			c.slow++
+		}
+	}
+}
+
+// sloReport summarizes the window for one source (or "all"), or for one
+// listener across sources.
+type sloReport struct {
+	Source     string  `json:"source,omitempty"`
+	Listener   string  `json:"listener,omitempty"`
+	Queries    int     `json:"queries"`
+	WithinSLO  float64 `json:"within_slo"`
+	Target     float64 `json:"target"`
+	Threshold  int     `json:"threshold_ms"`
+	WindowSecs int     `json:"window_seconds"`
+}
+
+// snapshot aggregates the buckets still inside the window, by source and
+// by listener.
+func (t *sloTracker) snapshot() (bySource, byListener map[string]sloCounts) {
+	now := time.Now().Unix()
+	bySource = make(map[string]sloCounts)
+	byListener = make(map[string]sloCounts)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, b := range t.buckets {
+		if now-b.sec >= int64(len(t.buckets)) {
+			continue
+		}
+		for src, c := range b.counts {
+			agg := bySource[src]
+			agg.total += c.total
+			agg.slow += c.slow
+			bySource[src] = agg
+		}
+		for l, c := range b.listeners {
+			agg := byListener[l]
+			agg.total += c.total
+			agg.slow += c.slow
+			byListener[l] = agg
+		}
+	}
+	return bySource, byListener
+}
+
+func (t *sloTracker) reports() []sloReport {
+	cfg := config.SLO
+	counts, listeners := t.snapshot()
+	var all sloCounts
+	var reports []sloReport
+	mk := func(src string, c sloCounts) sloReport {
+		r := sloReport{Source: src, Queries: c.total, Target: cfg.Target, Threshold: cfg.ThresholdMs, WindowSecs: cfg.Window, WithinSLO: 1}
+		if c.total > 0 {
+			r.WithinSLO = float64(c.total-c.slow) / float64(c.total)
+		}
+		return r
+	}
+	for _, src := range sloSources {
+		c := counts[src]
+		all.total += c.total
+		all.slow += c.slow
+		reports = append(reports, mk(src, c))
+	}
+	reports = append([]sloReport{mk("all", all)}, reports...)
+
+	names := make([]string, 0, len(listeners))
+	for l := range listeners {
+		names = append(names, l)
+	}
+	sort.Strings(names)
+	for _, l := range names {
+		r := mk("", listeners[l])
+		r.Listener = l
+		reports = append(reports, r)
+	}
+	return reports
+}
+
+// watchSLO evaluates the objective periodically and alerts on transitions.
+func watchSLO() {
+	cfg := config.SLO
+	violated := false
+	for {
+		time.Sleep(time.Duration(cfg.Interval) * time.Second)
+		reports := slo.reports()
+		overall := reports[0]
+		if overall.Queries < cfg.MinQueries {
+			continue
+		}
+		now := overall.WithinSLO < cfg.Target
+		if now == violated {
+			continue
+		}
+		violated = now
+
+		state := "recovered"
+		if violated {
+			state = "violated"
+		}
+		var perListener []string
+		for _, r := range reports[len(sloSources)+1:] {
+			perListener = append(perListener, fmt.Sprintf("%s %.2f%%", r.Listener, r.WithinSLO*100))
+		}
+		log.Printf("Latency SLO %s: %.2f%% of %d queries within %dms (target %.2f%%); local %.2f%%, forward %.2f%%, cache %.2f%%; %s",
+			state, overall.WithinSLO*100, overall.Queries, cfg.ThresholdMs, cfg.Target*100,
+			reports[1].WithinSLO*100, reports[2].WithinSLO*100, reports[3].WithinSLO*100, strings.Join(perListener, ", "))
+		if cfg.Webhook != "" {
+			go postSLOAlert(cfg.Webhook, state, reports)
+		}
+	}
+}
+
+func postSLOAlert(url, state string, reports []sloReport) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"state":   state,
+		"time":    time.Now().UTC().Format(time.RFC3339),
+		"reports": reports,
+	})
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("SLO webhook failed: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("SLO webhook returned %s", resp.Status)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+
+	"github.com/miekg/dns"
+)
+
+// SortlistConfig orders the A and AAAA records of an answer for the client
+// that asked, the way BIND's sortlist does: the first rule whose Clients
+// match the querying address puts addresses on its Prefer networks first,
+// in the order listed. With SameSubnet, addresses on the client's own
+// subnet (IPv4Prefix and IPv6Prefix bits of its address) come next, then
+// the rest in the order answer_order left them.
+type SortlistConfig struct {
+	SameSubnet bool           `yaml:"same_subnet"`
+	IPv4Prefix int            `yaml:"ipv4_prefix"` // default 24
+	IPv6Prefix int            `yaml:"ipv6_prefix"` // default 64
+	Rules      []SortlistRule `yaml:"rules"`
+}
+
+type SortlistRule struct {
+	Clients []string `yaml:"clients"` // CIDRs; empty is every client
+	Prefer  []string `yaml:"prefer"`  // CIDRs, most preferred first
+}
+
+type sortRule struct {
+	clients []*net.IPNet
+	prefer  []*net.IPNet
+}
+
+type addressSorter struct {
+	sameSubnet bool
+	v4, v6     net.IPMask
+	rules      []sortRule
+}
+
+var sortlist *addressSorter
+
+func setupSortlist() error {
+	cfg := config.Sortlist
+	if !cfg.SameSubnet && len(cfg.Rules) == 0 {
+		return nil
+	}
+	if cfg.IPv4Prefix == 0 {
+		cfg.IPv4Prefix = 24
+	}
+	if cfg.IPv6Prefix == 0 {
+		cfg.IPv6Prefix = 64
+	}
+	if cfg.IPv4Prefix < 1 || cfg.IPv4Prefix > 32 {
+		return fmt.Errorf("sortlist.ipv4_prefix: %d is out of range (1-32)", cfg.IPv4Prefix)
+	}
+	if cfg.IPv6Prefix < 1 || cfg.IPv6Prefix > 128 {
+		return fmt.Errorf("sortlist.ipv6_prefix: %d is out of range (1-128)", cfg.IPv6Prefix)
+	}
+	s := &addressSorter{
+		sameSubnet: cfg.SameSubnet,
+		v4:         net.CIDRMask(cfg.IPv4Prefix, 32),
+		v6:         net.CIDRMask(cfg.IPv6Prefix, 128),
+	}
+	for i, r := range cfg.Rules {
+		key := fmt.Sprintf("sortlist.rules[%d]", i)
+		clients, err := parseCIDRs(key+".clients", r.Clients)
+		if err != nil {
+			return err
+		}
+		prefer, err := parseCIDRs(key+".prefer", r.Prefer)
+		if err != nil {
+			return err
+		}
+		if len(prefer) == 0 {
+			return fmt.Errorf("%s: prefer lists no networks", key)
+		}
+		s.rules = append(s.rules, sortRule{clients: clients, prefer: prefer})
+	}
+	sortlist = s
+	log.Printf("Sorting addresses for clients (%d rules, same subnet %v)", len(s.rules), s.sameSubnet)
+	return nil
+}
+
+// networksFor lists the networks whose addresses client gets first, most
+// preferred first.
+func (s *addressSorter) networksFor(client net.IP) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, r := range s.rules {
+		if len(r.clients) == 0 || onNetworks(client, r.clients) {
+			nets = append(nets, r.prefer...)
+			break
+		}
+	}
+	if s.sameSubnet {
+		mask := s.v6
+		if v4 := client.To4(); v4 != nil {
+			client, mask = v4, s.v4
+		}
+		nets = append(nets, &net.IPNet{IP: client.Mask(mask), Mask: mask})
+	}
+	return nets
+}
+
+// rank is the index of the first of nets holding ip, or len(nets).
+func rank(ip net.IP, nets []*net.IPNet) int {
+	for i, n := range nets {
+		if n.Contains(ip) {
+			return i
+		}
+	}
+	return len(nets)
+}
+
+// sortWriter orders the addresses of responses written through it for
+// the client.
+type sortWriter struct {
+	dns.ResponseWriter
+	client net.IP
+}
+
+func (w sortWriter) WriteMsg(m *dns.Msg) error {
+	nets := sortlist.networksFor(w.client)
+	if len(nets) == 0 || len(m.Answer) < 2 {
+		return w.ResponseWriter.WriteMsg(m)
+	}
+	ranks := make([]int, len(m.Answer))
+	sorted := true
+	for i, rr := range m.Answer {
+		ranks[i] = -1 // anything but an address keeps its place
+		switch rr := rr.(type) {
+		case *dns.A:
+			ranks[i] = rank(rr.A, nets)
+		case *dns.AAAA:
+			ranks[i] = rank(rr.AAAA, nets)
+		}
+		if ranks[i] >= 0 && !inOrder(ranks[:i], ranks[i]) {
+			sorted = false
+		}
+	}
+	if sorted {
+		return w.ResponseWriter.WriteMsg(m)
+	}
+	// Responses may be shared with the cache; reorder a copy.
+	m = m.Copy()
+	type ranked struct {
+		rr   dns.RR
+		rank int
+	}
+	var pos []int
+	var addrs []ranked
+	for i, r := range ranks {
+		if r >= 0 {
+			pos = append(pos, i)
+			addrs = append(addrs, ranked{m.Answer[i], r})
+		}
+	}
+	sort.SliceStable(addrs, func(i, j int) bool { return addrs[i].rank < addrs[j].rank })
+	for i, a := range addrs {
+		m.Answer[pos[i]] = a.rr
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// inOrder reports whether an address of rank r may follow the addresses
+// ranked in prev.
+func inOrder(prev []int, r int) bool {
+	for i := len(prev) - 1; i >= 0; i-- {
+		if prev[i] >= 0 {
+			return prev[i] <= r
+		}
+	}
+	return true
+}
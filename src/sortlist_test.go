@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestSortlist(t *testing.T) {
+	old, oldSorter := *config, sortlist
+	t.Cleanup(func() { *config, sortlist = old, oldSorter })
+
+	config.Sortlist = SortlistConfig{
+		SameSubnet: true,
+		Rules: []SortlistRule{
+			{Clients: []string{"10.1.0.0/16"}, Prefer: []string{"192.0.2.128/25", "198.51.100.0/24"}},
+			{Prefer: []string{"203.0.113.0/24"}},
+		},
+	}
+	if err := setupSortlist(); err != nil {
+		t.Fatal(err)
+	}
+
+	answer := func(data ...string) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("www.example.com.", dns.TypeA)
+		for _, d := range data {
+			rr, _ := dns.NewRR("www.example.com. 60 IN " + d)
+			m.Answer = append(m.Answer, rr)
+		}
+		return m
+	}
+	order := func(m *dns.Msg) string {
+		var out []string
+		for _, rr := range m.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				out = append(out, rr.A.String())
+			case *dns.AAAA:
+				out = append(out, rr.AAAA.String())
+			default:
+				out = append(out, dns.TypeToString[rr.Header().Rrtype])
+			}
+		}
+		return fmt.Sprint(out)
+	}
+	in := answer("A 203.0.113.5", "A 10.1.2.9", "A 198.51.100.7", "A 192.0.2.200", "A 192.0.2.1")
+
+	for _, tc := range []struct{ client, want string }{
+		// The first matching rule's networks, then the client's own /24.
+		{"10.1.2.3", "[192.0.2.200 198.51.100.7 10.1.2.9 203.0.113.5 192.0.2.1]"},
+		// The catch-all rule.
+		{"172.16.0.1", "[203.0.113.5 10.1.2.9 198.51.100.7 192.0.2.200 192.0.2.1]"},
+		{"192.0.2.77", "[203.0.113.5 192.0.2.200 192.0.2.1 10.1.2.9 198.51.100.7]"},
+	} {
+		rw := &recordingWriter{}
+		sortWriter{rw, net.ParseIP(tc.client)}.WriteMsg(in)
+		if got := order(rw.written[0]); got != tc.want {
+			t.Errorf("for %s: %s, want %s", tc.client, got, tc.want)
+		}
+	}
+	if got := order(in); got != "[203.0.113.5 10.1.2.9 198.51.100.7 192.0.2.200 192.0.2.1]" {
+		t.Errorf("shared response reordered: %s", got)
+	}
+
+	// Records other than addresses keep their places.
+	rw := &recordingWriter{}
+	sortWriter{rw, net.ParseIP("10.1.2.3")}.WriteMsg(answer("CNAME www.cdn.example.", "A 10.1.2.9", "A 192.0.2.200"))
+	if got := order(rw.written[0]); got != "[CNAME 192.0.2.200 10.1.2.9]" {
+		t.Errorf("with a CNAME: %s", got)
+	}
+	// Already in order: written as is.
+	sorted := answer("A 192.0.2.200", "A 203.0.113.5")
+	rw = &recordingWriter{}
+	sortWriter{rw, net.ParseIP("10.1.2.3")}.WriteMsg(sorted)
+	if rw.written[0] != sorted {
+		t.Error("response in order copied")
+	}
+
+	for _, bad := range []SortlistConfig{
+		{SameSubnet: true, IPv4Prefix: 33},
+		{SameSubnet: true, IPv6Prefix: 129},
+		{Rules: []SortlistRule{{Clients: []string{"10.0.0.0/8"}}}},
+		{Rules: []SortlistRule{{Prefer: []string{"not-a-cidr"}}}},
+	} {
+		config.Sortlist = bad
+		if err := setupSortlist(); err == nil {
+			t.Errorf("%+v accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// SplitConfig splits a name's traffic between groups of addresses, e.g.
+// 90% to the current release and 10% to a canary, for gradual rollouts.
+// Each query picks one group by weight and is answered with that group's
+// addresses of the asked type; a group with none (say, IPv4 only for an
+// AAAA query) or whose health checks all fail leaves the answer to every
+// address of the type. Weights are relative: 90 and 10 is the same split
+// as 9 and 1.
+//
+// POST /splits changes the weights of a running server, e.g.
+// {"name": "api.lan", "weights": {"canary": 25, "stable": 75}}; GET /splits
+// shows the weights in force and how many answers each group has had.
+// Weights set that way last until the next restart.
+type SplitConfig struct {
+	Name   string             `yaml:"name"`
+	TTL    uint32             `yaml:"ttl"` // default 60
+	Groups []SplitGroupConfig `yaml:"groups"`
+}
+
+type SplitGroupConfig struct {
+	Name      string   `yaml:"name"`
+	Weight    int      `yaml:"weight"`
+	Addresses []string `yaml:"addresses"`
+}
+
+const sourceSplits = "splits"
+
+type trafficSplit struct {
+	name   string
+	groups []*splitGroup
+}
+
+type splitGroup struct {
+	name   string
+	weight atomic.Int64
+	addrs  map[string]bool // as the records' Data
+	served atomic.Uint64
+}
+
+// splits holds the split names, lowercase and fully qualified. The set is
+// fixed at startup; only the weights change.
+var splits map[string]*trafficSplit
+
+func setupSplits() error {
+	if len(config.Splits) == 0 {
+		return nil
+	}
+	splits = make(map[string]*trafficSplit)
+	recs := make(map[string][]Record)
+	for i, cfg := range config.Splits {
+		key := fmt.Sprintf("splits[%d]", i)
+		name := dns.Fqdn(strings.ToLower(cfg.Name))
+		if _, ok := dns.IsDomainName(name); !ok || cfg.Name == "" {
+			return fmt.Errorf("%s.name: invalid name %q", key, cfg.Name)
+		}
+		if splits[name] != nil {
+			return fmt.Errorf("%s: duplicate split for %s", key, name)
+		}
+		if len(cfg.Groups) < 2 {
+			return fmt.Errorf("%s: a split takes at least two groups", key)
+		}
+		ttl := cfg.TTL
+		if ttl == 0 {
+			ttl = 60
+		}
+		s := &trafficSplit{name: name}
+		seen := make(map[string]bool)
+		total := 0
+		for j, gc := range cfg.Groups {
+			gkey := fmt.Sprintf("%s.groups[%d]", key, j)
+			if gc.Name == "" || seen[gc.Name] {
+				return fmt.Errorf("%s.name: missing or duplicate group name %q", gkey, gc.Name)
+			}
+			seen[gc.Name] = true
+			if gc.Weight < 0 {
+				return fmt.Errorf("%s.weight must not be negative", gkey)
+			}
+			if len(gc.Addresses) == 0 {
+				return fmt.Errorf("%s.addresses: no addresses", gkey)
+			}
+			g := &splitGroup{name: gc.Name, addrs: make(map[string]bool)}
+			g.weight.Store(int64(gc.Weight))
+			for _, a := range gc.Addresses {
+				ip := net.ParseIP(a)
+				if ip == nil {
+					return fmt.Errorf("%s.addresses: %q is not an IP address", gkey, a)
+				}
+				rec := Record{Type: "AAAA", TTL: ttl, Data: ip.String()}
+				if ip.To4() != nil {
+					rec.Type = "A"
+				}
+				if !g.addrs[rec.Data] {
+					recs[name] = append(recs[name], rec)
+				}
+				g.addrs[rec.Data] = true
+			}
+			total += gc.Weight
+			s.groups = append(s.groups, g)
+		}
+		if total == 0 {
+			return fmt.Errorf("%s: every group has weight 0", key)
+		}
+		splits[name] = s
+	}
+	records.setSource(sourceSplits, recs)
+	log.Printf("Splitting traffic for %d name(s)", len(splits))
+	return nil
+}
+
+// pickSplit narrows the address records of name to one group of its
+// split, if it has one.
+func pickSplit(name string, recs []Record) []Record {
+	s := splits[name]
+	if s == nil || len(recs) < 2 {
+		return recs
+	}
+	var total int64
+	for _, g := range s.groups {
+		total += g.weight.Load()
+	}
+	if total <= 0 {
+		return recs
+	}
+	roll := rand.Int64N(total)
+	for _, g := range s.groups {
+		w := g.weight.Load()
+		if roll >= w {
+			roll -= w
+			continue
+		}
+		var out []Record
+		for _, rec := range recs {
+			if g.addrs[rec.Data] {
+				out = append(out, rec)
+			}
+		}
+		if len(out) == 0 {
+			return recs
+		}
+		g.served.Add(1)
+		return out
+	}
+	return recs
+}
+
+type splitReport struct {
+	Name   string             `json:"name"`
+	Groups []splitGroupReport `json:"groups"`
+}
+
+type splitGroupReport struct {
+	Name      string   `json:"name"`
+	Weight    int64    `json:"weight"`
+	Addresses []string `json:"addresses"`
+	Served    uint64   `json:"served"`
+}
+
+func splitReports() []splitReport {
+	out := []splitReport{}
+	for _, cfg := range config.Splits {
+		s := splits[dns.Fqdn(strings.ToLower(cfg.Name))]
+		rep := splitReport{Name: s.name}
+		for _, g := range s.groups {
+			gr := splitGroupReport{Name: g.name, Weight: g.weight.Load(), Served: g.served.Load(), Addresses: []string{}}
+			for a := range g.addrs {
+				gr.Addresses = append(gr.Addresses, a)
+			}
+			slices.Sort(gr.Addresses)
+			rep.Groups = append(rep.Groups, gr)
+		}
+		out = append(out, rep)
+	}
+	return out
+}
+
+func handleSplits(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, splitReports())
+}
+
+// handleSplitWeights sets the weights of some or all of a split's groups.
+func handleSplitWeights(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name    string           `json:"name"`
+		Weights map[string]int64 `json:"weights"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	s := splits[dns.Fqdn(strings.ToLower(req.Name))]
+	if s == nil {
+		http.Error(w, fmt.Sprintf("no split for %q", req.Name), http.StatusNotFound)
+		return
+	}
+	var total int64
+	for _, g := range s.groups {
+		wt, ok := req.Weights[g.name]
+		if !ok {
+			wt = g.weight.Load()
+		}
+		if wt < 0 {
+			http.Error(w, fmt.Sprintf("weight of %s must not be negative", g.name), http.StatusBadRequest)
+			return
+		}
+		total += wt
+	}
+	for name := range req.Weights {
+		if !s.hasGroup(name) {
+			http.Error(w, fmt.Sprintf("split %s has no group %q", s.name, name), http.StatusBadRequest)
+			return
+		}
+	}
+	if total == 0 {
+		http.Error(w, "every group would have weight 0", http.StatusBadRequest)
+		return
+	}
+	for _, g := range s.groups {
+		if wt, ok := req.Weights[g.name]; ok {
+			g.weight.Store(wt)
+			auditf(r, "split %s: weight of %s set to %d", s.name, g.name, wt)
+		}
+	}
+	writeJSON(w, http.StatusOK, splitReports())
+}
+
+func (s *trafficSplit) hasGroup(name string) bool {
+	for _, g := range s.groups {
+		if g.name == name {
+			return true
+		}
+	}
+	return false
+}
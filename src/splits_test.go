@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func withSplits(t *testing.T) {
+	t.Helper()
+	withRecords(t)
+	old, oldSplits := *config, splits
+	t.Cleanup(func() { *config, splits = old, oldSplits })
+	config.Splits = []SplitConfig{{
+		Name: "API.example.com",
+		Groups: []SplitGroupConfig{
+			{Name: "stable", Weight: 100, Addresses: []string{"192.0.2.1", "192.0.2.2", "2001:db8::1"}},
+			{Name: "canary", Weight: 0, Addresses: []string{"192.0.2.9"}},
+		},
+	}}
+	if err := setupSplits(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func answerAddrs(store *recordStore, name string, qtype uint16) []string {
+	answers, _ := resolveLocal(store, name, qtype, geoLocation{})
+	var out []string
+	for _, rr := range answers {
+		switch rr := rr.(type) {
+		case *dns.A:
+			out = append(out, rr.A.String())
+		case *dns.AAAA:
+			out = append(out, rr.AAAA.String())
+		}
+	}
+	return out
+}
+
+func TestSplits(t *testing.T) {
+	withSplits(t)
+
+	if got := len(records.lookup("api.example.com.")); got != 4 {
+		t.Fatalf("%d records published", got)
+	}
+	for range 20 {
+		if got := answerAddrs(records, "api.example.com.", dns.TypeA); len(got) != 2 || strings.Contains(strings.Join(got, " "), "192.0.2.9") {
+			t.Fatalf("canary at weight 0 answered: %v", got)
+		}
+	}
+	// The canary group has no IPv6 address: AAAA queries landing there
+	// get every AAAA record.
+	splits["api.example.com."].groups[0].weight.Store(0)
+	splits["api.example.com."].groups[1].weight.Store(1)
+	if got := answerAddrs(records, "api.example.com.", dns.TypeA); len(got) != 1 || got[0] != "192.0.2.9" {
+		t.Errorf("A answer at full canary weight: %v", got)
+	}
+	if got := answerAddrs(records, "api.example.com.", dns.TypeAAAA); len(got) != 1 || got[0] != "2001:db8::1" {
+		t.Errorf("AAAA answer at full canary weight: %v", got)
+	}
+	if served := splits["api.example.com."].groups[1].served.Load(); served != 1 {
+		t.Errorf("canary served %d answers, want 1", served)
+	}
+}
+
+func TestSplitWeights(t *testing.T) {
+	withSplits(t)
+
+	post := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handleSplitWeights(rec, httptest.NewRequest(http.MethodPost, "/splits", strings.NewReader(body)))
+		return rec
+	}
+	rec := post(`{"name": "api.example.com", "weights": {"canary": 25, "stable": 75}}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST: %d %s", rec.Code, rec.Body)
+	}
+	var reports []splitReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &reports); err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 || reports[0].Name != "api.example.com." ||
+		reports[0].Groups[0].Weight != 75 || reports[0].Groups[1].Weight != 25 ||
+		strings.Join(reports[0].Groups[0].Addresses, " ") != "192.0.2.1 192.0.2.2 2001:db8::1" {
+		t.Errorf("report %+v", reports)
+	}
+
+	for body, code := range map[string]int{
+		`{"name": "nowhere.example.com", "weights": {"canary": 1}}`:          http.StatusNotFound,
+		`{"name": "api.example.com", "weights": {"beta": 1}}`:                http.StatusBadRequest,
+		`{"name": "api.example.com", "weights": {"canary": -1}}`:             http.StatusBadRequest,
+		`{"name": "api.example.com", "weights": {"canary": 0, "stable": 0}}`: http.StatusBadRequest,
+		`not json`: http.StatusBadRequest,
+	} {
+		if rec := post(body); rec.Code != code {
+			t.Errorf("%s: %d, want %d", body, rec.Code, code)
+		}
+	}
+	// Rejected changes leave the weights as they were.
+	if w := splits["api.example.com."].groups[1].weight.Load(); w != 25 {
+		t.Errorf("canary weight %d after rejected changes", w)
+	}
+}
+
+func TestSetupSplitsErrors(t *testing.T) {
+	withRecords(t)
+	old, oldSplits := *config, splits
+	t.Cleanup(func() { *config, splits = old, oldSplits })
+
+	group := func(name string, weight int, addrs ...string) SplitGroupConfig {
+		return SplitGroupConfig{Name: name, Weight: weight, Addresses: addrs}
+	}
+	for _, cfg := range [][]SplitConfig{
+		{{Name: "", Groups: []SplitGroupConfig{group("a", 1, "192.0.2.1"), group("b", 1, "192.0.2.2")}}},
+		{{Name: "x.example.", Groups: []SplitGroupConfig{group("a", 1, "192.0.2.1")}}},
+		{{Name: "x.example.", Groups: []SplitGroupConfig{group("a", 1, "192.0.2.1"), group("a", 1, "192.0.2.2")}}},
+		{{Name: "x.example.", Groups: []SplitGroupConfig{group("a", -1, "192.0.2.1"), group("b", 2, "192.0.2.2")}}},
+		{{Name: "x.example.", Groups: []SplitGroupConfig{group("a", 0, "192.0.2.1"), group("b", 0, "192.0.2.2")}}},
+		{{Name: "x.example.", Groups: []SplitGroupConfig{group("a", 1, "nowhere"), group("b", 1, "192.0.2.2")}}},
+		{{Name: "x.example.", Groups: []SplitGroupConfig{group("a", 1), group("b", 1, "192.0.2.2")}}},
+		{
+			{Name: "x.example.", Groups: []SplitGroupConfig{group("a", 1, "192.0.2.1"), group("b", 1, "192.0.2.2")}},
+			{Name: "X.example", Groups: []SplitGroupConfig{group("a", 1, "192.0.2.1"), group("b", 1, "192.0.2.2")}},
+		},
+	} {
+		config.Splits = cfg
+		if err := setupSplits(); err == nil {
+			t.Errorf("%+v accepted", cfg)
+		}
+	}
+}
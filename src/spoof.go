@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// exchangeUDP sends r to the upstream over conn, a UDP socket connected to
+// it, and waits for the reply. The kernel already filters datagrams on a
+// connected socket; every reply is checked again explicitly, and one from
+// another address or port, with another ID or for another question is
+// counted as a spoof attempt and dropped while the wait goes on.
+func (u *upstream) exchangeUDP(ctx context.Context, r *dns.Msg, conn *dns.Conn) (*dns.Msg, error) {
+	udp, ok := conn.Conn.(*net.UDPConn)
+	if !ok {
+		resp, _, err := u.client.ExchangeWithConnContext(ctx, r, conn)
+		return resp, err
+	}
+	want, _ := udp.RemoteAddr().(*net.UDPAddr)
+	q := r
+	if config.Forward.RandomizeCase {
+		q = randomizeCase(r)
+	}
+	wire, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(u.client.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	udp.SetDeadline(deadline)
+	if _, err := udp.Write(wire); err != nil {
+		return nil, err
+	}
+	size := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil {
+		size = max(size, int(opt.UDPSize()))
+	}
+	buf := make([]byte, size)
+	for {
+		n, from, err := udp.ReadFromUDP(buf)
+		if err != nil {
+			return nil, err
+		}
+		if want != nil && (!from.IP.Equal(want.IP) || from.Port != want.Port) {
+			u.spoofed(from, "reply from an unexpected address")
+			continue
+		}
+		resp := new(dns.Msg)
+		if err := resp.Unpack(buf[:n]); err != nil {
+			u.spoofed(from, "malformed reply")
+			continue
+		}
+		if resp.Id != r.Id {
+			u.spoofed(from, fmt.Sprintf("reply ID %d, query ID %d", resp.Id, r.Id))
+			continue
+		}
+		if !sameQuestion(q, resp, config.Forward.RandomizeCase) {
+			u.spoofed(from, "reply for another question")
+			continue
+		}
+		if !u.ownCookie(resp) {
+			u.spoofed(from, "reply without our client cookie")
+			continue
+		}
+		restoreCase(r, resp)
+		return resp, nil
+	}
+}
+
+// sameQuestion reports whether resp answers the question of r. With
+// exactCase the names must match letter for letter, as with randomizeCase.
+func sameQuestion(r, resp *dns.Msg, exactCase bool) bool {
+	if len(resp.Question) != len(r.Question) {
+		return false
+	}
+	for i, q := range r.Question {
+		a := resp.Question[i]
+		if a.Qtype != q.Qtype || a.Qclass != q.Qclass || !strings.EqualFold(a.Name, q.Name) {
+			return false
+		}
+		if exactCase && a.Name != q.Name {
+			return false
+		}
+	}
+	return true
+}
+
+// randomizeCase returns a copy of r with the letters of its question names
+// in random case (draft-vixie-dnsext-dns0x20). Servers echo the question
+// as asked, so a forged reply must also guess the case: one more bit of
+// entropy per letter on top of the ID and port.
+func randomizeCase(r *dns.Msg) *dns.Msg {
+	q := r.Copy()
+	for i := range q.Question {
+		name := []byte(q.Question[i].Name)
+		for j, c := range name {
+			if ('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') && rand.IntN(2) == 0 {
+				name[j] = c ^ 0x20
+			}
+		}
+		q.Question[i].Name = string(name)
+	}
+	return q
+}
+
+// restoreCase gives resp the question of r as the client asked it, along
+// with the owner names echoed from a randomized one.
+func restoreCase(r, resp *dns.Msg) {
+	if len(resp.Question) != len(r.Question) {
+		return
+	}
+	for i, q := range r.Question {
+		asked := resp.Question[i].Name
+		if asked == q.Name {
+			continue
+		}
+		for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+			for _, rr := range section {
+				if h := rr.Header(); h.Name == asked {
+					h.Name = q.Name
+				}
+			}
+		}
+		resp.Question[i].Name = q.Name
+	}
+}
+
+// spoofed counts a dropped reply. The log is limited to one line per
+// second per upstream, so a flood of forged replies can't flood it too.
+func (u *upstream) spoofed(from *net.UDPAddr, reason string) {
+	n := u.spoofs.Add(1)
+	now := time.Now().Unix()
+	if last := u.spoofLogged.Load(); last != now && u.spoofLogged.CompareAndSwap(last, now) {
+		log.Printf("Upstream %s: dropped %s (from %s; %d dropped so far)", u.name, reason, from, n)
+	}
+}
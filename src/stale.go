@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ServeStaleConfig answers from expired cache entries, as in RFC 8767,
+// when the upstreams time out or fail, so a flapping link doesn't take out
+// names that were just resolved. After a failure, stale answers are given
+// straight away for Recheck seconds instead of waiting on the upstreams
+// again, and each one is refreshed in the background.
+type ServeStaleConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	MaxStale int    `yaml:"max_stale"` // seconds past expiry an answer may be served; default 86400
+	TTL      uint32 `yaml:"ttl"`       // of stale answers; default 30
+	Recheck  int    `yaml:"recheck"`   // seconds; default 30
+}
+
+const (
+	defaultMaxStale     = 86400
+	defaultStaleTTL     = 30
+	defaultStaleRecheck = 30
+)
+
+var (
+	staleMu        sync.Mutex
+	upstreamDownAt time.Time // last failure; zero after a success
+)
+
+func setupServeStale(cfg *ServeStaleConfig) error {
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.MaxStale < 0 || cfg.Recheck < 0 {
+		return fmt.Errorf("cache.serve_stale: max_stale and recheck must not be negative")
+	}
+	if cfg.MaxStale == 0 {
+		cfg.MaxStale = defaultMaxStale
+	}
+	if cfg.TTL == 0 {
+		cfg.TTL = defaultStaleTTL
+	}
+	if cfg.Recheck == 0 {
+		cfg.Recheck = defaultStaleRecheck
+	}
+	return nil
+}
+
+// staleWindow is how long entries are kept past their expiry.
+func staleWindow() time.Duration {
+	if !config.Cache.ServeStale.Enabled {
+		return 0
+	}
+	return time.Duration(config.Cache.ServeStale.MaxStale) * time.Second
+}
+
+// storePositive caches a successful answer for its smallest TTL.
+func (c *responseCache) storePositive(r, resp *dns.Msg) {
+	if c == nil || !cachesPositive() || len(r.Question) != 1 {
+		return
+	}
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) == 0 || resp.Truncated {
+		return
+	}
+	ttl := resp.Answer[0].Header().Ttl
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns} {
+		for _, rr := range section {
+			ttl = min(ttl, rr.Header().Ttl)
+		}
+	}
+	now := time.Now()
+	c.put(storeKey(r, resp), cacheEntry{msg: resp.Copy(), stored: now, expires: now.Add(time.Duration(ttl) * time.Second)})
+}
+
+// lookupStale returns a copy of the cached response to r, even if expired,
+// with every TTL set to the stale TTL.
+func (c *responseCache) lookupStale(r *dns.Msg) *dns.Msg {
+	if c == nil || !config.Cache.ServeStale.Enabled || len(r.Question) != 1 {
+		return nil
+	}
+	c.mu.Lock()
+	e, ok := c.entries[cacheKey(r)]
+	if !ok {
+		e, ok = c.entries[globalCacheKey(r)]
+	}
+	c.mu.Unlock()
+	if !ok || e.gone(time.Now()) {
+		return nil
+	}
+	resp := e.msg.Copy()
+	resp.Id = r.Id
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			if h := rr.Header(); h.Rrtype != dns.TypeOPT {
+				h.Ttl = min(h.Ttl, config.Cache.ServeStale.TTL)
+			}
+		}
+	}
+	return resp
+}
+
+// staleWhileDown answers r from the stale cache, without trying the
+// upstreams, while they failed within the recheck interval. The entry is
+// refreshed in the background.
+func (c *responseCache) staleWhileDown(r *dns.Msg) *dns.Msg {
+	if c == nil || !config.Cache.ServeStale.Enabled {
+		return nil
+	}
+	staleMu.Lock()
+	down := !upstreamDownAt.IsZero() && time.Since(upstreamDownAt) < time.Duration(config.Cache.ServeStale.Recheck)*time.Second
+	staleMu.Unlock()
+	if !down {
+		return nil
+	}
+	resp := c.lookupStale(r)
+	if resp != nil {
+		go c.refresh(r.Copy())
+	}
+	return resp
+}
+
+// staleOnFailure notes how forwarding r went and, if it failed, returns a
+// stale answer to use instead, or nil. DNSSEC failures are never masked.
+func (c *responseCache) staleOnFailure(r, resp *dns.Msg, err error) *dns.Msg {
+	if c == nil || !config.Cache.ServeStale.Enabled || errors.Is(err, errBogus) {
+		return nil
+	}
+	failed := err != nil || resp.Rcode == dns.RcodeServerFailure
+	staleMu.Lock()
+	if failed {
+		upstreamDownAt = time.Now()
+	} else {
+		upstreamDownAt = time.Time{}
+	}
+	staleMu.Unlock()
+	if !failed {
+		return nil
+	}
+	return c.lookupStale(r)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// listenerCounters count the queries received on one listener.
+type listenerCounters struct {
+	queries   atomic.Uint64
+	dropped   atomic.Uint64 // rate limited
+	refused   atomic.Uint64
+	local     atomic.Uint64
+	forwarded atomic.Uint64
+	cached    atomic.Uint64
+	nxdomain  atomic.Uint64
+	servfail  atomic.Uint64
+}
+
+var listenerStats sync.Map // listener label -> *listenerCounters
+
+// listenerLabel names the listener a query arrived on, e.g.
+// "udp/[::]:53", for logs and statistics.
+func listenerLabel(w dns.ResponseWriter) string {
+	addr := w.LocalAddr()
+	return addr.Network() + "/" + addr.String()
+}
+
+func statsFor(listener string) *listenerCounters {
+	if c, ok := listenerStats.Load(listener); ok {
+		return c.(*listenerCounters)
+	}
+	c, _ := listenerStats.LoadOrStore(listener, &listenerCounters{})
+	return c.(*listenerCounters)
+}
+
+// countResponse records how a query was answered.
+func (c *listenerCounters) countResponse(source string, rcode int) {
+	switch source {
+	case answerForward:
+		c.forwarded.Add(1)
+	case answerCache:
+		c.cached.Add(1)
+	default:
+		c.local.Add(1)
+	}
+	switch rcode {
+	case dns.RcodeNameError:
+		c.nxdomain.Add(1)
+	case dns.RcodeServerFailure:
+		c.servfail.Add(1)
+	case dns.RcodeRefused:
+		c.refused.Add(1)
+	}
+}
+
+type listenerReport struct {
+	Listener  string `json:"listener"`
+	Queries   uint64 `json:"queries"`
+	Dropped   uint64 `json:"dropped"`
+	Refused   uint64 `json:"refused"`
+	Local     uint64 `json:"local"`
+	Forwarded uint64 `json:"forwarded"`
+	Cached    uint64 `json:"cached"`
+	NXDomain  uint64 `json:"nxdomain"`
+	ServFail  uint64 `json:"servfail"`
+}
+
+func listenerReports() []listenerReport {
+	var out []listenerReport
+	listenerStats.Range(func(k, v any) bool {
+		c := v.(*listenerCounters)
+		out = append(out, listenerReport{
+			Listener:  k.(string),
+			Queries:   c.queries.Load(),
+			Dropped:   c.dropped.Load(),
+			Refused:   c.refused.Load(),
+			Local:     c.local.Load(),
+			Forwarded: c.forwarded.Load(),
+			Cached:    c.cached.Load(),
+			NXDomain:  c.nxdomain.Load(),
+			ServFail:  c.servfail.Load(),
+		})
+		return true
+	})
+	sort.Slice(out, func(i, j int) bool { return out[i].Listener < out[j].Listener })
+	return out
+}
+
+func handleStats(w http.ResponseWriter, _ *http.Request) {
+	resp := map[string]any{
+		"listeners":         listenerReports(),
+		"upstreams":         upstreamReports(),
+		"forward":           forwardReports(),
+		"wire":              wireReports(),
+		"latency_bounds_ms": latencyBoundsMs(),
+		"latency":           latencyReports(),
+	}
+	if slo != nil {
+		resp["slo"] = slo.reports()
+	}
+	if fingerprints != nil {
+		resp["clients"] = fingerprints.reports()
+	}
+	if analytics != nil {
+		resp["analytics"] = analytics.report()
+	}
+	if len(activeFilters().rpzZones) > 0 {
+		resp["rpz"] = rpzReports()
+	}
+	if st := lastZoneReload.Load(); st != nil {
+		resp["zone_reload"] = st
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Record sources. Each backend owns one named set of records; the store
+// publishes their union.
+const (
+	sourceZone       = "zone"
+	sourceKubernetes = "kubernetes"
+	sourceServices   = "services"
+	sourceDocker     = "docker"
+	sourceKV         = "kv"
+)
+
+// recordStore holds the live record set. Readers load an immutable
+// snapshot without locking; writers rebuild the merged map and swap it in,
+// so a handler never observes a half-applied change.
+type recordStore struct {
+	mu      sync.Mutex // serializes writers and guards sources
+	sources map[string]map[string][]Record
+	snap    atomic.Pointer[map[string][]Record]
+}
+
+func newRecordStore() *recordStore {
+	s := &recordStore{sources: make(map[string]map[string][]Record)}
+	empty := make(map[string][]Record)
+	s.snap.Store(&empty)
+	return s
+}
+
+// snapshot returns the current record set. Callers must not modify it.
+func (s *recordStore) snapshot() map[string][]Record {
+	return *s.snap.Load()
+}
+
+// lookup returns every record owned by name. Callers must not modify it.
+func (s *recordStore) lookup(name string) []Record {
+	return s.snapshot()[name]
+}
+
+// source returns the records contributed by one source. Callers must not
+// modify it.
+func (s *recordStore) source(name string) map[string][]Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sources[name]
+}
+
+// setSource installs recs as the complete record set of one source. The
+// store takes ownership of the map.
+func (s *recordStore) setSource(name string, recs map[string][]Record) {
+	prepareRecords(recs)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sources[name] = recs
+	s.publish()
+}
+
+// setSources installs several sources at once, publishing a single
+// snapshot; it is setSource for loading many zones.
+func (s *recordStore) setSources(batch map[string]map[string][]Record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, recs := range batch {
+		prepareRecords(recs)
+		s.sources[name] = recs
+	}
+	s.publish()
+}
+
+// updateSource applies fn to a private copy of one source's records and
+// publishes the result. The copy is shallow: fn must replace, not modify in
+// place, any slice it changes.
+func (s *recordStore) updateSource(name string, fn func(recs map[string][]Record)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur := s.sources[name]
+	next := make(map[string][]Record, len(cur))
+	for k, v := range cur {
+		next[k] = v
+	}
+	fn(next)
+	prepareRecords(next)
+	s.sources[name] = next
+	s.publish()
+}
+
+// publish merges all sources, in name order, into a new snapshot. Callers
+// must hold s.mu.
+func (s *recordStore) publish() {
+	names := make([]string, 0, len(s.sources))
+	for name := range s.sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if len(names) == 1 {
+		only := s.sources[names[0]]
+		s.snap.Store(&only)
+		return
+	}
+	merged := make(map[string][]Record)
+	for _, src := range names {
+		for owner, recs := range s.sources[src] {
+			if existing := merged[owner]; len(existing) > 0 {
+				merged[owner] = append(append([]Record(nil), existing...), recs...)
+			} else {
+				merged[owner] = recs
+			}
+		}
+	}
+	s.snap.Store(&merged)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestRecordStoreMerge(t *testing.T) {
+	s := newRecordStore()
+	zone := map[string][]Record{
+		"web.local.": {{Type: "A", TTL: 60, Data: "10.0.0.1"}},
+	}
+	s.setSource(sourceZone, zone)
+	only := s.lookup("web.local.")
+	if len(only) != 1 {
+		t.Fatalf("single source: %v", only)
+	}
+
+	before := s.snapshot()
+	s.setSource(sourceDocker, map[string][]Record{
+		"web.local.": {{Type: "A", TTL: 10, Data: "172.17.0.2"}},
+		"db.local.":  {{Type: "A", TTL: 10, Data: "172.17.0.3"}},
+	})
+	if got := s.lookup("web.local."); len(got) != 2 || got[0].Data != "172.17.0.2" || got[1].Data != "10.0.0.1" {
+		t.Errorf("merged in source name order: %v", got)
+	}
+	if len(zone["web.local."]) != 1 {
+		t.Error("merging appended to a source's slice")
+	}
+	if len(before) != 1 || len(before["web.local."]) != 1 {
+		t.Error("an earlier snapshot changed")
+	}
+
+	s.updateSource(sourceDocker, func(recs map[string][]Record) {
+		delete(recs, "db.local.")
+	})
+	if s.lookup("db.local.") != nil {
+		t.Error("record removed by updateSource still published")
+	}
+	if got := s.source(sourceDocker); len(got) != 1 {
+		t.Errorf("docker source %v", got)
+	}
+
+	s.setSource(sourceDocker, nil)
+	if got := s.lookup("web.local."); len(got) != 1 || got[0].Data != "10.0.0.1" {
+		t.Errorf("after emptying a source: %v", got)
+	}
+}
+
+// Readers walk snapshots while sources are replaced and updated; run with
+// -race to check no reader sees a map being written.
+func TestRecordStoreConcurrentReload(t *testing.T) {
+	s := newRecordStore()
+	zone := func(n int) map[string][]Record {
+		recs := make(map[string][]Record)
+		for i := 0; i < 50; i++ {
+			recs[fmt.Sprintf("host%d.local.", i)] = []Record{{Type: "A", TTL: 60, Data: fmt.Sprintf("10.0.%d.%d", n%250, i)}}
+		}
+		return recs
+	}
+	s.setSource(sourceZone, zone(0))
+
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				for name, recs := range s.snapshot() {
+					if len(recs) == 0 || recs[0].Data == "" {
+						t.Errorf("%s: empty record set", name)
+					}
+				}
+				if got := s.lookup("host7.local."); len(got) == 0 {
+					t.Error("host7.local. missing during reload")
+				}
+				_ = recordToRR("host7.local.", s.lookup("host7.local.")[0])
+			}
+		}()
+	}
+
+	var writers sync.WaitGroup
+	for w := 0; w < 2; w++ {
+		writers.Add(1)
+		go func(w int) {
+			defer writers.Done()
+			for i := 0; i < 200; i++ {
+				s.setSource(sourceZone, zone(i))
+				s.updateSource(sourceDocker, func(recs map[string][]Record) {
+					recs[fmt.Sprintf("c%d.local.", w)] = []Record{{Type: "A", TTL: 10, Data: fmt.Sprintf("172.17.0.%d", i%250)}}
+				})
+			}
+		}(w)
+	}
+	writers.Wait()
+	close(stop)
+	readers.Wait()
+}
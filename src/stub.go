@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// A stub zone (type: stub) holds no records of its own. Like a BIND stub
+// zone it learns the zone's NS set and their addresses from its masters,
+// refreshes them on the SOA refresh interval, and sends queries for names
+// in the zone straight to those servers instead of the fallback.
+
+const (
+	zoneTypeStub = "stub"
+
+	// Bounds on the SOA refresh and retry timers.
+	stubMinRefresh = time.Minute
+	stubMaxRefresh = 24 * time.Hour
+	// maxStubReferrals caps referrals followed below the stub zone.
+	maxStubReferrals = 4
+)
+
+type stubZone struct {
+	origin  string
+	masters []string
+
+	mu      sync.Mutex
+	servers []string // learned authoritative servers, host:port
+}
+
+var stubZones []*stubZone
+
+func newStubZone(cfg ZoneConfig) (*stubZone, error) {
+	if len(cfg.Masters) == 0 {
+		return nil, fmt.Errorf("a stub zone needs masters")
+	}
+	if cfg.File != "" {
+		return nil, fmt.Errorf("a stub zone has no file")
+	}
+	s := &stubZone{origin: dns.CanonicalName(cfg.Name)}
+	for _, m := range cfg.Masters {
+		s.masters = append(s.masters, withDefaultPort(m, "53"))
+	}
+	return s, nil
+}
+
+// stubZoneFor returns the closest stub zone enclosing name, or nil.
+func stubZoneFor(name string) *stubZone {
+	var best *stubZone
+	for _, s := range stubZones {
+		if dns.IsSubDomain(s.origin, name) && (best == nil || len(s.origin) > len(best.origin)) {
+			best = s
+		}
+	}
+	return best
+}
+
+// watch refreshes the server list for as long as the process runs.
+func (s *stubZone) watch() {
+	for {
+		next, err := s.refresh()
+		if err != nil {
+			log.Printf("Stub zone %s: refresh failed: %v", s.origin, err)
+		}
+		time.Sleep(next)
+	}
+}
+
+// refresh asks the masters for the zone's SOA, NS set and server addresses
+// and returns when to refresh again.
+func (s *stubZone) refresh() (time.Duration, error) {
+	retry := stubMinRefresh
+	soaResp, err := exchangeAuthoritative(s.masters, s.origin, dns.TypeSOA)
+	if err != nil {
+		return retry, err
+	}
+	refresh := stubMaxRefresh
+	for _, rr := range soaResp.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			refresh = clampDuration(time.Duration(soa.Refresh)*time.Second, stubMinRefresh, stubMaxRefresh)
+			retry = clampDuration(time.Duration(soa.Retry)*time.Second, stubMinRefresh, refresh)
+		}
+	}
+
+	nsResp, err := exchangeAuthoritative(s.masters, s.origin, dns.TypeNS)
+	if err != nil {
+		return retry, err
+	}
+	glue := make(map[string][]string)
+	for _, rr := range nsResp.Extra {
+		switch rr := rr.(type) {
+		case *dns.A:
+			glue[dns.CanonicalName(rr.Hdr.Name)] = append(glue[dns.CanonicalName(rr.Hdr.Name)], rr.A.String())
+		case *dns.AAAA:
+			glue[dns.CanonicalName(rr.Hdr.Name)] = append(glue[dns.CanonicalName(rr.Hdr.Name)], rr.AAAA.String())
+		}
+	}
+	var servers []string
+	for _, rr := range nsResp.Answer {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		host := dns.CanonicalName(ns.Ns)
+		addrs := glue[host]
+		if len(addrs) == 0 {
+			addrs = s.lookupServer(host)
+		}
+		for _, a := range addrs {
+			servers = append(servers, net.JoinHostPort(a, "53"))
+		}
+	}
+	if len(servers) == 0 {
+		return retry, fmt.Errorf("no usable NS addresses in the answer from the masters")
+	}
+
+	s.mu.Lock()
+	changed := strings.Join(s.servers, " ") != strings.Join(servers, " ")
+	s.servers = servers
+	s.mu.Unlock()
+	if stubZonesLearned() {
+		markWarm(warmStubZones)
+	}
+	if changed {
+		log.Printf("Stub zone %s: servers %s", s.origin, strings.Join(servers, ", "))
+	}
+	return refresh, nil
+}
+
+// lookupServer finds the addresses of a name server the masters sent no
+// glue for: from the masters if it is in the zone, else via the fallback.
+func (s *stubZone) lookupServer(host string) []string {
+	var addrs []string
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		var resp *dns.Msg
+		var err error
+		if dns.IsSubDomain(s.origin, host) {
+			resp, err = exchangeAuthoritative(s.masters, host, qtype)
+		} else if len(activeUpstreams()) > 0 {
+			q := new(dns.Msg)
+			q.SetQuestion(host, qtype)
+			resp, err = forwardToFallback(q)
+		} else {
+			continue
+		}
+		if err != nil {
+			log.Printf("Stub zone %s: failed to look up %s: %v", s.origin, host, err)
+			continue
+		}
+		for _, rr := range resp.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				addrs = append(addrs, rr.A.String())
+			case *dns.AAAA:
+				addrs = append(addrs, rr.AAAA.String())
+			}
+		}
+	}
+	return addrs
+}
+
+// exchange sends r to the zone's servers, following referrals to
+// delegated children, and returns the answer as a recursive reply.
+func (s *stubZone) exchange(r *dns.Msg) (*dns.Msg, error) {
+	s.mu.Lock()
+	servers := s.servers
+	s.mu.Unlock()
+	if len(servers) == 0 {
+		// Not learned yet: the masters are authoritative too.
+		servers = s.masters
+	}
+
+	q := upstreamQuery(r)
+	q.RecursionDesired = false
+	if config.Forward.QnameMinimization {
+		servers = s.minimizedServers(servers, q.Question[0].Name)
+	}
+	for range maxStubReferrals {
+		resp, err := exchangeServers(servers, q)
+		if err != nil {
+			return nil, err
+		}
+		next := referralServers(resp)
+		if next == nil {
+			resp.Id = r.Id
+			resp.RecursionDesired = r.RecursionDesired
+			resp.RecursionAvailable = true
+			resp.Authoritative = false
+			clampTTLs(resp, config.MinTTL, config.MaxTTL)
+			return resp, nil
+		}
+		servers = next
+	}
+	return nil, fmt.Errorf("too many referrals below %s", s.origin)
+}
+
+// minimizedServers walks from the zone's origin down towards name one
+// label at a time (RFC 9156), asking each server only for the NS records of
+// the next name and following referrals. It returns the servers closest to
+// name, which then get the full question. The walk stops early on anything
+// but a referral or NOERROR, leaving the rest to the full query.
+func (s *stubZone) minimizedServers(servers []string, name string) []string {
+	labels := dns.SplitDomainName(name)
+	for n := dns.CountLabel(s.origin) + 1; n < len(labels); n++ {
+		child := dns.Fqdn(strings.Join(labels[len(labels)-n:], "."))
+		resp, err := exchangeAuthoritative(servers, child, dns.TypeNS)
+		if err != nil || resp.Rcode != dns.RcodeSuccess {
+			return servers
+		}
+		if next := referralServers(resp); next != nil {
+			servers = next
+			continue
+		}
+		for _, rr := range resp.Answer {
+			if _, ok := rr.(*dns.CNAME); ok {
+				return servers
+			}
+		}
+		// An empty non-terminal, or a name these servers hold themselves.
+	}
+	return servers
+}
+
+// referralServers returns the glue addresses of a referral response, or nil
+// if resp is a final answer.
+func referralServers(resp *dns.Msg) []string {
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) > 0 || resp.Authoritative {
+		return nil
+	}
+	var servers []string
+	for _, ns := range resp.Ns {
+		ns, ok := ns.(*dns.NS)
+		if !ok {
+			continue
+		}
+		for _, rr := range resp.Extra {
+			if !strings.EqualFold(rr.Header().Name, ns.Ns) {
+				continue
+			}
+			switch rr := rr.(type) {
+			case *dns.A:
+				servers = append(servers, net.JoinHostPort(rr.A.String(), "53"))
+			case *dns.AAAA:
+				servers = append(servers, net.JoinHostPort(rr.AAAA.String(), "53"))
+			}
+		}
+	}
+	return servers
+}
+
+// exchangeAuthoritative asks servers for name/qtype without recursion.
+func exchangeAuthoritative(servers []string, name string, qtype uint16) (*dns.Msg, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(name, qtype)
+	q.RecursionDesired = false
+	return exchangeServers(servers, q)
+}
+
+// exchangeServers tries servers in order until one gives a usable answer,
+// retrying over TCP when the UDP answer is truncated.
+func exchangeServers(servers []string, q *dns.Msg) (*dns.Msg, error) {
+	timeout := time.Duration(config.Forward.TimeoutMs) * time.Millisecond
+	var last *dns.Msg
+	var err error
+	for _, server := range servers {
+		udp := &dns.Client{Timeout: timeout, Dialer: outboundDialer("udp", server, timeout)}
+		tcp := &dns.Client{Net: "tcp", Timeout: timeout, Dialer: outboundDialer("tcp", server, timeout)}
+		uq := q
+		if config.Forward.RandomizeCase {
+			uq = randomizeCase(q)
+		}
+		var resp *dns.Msg
+		resp, _, err = udp.Exchange(uq, server)
+		if err == nil && !sameQuestion(uq, resp, config.Forward.RandomizeCase) {
+			err = fmt.Errorf("%s answered another question", server)
+		}
+		if err == nil {
+			restoreCase(q, resp)
+		}
+		if err == nil && resp.Truncated {
+			resp, _, err = tcp.Exchange(q, server)
+		}
+		if err != nil {
+			continue
+		}
+		if usableResponse(resp) {
+			return resp, nil
+		}
+		last = resp
+	}
+	if last != nil {
+		return last, nil
+	}
+	return nil, err
+}
+
+func clampDuration(d, lo, hi time.Duration) time.Duration {
+	return max(lo, min(d, hi))
+}
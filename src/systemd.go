@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// systemd integration. Under a socket unit the listening sockets are
+// inherited (LISTEN_FDS) instead of bound, so port 53 needs no privileges;
+// under Type=notify the service reports READY=1 once serving and, with
+// WatchdogSec set, WATCHDOG=1 while its listener still answers.
+
+// listenFDsStart is the first inherited descriptor (SD_LISTEN_FDS_START).
+const listenFDsStart = 3
+
+var notifyConn *net.UnixConn
+
+// systemdSockets returns the sockets passed by systemd, if any. The
+// environment variables are cleared so child processes (anycast hooks)
+// don't try to use them too.
+func systemdSockets() (pcs []net.PacketConn, ls []net.Listener, err error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil, nil
+	}
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		// Both calls dup the descriptor, so the original is closed
+		// either way.
+		if pc, err := net.FilePacketConn(f); err == nil {
+			pcs = append(pcs, pc)
+		} else if l, err := net.FileListener(f); err == nil {
+			ls = append(ls, l)
+		} else {
+			f.Close()
+			return nil, nil, fmt.Errorf("inherited descriptor %d is neither a datagram nor a listening socket", fd)
+		}
+		f.Close()
+	}
+	return pcs, ls, nil
+}
+
+// setupNotify connects to the notification socket while the sandbox still
+// allows it.
+func setupNotify() error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("NOTIFY_SOCKET: %v", err)
+	}
+	notifyConn = conn
+	return nil
+}
+
+// sdNotify sends a state string such as "READY=1" to the service manager.
+func sdNotify(state string) {
+	if notifyConn == nil {
+		return
+	}
+	if _, err := notifyConn.Write([]byte(state)); err != nil {
+		log.Printf("sd_notify %q failed: %v", state, err)
+	}
+}
+
+// watchdogInterval returns half the configured watchdog timeout, or 0 if
+// the watchdog is not enabled for this process.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// watchSystemdWatchdog pets the watchdog only while a query to addr gets
+// an answer, so a wedged server is restarted rather than kept alive by a
+// timer that runs regardless.
+func watchSystemdWatchdog(network, addr string, interval time.Duration) {
+	c := &dns.Client{Net: network, Timeout: interval / 2}
+	for {
+		q := new(dns.Msg)
+		q.SetQuestion(newLoopProbe(), dns.TypeHINFO)
+		_, _, err := c.Exchange(q, addr)
+		forgetLoopProbe(q.Question[0].Name)
+		if err == nil {
+			sdNotify("WATCHDOG=1")
+		} else {
+			log.Printf("Watchdog self-check failed: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// probeAddr returns an address this process can query a listener on.
+func probeAddr(a net.Addr) string {
+	host, port, err := net.SplitHostPort(a.String())
+	if err != nil {
+		return a.String()
+	}
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host = "127.0.0.1"
+		if ip != nil && ip.To4() == nil {
+			host = "::1"
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Top talkers: the last hour of queries in per-minute buckets, counted by
+// name, client and how they were answered, for GET /stats/top and the
+// /dashboard page. A bucket tracks at most topKeysPerMinute distinct names
+// and clients; queries past that count toward the totals only.
+
+const (
+	topMinutes       = 60
+	topKeysPerMinute = 5000
+	defaultTopLimit  = 10
+)
+
+// answerBlocked marks queries answered by an RPZ action or a rule's fixed
+// addresses; it takes the place of answerLocal in the breakdown.
+const answerBlocked = "blocked"
+
+type topBucket struct {
+	minute  int64 // unix minute
+	queries uint64
+	answers map[string]uint64 // by source
+	names   map[string]uint64
+	clients map[string]uint64
+	blocked map[string]uint64 // names
+}
+
+var (
+	topMu      sync.Mutex
+	topBuckets [topMinutes]topBucket
+)
+
+// countKey adds one to m[key] unless m is full and lacks key.
+func countKey(m map[string]uint64, key string) {
+	if _, ok := m[key]; ok || len(m) < topKeysPerMinute {
+		m[key]++
+	}
+}
+
+// observeTop records one answered query; a quiet one has no client or name.
+func observeTop(client net.IP, name, source string, blocked bool) {
+	now := time.Now().Unix() / 60
+	name = strings.ToLower(name)
+	if blocked {
+		source = answerBlocked
+	}
+	topMu.Lock()
+	defer topMu.Unlock()
+	b := &topBuckets[now%topMinutes]
+	if b.minute != now {
+		*b = topBucket{
+			minute:  now,
+			answers: make(map[string]uint64),
+			names:   make(map[string]uint64),
+			clients: make(map[string]uint64),
+			blocked: make(map[string]uint64),
+		}
+	}
+	b.queries++
+	b.answers[source]++
+	if name != "" {
+		countKey(b.names, name)
+	}
+	if client != nil {
+		countKey(b.clients, clientLabel(client))
+	}
+	if blocked && name != "" {
+		countKey(b.blocked, name)
+	}
+}
+
+type topEntry struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+}
+
+type topReport struct {
+	Minutes      int               `json:"minutes"`
+	Queries      uint64            `json:"queries"`
+	QPS          float64           `json:"qps"`
+	Answers      map[string]uint64 `json:"answers"` // local, blocked, forward, cache
+	Domains      []topEntry        `json:"top_domains"`
+	Clients      []topEntry        `json:"top_clients"`
+	Blocked      []topEntry        `json:"top_blocked"`
+	CacheEntries int               `json:"cache_entries"`
+	CacheHitRate float64           `json:"cache_hit_rate"` // of queries not answered locally
+	PerMinute    []uint64          `json:"per_minute"`     // oldest first
+}
+
+// topWindow sums the buckets of the last minutes minutes.
+func topWindow(minutes, limit int) topReport {
+	now := time.Now().Unix() / 60
+	rep := topReport{Minutes: minutes, Answers: make(map[string]uint64)}
+	names := make(map[string]uint64)
+	clients := make(map[string]uint64)
+	blocked := make(map[string]uint64)
+	topMu.Lock()
+	for m := now - int64(minutes) + 1; m <= now; m++ {
+		b := &topBuckets[m%topMinutes]
+		if b.minute != m {
+			rep.PerMinute = append(rep.PerMinute, 0)
+			continue
+		}
+		rep.PerMinute = append(rep.PerMinute, b.queries)
+		rep.Queries += b.queries
+		for k, n := range b.answers {
+			rep.Answers[k] += n
+		}
+		for k, n := range b.names {
+			names[k] += n
+		}
+		for k, n := range b.clients {
+			clients[k] += n
+		}
+		for k, n := range b.blocked {
+			blocked[k] += n
+		}
+	}
+	topMu.Unlock()
+
+	// The current minute has only partly passed.
+	elapsed := float64(minutes-1)*60 + float64(time.Now().Unix()%60+1)
+	rep.QPS = float64(rep.Queries) / elapsed
+	rep.Domains = topEntries(names, limit)
+	rep.Clients = topEntries(clients, limit)
+	rep.Blocked = topEntries(blocked, limit)
+	if cache != nil {
+		rep.CacheEntries = cache.len()
+	}
+	if upstream := rep.Answers[answerCache] + rep.Answers[answerForward]; upstream > 0 {
+		rep.CacheHitRate = float64(rep.Answers[answerCache]) / float64(upstream)
+	}
+	return rep
+}
+
+// topEntries returns the limit largest counts in m, largest first.
+func topEntries(m map[string]uint64, limit int) []topEntry {
+	out := make([]topEntry, 0, len(m))
+	for k, n := range m {
+		out = append(out, topEntry{k, n})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Key < out[j].Key
+	})
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out
+}
+
+// handleTop serves GET /stats/top?minutes=15&limit=10.
+func handleTop(w http.ResponseWriter, r *http.Request) {
+	minutes, limit := 15, defaultTopLimit
+	if s := r.URL.Query().Get("minutes"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > topMinutes {
+			http.Error(w, "minutes must be between 1 and 60", http.StatusBadRequest)
+			return
+		}
+		minutes = n
+	}
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	writeJSON(w, http.StatusOK, topWindow(minutes, limit))
+}
+
+// handleDashboard serves the dashboard page. The page holds no data itself;
+// it asks for the admin token when /stats/top wants one.
+func handleDashboard(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(dashboardHTML))
+}
+
+const dashboardHTML = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>micro-dns</title>
+<style>
+body{font:14px system-ui,sans-serif;margin:2em;color:#222}
+h1{font-size:1.3em}h2{font-size:1em;margin:0 0 .5em}
+.grid{display:grid;grid-template-columns:repeat(auto-fit,minmax(18em,1fr));gap:1.5em}
+.box{border:1px solid #ddd;border-radius:6px;padding:1em}
+.big{font-size:2em;font-weight:600}
+table{width:100%;border-collapse:collapse}td{padding:2px 4px}td.n{text-align:right}
+svg{width:100%;height:60px}
+</style></head><body>
+<h1>micro-dns <select id="win"><option value="5">5 min</option><option value="15" selected>15 min</option><option value="60">1 hour</option></select></h1>
+<div class="grid">
+<div class="box"><h2>Queries per second</h2><div class="big" id="qps">-</div><div id="total"></div><svg id="spark" viewBox="0 0 60 10" preserveAspectRatio="none"></svg></div>
+<div class="box"><h2>Answered from</h2><table id="answers"></table></div>
+<div class="box"><h2>Cache</h2><div class="big" id="hit">-</div><div id="entries"></div></div>
+<div class="box"><h2>Top domains</h2><table id="domains"></table></div>
+<div class="box"><h2>Top clients</h2><table id="clients"></table></div>
+<div class="box"><h2>Top blocked</h2><table id="blocked"></table></div>
+</div>
+<script>
+let token = sessionStorage.getItem("token") || "";
+const $ = id => document.getElementById(id);
+function rows(el, list) {
+  el.replaceChildren(...list.map(([k, n]) => {
+    const tr = document.createElement("tr");
+    for (const [v, c] of [[k, ""], [n, "n"]]) {
+      const td = document.createElement("td"); td.textContent = v; td.className = c; tr.append(td);
+    }
+    return tr;
+  }));
+}
+async function refresh() {
+  const res = await fetch("/stats/top?minutes=" + $("win").value + "&limit=15",
+    {headers: token ? {Authorization: "Bearer " + token} : {}});
+  if (res.status == 401) {
+    token = prompt("Admin token") || "";
+    sessionStorage.setItem("token", token);
+    return;
+  }
+  const s = await res.json();
+  $("qps").textContent = s.qps.toFixed(2);
+  $("total").textContent = s.queries + " queries";
+  rows($("answers"), ["local", "blocked", "forward", "cache"].map(k => [k, s.answers[k] || 0]));
+  $("hit").textContent = (s.cache_hit_rate * 100).toFixed(1) + "%";
+  $("entries").textContent = s.cache_entries + " entries";
+  rows($("domains"), s.top_domains.map(e => [e.key, e.count]));
+  rows($("clients"), s.top_clients.map(e => [e.key, e.count]));
+  rows($("blocked"), s.top_blocked.map(e => [e.key, e.count]));
+  const max = Math.max(1, ...s.per_minute), w = 60 / s.per_minute.length;
+  $("spark").innerHTML = s.per_minute.map((n, i) =>
+    '<rect x="' + i * w + '" width="' + w * 0.8 + '" y="' + (10 - 10 * n / max) + '" height="' + 10 * n / max + '" fill="#48c"/>').join("");
+}
+$("win").onchange = refresh;
+refresh(); setInterval(refresh, 5000);
+</script></body></html>
+`
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TraceConfig turns on per-query tracing. Every query gets an ID, and each
+// stage it goes through on the way to an answer (policy zones, rules, the
+// local records, the cache, forwarding, the response) is noted with the
+// time since the query arrived. At log_level debug the stages are logged as
+// they happen, tagged with the ID; the last Keep traces are also kept for
+// GET /traces on the admin API. Clients limits tracing to some networks.
+type TraceConfig struct {
+	Enabled bool     `yaml:"enabled"`
+	Keep    int      `yaml:"keep"`    // traces kept for the admin API, default 100
+	Clients []string `yaml:"clients"` // CIDRs; empty traces every client
+}
+
+// answerTrace follows one query: where its answer came from, the EDE to
+// attach when it wasn't an ordinary one, and, when tracing, its stages.
+type answerTrace struct {
+	via string
+	ede *dns.EDNS0_EDE
+
+	rec *traceRecord // nil unless the query is traced
+}
+
+// traceRecord is a finished or running trace.
+type traceRecord struct {
+	ID       uint64       `json:"id"`
+	Time     time.Time    `json:"time"`
+	Client   string       `json:"client"`
+	Listener string       `json:"listener"`
+	Name     string       `json:"name"`
+	Type     string       `json:"type"`
+	Rcode    string       `json:"rcode"`
+	Via      string       `json:"via"`
+	TotalMs  float64      `json:"total_ms"`
+	Stages   []traceStage `json:"stages"`
+}
+
+type traceStage struct {
+	Stage  string  `json:"stage"`
+	AtMs   float64 `json:"at_ms"`
+	Detail string  `json:"detail,omitempty"`
+}
+
+type traceLog struct {
+	clients []*net.IPNet
+	mu      sync.Mutex
+	ring    []*traceRecord
+	next    int
+}
+
+var (
+	traces  *traceLog
+	traceID atomic.Uint64
+)
+
+func setupTrace() error {
+	cfg := &config.Trace
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.Keep < 0 {
+		return fmt.Errorf("trace.keep must not be negative")
+	}
+	if cfg.Keep == 0 {
+		cfg.Keep = 100
+	}
+	clients, err := parseCIDRs("trace.clients", cfg.Clients)
+	if err != nil {
+		return err
+	}
+	traces = &traceLog{clients: clients, ring: make([]*traceRecord, cfg.Keep)}
+	return nil
+}
+
+// newAnswerTrace starts following a query, tracing it if tracing is on for
+// the client and the query isn't quiet (see PrivacyConfig).
+func newAnswerTrace(r *dns.Msg, client net.IP, listener string, quiet bool) answerTrace {
+	t := answerTrace{via: "local records"}
+	if traces == nil || len(r.Question) == 0 || quiet {
+		return t
+	}
+	if len(traces.clients) > 0 && (client == nil || !onNetworks(client, traces.clients)) {
+		return t
+	}
+	q := r.Question[0]
+	t.rec = &traceRecord{
+		ID:       traceID.Add(1),
+		Time:     time.Now(),
+		Client:   clientLabel(client),
+		Listener: listener,
+		Name:     q.Name,
+		Type:     dns.TypeToString[q.Qtype],
+	}
+	detail := fmt.Sprintf("%s %s, %d bytes", q.Name, dns.TypeToString[q.Qtype], r.Len())
+	if opt := r.IsEdns0(); opt != nil {
+		detail += fmt.Sprintf(", EDNS %d", opt.UDPSize())
+		if opt.Do() {
+			detail += " DO"
+		}
+	}
+	t.stage("received", detail)
+	return t
+}
+
+// stage notes a step in a traced query.
+func (t *answerTrace) stage(name, detail string) {
+	if t.rec == nil {
+		return
+	}
+	at := time.Since(t.rec.Time)
+	t.rec.Stages = append(t.rec.Stages, traceStage{Stage: name, AtMs: float64(at) / float64(time.Millisecond), Detail: detail})
+	debugLogf("[%s] Trace %d +%s %s %s", t.rec.Listener, t.rec.ID, at.Round(time.Microsecond), name, detail)
+}
+
+// stagef is stage with a formatted detail.
+func (t *answerTrace) stagef(name, format string, args ...any) {
+	if t.rec != nil {
+		t.stage(name, fmt.Sprintf(format, args...))
+	}
+}
+
+// finish closes a traced query and keeps it for the admin API.
+func (t *answerTrace) finish(rcode int) {
+	if t.rec == nil {
+		return
+	}
+	t.stage("responded", dns.RcodeToString[rcode])
+	t.rec.Rcode = dns.RcodeToString[rcode]
+	t.rec.Via = t.via
+	t.rec.TotalMs = float64(time.Since(t.rec.Time)) / float64(time.Millisecond)
+	traces.mu.Lock()
+	traces.ring[traces.next] = t.rec
+	traces.next = (traces.next + 1) % len(traces.ring)
+	traces.mu.Unlock()
+}
+
+// handleTraces serves GET /traces, newest first, optionally filtered by
+// client, name and a limit n.
+func handleTraces(w http.ResponseWriter, r *http.Request) {
+	if traces == nil {
+		http.Error(w, "tracing is not enabled", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	client := q.Get("client")
+	name := ""
+	if q.Get("name") != "" {
+		name = dns.CanonicalName(q.Get("name"))
+	}
+	limit := len(traces.ring)
+	if s := q.Get("n"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, "n must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, limit)
+	}
+	out := []*traceRecord{}
+	traces.mu.Lock()
+	for i := 1; i <= len(traces.ring) && len(out) < limit; i++ {
+		rec := traces.ring[(traces.next-i+len(traces.ring))%len(traces.ring)]
+		if rec == nil {
+			break
+		}
+		if client != "" && rec.Client != client {
+			continue
+		}
+		if name != "" && !strings.EqualFold(rec.Name, name) {
+			continue
+		}
+		out = append(out, rec)
+	}
+	traces.mu.Unlock()
+	writeJSON(w, http.StatusOK, out)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// min_ttl and max_ttl bound every TTL the server hands out. Local records
+// are clamped as they are turned into wire records, ahead of any signing,
+// and forwarded responses as they arrive, so the cache keeps them for the
+// clamped time as well.
+
+func setupTTL() error {
+	if config.MaxTTL > 0 && config.MinTTL > config.MaxTTL {
+		return fmt.Errorf("min_ttl %d is above max_ttl %d", config.MinTTL, config.MaxTTL)
+	}
+	return nil
+}
+
+// clampTTL bounds ttl by lo and hi; a zero bound is no bound.
+func clampTTL(ttl, lo, hi uint32) uint32 {
+	ttl = max(ttl, lo)
+	if hi > 0 {
+		ttl = min(ttl, hi)
+	}
+	return ttl
+}
+
+// clampTTLs bounds the TTL of every record in m but the OPT.
+func clampTTLs(m *dns.Msg, lo, hi uint32) {
+	if lo == 0 && hi == 0 {
+		return
+	}
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if h := rr.Header(); h.Rrtype != dns.TypeOPT {
+				h.Ttl = clampTTL(h.Ttl, lo, hi)
+			}
+		}
+	}
+}
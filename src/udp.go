@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"runtime"
+)
+
+// UDPConfig tunes the UDP listeners for high query rates. With sockets
+// above 1 each address is bound that many times with SO_REUSEPORT: the
+// kernel spreads clients over the sockets and each has its own reader and
+// handlers, instead of every packet going through one socket's receive
+// queue. 0 means one socket per CPU when reuse_port is set. read_buffer
+// and write_buffer set the socket buffer sizes in bytes (SO_RCVBUF,
+// SO_SNDBUF), so bursts aren't dropped before they're read; the kernel
+// caps them (net.core.rmem_max and wmem_max on Linux).
+type UDPConfig struct {
+	ReusePort   bool `yaml:"reuse_port"`
+	Sockets     int  `yaml:"sockets"`
+	ReadBuffer  int  `yaml:"read_buffer"`
+	WriteBuffer int  `yaml:"write_buffer"`
+}
+
+func setupUDP() error {
+	cfg := &config.UDP
+	switch {
+	case cfg.Sockets < 0:
+		return fmt.Errorf("udp.sockets must not be negative")
+	case cfg.ReadBuffer < 0 || cfg.WriteBuffer < 0:
+		return fmt.Errorf("udp buffer sizes must not be negative")
+	case cfg.Sockets > 1 && !cfg.ReusePort:
+		return fmt.Errorf("udp.sockets above 1 needs udp.reuse_port")
+	case cfg.ReusePort && !reusePortSupported:
+		return fmt.Errorf("udp.reuse_port is not supported on this platform")
+	}
+	if cfg.Sockets == 0 {
+		cfg.Sockets = 1
+		if cfg.ReusePort {
+			cfg.Sockets = runtime.NumCPU()
+		}
+	}
+	return nil
+}
+
+// listenUDP binds the UDP sockets for addr as udp configures them.
+func listenUDP(addr string) ([]net.PacketConn, error) {
+	cfg := config.UDP
+	lc := net.ListenConfig{}
+	if cfg.ReusePort {
+		lc.Control = reusePort
+	}
+	var pcs []net.PacketConn
+	for i := 0; i < max(cfg.Sockets, 1); i++ {
+		pc, err := lc.ListenPacket(context.Background(), "udp", addr)
+		if err != nil {
+			for _, pc := range pcs {
+				pc.Close()
+			}
+			return nil, err
+		}
+		if conn, ok := pc.(*net.UDPConn); ok {
+			if cfg.ReadBuffer > 0 {
+				if err := conn.SetReadBuffer(cfg.ReadBuffer); err != nil {
+					log.Printf("UDP %s: can't set the read buffer: %v", addr, err)
+				}
+			}
+			if cfg.WriteBuffer > 0 {
+				if err := conn.SetWriteBuffer(cfg.WriteBuffer); err != nil {
+					log.Printf("UDP %s: can't set the write buffer: %v", addr, err)
+				}
+			}
+		}
+		pcs = append(pcs, pc)
+	}
+	if len(pcs) > 1 {
+		log.Printf("Bound %d UDP sockets to %s with SO_REUSEPORT", len(pcs), pcs[0].LocalAddr())
+	}
+	return pcs, nil
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// UpdateConfig enables RFC 2136 dynamic updates for one zone. Every update
+// must be signed, either with a TSIG shared secret or with SIG(0) using one
+// of the configured public KEY records.
+type UpdateConfig struct {
+	Zone     string            `yaml:"zone"`
+	Allow    []string          `yaml:"allow"`
+	TSIGKeys map[string]string `yaml:"tsig_keys"` // key name -> base64 secret (hmac-sha256)
+	SIG0Keys []string          `yaml:"sig0_keys"` // files holding KEY records
+}
+
+var (
+	updateAllow []*net.IPNet
+	sig0Keys    []*dns.KEY
+)
+
+func setupUpdates() error {
+	cfg := &config.Update
+	if cfg.Zone == "" {
+		return nil
+	}
+	cfg.Zone = dns.Fqdn(strings.ToLower(cfg.Zone))
+	if len(cfg.TSIGKeys) == 0 && len(cfg.SIG0Keys) == 0 {
+		return fmt.Errorf("update: zone %s needs tsig_keys or sig0_keys", cfg.Zone)
+	}
+
+	var err error
+	if updateAllow, err = parseCIDRs("update.allow", cfg.Allow); err != nil {
+		return err
+	}
+	for _, path := range cfg.SIG0Keys {
+		key, err := loadKeyFile(path)
+		if err != nil {
+			return fmt.Errorf("update.sig0_keys: %v", err)
+		}
+		sig0Keys = append(sig0Keys, key)
+	}
+	return nil
+}
+
+// loadKeyFile reads a public KEY record as written by dnssec-keygen -T KEY.
+func loadKeyFile(path string) (*dns.KEY, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	zp := dns.NewZoneParser(strings.NewReader(string(data)), "", path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if key, isKey := rr.(*dns.KEY); isKey {
+			return key, nil
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("%s: no KEY record found", path)
+}
+
+// tsigSecrets returns the TSIG secrets in the form dns.Server expects.
+func tsigSecrets() map[string]string {
+	if len(config.Update.TSIGKeys) == 0 {
+		return nil
+	}
+	secrets := make(map[string]string, len(config.Update.TSIGKeys))
+	for name, secret := range config.Update.TSIGKeys {
+		secrets[dns.Fqdn(strings.ToLower(name))] = secret
+	}
+	return secrets
+}
+
+// rawUpdates keeps the wire form of incoming UPDATE messages until the
+// handler picks them up; SIG(0) signs the exact bytes the client sent, which
+// re-packing the parsed message does not reproduce.
+var rawUpdates = struct {
+	sync.Mutex
+	m map[string]rawMsg
+}{m: make(map[string]rawMsg)}
+
+type rawMsg struct {
+	buf  []byte
+	seen time.Time
+}
+
+func rawKey(addr net.Addr, id uint16) string {
+	return fmt.Sprintf("%s/%d", addr, id)
+}
+
+// isUpdate peeks at the opcode in a raw message header.
+func isUpdate(buf []byte) bool {
+	return len(buf) >= 12 && int(buf[2]>>3)&0xF == dns.OpcodeUpdate
+}
+
+func stashRaw(addr net.Addr, buf []byte) {
+	if !isUpdate(buf) {
+		return
+	}
+	cp := append([]byte(nil), buf...)
+	now := time.Now()
+	rawUpdates.Lock()
+	defer rawUpdates.Unlock()
+	for k, v := range rawUpdates.m {
+		if now.Sub(v.seen) > 10*time.Second {
+			delete(rawUpdates.m, k)
+		}
+	}
+	rawUpdates.m[rawKey(addr, binary.BigEndian.Uint16(cp))] = rawMsg{buf: cp, seen: now}
+}
+
+func takeRaw(addr net.Addr, id uint16) []byte {
+	rawUpdates.Lock()
+	defer rawUpdates.Unlock()
+	key := rawKey(addr, id)
+	raw := rawUpdates.m[key]
+	delete(rawUpdates.m, key)
+	return raw.buf
+}
+
+// captureReader records raw UPDATE messages as they are read.
+type captureReader struct {
+	dns.Reader
+}
+
+func decorateReader(r dns.Reader) dns.Reader {
+	return captureReader{r}
+}
+
+func (c captureReader) ReadTCP(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	buf, err := c.Reader.ReadTCP(conn, timeout)
+	if err == nil {
+		stashRaw(conn.RemoteAddr(), buf)
+	}
+	return buf, err
+}
+
+func (c captureReader) ReadUDP(conn *net.UDPConn, timeout time.Duration) ([]byte, *dns.SessionUDP, error) {
+	buf, s, err := c.Reader.ReadUDP(conn, timeout)
+	if err == nil {
+		stashRaw(s.RemoteAddr(), buf)
+	}
+	return buf, s, err
+}
+
+// acceptMsg extends the default message filter, which rejects every UPDATE,
+// to let updates through when a zone is configured for them.
+func acceptMsg(dh dns.Header) dns.MsgAcceptAction {
+	const qrBit = 1 << 15
+	if config.Update.Zone != "" && dh.Bits&qrBit == 0 && int(dh.Bits>>11)&0xF == dns.OpcodeUpdate {
+		return dns.MsgAccept
+	}
+	return dns.DefaultMsgAcceptFunc(dh)
+}
+
+// handleUpdate authenticates and applies an UPDATE message.
+func handleUpdate(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	raw := takeRaw(w.RemoteAddr(), r.Id)
+
+	m.Rcode = processUpdate(w, r, raw)
+	if t := r.IsTsig(); t != nil && w.TsigStatus() == nil {
+		m.SetTsig(t.Hdr.Name, t.Algorithm, 300, time.Now().Unix())
+	}
+	w.WriteMsg(m)
+}
+
+func processUpdate(w dns.ResponseWriter, r *dns.Msg, raw []byte) int {
+	zone := config.Update.Zone
+	if zone == "" {
+		return dns.RcodeRefused
+	}
+	if len(r.Question) != 1 || r.Question[0].Qtype != dns.TypeSOA {
+		return dns.RcodeFormatError
+	}
+	if !strings.EqualFold(dns.Fqdn(r.Question[0].Name), zone) {
+		return dns.RcodeNotAuth
+	}
+
+	client := clientIP(w)
+	if len(updateAllow) > 0 && (client == nil || !onNetworks(client, updateAllow)) {
+		log.Printf("Refused update from %s: not in update.allow", client)
+		return dns.RcodeRefused
+	}
+
+	signer, err := authenticateUpdate(w, r, raw)
+	if err != nil {
+		log.Printf("Refused update from %s: %v", client, err)
+		return dns.RcodeNotAuth
+	}
+
+	if rcode := checkPrerequisites(r.Answer); rcode != dns.RcodeSuccess {
+		return rcode
+	}
+	for _, rr := range r.Ns {
+		if !dns.IsSubDomain(zone, strings.ToLower(rr.Header().Name)) {
+			return dns.RcodeNotZone
+		}
+		if rr.Header().Class == dns.ClassINET {
+			if _, ok := rrToRecord(rr); !ok {
+				return dns.RcodeNotImplemented
+			}
+		}
+	}
+
+	records.updateSource(sourceZone, func(recs map[string][]Record) {
+		old := make(map[string][]Record)
+		for _, rr := range r.Ns {
+			name := dns.Fqdn(strings.ToLower(rr.Header().Name))
+			if _, ok := old[name]; !ok {
+				old[name] = recs[name]
+			}
+			applyUpdateRR(recs, rr)
+		}
+		recordChange("update signed by "+signer, old, recs)
+		snapshotZone("update signed by "+signer, recs)
+	})
+	log.Printf("Applied %d update(s) to %s signed by %s", len(r.Ns), zone, signer)
+	return dns.RcodeSuccess
+}
+
+// authenticateUpdate accepts a valid TSIG (checked by the server before the
+// handler runs) or a SIG(0) made with one of the configured keys, and returns
+// the signer name.
+func authenticateUpdate(w dns.ResponseWriter, r *dns.Msg, raw []byte) (string, error) {
+	if t := r.IsTsig(); t != nil {
+		if err := w.TsigStatus(); err != nil {
+			return "", fmt.Errorf("TSIG %s: %v", t.Hdr.Name, err)
+		}
+		return t.Hdr.Name, nil
+	}
+
+	if len(r.Extra) == 0 {
+		return "", fmt.Errorf("unsigned update")
+	}
+	sig, ok := r.Extra[len(r.Extra)-1].(*dns.SIG)
+	if !ok {
+		return "", fmt.Errorf("unsigned update")
+	}
+	if raw == nil {
+		return "", fmt.Errorf("SIG(0): raw message unavailable")
+	}
+	for _, key := range sig0Keys {
+		if !strings.EqualFold(key.Hdr.Name, sig.SignerName) || key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+			continue
+		}
+		if err := sig.Verify(key, raw); err != nil {
+			return "", fmt.Errorf("SIG(0) %s: %v", sig.SignerName, err)
+		}
+		return sig.SignerName, nil
+	}
+	return "", fmt.Errorf("SIG(0): unknown key %s/%d", sig.SignerName, sig.KeyTag)
+}
+
+// checkPrerequisites evaluates the RFC 2136 section 2.4 prerequisites that
+// don't compare record data.
+func checkPrerequisites(prereqs []dns.RR) int {
+	snap := records.snapshot()
+	for _, rr := range prereqs {
+		h := rr.Header()
+		name := dns.Fqdn(strings.ToLower(h.Name))
+		recs := snap[name]
+		switch {
+		case h.Class == dns.ClassANY && h.Rrtype == dns.TypeANY:
+			if len(recs) == 0 {
+				return dns.RcodeNameError
+			}
+		case h.Class == dns.ClassNONE && h.Rrtype == dns.TypeANY:
+			if len(recs) > 0 {
+				return dns.RcodeYXDomain
+			}
+		case h.Class == dns.ClassANY:
+			if !hasType(recs, h.Rrtype) {
+				return dns.RcodeNXRrset
+			}
+		case h.Class == dns.ClassNONE:
+			if hasType(recs, h.Rrtype) {
+				return dns.RcodeYXRrset
+			}
+		default:
+			return dns.RcodeNotImplemented
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+func hasType(recs []Record, rrtype uint16) bool {
+	for _, rec := range recs {
+		if dns.StringToType[rec.Type] == rrtype {
+			return true
+		}
+	}
+	return false
+}
+
+// applyUpdateRR applies one update-section RR per RFC 2136 section 2.5.
+func applyUpdateRR(recs map[string][]Record, rr dns.RR) {
+	h := rr.Header()
+	name := dns.Fqdn(strings.ToLower(h.Name))
+	cur := recs[name]
+
+	var next []Record
+	switch h.Class {
+	case dns.ClassINET:
+		rec, _ := rrToRecord(rr)
+		next = append(next, cur...)
+		for _, existing := range cur {
+			if sameRecord(existing, rec) {
+				return
+			}
+		}
+		next = append(next, rec)
+	case dns.ClassANY:
+		for _, existing := range cur {
+			if h.Rrtype != dns.TypeANY && dns.StringToType[existing.Type] != h.Rrtype {
+				next = append(next, existing)
+			}
+		}
+	case dns.ClassNONE:
+		del, ok := rrToRecord(rr)
+		for _, existing := range cur {
+			if !ok || !sameRecord(existing, del) {
+				next = append(next, existing)
+			}
+		}
+	default:
+		return
+	}
+
+	if len(next) == 0 {
+		delete(recs, name)
+	} else {
+		recs[name] = next
+	}
+}
+
+// sameRecord reports whether two records carry the same data, ignoring TTL
+// and serving options.
+func sameRecord(a, b Record) bool {
+	return a.Type == b.Type && a.Data == b.Data && a.Pref == b.Pref && a.SrvWeight == b.SrvWeight && a.Port == b.Port
+}
+
+// rrToRecord converts a wire record into the local record form.
+func rrToRecord(rr dns.RR) (Record, bool) {
+	ttl := rr.Header().Ttl
+	switch v := rr.(type) {
+	case *dns.A:
+		return Record{Type: "A", TTL: ttl, Data: v.A.String()}, true
+	case *dns.CNAME:
+		return Record{Type: "CNAME", TTL: ttl, Data: dns.Fqdn(v.Target)}, true
+	case *dns.PTR:
+		return Record{Type: "PTR", TTL: ttl, Data: dns.Fqdn(v.Ptr)}, true
+	case *dns.NS:
+		return Record{Type: "NS", TTL: ttl, Data: dns.Fqdn(v.Ns)}, true
+	case *dns.TXT:
+		return Record{Type: "TXT", TTL: ttl, Data: strings.Join(v.Txt, " "), Strings: v.Txt}, true
+	case *dns.MX:
+		return Record{Type: "MX", TTL: ttl, Data: dns.Fqdn(v.Mx), Pref: v.Preference}, true
+	case *dns.SRV:
+		return Record{Type: "SRV", TTL: ttl, Data: dns.Fqdn(v.Target), Pref: v.Priority, SrvWeight: v.Weight, Port: v.Port}, true
+	}
+	if rtype := dns.TypeToString[rr.Header().Rrtype]; rdataTypes[rtype] {
+		return Record{Type: rtype, TTL: ttl, Data: rdataString(rr)}, true
+	}
+	return Record{}, false
+}
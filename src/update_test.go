@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startUpdateServer serves UPDATE messages on a loopback UDP port the way
+// main sets up its servers, and returns the address.
+func startUpdateServer(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	srv := &dns.Server{
+		PacketConn:        pc,
+		Handler:           dns.HandlerFunc(handleUpdate),
+		TsigSecret:        tsigSecrets(),
+		DecorateReader:    decorateReader,
+		MsgAcceptFunc:     acceptMsg,
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+// withUpdates configures updates of example.com. signed with the TSIG key
+// upd. or the SIG(0) key returned.
+func withUpdates(t *testing.T) (*dns.KEY, crypto.Signer) {
+	t.Helper()
+	withRecords(t)
+	old, oldKeys := *config, sig0Keys
+	t.Cleanup(func() { *config, sig0Keys = old, oldKeys })
+
+	key := &dns.KEY{DNSKEY: dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: "client.example.com.", Rrtype: dns.TypeKEY, Class: dns.ClassINET},
+		Flags:     512, // a host key
+		Protocol:  3,
+		Algorithm: dns.ED25519,
+	}}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Update = UpdateConfig{
+		Zone:     "example.com.",
+		TSIGKeys: map[string]string{"upd.": "c2VjcmV0LXNlY3JldC1zZWNyZXQtc2VjcmV0IQ=="},
+	}
+	sig0Keys = []*dns.KEY{key}
+	return key, priv.(crypto.Signer)
+}
+
+func newUpdate(host, ip string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetUpdate("example.com.")
+	rr, _ := dns.NewRR(host + " 300 IN A " + ip)
+	m.Insert([]dns.RR{rr})
+	return m
+}
+
+func TestUpdateTSIG(t *testing.T) {
+	withUpdates(t)
+	addr := startUpdateServer(t)
+
+	c := &dns.Client{TsigSecret: map[string]string{"upd.": config.Update.TSIGKeys["upd."]}}
+	m := newUpdate("web.example.com.", "192.0.2.10")
+	m.SetTsig("upd.", dns.HmacSHA256, 300, time.Now().Unix())
+	resp, _, err := c.Exchange(m, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		t.Fatalf("signed update: %s", dns.RcodeToString[resp.Rcode])
+	}
+	if recs := records.lookup("web.example.com."); len(recs) != 1 || recs[0].Data != "192.0.2.10" {
+		t.Errorf("after update: %v", recs)
+	}
+
+	// The same key name with another secret fails verification.
+	c.TsigSecret = map[string]string{"upd.": "b3RoZXItb3RoZXItb3RoZXItb3RoZXIhIQ=="}
+	m = newUpdate("evil.example.com.", "192.0.2.66")
+	m.SetTsig("upd.", dns.HmacSHA256, 300, time.Now().Unix())
+	resp, _, _ = c.Exchange(m, addr)
+	if resp == nil || resp.Rcode != dns.RcodeNotAuth {
+		t.Errorf("wrongly signed update answered %v", resp)
+	}
+
+	resp, _, err = new(dns.Client).Exchange(newUpdate("evil.example.com.", "192.0.2.66"), addr)
+	if err != nil || resp.Rcode != dns.RcodeNotAuth {
+		t.Errorf("unsigned update: %v, %v", resp, err)
+	}
+	if recs := records.lookup("evil.example.com."); len(recs) != 0 {
+		t.Errorf("rejected updates applied: %v", recs)
+	}
+}
+
+func TestUpdateSIG0(t *testing.T) {
+	key, priv := withUpdates(t)
+	addr := startUpdateServer(t)
+
+	sign := func(m *dns.Msg, k *dns.KEY, signer crypto.Signer) *dns.Msg {
+		now := uint32(time.Now().Unix())
+		sig := &dns.SIG{RRSIG: dns.RRSIG{
+			Hdr:        dns.RR_Header{Name: ".", Rrtype: dns.TypeSIG, Class: dns.ClassANY},
+			Algorithm:  k.Algorithm,
+			SignerName: k.Hdr.Name,
+			KeyTag:     k.KeyTag(),
+			Inception:  now - 300,
+			Expiration: now + 300,
+		}}
+		buf, err := sig.Sign(signer, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed := new(dns.Msg)
+		if err := signed.Unpack(buf); err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	resp, _, err := new(dns.Client).Exchange(sign(newUpdate("db.example.com.", "192.0.2.20"), key, priv), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		t.Fatalf("SIG(0) update: %s", dns.RcodeToString[resp.Rcode])
+	}
+	if recs := records.lookup("db.example.com."); len(recs) != 1 || recs[0].Data != "192.0.2.20" {
+		t.Errorf("after update: %v", recs)
+	}
+
+	// A key that isn't configured, even under the same name.
+	other := *key
+	otherPriv, err := other.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, _, err = new(dns.Client).Exchange(sign(newUpdate("evil.example.com.", "192.0.2.66"), &other, otherPriv.(crypto.Signer)), addr)
+	if err != nil || resp.Rcode != dns.RcodeNotAuth {
+		t.Errorf("update signed with an unknown key: %v, %v", resp, err)
+	}
+	if recs := records.lookup("evil.example.com."); len(recs) != 0 {
+		t.Errorf("rejected update applied: %v", recs)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ViewConfig serves a separate set of zone files on its own port, e.g. a
+// staging snapshot next to production. A view answers only from its files;
+// dynamic sources, updates and signing stay with the main listener, while
+// forwarding, ACLs and the other query policies apply as usual.
+type ViewConfig struct {
+	Name      string   `yaml:"name"`
+	Port      string   `yaml:"port"`
+	ZoneFiles []string `yaml:"zone_files"`
+}
+
+type view struct {
+	name   string
+	port   string
+	files  []string
+	store  *recordStore
+	mtimes []time.Time
+}
+
+var views []*view
+
+func setupViews() error {
+	ports := make(map[string]bool)
+	for _, port := range listenPorts() {
+		ports[port] = true
+	}
+	for i, cfg := range config.Views {
+		if cfg.Port == "" || len(cfg.ZoneFiles) == 0 {
+			return fmt.Errorf("views[%d]: port and zone_files are required", i)
+		}
+		if ports[cfg.Port] {
+			return fmt.Errorf("views[%d]: port %s is already in use", i, cfg.Port)
+		}
+		ports[cfg.Port] = true
+		v := &view{
+			name:   cfg.Name,
+			port:   cfg.Port,
+			files:  cfg.ZoneFiles,
+			store:  newRecordStore(),
+			mtimes: make([]time.Time, len(cfg.ZoneFiles)),
+		}
+		if v.name == "" {
+			v.name = "port " + cfg.Port
+		}
+		for i := range v.files {
+			if err := v.load(i); err != nil {
+				return fmt.Errorf("view %s: %v", v.name, err)
+			}
+		}
+		views = append(views, v)
+		log.Printf("View %s: serving %d zone file(s) on port %s", v.name, len(v.files), v.port)
+	}
+	return nil
+}
+
+// load (re)reads the i'th zone file of the view into its own source.
+func (v *view) load(i int) error {
+	mtime, err := zoneModTime(v.files[i])
+	if err != nil {
+		return err
+	}
+	recs, err := loadZoneFile(v.files[i])
+	if err != nil {
+		return err
+	}
+	v.store.setSource(fmt.Sprint(i), recs)
+	v.mtimes[i] = mtime
+	return nil
+}
+
+// watchViews reloads view zone files when they change.
+func watchViews() {
+	for {
+		time.Sleep(time.Duration(config.PollFreq) * time.Second)
+		for _, v := range views {
+			for i, path := range v.files {
+				mtime, err := zoneModTime(path)
+				if err != nil || !mtime.After(v.mtimes[i]) {
+					continue
+				}
+				if err := v.load(i); err != nil {
+					log.Printf("View %s: failed to reload %s: %v", v.name, path, err)
+					continue
+				}
+				log.Printf("View %s: reloaded %s", v.name, path)
+			}
+		}
+	}
+}
+
+// handler answers from the view's records.
+func (v *view) handler() dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		answerQuery(w, r, v.store)
+	})
+}
+
+// viewFor returns the view served on the port of addr, if any.
+func viewFor(addr net.Addr) *view {
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	for _, v := range views {
+		if v.port == port {
+			return v
+		}
+	}
+	return nil
+}
+
+// listenPorts returns the ports of the main listeners.
+func listenPorts() []string {
+	if len(config.ListenAddrs) == 0 {
+		return []string{config.ListenPort}
+	}
+	var ports []string
+	for _, addr := range config.ListenAddrs {
+		if _, port, err := net.SplitHostPort(addr); err == nil && !slices.Contains(ports, port) {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
+
+// zoneFilePaths returns every configured zone file, for code that must
+// find or rewrite them all (chroot, sandbox).
+func zoneFilePaths() []*string {
+	var paths []*string
+	if config.HostsFile != "" && config.Mode != modeForwarder && !isRemoteZone(config.HostsFile) {
+		paths = append(paths, &config.HostsFile)
+	}
+	for _, z := range zones {
+		paths = append(paths, &z.File)
+	}
+	for _, v := range views {
+		for i := range v.files {
+			paths = append(paths, &v.files[i])
+		}
+	}
+	for _, z := range activeFilters().rpzZones {
+		paths = append(paths, &z.File)
+	}
+	return paths
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Counters for responses that didn't leave as built: writes the socket
+// refused, UDP responses cut down to the client's size with TC set, and
+// incoming messages too broken to answer. Each kind is logged at most once
+// a second, with the running count, so a burst doesn't flood the log.
+type wireCounter struct {
+	count  atomic.Uint64
+	logged atomic.Int64 // unix second of the last log line
+}
+
+var (
+	writeErrors wireCounter
+	truncations wireCounter
+	malformed   wireCounter
+)
+
+// note counts one event and logs it unless one was logged this second.
+func (c *wireCounter) note(format string, args ...any) {
+	n := c.count.Add(1)
+	now := time.Now().Unix()
+	if last := c.logged.Load(); last != now && c.logged.CompareAndSwap(last, now) {
+		log.Printf(format+" (%d so far)", append(args, n)...)
+	}
+}
+
+type wireReport struct {
+	WriteErrors uint64 `json:"write_errors"`
+	Truncated   uint64 `json:"truncated"`
+	Malformed   uint64 `json:"malformed"`
+}
+
+func wireReports() wireReport {
+	return wireReport{
+		WriteErrors: writeErrors.count.Load(),
+		Truncated:   truncations.count.Load(),
+		Malformed:   malformed.count.Load(),
+	}
+}
+
+// checkedWriter is the innermost writer of every response: it fits UDP
+// responses to the size the client can take and counts failed writes.
+type checkedWriter struct {
+	dns.ResponseWriter
+	r *dns.Msg
+}
+
+func (w checkedWriter) WriteMsg(m *dns.Msg) error {
+	if _, udp := w.RemoteAddr().(*net.UDPAddr); udp {
+		if size := udpResponseSize(w.r); m.Len() > size {
+			// Responses may be shared with the cache; cut a copy.
+			m = m.Copy()
+			m.Truncate(size)
+			if len(m.Question) > 0 {
+				truncations.note("Truncated the response to %s %s for %s to %d bytes",
+					m.Question[0].Name, dns.TypeToString[m.Question[0].Qtype], clientIP(w), size)
+			}
+		}
+	}
+	err := w.ResponseWriter.WriteMsg(m)
+	if err != nil {
+		writeErrors.note("Failed to send a response to %s: %v", w.RemoteAddr(), err)
+	}
+	return err
+}
+
+// udpResponseSize is the largest UDP response r's sender takes: its EDNS
+// buffer size, capped by ours, or 512 bytes without EDNS.
+func udpResponseSize(r *dns.Msg) int {
+	size := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil {
+		size = max(size, min(int(opt.UDPSize()), int(config.EDNS.UDPSize)))
+	}
+	return size
+}
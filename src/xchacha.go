@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/poly1305"
+)
+
+// XChaCha20-Poly1305 in the secretbox construction DNSCrypt uses
+// (es_version 2): the first 32 bytes of the key stream are the Poly1305
+// key, the message is encrypted with the rest, and the tag comes first.
+// This is not the IETF AEAD of chacha20poly1305.NewX, which starts the
+// message at block 1 and puts the tag last, so it is built here from the
+// x/crypto primitives.
+
+const (
+	secretboxNonceSize = 24
+	secretboxTagSize   = 16
+)
+
+var errSecretboxOpen = errors.New("message authentication failed")
+
+// secretboxSeal encrypts msg under key and a 24-byte nonce, returning the
+// tag followed by the ciphertext.
+func secretboxSeal(key *[32]byte, nonce, msg []byte) []byte {
+	polyKey, stream := secretboxStream(key, nonce)
+	out := make([]byte, secretboxTagSize+len(msg))
+	ct := out[secretboxTagSize:]
+	stream.XORKeyStream(ct, msg)
+	var tag [16]byte
+	poly1305.Sum(&tag, ct, polyKey)
+	copy(out, tag[:])
+	return out
+}
+
+// secretboxOpen authenticates and decrypts a box made by secretboxSeal.
+func secretboxOpen(key *[32]byte, nonce, box []byte) ([]byte, error) {
+	if len(box) < secretboxTagSize {
+		return nil, errSecretboxOpen
+	}
+	polyKey, stream := secretboxStream(key, nonce)
+	ct := box[secretboxTagSize:]
+	var tag [16]byte
+	poly1305.Sum(&tag, ct, polyKey)
+	if subtle.ConstantTimeCompare(tag[:], box[:secretboxTagSize]) != 1 {
+		return nil, errSecretboxOpen
+	}
+	msg := make([]byte, len(ct))
+	stream.XORKeyStream(msg, ct)
+	return msg, nil
+}
+
+// secretboxStream returns the Poly1305 key and the XChaCha20 key stream
+// positioned after it.
+func secretboxStream(key *[32]byte, nonce []byte) (*[32]byte, *chacha20.Cipher) {
+	stream, err := chacha20.NewUnauthenticatedCipher(key[:], nonce)
+	if err != nil {
+		panic(err) // the key and nonce sizes are fixed
+	}
+	var polyKey [32]byte
+	stream.XORKeyStream(polyKey[:], polyKey[:])
+	return &polyKey, stream
+}
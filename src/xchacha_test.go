@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"golang.org/x/crypto/chacha20"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// The DNSCrypt shared key is HChaCha20 of the X25519 secret;
+// draft-irtf-cfrg-xchacha section 2.2.1.
+func TestHChaCha20(t *testing.T) {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	got, err := chacha20.HChaCha20(key, mustHex(t, "000000090000004a0000000031415927"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := mustHex(t, "82413b4227b27bfed30e42508a877d73a0f9e4d58a74a853c12ec41326d3ecdc")
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+}
+
+// The box was computed independently with openssl: ChaCha20 under the
+// HChaCha20 subkey with the last 8 nonce bytes, the first 32 bytes of key
+// stream as the Poly1305 key.
+func TestSecretbox(t *testing.T) {
+	var key [32]byte
+	for i := range key {
+		key[i] = byte(i)
+	}
+	nonce := make([]byte, secretboxNonceSize)
+	for i := range nonce {
+		nonce[i] = byte(0x40 + i)
+	}
+	msg := []byte("Ladies and Gentlemen of the class of '99: If I could offer you only one tip for the future, sunscreen would be it.")
+	want := mustHex(t, "4d8a5e79ec0d04f42e62339148e9611d"+
+		"73d660e72d12b88420dc31d25e9ea81ac20accbcb15bbcc8d9014039ccbbd7aba7196a16f0c7402fb5d4ced88fd545f1"+
+		"fdcfc1a0333635fc0f43dd3c667103ff78957b4e3afce1308bdb846c6cb5a8d1ef0318c809f0c0e9c49924d460c72227"+
+		"39599d177a9332a7f06fd4dfbe1cbc8682e9")
+
+	box := secretboxSeal(&key, nonce, msg)
+	if !bytes.Equal(box, want) {
+		t.Fatalf("seal:\n got %x\nwant %x", box, want)
+	}
+	got, err := secretboxOpen(&key, nonce, box)
+	if err != nil || !bytes.Equal(got, msg) {
+		t.Fatalf("open: %q, %v", got, err)
+	}
+	for _, i := range []int{0, secretboxTagSize, len(box) - 1} {
+		tampered := append([]byte(nil), box...)
+		tampered[i] ^= 1
+		if _, err := secretboxOpen(&key, nonce, tampered); err != errSecretboxOpen {
+			t.Errorf("open with byte %d flipped: %v", i, err)
+		}
+	}
+	if _, err := secretboxOpen(&key, nonce, box[:secretboxTagSize-1]); err != errSecretboxOpen {
+		t.Errorf("open of a short box: %v", err)
+	}
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Zone transfers. A zone with notify targets sends them DNS NOTIFY
+// (RFC 1996) whenever its serial changes, and answers AXFR over TCP from
+// them and from its allow_transfer networks. A secondary zone checks its
+// masters' SOA serial on the SOA refresh timer, or at once when a master
+// sends NOTIFY, transfers the zone when the serial has moved on, and stops
+// answering for it once the masters have been unreachable for the SOA
+// expire time.
+//
+// Only the record types the local store holds are transferred, and a
+// primary sends its base records: canary and GeoIP variants stay on it.
+
+const zoneTypeSecondary = "secondary"
+
+const (
+	// notifyAttempts bounds the NOTIFY retransmissions to one secondary.
+	notifyAttempts = 5
+	// Bounds on a secondary's SOA refresh and retry timers.
+	xfrMinRetry   = 30 * time.Second
+	xfrMaxRefresh = 24 * time.Hour
+	xfrTimeout    = 30 * time.Second
+)
+
+// setupTransfers checks the zone's notify targets and builds the networks
+// it may be transferred to. A zone served to secondaries is authoritative.
+func (z *zone) setupTransfers() error {
+	nets, err := parseCIDRs("allow_transfer", z.AllowTransfer)
+	if err != nil {
+		return err
+	}
+	var targets []string
+	for _, t := range z.Notify {
+		t = withDefaultPort(t, "53")
+		host, _, err := net.SplitHostPort(t)
+		ip := net.ParseIP(host)
+		if err != nil || ip == nil {
+			return fmt.Errorf("notify: %q is not an address", t)
+		}
+		targets = append(targets, t)
+		more, _ := parseCIDRs("notify", []string{host})
+		nets = append(nets, more...)
+	}
+	z.Notify, z.transferACL = targets, nets
+	if len(nets) > 0 {
+		// Secondaries check the serial with a SOA query, which only an
+		// authoritative zone answers.
+		z.Authoritative = true
+	}
+	if len(nets) > 0 && len(config.ListenAddrs) == 0 {
+		log.Printf("Zone %s: transfers need TCP, which only listen_addrs serves", z.origin)
+	}
+	return nil
+}
+
+// zoneByOrigin returns the zone, configured or from a catalog, whose apex
+// is origin, or nil.
+func zoneByOrigin(origin string) *zone {
+	for _, list := range [][]*zone{zones, memberZones()} {
+		for _, z := range list {
+			if z.origin == origin {
+				return z
+			}
+		}
+	}
+	return nil
+}
+
+// sendNotifies tells every notify target that the zone changed.
+func (z *zone) sendNotifies() {
+	soa := z.soa()
+	for _, target := range z.Notify {
+		go z.sendNotify(target, soa)
+	}
+}
+
+// sendNotify retransmits a NOTIFY to target, backing off, until it is
+// acknowledged or notifyAttempts have gone unanswered.
+func (z *zone) sendNotify(target string, soa dns.RR) {
+	m := new(dns.Msg)
+	m.SetNotify(z.origin)
+	m.Answer = []dns.RR{soa}
+	c := &dns.Client{Timeout: 2 * time.Second}
+	wait := time.Second
+	for attempt := 1; ; attempt++ {
+		resp, _, err := c.Exchange(m, target)
+		if err == nil && resp.Rcode == dns.RcodeSuccess {
+			log.Printf("Zone %s: NOTIFY for serial %d acknowledged by %s", z.origin, soa.(*dns.SOA).Serial, target)
+			return
+		}
+		if err == nil {
+			err = fmt.Errorf("answered %s", dns.RcodeToString[resp.Rcode])
+		}
+		if attempt == notifyAttempts {
+			log.Printf("Zone %s: NOTIFY to %s failed: %v", z.origin, target, err)
+			return
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// handleNotify acknowledges a NOTIFY from a secondary zone's master and
+// has the zone check for a new serial at once.
+func handleNotify(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	client := clientIP(w)
+	if len(r.Question) != 1 {
+		m.Rcode = dns.RcodeFormatError
+		w.WriteMsg(m)
+		return
+	}
+	origin := dns.CanonicalName(r.Question[0].Name)
+	z := zoneByOrigin(origin)
+	switch {
+	case z == nil || !z.secondary:
+		m.Rcode = dns.RcodeNotAuth
+		log.Printf("Ignored NOTIFY for %s from %s: not a secondary zone here", origin, client)
+	case !z.fromMaster(client):
+		m.Rcode = dns.RcodeRefused
+		log.Printf("Refused NOTIFY for %s from %s: not one of its masters", origin, client)
+	default:
+		log.Printf("Zone %s: NOTIFY from %s", origin, client)
+		select {
+		case z.notified <- struct{}{}:
+		default: // a check is already due
+		}
+	}
+	w.WriteMsg(m)
+}
+
+// fromMaster reports whether ip is one of the zone's masters.
+func (z *zone) fromMaster(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, m := range z.Masters {
+		host, _, err := net.SplitHostPort(m)
+		if err != nil {
+			continue
+		}
+		addrs, err := net.LookupHost(host)
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if net.ParseIP(a).Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serveTransfer answers an AXFR or IXFR to a client the zone may be
+// transferred to. An IXFR from a serial the zone has no changes from gets
+// the whole zone, as RFC 1995 allows.
+func serveTransfer(w dns.ResponseWriter, r *dns.Msg, client net.IP) {
+	q := r.Question[0]
+	origin := dns.CanonicalName(q.Name)
+	z := zoneByOrigin(origin)
+	m := new(dns.Msg)
+	m.SetReply(r)
+	switch {
+	case z == nil:
+		m.Rcode = dns.RcodeNotAuth
+	case client == nil || !onNetworks(client, z.transferACL):
+		m.Rcode = dns.RcodeRefused
+		log.Printf("Refused %s of %s to %s", dns.TypeToString[q.Qtype], origin, client)
+	default:
+		var rrs []dns.RR
+		if q.Qtype == dns.TypeIXFR {
+			rrs = z.incrementalRecords(r)
+		}
+		incremental := rrs != nil
+		if _, udp := w.RemoteAddr().(*net.UDPAddr); udp {
+			if len(rrs) == 1 {
+				// Up to date: the current SOA fits.
+				m.Answer = rrs
+				break
+			}
+			// Transfers need TCP; the truncated answer sends the client there.
+			m.Truncated = true
+			break
+		}
+		if !incremental {
+			rrs = z.transferRecords()
+		}
+		sent := len(rrs)
+		ch := make(chan *dns.Envelope)
+		go func() {
+			defer close(ch)
+			for len(rrs) > 0 {
+				n := min(len(rrs), 500)
+				ch <- &dns.Envelope{RR: rrs[:n]}
+				rrs = rrs[n:]
+			}
+		}()
+		err := new(dns.Transfer).Out(w, r, ch)
+		for range ch {
+			// Let the sender finish after a failed write.
+		}
+		switch {
+		case err != nil:
+			log.Printf("Zone %s: transfer to %s failed: %v", origin, client, err)
+		case incremental:
+			log.Printf("Zone %s: incremental transfer to %s, %d record(s)", origin, client, sent)
+		default:
+			log.Printf("Zone %s: transferred to %s", origin, client)
+		}
+		return
+	}
+	w.WriteMsg(m)
+}
+
+// transferRecords returns the zone as sent in a transfer: SOA, records,
+// SOA.
+func (z *zone) transferRecords() []dns.RR {
+	soa := z.soa()
+	return append(append([]dns.RR{soa}, z.zoneRRs()...), soa)
+}
+
+// zoneRRs returns the records a transfer carries between the SOAs.
+func (z *zone) zoneRRs() []dns.RR {
+	recs := records.source(z.source())
+	names := make([]string, 0, len(recs))
+	for name := range recs {
+		if dns.IsSubDomain(z.origin, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var out []dns.RR
+	for _, name := range names {
+		for _, rec := range recs[name] {
+			if rec.Canary > 0 || len(rec.Countries)+len(rec.Continents) > 0 {
+				continue
+			}
+			if rr := recordToRR(name, rec); rr != nil {
+				out = append(out, rr)
+			}
+		}
+	}
+	return out
+}
+
+// loadCopy serves a secondary zone from its last saved transfer until the
+// first transfer succeeds.
+func (z *zone) loadCopy() {
+	if z.File == "" {
+		return
+	}
+	if _, err := os.Stat(z.File); errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	recs, _, err := z.read()
+	if err != nil {
+		log.Printf("Zone %s: failed to read the saved copy %s: %v", z.origin, z.File, err)
+		return
+	}
+	if z.catalog {
+		z.applyCatalog(recs)
+	} else {
+		records.setSource(z.source(), recs)
+	}
+	log.Printf("Zone %s: serving the saved copy in %s until the first transfer", z.origin, z.File)
+}
+
+// follow keeps a secondary zone in step with its masters until a catalog
+// removes it.
+func (z *zone) follow() {
+	for {
+		wait := z.refresh()
+		select {
+		case <-time.After(wait):
+		case <-z.notified:
+		case <-z.stop:
+			return
+		}
+	}
+}
+
+// refresh checks the masters' serial, transfers the zone when it is newer
+// than the one held, and returns when to check again.
+func (z *zone) refresh() time.Duration {
+	z.mu.Lock()
+	cur, last := z.xfrSOA, z.lastXfr
+	z.mu.Unlock()
+	refresh, retry, expire := time.Hour, xfrMinRetry, time.Duration(0)
+	if cur != nil {
+		refresh = time.Duration(cur.Refresh) * time.Second
+		retry = time.Duration(cur.Retry) * time.Second
+		expire = time.Duration(cur.Expire) * time.Second
+	}
+	refresh = clampDuration(refresh, xfrMinRetry, xfrMaxRefresh)
+	retry = clampDuration(retry, xfrMinRetry, xfrMaxRefresh)
+
+	var soa *dns.SOA
+	resp, err := exchangeAuthoritative(z.Masters, z.origin, dns.TypeSOA)
+	if err == nil {
+		for _, rr := range resp.Answer {
+			if s, ok := rr.(*dns.SOA); ok {
+				soa = s
+			}
+		}
+		if soa == nil {
+			err = fmt.Errorf("no SOA in the answer (%s)", dns.RcodeToString[resp.Rcode])
+		}
+	}
+	if err == nil && cur != nil && !serialNewer(soa.Serial, cur.Serial) {
+		z.mu.Lock()
+		z.lastXfr = time.Now()
+		z.mu.Unlock()
+		return refresh
+	}
+	if err == nil {
+		err = z.transfer()
+	}
+	if err != nil {
+		log.Printf("Zone %s: refresh from masters failed: %v", z.origin, err)
+		if expire > 0 && time.Since(last) > expire && !z.catalog {
+			records.setSource(z.source(), nil)
+			z.mu.Lock()
+			z.xfrSOA = nil
+			z.mu.Unlock()
+			log.Printf("Zone %s: expired, no master reached since %s", z.origin, last.Format(time.RFC3339))
+		}
+		return retry
+	}
+	z.mu.Lock()
+	refresh = time.Duration(z.xfrSOA.Refresh) * time.Second
+	z.mu.Unlock()
+	return clampDuration(refresh, xfrMinRetry, xfrMaxRefresh)
+}
+
+// serialNewer reports whether serial a is ahead of b in RFC 1982 serial
+// number arithmetic.
+func serialNewer(a, b uint32) bool {
+	return a != b && int32(a-b) > 0
+}
+
+// transfer fetches the zone from the first master that sends it whole and
+// installs it.
+func (z *zone) transfer() error {
+	var errs []error
+	for _, master := range z.Masters {
+		soa, recs, skipped, err := z.transferFrom(master)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", master, err))
+			continue
+		}
+		if z.removed() {
+			return nil
+		}
+		old := z.version()
+		if z.catalog {
+			z.applyCatalog(recs)
+		} else {
+			records.setSource(z.source(), recs)
+		}
+		z.mu.Lock()
+		z.xfrSOA, z.serial, z.lastXfr = soa, soa.Serial, time.Now()
+		z.mu.Unlock()
+		z.noteDelta(old)
+		count := 0
+		for _, rs := range recs {
+			count += len(rs)
+		}
+		msg := fmt.Sprintf("Zone %s: transferred serial %d from %s, %d record(s)", z.origin, soa.Serial, master, count)
+		if skipped > 0 {
+			msg += fmt.Sprintf(", %d of types not served here skipped", skipped)
+		}
+		log.Print(msg)
+		if z.File != "" {
+			if err := z.saveCopy(recs, master, soa.Serial); err != nil {
+				log.Printf("Zone %s: failed to save a copy to %s: %v", z.origin, z.File, err)
+			}
+		}
+		if len(z.Notify) > 0 {
+			go z.sendNotifies()
+		}
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+// transferFrom runs one transfer, returning the zone's SOA and the records
+// the local store can hold. A zone already held is asked for by IXFR; the
+// master may still send it whole.
+func (z *zone) transferFrom(master string) (*dns.SOA, map[string][]Record, int, error) {
+	z.mu.Lock()
+	cur := z.xfrSOA
+	z.mu.Unlock()
+	m := new(dns.Msg)
+	if cur != nil && !z.catalog {
+		m.SetIxfr(z.origin, cur.Serial, cur.Ns, cur.Mbox)
+	} else {
+		m.SetAxfr(z.origin)
+	}
+	rrs, err := fetchTransfer(m, master)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if len(rrs) == 0 {
+		return nil, nil, 0, fmt.Errorf("no SOA in the transfer")
+	}
+	if len(rrs) == 1 && cur != nil {
+		// The master has nothing newer after all.
+		return cur, z.recordsCopy(), 0, nil
+	}
+	if isIncremental(rrs) {
+		soa, recs, err := z.applyIncremental(rrs)
+		if err == nil {
+			return soa, recs, 0, nil
+		}
+		log.Printf("Zone %s: incremental transfer from %s unusable (%v); asking for the whole zone", z.origin, master, err)
+		m.SetAxfr(z.origin)
+		m.Ns = nil
+		if rrs, err = fetchTransfer(m, master); err != nil {
+			return nil, nil, 0, err
+		}
+	}
+	var soa *dns.SOA
+	recs := make(map[string][]Record)
+	skipped := 0
+	for _, rr := range rrs {
+		if s, ok := rr.(*dns.SOA); ok {
+			if soa == nil {
+				soa = s
+			}
+			continue
+		}
+		name := dns.CanonicalName(rr.Header().Name)
+		rec, ok := rrToRecord(rr)
+		if !ok || !dns.IsSubDomain(z.origin, name) {
+			skipped++
+			continue
+		}
+		recs[name] = append(recs[name], rec)
+	}
+	if soa == nil {
+		return nil, nil, 0, fmt.Errorf("no SOA in the transfer")
+	}
+	return soa, recs, skipped, nil
+}
+
+// fetchTransfer runs the AXFR or IXFR m and returns every record sent.
+func fetchTransfer(m *dns.Msg, master string) ([]dns.RR, error) {
+	tr := &dns.Transfer{DialTimeout: xfrTimeout, ReadTimeout: xfrTimeout}
+	ch, err := tr.In(m, master)
+	if err != nil {
+		return nil, err
+	}
+	var rrs []dns.RR
+	for env := range ch {
+		if env.Error != nil {
+			err = env.Error
+			continue
+		}
+		rrs = append(rrs, env.RR...)
+	}
+	return rrs, err
+}
+
+// saveCopy writes a transferred zone to the zone's file, in the format
+// loadCopy reads back.
+func (z *zone) saveCopy(recs map[string][]Record, master string, serial uint32) error {
+	names := make([]string, 0, len(recs))
+	for name := range recs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	fmt.Fprintf(&b, "; %s transferred from %s, serial %d\n", z.origin, master, serial)
+	for _, name := range names {
+		for _, rec := range recs[name] {
+			b.WriteString(formatZoneLine(name, rec) + "\n")
+		}
+	}
+	if _, err := os.Stat(z.File); errors.Is(err, os.ErrNotExist) {
+		return os.WriteFile(z.File, []byte(b.String()), 0o644)
+	}
+	return writeFileAtomic(z.File, []byte(b.String()))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// The zone file is reloaded only once it has settled: it must be at least
+// zoneSettleTime old, and unchanged from before it was read to after, so a
+// file caught mid-save is left for the next poll instead of being served
+// half-written. Unlike at startup, a line that doesn't parse fails the
+// reload as a whole; the last good zone keeps serving and the file isn't
+// read again until it changes.
+const zoneSettleTime = time.Second
+
+// zoneReloadStatus is the outcome of the last zone reload, for /stats.
+type zoneReloadStatus struct {
+	Time    time.Time `json:"time"`
+	OK      bool      `json:"ok"`
+	Error   string    `json:"error,omitempty"`
+	Records int       `json:"records"` // in the zone now
+	Added   int       `json:"added"`
+	Removed int       `json:"removed"`
+	Names   int       `json:"names_changed"`
+}
+
+var (
+	lastZoneReload atomic.Pointer[zoneReloadStatus]
+	failedModTime  time.Time // of the zone file that last failed to load
+)
+
+// reloadZoneFile reloads the zone file if it changed and has settled.
+// Callers must hold zoneFileMu.
+func reloadZoneFile() {
+	mtime, err := zoneModTime(config.HostsFile)
+	if err != nil || !mtime.After(hostsFileModTime) || mtime.Equal(failedModTime) {
+		return
+	}
+	if time.Since(mtime) < zoneSettleTime {
+		return
+	}
+	recs, err := readZoneFile(config.HostsFile, hostsFileSyntax(), true)
+	if after, serr := zoneModTime(config.HostsFile); serr == nil && !after.Equal(mtime) {
+		return // written to while we read it
+	}
+	zoneLoadFailed.Store(err != nil)
+	if err != nil {
+		failedModTime = mtime
+		lastZoneReload.Store(&zoneReloadStatus{Time: time.Now(), Error: err.Error(), Records: countRecords(records.source(sourceZone))})
+		log.Printf("Failed to reload zone file, still serving the last good zone: %v", err)
+		return
+	}
+	installReloaded(recs, "zone file")
+	hostsFileModTime = mtime
+}
+
+// installReloaded installs a freshly loaded zone and logs what changed.
+func installReloaded(recs map[string][]Record, from string) {
+	before := records.source(sourceZone)
+	installZone(recs)
+	after := records.source(sourceZone)
+	st := diffZone(before, after)
+	st.Time, st.OK, st.Records = time.Now(), true, countRecords(after)
+	lastZoneReload.Store(&st)
+	log.Printf("Reloaded %s: %d record(s), +%d -%d across %d name(s)", from, st.Records, st.Added, st.Removed, st.Names)
+}
+
+// diffZone counts the records added and removed between two versions of
+// the zone, and the names whose records changed.
+func diffZone(old, cur map[string][]Record) zoneReloadStatus {
+	var st zoneReloadStatus
+	count := func(name string, recs []Record) map[string]int {
+		lines := make(map[string]int, len(recs))
+		for _, rec := range recs {
+			lines[formatZoneLine(name, rec)]++
+		}
+		return lines
+	}
+	diffName := func(name string) {
+		was, now := count(name, old[name]), count(name, cur[name])
+		added, removed := 0, 0
+		for line, n := range now {
+			added += max(0, n-was[line])
+		}
+		for line, n := range was {
+			removed += max(0, n-now[line])
+		}
+		st.Added += added
+		st.Removed += removed
+		if added+removed > 0 {
+			st.Names++
+		}
+	}
+	for name := range cur {
+		diffName(name)
+	}
+	for name := range old {
+		if _, ok := cur[name]; !ok {
+			diffName(name)
+		}
+	}
+	return st
+}
+
+func countRecords(recs map[string][]Record) int {
+	n := 0
+	for _, list := range recs {
+		n += len(list)
+	}
+	return n
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ZoneConfig is one zone served from its own file. Names in the file are
+// relative to the zone (a bare "www" is www.<zone>, "@" the apex) and the
+// TTL column may be left out when DefaultTTL is set. An authoritative zone
+// answers NXDOMAIN or NODATA for names it lacks instead of forwarding them.
+// A zone of type "stub" has no file; see stub.go. A "secondary" zone is
+// transferred from its masters, and its file, if any, keeps a copy to
+// serve from at startup; see xfr.go. A "catalog" zone provisions
+// secondaries; see catalog.go.
+type ZoneConfig struct {
+	Name          string   `yaml:"name"`
+	Type          string   `yaml:"type"`    // "", "stub", "secondary" or "catalog"
+	Masters       []string `yaml:"masters"` // stub zones: servers to learn the NS set from; secondaries and catalogs: primaries
+	File          string   `yaml:"file"`
+	Reload        int      `yaml:"reload"`      // seconds between checks; 0 = poll_freq, -1 = never
+	DefaultTTL    uint32   `yaml:"default_ttl"` // also the SOA minimum
+	Authoritative bool     `yaml:"authoritative"`
+	Notify        []string `yaml:"notify"`         // secondaries to NOTIFY of changes, host[:port]
+	AllowTransfer []string `yaml:"allow_transfer"` // CIDRs that may AXFR, besides the notify hosts
+}
+
+type zone struct {
+	ZoneConfig
+	origin      string
+	secondary   bool
+	transferACL []*net.IPNet
+	notified    chan struct{} // secondaries: a master sent NOTIFY
+	catalog     bool
+	members     map[string]*zone // catalogs: the zones listed, by origin
+	stop        chan struct{}    // catalog members: closed on removal
+
+	mu      sync.Mutex
+	mtime   time.Time
+	serial  uint32
+	xfrSOA  *dns.SOA    // secondaries: the master's SOA as last transferred
+	lastXfr time.Time   // secondaries: when the master last confirmed the zone
+	deltas  []zoneDelta // for IXFR, oldest first
+}
+
+var zones []*zone
+
+func setupZones() error {
+	seen := make(map[string]bool)
+	ignored := 0
+	for i, cfg := range config.Zones {
+		if cfg.Name == "" {
+			return fmt.Errorf("zones[%d]: name is required", i)
+		}
+		origin := dns.CanonicalName(cfg.Name)
+		if seen[origin] {
+			return fmt.Errorf("zones[%d]: zone %s is configured twice", i, origin)
+		}
+		seen[origin] = true
+
+		switch cfg.Type {
+		case zoneTypeStub:
+			s, err := newStubZone(cfg)
+			if err != nil {
+				return fmt.Errorf("zone %s: %v", origin, err)
+			}
+			stubZones = append(stubZones, s)
+			continue
+		case "", zoneTypeSecondary, zoneTypeCatalog:
+		default:
+			return fmt.Errorf("zones[%d]: unknown type %q", i, cfg.Type)
+		}
+		if config.Mode == modeForwarder {
+			ignored++
+			continue
+		}
+		z := &zone{ZoneConfig: cfg, origin: origin, secondary: cfg.Type != "", catalog: cfg.Type == zoneTypeCatalog}
+		if z.catalog {
+			z.members = make(map[string]*zone)
+		}
+		if z.secondary {
+			if len(cfg.Masters) == 0 {
+				return fmt.Errorf("zone %s: a %s zone needs masters", origin, cfg.Type)
+			}
+			z.Masters = nil
+			for _, m := range cfg.Masters {
+				z.Masters = append(z.Masters, withDefaultPort(m, "53"))
+			}
+			z.notified = make(chan struct{}, 1)
+		} else if cfg.File == "" {
+			return fmt.Errorf("zones[%d]: file is required", i)
+		}
+		if err := z.setupTransfers(); err != nil {
+			return fmt.Errorf("zone %s: %v", origin, err)
+		}
+		if z.Reload == 0 {
+			z.Reload = config.PollFreq
+		}
+		zones = append(zones, z)
+	}
+	if ignored > 0 {
+		log.Printf("Forwarder mode: ignoring %d configured zone file(s)", ignored)
+	}
+	if config.ZoneWorkers < 0 {
+		return fmt.Errorf("zone_workers must not be negative")
+	}
+	if config.ZoneWorkers == 0 {
+		config.ZoneWorkers = runtime.NumCPU()
+	}
+	var files []*zone
+	for _, z := range zones {
+		if z.secondary {
+			z.loadCopy()
+		} else {
+			files = append(files, z)
+		}
+	}
+	return loadZones(files, config.ZoneWorkers)
+}
+
+// loadZones reads the zone files with up to workers at a time and installs
+// them together. Every failing zone is reported, not just the first; if
+// any fails, none is installed.
+func loadZones(list []*zone, workers int) error {
+	if len(list) == 0 {
+		return nil
+	}
+	start := time.Now()
+	type result struct {
+		recs  map[string][]Record
+		mtime time.Time
+		err   error
+	}
+	results := make([]result, len(list))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range min(workers, len(list)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				r := &results[i]
+				r.recs, r.mtime, r.err = list[i].read()
+			}
+		}()
+	}
+	for i := range list {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	var errs []error
+	batch := make(map[string]map[string][]Record, len(list))
+	for i, z := range list {
+		if err := results[i].err; err != nil {
+			errs = append(errs, fmt.Errorf("zone %s: %v", z.origin, err))
+			continue
+		}
+		batch[z.source()] = results[i].recs
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	records.setSources(batch)
+	for i, z := range list {
+		z.installed(results[i].mtime, nil)
+	}
+	log.Printf("Loaded %d zone(s) in %v", len(list), time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+func (z *zone) source() string { return "zone:" + z.origin }
+
+// load reads the zone file into the zone's own record source.
+func (z *zone) load() error {
+	recs, mtime, err := z.read()
+	if err != nil {
+		return err
+	}
+	old := z.version()
+	records.setSource(z.source(), recs)
+	z.installed(mtime, old)
+	return nil
+}
+
+// read parses the zone file, returning its records and modification time.
+func (z *zone) read() (map[string][]Record, time.Time, error) {
+	mtime, err := zoneModTime(z.File)
+	if err != nil {
+		return nil, mtime, err
+	}
+	recs, err := loadZoneFileIn(z.File, zoneSyntax{origin: z.origin, defaultTTL: z.DefaultTTL})
+	if err != nil {
+		return nil, mtime, err
+	}
+	// Owners are matched lowercased, like queries.
+	for name, list := range recs {
+		if lower := strings.ToLower(name); lower != name {
+			delete(recs, name)
+			recs[lower] = append(recs[lower], list...)
+		}
+	}
+	return recs, mtime, nil
+}
+
+// installed records the modification time of the file just installed,
+// and for IXFR, how it differs from old, the version it replaced.
+func (z *zone) installed(mtime time.Time, old *xfrVersion) {
+	z.mu.Lock()
+	changed := z.serial != uint32(mtime.Unix())
+	z.mtime = mtime
+	z.serial = uint32(mtime.Unix())
+	z.mu.Unlock()
+	if changed {
+		z.noteDelta(old)
+	}
+	if changed && len(z.Notify) > 0 {
+		go z.sendNotifies()
+	}
+}
+
+// watch reloads the zone file whenever it changes, or for a secondary,
+// keeps the zone in step with its masters.
+func (z *zone) watch() {
+	if z.secondary {
+		z.follow()
+		return
+	}
+	if z.Reload <= 0 {
+		return
+	}
+	for {
+		time.Sleep(time.Duration(z.Reload) * time.Second)
+		mtime, err := zoneModTime(z.File)
+		z.mu.Lock()
+		changed := err == nil && mtime.After(z.mtime)
+		z.mu.Unlock()
+		if !changed {
+			continue
+		}
+		if err := z.load(); err != nil {
+			log.Printf("Zone %s: failed to reload %s: %v", z.origin, z.File, err)
+			continue
+		}
+		log.Printf("Zone %s: reloaded %s", z.origin, z.File)
+	}
+}
+
+// authoritativeZone returns the closest enclosing authoritative zone of
+// name, or nil.
+func authoritativeZone(name string) *zone {
+	var best *zone
+	for _, list := range [][]*zone{zones, memberZones()} {
+		for _, z := range list {
+			if z.Authoritative && dns.IsSubDomain(z.origin, name) && (best == nil || len(z.origin) > len(best.origin)) {
+				best = z
+			}
+		}
+	}
+	return best
+}
+
+// soa synthesizes the zone's SOA; the serial follows the file's mtime. A
+// secondary has its master's.
+func (z *zone) soa() dns.RR {
+	z.mu.Lock()
+	serial, xfrSOA := z.serial, z.xfrSOA
+	z.mu.Unlock()
+	if xfrSOA != nil {
+		return dns.Copy(xfrSOA)
+	}
+	minTTL := z.DefaultTTL
+	if minTTL == 0 {
+		minTTL = 300
+	}
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: z.origin, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: minTTL},
+		Ns:      "ns." + z.origin,
+		Mbox:    "hostmaster." + z.origin,
+		Serial:  serial,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  604800,
+		Minttl:  minTTL,
+	}
+}
+
+// exists reports whether name owns records or, as an empty non-terminal,
+// has names below it.
+func (z *zone) exists(name string) bool {
+	if name == z.origin {
+		return true
+	}
+	for owner := range records.snapshot() {
+		if dns.IsSubDomain(name, owner) {
+			return true
+		}
+	}
+	return false
+}